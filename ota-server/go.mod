@@ -1,5 +0,0 @@
-module ota-server
-
-go 1.22.3
-
-require github.com/Masterminds/semver/v3 v3.3.0 // indirect
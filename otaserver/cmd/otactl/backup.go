@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ota-server/pkg/backup"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// stateLockFile is the lock a running server holds on its state directory.
+const stateLockFile = "ota-server.lock"
+
+// runBackup downloads a backup archive of the server's state and checks it
+// against its manifest before keeping it.
+func runBackup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", "", "where to write the archive (default: ota-backup-<time>.tar.gz)")
+	keys := flags.Bool("keys", false, "include the signing, CA and TLS keys")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: otactl backup [-keys] [-o <archive>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if *out == "" {
+		*out = "ota-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+
+	client := newClient()
+	path := "/admin/backup"
+	if *keys {
+		path += "?keys=true"
+	}
+	req, err := http.NewRequest(http.MethodGet, client.server+path, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	resp, err := client.do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		fmt.Fprintf(os.Stderr, "backup: %s: %s\n", resp.Status, strings.TrimSpace(string(data)))
+		return 1
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*out), ".ota-backup-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		fmt.Fprintf(os.Stderr, "backup: downloading: %v\n", err)
+		return 1
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	m, err := backup.Verify(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	if err := os.Rename(tmp.Name(), *out); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	fmt.Printf("wrote %s: %d files, %d releases, %d keys, catalog revision %s\n", *out, len(m.Files), m.Releases, len(m.Keys), m.CatalogRevision)
+	return 0
+}
+
+// runRestore checks a backup archive and restores it into the state directory
+// of a stopped server, moving the state it replaces aside.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	stateDir := flags.String("state-dir", firstNonEmpty(os.Getenv("OTA_STATE_DIR"), "."), "state directory of the server")
+	filesDir := flags.String("files-dir", "", "check that the artifacts of the backed up catalog are in this files directory")
+	keysDir := flags.String("keys-dir", "", "write the keys in the archive to this directory")
+	force := flags.Bool("force", false, "replace the state directory's metadata and snapshots, keeping them in *.before-restore-<time>")
+	checkOnly := flags.Bool("check", false, "only check the archive, restoring nothing")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: otactl restore [-state-dir <dir>] [-files-dir <dir>] [-keys-dir <dir>] [-force] [-check] <archive>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	archive, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	defer archive.Close()
+
+	if *checkOnly {
+		m, err := backup.Verify(archive)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%s: %d files, %d releases, %d keys, taken %s\n", flags.Arg(0), len(m.Files), m.Releases, len(m.Keys), m.CreatedAt.Format(time.RFC3339))
+		return 0
+	}
+
+	// The lock the server holds keeps a restore from pulling the state from
+	// under a running server
+	lock, err := storage.LockDir(*stateDir, stateLockFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v; stop the server first\n", err)
+		return 1
+	}
+	defer lock.Close()
+
+	staging, err := os.MkdirTemp(*stateDir, ".restore-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(staging)
+	m, err := backup.Extract(archive, staging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+
+	if *filesDir != "" {
+		if missing, err := missingArtifacts(filepath.Join(staging, backup.CatalogName), *filesDir); err != nil {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			return 1
+		} else if len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "restore: %d artifacts of the backed up catalog are missing or differ in %s:\n  %s\n", len(missing), *filesDir, strings.Join(missing, "\n  "))
+			return 1
+		}
+	}
+
+	suffix := ".before-restore-" + time.Now().UTC().Format("20060102T150405Z")
+	for _, dir := range []string{backup.MetadataDir, backup.SnapshotsDir} {
+		target := filepath.Join(*stateDir, dir)
+		if entries, err := os.ReadDir(target); err == nil && len(entries) > 0 {
+			if !*force {
+				fmt.Fprintf(os.Stderr, "restore: %s is not empty; -force moves it aside\n", target)
+				return 1
+			}
+			if err := os.Rename(target, target+suffix); err != nil {
+				fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+				return 1
+			}
+			fmt.Printf("moved %s to %s\n", target, target+suffix)
+		} else if err == nil {
+			os.Remove(target)
+		}
+		if err := os.Rename(filepath.Join(staging, dir), target); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			return 1
+		}
+	}
+	storage.SyncDir(*stateDir)
+	fmt.Printf("restored %d files, %d releases, catalog revision %s, into %s\n", len(m.Files), m.Releases, m.CatalogRevision, *stateDir)
+
+	if len(m.Keys) > 0 {
+		if *keysDir == "" {
+			fmt.Println("the archive holds keys; restore them with -keys-dir")
+			return 0
+		}
+		if err := os.MkdirAll(*keysDir, 0o700); err != nil {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			return 1
+		}
+		for _, key := range m.Keys {
+			target := filepath.Join(*keysDir, key.Name)
+			if err := storage.CopyFile(filepath.Join(staging, backup.KeysDir, key.Name), target); err != nil {
+				fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+				return 1
+			}
+			os.Chmod(target, 0o600)
+			fmt.Printf("wrote %s (%s, was %s)\n", target, key.Env, key.Path)
+		}
+	}
+	return 0
+}
+
+// Helper function to list the artifacts of a backed up catalog index that a
+// files directory lacks or holds with another size
+func missingArtifacts(indexFile, filesDir string) ([]string, error) {
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	var index manifest.CatalogIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("%s: %w", backup.CatalogName, err)
+	}
+	dir := catalog.NewDir(filesDir)
+	var missing []string
+	for _, release := range index.Releases {
+		if info, err := os.Stat(dir.ArtifactPath(release.FileName)); err != nil || info.Size() != release.Size {
+			missing = append(missing, release.FileName)
+		}
+	}
+	return missing, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// runCatalogIndex hashes the artifacts of a files directory and writes the
+// signed catalog index a server can serve them from without scanning, e.g.
+// before burning the directory to read-only media.
+func runCatalogIndex(args []string) int {
+	flags := flag.NewFlagSet("catalog-index", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "Ed25519 private key (PKCS#8 PEM) to sign the index with")
+	out := flags.String("o", "", "where to write the index (default: catalog.json in the files directory)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: otactl catalog-index -key-file <private key> <files-dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *keyFile == "" {
+		flags.Usage()
+		return 2
+	}
+	dir := flags.Arg(0)
+	if *out == "" {
+		*out = filepath.Join(dir, manifest.CatalogIndexFile)
+	}
+
+	private, err := loadPrivateKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "catalog-index: %v\n", err)
+		return 2
+	}
+	releases, err := catalog.NewDir(dir).Releases()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "catalog-index: %v\n", err)
+		return 1
+	}
+	if releases == nil {
+		releases = []catalog.Release{}
+	}
+	signed, err := manifest.SealCatalogIndex(manifest.CatalogIndex{Releases: releases, GeneratedAt: time.Now().UTC()}, private)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "catalog-index: %v\n", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "catalog-index: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "catalog-index: %v\n", err)
+		return 1
+	}
+	fmt.Printf("indexed %d releases in %s, signed with key %s\n", len(releases), *out, signed.Signatures[0].KeyID)
+	return 0
+}
+
+// Helper function to read an Ed25519 private key from a PKCS#8 PEM file
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return private, nil
+}
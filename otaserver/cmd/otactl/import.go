@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// importRecord is a release to publish, whatever system it was exported from.
+type importRecord struct {
+	App       string    `json:"app"`
+	Version   string    `json:"version"`
+	Channel   string    `json:"channel,omitempty"`
+	File      string    `json:"file"` // relative to the artifacts directory
+	Notes     string    `json:"notes,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+}
+
+// importers parse an export into records; app overrides the app name where
+// the export does not carry one.
+var importers = map[string]func(data []byte, app string) ([]importRecord, error){
+	"hawkbit": parseHawkbit,
+	"mender":  parseMender,
+	"json":    parseJSONRecords,
+	"csv":     parseCSVRecords,
+}
+
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "export format: hawkbit, mender, json or csv (default: from the file extension)")
+	artifacts := flags.String("artifacts", "", "directory holding the artifact files (default: next to the export)")
+	channel := flags.String("channel", "", "channel for records that do not name one")
+	app := flags.String("app", "", "app name for exports that do not carry one")
+	dryRun := flags.Bool("dry-run", false, "only print what would be published")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: otactl import [flags] <export-file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	exportFile := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(exportFile), ".")
+	}
+	parse, ok := importers[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "import: unknown format %q\n", *format)
+		return 2
+	}
+	if *artifacts == "" {
+		*artifacts = filepath.Dir(exportFile)
+	}
+
+	data, err := os.ReadFile(exportFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	records, err := parse(data, *app)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: parsing %s: %v\n", exportFile, err)
+		return 1
+	}
+
+	// Publish oldest first so that the catalog history matches the original
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	client := newClient()
+	failed := 0
+	for _, record := range records {
+		if record.Channel == "" {
+			record.Channel = *channel
+		}
+		if err := validateRecord(record); err != nil {
+			fmt.Fprintf(os.Stderr, "skip %s %s: %v\n", record.App, record.Version, err)
+			failed++
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("would publish %s %s from %s\n", record.App, record.Version, record.File)
+			continue
+		}
+		if err := client.publish(filepath.Join(*artifacts, record.File), record); err != nil {
+			fmt.Fprintf(os.Stderr, "fail %s %s: %v\n", record.App, record.Version, err)
+			failed++
+			continue
+		}
+		fmt.Printf("published %s %s\n", record.App, record.Version)
+	}
+
+	if !*dryRun {
+		fmt.Printf("%d of %d releases imported\n", len(records)-failed, len(records))
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// The server derives app and version from "<app>_<version>.<ext>", so neither
+// may contain an underscore.
+var namePartPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+-]*$`)
+
+func validateRecord(record importRecord) error {
+	if !namePartPattern.MatchString(record.App) {
+		return fmt.Errorf("invalid app name %q", record.App)
+	}
+	if !namePartPattern.MatchString(record.Version) {
+		return fmt.Errorf("invalid version %q", record.Version)
+	}
+	if record.File == "" {
+		return errors.New("no artifact file")
+	}
+	return nil
+}
+
+// Helper function to upload one artifact through the admin upload endpoint,
+// streaming the file rather than reading it into memory
+func (c *client) publish(path string, record importRecord) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body, pipe := io.Pipe()
+	form := multipart.NewWriter(pipe)
+	go func() {
+		fields := map[string]string{
+			"sha256":  strings.ToLower(record.SHA256),
+			"notes":   record.Notes,
+			"channel": record.Channel,
+		}
+		if !record.CreatedAt.IsZero() {
+			fields["created_at"] = record.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		for name, value := range fields {
+			if value != "" {
+				form.WriteField(name, value)
+			}
+		}
+		part, err := form.CreateFormFile("file", record.App+"_"+record.Version+filepath.Ext(path))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pipe.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, c.server+"/admin/upload", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// hawkbitModule is a software module as returned by hawkBit's management API
+// (GET /rest/v1/softwaremodules), with the module's artifacts embedded.
+type hawkbitModule struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	CreatedAt   int64  `json:"createdAt"` // milliseconds since the epoch
+	Artifacts   []struct {
+		ProvidedFilename string `json:"providedFilename"`
+		Hashes           struct {
+			SHA256 string `json:"sha256"`
+		} `json:"hashes"`
+	} `json:"artifacts"`
+}
+
+// Helper function to parse hawkBit software modules, given either as a list or
+// as a paged response with a "content" list
+func parseHawkbit(data []byte, app string) ([]importRecord, error) {
+	var modules []hawkbitModule
+	if err := json.Unmarshal(data, &modules); err != nil {
+		var page struct {
+			Content []hawkbitModule `json:"content"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		modules = page.Content
+	}
+
+	var records []importRecord
+	for _, module := range modules {
+		if len(module.Artifacts) != 1 {
+			return nil, fmt.Errorf("software module %s %s has %d artifacts, expected one", module.Name, module.Version, len(module.Artifacts))
+		}
+		record := importRecord{
+			App:     module.Name,
+			Version: module.Version,
+			File:    module.Artifacts[0].ProvidedFilename,
+			Notes:   module.Description,
+			SHA256:  module.Artifacts[0].Hashes.SHA256,
+		}
+		if app != "" {
+			record.App = app
+		}
+		if module.CreatedAt > 0 {
+			record.CreatedAt = time.UnixMilli(module.CreatedAt)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// menderArtifact is an artifact as returned by Mender's deployments API
+// (GET /api/management/v1/deployments/artifacts).
+type menderArtifact struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Modified    time.Time         `json:"modified"`
+	Provides    map[string]string `json:"artifact_provides"`
+	Updates     []struct {
+		Files []struct {
+			Name     string `json:"name"`
+			Checksum string `json:"checksum"`
+		} `json:"files"`
+	} `json:"updates"`
+}
+
+// Mender artifact names conventionally end in the version, e.g. "plugin-1.2.0".
+var menderNamePattern = regexp.MustCompile(`^(.+?)[-_]v?(\d[^-_]*)$`)
+
+// Helper function to parse Mender artifacts. The payload file is imported when
+// it has been extracted into the artifacts directory, the .mender file otherwise.
+func parseMender(data []byte, app string) ([]importRecord, error) {
+	var artifacts []menderArtifact
+	if err := json.Unmarshal(data, &artifacts); err != nil {
+		return nil, err
+	}
+
+	var records []importRecord
+	for _, artifact := range artifacts {
+		record := importRecord{
+			File:      artifact.Name + ".mender",
+			Notes:     artifact.Description,
+			CreatedAt: artifact.Modified,
+		}
+		if m := menderNamePattern.FindStringSubmatch(artifact.Name); m != nil {
+			record.App, record.Version = m[1], m[2]
+		}
+		if version := artifact.Provides["rootfs-image.version"]; version != "" {
+			record.Version = version
+		}
+		if app != "" {
+			record.App = app
+		}
+		if len(artifact.Updates) == 1 && len(artifact.Updates[0].Files) == 1 {
+			payload := artifact.Updates[0].Files[0]
+			record.File, record.SHA256 = payload.Name, payload.Checksum
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Helper function to parse a JSON list of records
+func parseJSONRecords(data []byte, app string) ([]importRecord, error) {
+	var records []importRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].App == "" {
+			records[i].App = app
+		}
+	}
+	return records, nil
+}
+
+// Helper function to parse CSV records; the header row names the columns,
+// which are the JSON field names of importRecord
+func parseCSVRecords(data []byte, app string) ([]importRecord, error) {
+	rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	var records []importRecord
+	for line, row := range rows[1:] {
+		record := importRecord{App: app}
+		for i, column := range header {
+			value := strings.TrimSpace(row[i])
+			switch strings.TrimSpace(column) {
+			case "app":
+				if value != "" {
+					record.App = value
+				}
+			case "version":
+				record.Version = value
+			case "channel":
+				record.Channel = value
+			case "file":
+				record.File = value
+			case "notes":
+				record.Notes = value
+			case "sha256":
+				record.SHA256 = value
+			case "created_at":
+				if value == "" {
+					continue
+				}
+				if record.CreatedAt, err = time.Parse(time.RFC3339, value); err != nil {
+					return nil, fmt.Errorf("line %d: created_at: %v", line+2, err)
+				}
+			default:
+				return nil, fmt.Errorf("unknown column %q", column)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const tokenUsage = `usage: otactl token <create|list|revoke> [flags]
+
+  create -app <app> [-ttl 1h] [-scope publish] [-description text]
+         mint a delegated upload token and print it
+  list   list the live upload tokens
+  revoke <id>
+         revoke an upload token
+`
+
+func runToken(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return 2
+	}
+	client := newClient()
+	switch args[0] {
+	case "create":
+		return runTokenCreate(client, args[1:])
+	case "list":
+		return client.printJSON(http.MethodGet, "/admin/tokens", nil)
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, tokenUsage)
+			return 2
+		}
+		return client.printJSON(http.MethodDelete, "/admin/tokens/"+args[1], nil)
+	default:
+		fmt.Fprintf(os.Stderr, "token: unknown command %q\n\n%s", args[0], tokenUsage)
+		return 2
+	}
+}
+
+func runTokenCreate(client *client, args []string) int {
+	flags := flag.NewFlagSet("token create", flag.ExitOnError)
+	app := flags.String("app", "", "app the token may publish")
+	ttl := flags.String("ttl", "1h", "lifetime of the token")
+	scope := flags.String("scope", "publish", "what the token may do")
+	description := flags.String("description", "", "note shown when listing tokens, e.g. the CI job")
+	quiet := flags.Bool("q", false, "only print the token, e.g. to capture it in a CI variable")
+	flags.Parse(args)
+	if *app == "" || flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return 2
+	}
+
+	body, _ := json.Marshal(map[string]string{"app": *app, "ttl": *ttl, "scope": *scope, "description": *description})
+	if !*quiet {
+		return client.printJSON(http.MethodPost, "/admin/tokens", body)
+	}
+	data, err := client.call(http.MethodPost, "/admin/tokens", body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "token: %v\n", err)
+		return 1
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &created); err != nil {
+		fmt.Fprintf(os.Stderr, "token: %v\n", err)
+		return 1
+	}
+	fmt.Println(created.Token)
+	return 0
+}
+
+// Helper function to send a JSON admin request, returning the response body
+// of a successful one
+func (c *client) call(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Helper function to send a JSON admin request and print the response
+func (c *client) printJSON(method, path string, body []byte) int {
+	data, err := c.call(method, path, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "token: %v\n", err)
+		return 1
+	}
+	if len(data) > 0 {
+		var out bytes.Buffer
+		if json.Indent(&out, data, "", "  ") == nil {
+			data = out.Bytes()
+		}
+		fmt.Println(string(data))
+	}
+	return 0
+}
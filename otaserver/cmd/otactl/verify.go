@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"ota-server/pkg/manifest"
+)
+
+// runVerifyBundle checks an artifact against a signed offline release bundle
+// without contacting the server.
+func runVerifyBundle(args []string) int {
+	flags := flag.NewFlagSet("verify-bundle", flag.ExitOnError)
+	key := flags.String("key", "", "base64 Ed25519 public key, as served by /signing-key")
+	keyFile := flags.String("key-file", "", "file holding the key or the JSON served by /signing-key")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: otactl verify-bundle -key <public key> <bundle-file> <artifact-file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 || (*key == "") == (*keyFile == "") {
+		flags.Usage()
+		return 2
+	}
+
+	pub, err := loadPublicKey(*key, *keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %v\n", err)
+		return 2
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %v\n", err)
+		return 1
+	}
+	var signed manifest.SignedReleaseBundle
+	if err := json.Unmarshal(data, &signed); err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	bundle, err := manifest.OpenReleaseBundle(signed, pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	artifact, err := os.Open(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %v\n", err)
+		return 1
+	}
+	defer artifact.Close()
+	if err := bundle.VerifyArtifact(artifact); err != nil {
+		fmt.Fprintf(os.Stderr, "verify-bundle: %s: %v\n", flags.Arg(1), err)
+		return 1
+	}
+	fmt.Printf("%s %s (%s) verified\n", bundle.Release.App, bundle.Release.Version, bundle.Release.ID)
+	return 0
+}
+
+// Helper function to read a public key given inline or in a file
+func loadPublicKey(key, keyFile string) (ed25519.PublicKey, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		var served struct {
+			PublicKey string `json:"public_key"`
+		}
+		if json.Unmarshal(data, &served) == nil && served.PublicKey != "" {
+			key = served.PublicKey
+		} else {
+			key = strings.TrimSpace(string(data))
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("not a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
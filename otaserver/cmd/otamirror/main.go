@@ -0,0 +1,154 @@
+// Command otamirror is a minimal read-only OTA server for a directory of
+// versioned artifacts, e.g. a copy synced to a site without the full server's
+// state, admin API or device records. It answers update checks on /check and
+// serves the artifacts on /download, rescanning the directory periodically.
+// It replaces the standalone prototype that used to live next to this module
+// and shares the catalog and access log packages with otaserver.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"ota-server/pkg/accesslog"
+	"ota-server/pkg/catalog"
+)
+
+// apiError is the body of every error response, wrapped as {"error": {...}},
+// with the codes of the full server.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// mirror serves one directory of artifacts.
+type mirror struct {
+	dir     *catalog.Dir
+	index   catalog.Index
+	baseURL string
+}
+
+func main() {
+	filesDir := flag.String("dir", "./ota_files", "directory of versioned artifacts")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	baseURL := flag.String("base-url", "", "prefix of download URLs, root-relative when empty")
+	rescan := flag.Duration("rescan", 30*time.Second, "interval between directory rescans")
+	logSpecs := flag.String("access-log", "stdout", "access log sinks, see pkg/accesslog")
+	flag.Parse()
+
+	m := &mirror{dir: catalog.NewDir(*filesDir), baseURL: strings.TrimSuffix(*baseURL, "/")}
+	if err := m.scan(); err != nil {
+		log.Fatalf("Failed to scan %s: %v", *filesDir, err)
+	}
+	go func() {
+		for range time.Tick(*rescan) {
+			if err := m.scan(); err != nil {
+				log.Printf("rescanning %s: %v", *filesDir, err)
+			}
+		}
+	}()
+
+	logger, err := accesslog.Open(*logSpecs)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %v", err)
+	}
+	defer logger.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", m.handleCheck)
+	mux.HandleFunc("/download", m.handleDownload)
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           accesslog.Middleware(logger, false, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("otamirror serving %s on %s", *filesDir, *addr)
+	log.Fatal(server.ListenAndServe())
+}
+
+// Helper function to rebuild the index from the directory
+func (m *mirror) scan() error {
+	releases, err := m.dir.Releases()
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		log.Println("No valid versioned files found.")
+	}
+	m.index.Set(releases)
+	return nil
+}
+
+// Helper function to send a structured JSON error response
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{
+		"error": {Code: code, Message: message, RequestID: r.Header.Get("X-Request-ID")},
+	})
+}
+
+// Endpoint telling a device whether a newer release of an app is available,
+// e.g. /check?app=plugin&current_version=1.2.0 (app "plugin" and the stable
+// channel when omitted)
+func (m *mirror) handleCheck(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	current, err := catalog.NormalizeVersion(query.Get("current_version"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_VERSION", "Missing or invalid 'current_version' parameter")
+		return
+	}
+	app, channel := query.Get("app"), query.Get("channel")
+	if app == "" {
+		app = "plugin"
+	}
+	if channel == "" {
+		channel = catalog.DefaultChannel
+	}
+	if !catalog.ValidChannel(channel) {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "Invalid 'channel' parameter")
+		return
+	}
+
+	latest, ok := m.index.Latest(app, channel)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "CATALOG_EMPTY", "no versions have been published")
+		return
+	}
+	response := map[string]interface{}{"update_available": false, "latest_version": latest.Version}
+	if catalog.CompareVersions(latest.Version, current) > 0 {
+		response["update_available"] = true
+		response["download_url"] = fmt.Sprintf("%s/download?file=%s", m.baseURL, latest.FileName)
+		response["sha256"] = latest.ID
+		response["size"] = latest.Size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Endpoint serving an artifact by its path in the directory, e.g.
+// /download?file=plugin_1.3.0.wasm
+func (m *mirror) handleDownload(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("file")
+	if file == "" || path.Clean("/"+file) != "/"+file || strings.Contains(file, "\\") {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "Missing or invalid 'file' parameter")
+		return
+	}
+	full := m.dir.ArtifactPath(file)
+	if info, err := os.Stat(full); err != nil || info.IsDir() || !m.dir.Servable(full) {
+		writeError(w, r, http.StatusNotFound, "VERSION_NOT_FOUND", "File not found")
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file)))
+	http.ServeFile(w, r, full)
+}
@@ -0,0 +1,75 @@
+// Command otaserver serves OTA updates to devices and the admin API. The
+// API itself lives in pkg/httpapi; this command adds the listener (including
+// systemd socket activation), privilege dropping, mDNS advertisement, the
+// reload and read-only mode signals and the healthcheck subcommand.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"ota-server/pkg/httpapi"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
+	runAs := flag.String("user", "", "switch to this user after binding the listening socket")
+	flag.Parse()
+
+	// The TLS keys and the listening socket may need root, everything after
+	// that runs as the --user account
+	tlsConfig, err := httpapi.TLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to load TLS configuration: %v", err)
+	}
+	addr := ":8080"
+	if tlsConfig != nil {
+		addr = ":8443"
+	}
+	listener, err := serverListener(addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	if *runAs != "" {
+		if err := dropPrivileges(*runAs); err != nil {
+			log.Fatalf("Failed to switch to user %s: %v", *runAs, err)
+		}
+	}
+
+	lock, err := httpapi.Init(httpapi.Config{})
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	defer lock.Close()
+	handleSignals(lock)
+
+	router := httpapi.NewRouter()
+
+	advertisement, err := httpapi.StartMDNS(listener.Addr(), tlsConfig != nil)
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: %v", err)
+	} else if advertisement != nil {
+		defer advertisement.Close()
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("notifying systemd: %v", err)
+	}
+
+	server := &http.Server{Handler: router, TLSConfig: tlsConfig}
+	limits := "http"
+	if tlsConfig != nil {
+		limits = "https"
+	}
+	httpapi.ListenerLimitsFromEnv(limits).Apply(server)
+	log.Printf("Listening on %s", listener.Addr())
+	if tlsConfig == nil {
+		log.Fatal(server.Serve(listener))
+	}
+	log.Fatal(server.ServeTLS(listener, "", ""))
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on this platform; run the server as an
+// unprivileged account instead.
+func dropPrivileges(name string) error {
+	return errors.New("--user is not supported on this platform")
+}
@@ -0,0 +1,26 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// handleSignals releases the state lock, which writes back the pending device
+// records, and exits on an interrupt. Settings are reloaded with POST
+// /admin/reload and read-only mode is switched with PUT /admin/read-only on
+// this platform.
+func handleSignals(lock io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		if err := lock.Close(); err != nil {
+			log.Printf("releasing state directory: %v", err)
+		}
+		os.Exit(0)
+	}()
+}
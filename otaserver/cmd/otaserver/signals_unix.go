@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"ota-server/pkg/httpapi"
+)
+
+// handleSignals reloads the settings files on SIGHUP and switches read-only
+// mode on SIGUSR1 (on) and SIGUSR2 (off), e.g. from the scripts of a
+// maintenance window. SIGINT and SIGTERM release the state lock, which
+// writes back the pending device records, and exit.
+func handleSignals(lock io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				log.Printf("Shutting down on %s", sig)
+				if err := lock.Close(); err != nil {
+					log.Printf("releasing state directory: %v", err)
+				}
+				os.Exit(0)
+			case syscall.SIGHUP:
+				if failed := httpapi.Reload(); len(failed) == 0 {
+					log.Println("Settings reloaded")
+				}
+			case syscall.SIGUSR1:
+				httpapi.SetReadOnly(true, "SIGUSR1")
+				log.Println("Read-only mode on")
+			case syscall.SIGUSR2:
+				httpapi.SetReadOnly(false, "")
+				log.Println("Read-only mode off")
+			}
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+// Package accesslog writes structured access logs, one JSON object per
+// request, to any number of sinks: standard output, size-rotated files and
+// syslog. Sinks are configured with URL-like specs (see Parse), and Middleware
+// logs the requests of any net/http server; servers with richer request
+// context build their own Entry and call Logger.Log.
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one logged request. Fields a server does not know are omitted.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Route          string    `json:"route,omitempty"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	DurationMS     float64   `json:"duration_ms"`
+	RemoteIP       string    `json:"remote_ip,omitempty"`
+	DeviceID       string    `json:"device_id,omitempty"`
+	App            string    `json:"app,omitempty"`
+	CurrentVersion string    `json:"current_version,omitempty"`
+	Version        string    `json:"version,omitempty"` // offered or served
+	Result         string    `json:"result,omitempty"`
+	ErrorCode      string    `json:"error_code,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Principal      string    `json:"principal,omitempty"`
+}
+
+// Sink receives encoded entries, one JSON line at a time.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger fans entries out to its sinks. A nil Logger discards entries.
+type Logger struct {
+	sinks []Sink
+
+	mu       sync.Mutex
+	lastFail time.Time
+}
+
+// New returns a logger writing to the given sinks.
+func New(sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// Open builds a logger from a comma-separated list of sink specs.
+func Open(specs string) (*Logger, error) {
+	var sinks []Sink
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		sink, err := Parse(spec)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("access log %q: %w", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return New(sinks...), nil
+}
+
+// Parse opens the sink described by spec:
+//
+//	stdout                                  JSON lines on standard output
+//	file:///var/log/ota/access.log?max_mb=100&keep=5
+//	syslog:///dev/log                       local syslog daemon
+//	syslog://logs.example.com:514           remote syslog over UDP
+//	syslog+tcp://logs.example.com:601       remote syslog over TCP
+//
+// Files rotate when they reach max_mb megabytes (default 100), keeping keep
+// rotated files (default 5).
+func Parse(spec string) (Sink, error) {
+	if spec == "stdout" {
+		return NewWriterSink(os.Stdout), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		maxMB, keep := 100, 5
+		if value := u.Query().Get("max_mb"); value != "" {
+			if maxMB, err = strconv.Atoi(value); err != nil || maxMB <= 0 {
+				return nil, errors.New("max_mb must be a positive number")
+			}
+		}
+		if value := u.Query().Get("keep"); value != "" {
+			if keep, err = strconv.Atoi(value); err != nil || keep < 0 {
+				return nil, errors.New("keep must be a number")
+			}
+		}
+		if u.Path == "" {
+			return nil, errors.New("file sinks need a path")
+		}
+		return OpenFile(u.Path, int64(maxMB)<<20, keep)
+	case "syslog", "syslog+tcp", "syslog+udp":
+		if u.Host == "" {
+			if u.Path == "" {
+				return nil, errors.New("syslog sinks need a host or socket path")
+			}
+			return DialSyslog("unixgram", u.Path)
+		}
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		return DialSyslog(network, u.Host)
+	}
+	return nil, fmt.Errorf("unsupported sink %q", u.Scheme)
+}
+
+// Log writes an entry to every sink. Failing sinks do not fail the request;
+// their errors are logged at most once a minute.
+func (l *Logger) Log(entry Entry) {
+	if l == nil || len(l.sinks) == 0 {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Write(line); err != nil {
+			l.mu.Lock()
+			if time.Since(l.lastFail) > time.Minute {
+				l.lastFail = time.Now()
+				log.Printf("writing access log: %v", err)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Close closes every sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	var errs []error
+	for _, sink := range l.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
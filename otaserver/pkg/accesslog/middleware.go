@@ -0,0 +1,77 @@
+package accesslog
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Middleware logs every request served by next. Devices are identified by
+// the device_id query parameter and versions by current_version, as on the
+// OTA endpoints; pass anonymous to leave out device IDs and client addresses.
+func Middleware(l *Logger, anonymous bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		query := r.URL.Query()
+		entry := Entry{
+			Time:           start.UTC(),
+			RequestID:      r.Header.Get("X-Request-ID"),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Status:         recorder.status,
+			Bytes:          recorder.written,
+			DurationMS:     Milliseconds(time.Since(start)),
+			App:            query.Get("app"),
+			CurrentVersion: query.Get("current_version"),
+			Result:         StatusResult(recorder.status),
+		}
+		if !anonymous {
+			entry.DeviceID = query.Get("device_id")
+			entry.RemoteIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		l.Log(entry)
+	})
+}
+
+// Milliseconds converts a duration to fractional milliseconds.
+func Milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// StatusResult is the result of a request known only by its status code.
+func StatusResult(status int) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "rejected"
+	case status == http.StatusNotModified:
+		return "not_modified"
+	case status >= 300:
+		return "redirected"
+	}
+	return "ok"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
@@ -0,0 +1,282 @@
+// Package backup writes and reads the archives an OTA server's state is backed
+// up to: a gzipped tar of the metadata directory, the catalog snapshots, the
+// catalog index and optionally the signing and CA keys, closed by a manifest
+// listing the size and SHA-256 digest of every file, so that an archive can
+// be checked before anything is restored from it.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Format identifies the layout of the archives this package writes.
+const Format = 1
+
+// ManifestName is the name of the manifest, the last entry of an archive.
+const ManifestName = "MANIFEST.json"
+
+// Top-level directories of an archive
+const (
+	MetadataDir  = "metadata"  // the state directory's metadata
+	SnapshotsDir = "snapshots" // the catalog snapshots
+	KeysDir      = "keys"      // signing and CA keys, when included
+)
+
+// CatalogName is the catalog index, the releases published when the backup
+// was taken.
+const CatalogName = "catalog.json"
+
+// maxManifestSize bounds the manifest read from an archive.
+const maxManifestSize = 64 << 20
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format          int       `json:"format"`
+	CreatedAt       time.Time `json:"created_at"`
+	ServerVersion   string    `json:"server_version,omitempty"`
+	CatalogRevision string    `json:"catalog_revision,omitempty"`
+	Releases        int       `json:"releases"`
+
+	// Keys lists the key files included, with where the server read them
+	Keys []Key `json:"keys,omitempty"`
+
+	Files []File `json:"files"`
+}
+
+// File is an entry of an archive.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Key is a key file included in an archive.
+type Key struct {
+	Name string `json:"name"` // in the archive, under KeysDir
+	Env  string `json:"env"`  // the setting naming it, e.g. OTA_SIGNING_KEY_FILE
+	Path string `json:"path"` // where the server read it
+}
+
+// Writer writes an archive.
+type Writer struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest Manifest
+}
+
+// NewWriter starts an archive described by m, whose Files are filled in as
+// files are added.
+func NewWriter(w io.Writer, m Manifest) *Writer {
+	gz := gzip.NewWriter(w)
+	m.Format = Format
+	m.Files = nil
+	return &Writer{gz: gz, tw: tar.NewWriter(gz), manifest: m}
+}
+
+// AddBytes adds a file with the given contents.
+func (w *Writer) AddBytes(name string, data []byte) error {
+	return w.add(name, int64(len(data)), time.Now(), bytes.NewReader(data))
+}
+
+// AddFile adds the file at path under name.
+func (w *Writer) AddFile(name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return w.add(name, info.Size(), info.ModTime(), file)
+}
+
+// AddDir adds the regular files under dir beneath prefix, leaving out the
+// temporary files of writes in progress. A missing dir adds nothing.
+func (w *Writer) AddDir(prefix, dir string) error {
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		err = w.AddFile(path.Join(prefix, filepath.ToSlash(rel)), p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed while walking
+		}
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Helper function to write an entry, recording its digest
+func (w *Writer) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := w.tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(w.tw, hash), r, size); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	w.manifest.Files = append(w.manifest.Files, File{Name: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
+
+// Close writes the manifest and finishes the archive.
+func (w *Writer) Close() error {
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := w.tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0o600, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// Verify reads a whole archive and checks every file against the manifest.
+func Verify(r io.Reader) (Manifest, error) {
+	return read(r, func(string, io.Reader) error { return nil })
+}
+
+// Extract checks an archive while writing its files beneath dir, which
+// should be empty; on an error, what was extracted must not be used.
+func Extract(r io.Reader, dir string) (Manifest, error) {
+	return read(r, func(name string, content io.Reader) error {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, content); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// Helper function to read an archive, passing every file but the manifest to
+// fn and checking them all against the manifest at the end
+func read(r io.Reader, fn func(name string, content io.Reader) error) (Manifest, error) {
+	var manifest Manifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	seen := make(map[string]File)
+	found := false
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("reading archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("%s: not a regular file", header.Name)
+		}
+		if err := checkName(header.Name); err != nil {
+			return manifest, err
+		}
+		if found {
+			return manifest, fmt.Errorf("%s: after the manifest", header.Name)
+		}
+		if header.Name == ManifestName {
+			if err := json.NewDecoder(io.LimitReader(tr, maxManifestSize)).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("reading manifest: %w", err)
+			}
+			found = true
+			continue
+		}
+		if _, ok := seen[header.Name]; ok {
+			return manifest, fmt.Errorf("%s: duplicate entry", header.Name)
+		}
+		hash := sha256.New()
+		counter := &countingReader{r: io.TeeReader(tr, hash)}
+		if err := fn(header.Name, counter); err != nil {
+			return manifest, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		if _, err := io.Copy(io.Discard, counter); err != nil {
+			return manifest, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		seen[header.Name] = File{Name: header.Name, Size: counter.n, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if !found {
+		return manifest, errors.New("archive has no manifest, it may be truncated")
+	}
+	if manifest.Format != Format {
+		return manifest, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+	if len(manifest.Files) != len(seen) {
+		return manifest, fmt.Errorf("manifest lists %d files, archive has %d", len(manifest.Files), len(seen))
+	}
+	for _, want := range manifest.Files {
+		if got, ok := seen[want.Name]; !ok {
+			return manifest, fmt.Errorf("%s: missing from archive", want.Name)
+		} else if got != want {
+			return manifest, fmt.Errorf("%s: size or digest does not match the manifest", want.Name)
+		}
+	}
+	return manifest, nil
+}
+
+// Helper function to refuse entry names that would escape the directory an
+// archive is extracted to
+func checkName(name string) error {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,219 @@
+package catalog
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Besides following the <app>_<version>.<ext> convention, applications can
+// be defined in configuration: a file name template such as
+// "blink5-{version}.bin", or a regular expression with a "version" group,
+// picks out their artifacts, which may keep each channel in a directory of
+// its own. A configured app takes precedence over the convention for the
+// files it matches.
+
+// AppDef defines an application in configuration.
+type AppDef struct {
+	// Files is the template of the artifacts' file names, {version}
+	// standing for the version, e.g. "five-second-delay_{version}.wasm".
+	Files string `json:"files,omitempty"`
+	// Pattern is a regular expression the whole file name must match, with
+	// a (?P<version>...) group, for names a template cannot describe.
+	Pattern string `json:"pattern,omitempty"`
+	// ContentType is sent with downloads instead of the type guessed from
+	// the file name.
+	ContentType string `json:"content_type,omitempty"`
+	// Channels maps each channel to the directory holding its artifacts,
+	// relative to the OTA files directory ("" for the directory itself).
+	// Without it the default channel's artifacts are kept flat and those
+	// of other channels in <app>/<channel>.
+	Channels map[string]string `json:"channels,omitempty"`
+
+	name    string
+	pattern *regexp.Regexp
+}
+
+var appNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]{0,63}$`)
+
+// versionGroup matches the versions a file name template stands for.
+const versionGroup = `(?P<version>[0-9A-Za-z.+-]+)`
+
+// configuredApps holds the configured apps sorted by name.
+var configuredApps atomic.Pointer[[]AppDef]
+
+// SetApps replaces the configured apps, by name, after checking every one.
+func SetApps(apps map[string]AppDef) error {
+	defs := make([]AppDef, 0, len(apps))
+	for name, def := range apps {
+		if err := def.compile(name); err != nil {
+			return fmt.Errorf("app %s: %w", name, err)
+		}
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].name < defs[j].name })
+	configuredApps.Store(&defs)
+	return nil
+}
+
+// CheckApp reports what is wrong with the definition of an app, if anything.
+func CheckApp(name string, def AppDef) error {
+	return def.compile(name)
+}
+
+// Apps returns the configured apps by name.
+func Apps() map[string]AppDef {
+	apps := make(map[string]AppDef)
+	if defs := configuredApps.Load(); defs != nil {
+		for _, def := range *defs {
+			apps[def.name] = def
+		}
+	}
+	return apps
+}
+
+// LookupApp returns the definition of a configured app.
+func LookupApp(name string) (AppDef, bool) {
+	if defs := configuredApps.Load(); defs != nil {
+		for _, def := range *defs {
+			if def.name == name {
+				return def, true
+			}
+		}
+	}
+	return AppDef{}, false
+}
+
+// ChannelDir returns the directory, relative to the OTA files directory,
+// that holds the artifacts of an app's channel. It reports false for a
+// channel a configured app does not have.
+func ChannelDir(app, channel string) (string, bool) {
+	if def, ok := LookupApp(app); ok && len(def.Channels) > 0 {
+		dir, ok := def.Channels[channel]
+		return dir, ok
+	}
+	if channel == DefaultChannel {
+		return "", true
+	}
+	return path.Join(app, channel), ValidChannel(channel)
+}
+
+// ParseFileName parses the app and version from an artifact's file name,
+// trying the configured apps before the <app>_<version>.<ext> convention.
+// The version is empty when the name follows neither.
+func ParseFileName(fileName string) (app, version string) {
+	if defs := configuredApps.Load(); defs != nil {
+		for _, def := range *defs {
+			if version, ok := def.version(fileName); ok {
+				return def.name, version
+			}
+		}
+	}
+	return AppFromFile(fileName), VersionFromFile(fileName)
+}
+
+// Helper function to parse the path of an artifact of a configured app
+func parseConfiguredPath(rel string) (app, channel, version string, ok bool) {
+	defs := configuredApps.Load()
+	if defs == nil {
+		return "", "", "", false
+	}
+	dir, fileName := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+	for _, def := range *defs {
+		version, ok := def.version(fileName)
+		if !ok {
+			continue
+		}
+		if channel, ok := def.channelOf(dir); ok {
+			return def.name, channel, version, true
+		}
+	}
+	return "", "", "", false
+}
+
+// Helper function to check an app's definition and compile its file name
+// pattern
+func (d *AppDef) compile(name string) error {
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("name must be letters, digits, '.' or '-'")
+	}
+	d.name = name
+	switch {
+	case d.Files != "" && d.Pattern != "":
+		return fmt.Errorf("set files or pattern, not both")
+	case d.Files != "":
+		before, after, found := strings.Cut(d.Files, "{version}")
+		if !found || strings.Contains(after, "{version}") || strings.Contains(d.Files, "/") || IgnoredName(d.Files) {
+			return fmt.Errorf("files must be a file name with one {version}")
+		}
+		d.pattern = regexp.MustCompile("^" + regexp.QuoteMeta(before) + versionGroup + regexp.QuoteMeta(after) + "$")
+	case d.Pattern != "":
+		re, err := regexp.Compile("^(?:" + d.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		if re.SubexpIndex("version") < 0 {
+			return fmt.Errorf("pattern needs a (?P<version>...) group")
+		}
+		d.pattern = re
+	default:
+		return fmt.Errorf("files or pattern is required")
+	}
+	seen := make(map[string]string, len(d.Channels))
+	for channel, dir := range d.Channels {
+		if !ValidChannel(channel) {
+			return fmt.Errorf("invalid channel %q", channel)
+		}
+		if dir != "" && (path.Clean(dir) != dir || path.IsAbs(dir) || strings.HasPrefix(dir, "..") || strings.Count(dir, "/")+1 > maxArtifactDepth) {
+			return fmt.Errorf("channel %s: directory must be a relative path at most %d levels deep", channel, maxArtifactDepth)
+		}
+		if other, ok := seen[dir]; ok {
+			return fmt.Errorf("channels %s and %s share a directory", other, channel)
+		}
+		seen[dir] = channel
+	}
+	return nil
+}
+
+// Helper function to parse the version from a file name of the app
+func (d *AppDef) version(fileName string) (string, bool) {
+	m := d.pattern.FindStringSubmatch(fileName)
+	if m == nil {
+		return "", false
+	}
+	version := m[d.pattern.SubexpIndex("version")]
+	return version, version != ""
+}
+
+// Helper function to find the channel an app keeps in a directory
+func (d *AppDef) channelOf(dir string) (string, bool) {
+	if len(d.Channels) > 0 {
+		for channel, channelDir := range d.Channels {
+			if channelDir == dir {
+				return channel, true
+			}
+		}
+		return "", false
+	}
+	if dir == "" {
+		return DefaultChannel, true
+	}
+	app, channel, found := strings.Cut(dir, "/")
+	if !found || app != d.name || !ValidChannel(channel) {
+		return "", false
+	}
+	return channel, true
+}
+
+// FileName returns the file name of a version of an app defined by a
+// template, or "" for one defined by a pattern.
+func (d AppDef) FileName(version string) string {
+	if d.Files == "" {
+		return ""
+	}
+	return strings.Replace(d.Files, "{version}", version, 1)
+}
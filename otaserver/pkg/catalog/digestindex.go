@@ -0,0 +1,85 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ota-server/pkg/storage"
+)
+
+// The digest cache outlives the process in a digest index file, so that a
+// restart only hashes the artifacts added or changed since the index was
+// saved. As in memory, a file whose size and modification time are unchanged
+// is taken to be unchanged. Paths in the file are relative to the OTA files
+// directory, so the index stays valid when the directory is mounted
+// elsewhere.
+
+// digestIndexFormat is the version of the digest index file layout.
+const digestIndexFormat = 1
+
+type digestIndex struct {
+	Format  int                         `json:"format"`
+	Entries map[string]digestIndexEntry `json:"entries"` // by slash-separated file name
+}
+
+type digestIndexEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// LoadDigests fills the digest cache from a digest index file saved by
+// SaveDigests, returning the number of digests loaded. A missing file loads
+// nothing.
+func (d *Dir) LoadDigests(file string) (int, error) {
+	var index digestIndex
+	if err := storage.ReadJSON(file, &index); err != nil {
+		return 0, err
+	}
+	if index.Format != digestIndexFormat {
+		if index.Format != 0 {
+			return 0, fmt.Errorf("%s: unknown digest index format %d", file, index.Format)
+		}
+		return 0, nil
+	}
+
+	digestCache.Lock()
+	defer digestCache.Unlock()
+	for rel, entry := range index.Entries {
+		path := d.ArtifactPath(rel)
+		if _, ok := digestCache.entries[path]; ok {
+			continue
+		}
+		digestCache.entries[path] = digestEntry{size: entry.Size, modTime: entry.ModTime, digest: entry.SHA256}
+	}
+	return len(index.Entries), nil
+}
+
+// SaveDigests writes the cached digests of the directory's files to a digest
+// index file, leaving out files that are gone or changed since they were
+// hashed. It returns the number of digests saved.
+func (d *Dir) SaveDigests(file string) (int, error) {
+	digestCache.Lock()
+	cached := make(map[string]digestEntry, len(digestCache.entries))
+	for path, entry := range digestCache.entries {
+		cached[path] = entry
+	}
+	digestCache.Unlock()
+
+	index := digestIndex{Format: digestIndexFormat, Entries: make(map[string]digestIndexEntry, len(cached))}
+	for path, entry := range cached {
+		rel, err := filepath.Rel(d.path, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != entry.size || !info.ModTime().Equal(entry.modTime) {
+			continue
+		}
+		index.Entries[filepath.ToSlash(rel)] = digestIndexEntry{Size: entry.size, ModTime: entry.modTime, SHA256: entry.digest}
+	}
+	return len(index.Entries), storage.WriteJSON(file, index)
+}
@@ -0,0 +1,333 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ota-server/pkg/storage"
+)
+
+// Only <app>/<channel> directories can hold artifacts, so the scan never
+// descends deeper than this.
+const maxArtifactDepth = 2
+
+// ErrReleaseGone is returned when a release ID no longer matches any file.
+var ErrReleaseGone = errors.New("release is no longer available")
+
+// Dir is an OTA files directory.
+type Dir struct {
+	path  string
+	index atomic.Pointer[releaseList] // set when driven by a list of releases, see UseIndex
+}
+
+// NewDir returns the OTA files directory at path.
+func NewDir(path string) *Dir {
+	return &Dir{path: path}
+}
+
+// Path returns the directory's path.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// ArtifactPath turns a slash-separated release file name into a path in the
+// directory on any platform.
+func (d *Dir) ArtifactPath(rel string) string {
+	return filepath.Join(d.path, filepath.FromSlash(rel))
+}
+
+// Walk visits every versioned artifact in the directory. Hidden and temporary
+// files are skipped, and symlinks are only followed to regular files inside
+// the directory. A directory driven by a list of releases visits the listed
+// files that are present.
+func (d *Dir) Walk(visit func(rel string, info os.FileInfo) error) error {
+	if list := d.index.Load(); list != nil {
+		return d.walkIndex(list, func(release Release, info os.FileInfo) error {
+			return visit(release.FileName, info)
+		})
+	}
+	root, err := filepath.EvalSymlinks(d.path)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.path, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if IgnoredName(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if depth := strings.Count(filepath.ToSlash(rel), "/") + 1; depth > maxArtifactDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info = resolveLink(root, path); info == nil {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, _, version := ParseArtifactPath(rel); version == "" {
+			return nil
+		}
+		return visit(filepath.ToSlash(rel), info)
+	})
+}
+
+// Helper function to resolve a symlink in the directory, returning nil
+// unless it points to a regular file inside root
+func resolveLink(root, path string) os.FileInfo {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	if !storage.InsideDir(root, target) {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return info
+}
+
+// Servable reports whether a file in the directory may be served: it must
+// not be hidden or temporary, nor resolve outside the directory.
+func (d *Dir) Servable(path string) bool {
+	if IgnoredName(filepath.Base(path)) {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(d.path)
+	if err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(path)
+	return err == nil && storage.InsideDir(root, target)
+}
+
+// Release builds the release record for a file in the directory.
+func (d *Dir) Release(rel string) (Release, error) {
+	if list := d.index.Load(); list != nil {
+		release, ok := list.byFile[filepath.ToSlash(rel)]
+		if !ok {
+			return Release{}, os.ErrNotExist
+		}
+		if _, ok := d.listedFile(release); !ok {
+			return Release{}, os.ErrNotExist
+		}
+		return release, nil
+	}
+	info, err := os.Stat(d.ArtifactPath(rel))
+	if err != nil {
+		return Release{}, err
+	}
+	return d.newRelease(rel, info)
+}
+
+func (d *Dir) newRelease(rel string, info os.FileInfo) (Release, error) {
+	digest, err := FileDigest(d.ArtifactPath(rel), info)
+	if err != nil {
+		return Release{}, err
+	}
+
+	app, channel, version := ParseArtifactPath(rel)
+	return Release{
+		ID:       digest,
+		App:      app,
+		Channel:  channel,
+		FileName: filepath.ToSlash(rel),
+		Version:  version,
+		Size:     info.Size(),
+	}, nil
+}
+
+// Releases lists every versioned artifact in the directory.
+func (d *Dir) Releases() ([]Release, error) {
+	var releases []Release
+	if list := d.index.Load(); list != nil {
+		err := d.walkIndex(list, func(release Release, _ os.FileInfo) error {
+			releases = append(releases, release)
+			return nil
+		})
+		return releases, err
+	}
+	var files []foundFile
+	if err := d.Walk(func(rel string, info os.FileInfo) error {
+		files = append(files, foundFile{rel, info})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return d.newReleases(files)
+}
+
+type foundFile struct {
+	rel  string
+	info os.FileInfo
+}
+
+// hashWorkers is the number of files hashed at once when listing releases.
+var hashWorkers atomic.Int32
+
+// SetHashWorkers sets how many files are hashed at once when listing
+// releases, the number of CPUs when n is zero or less.
+func SetHashWorkers(n int) {
+	hashWorkers.Store(int32(n))
+}
+
+// Helper function to build the release records of the files a walk found,
+// hashing those not in the digest cache on a pool of workers
+func (d *Dir) newReleases(files []foundFile) ([]Release, error) {
+	workers := int(hashWorkers.Load())
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	releases := make([]Release, len(files))
+	errs := make([]error, len(files))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := int(next.Add(1) - 1); j < len(files); j = int(next.Add(1) - 1) {
+				releases[j], errs[j] = d.newRelease(files[j].rel, files[j].info)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return releases, nil
+}
+
+// FindByID finds the file whose contents match a release ID.
+func (d *Dir) FindByID(id string) (Release, error) {
+	releases, err := d.Releases()
+	if err != nil {
+		return Release{}, err
+	}
+	for _, release := range releases {
+		if release.ID == id {
+			return release, nil
+		}
+	}
+	return Release{}, ErrReleaseGone
+}
+
+// Find finds the artifact file for an app and version, relative to the
+// directory (e.g., app "plugin" and version "1.2.0" matches
+// "plugin_1.2.0.wasm" or "plugin/beta/plugin_1.2.0.wasm").
+func (d *Dir) Find(app, version string) (string, error) {
+	found := ""
+	err := d.Walk(func(rel string, info os.FileInfo) error {
+		a, _, v := ParseArtifactPath(rel)
+		if found == "" && a == app && v == version {
+			found = rel
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", os.ErrNotExist
+	}
+	return found, nil
+}
+
+type digestEntry struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+// digestCache avoids re-hashing files that have not changed since last seen.
+var digestCache = struct {
+	sync.Mutex
+	entries map[string]digestEntry
+}{entries: make(map[string]digestEntry)}
+
+// digestFlight hashes a file once for concurrent callers missing the cache.
+var digestFlight Flight[string]
+
+// digestsHashed counts the files read to compute their digest.
+var digestsHashed atomic.Uint64
+
+// DigestsHashed returns how many files were read to compute their digest,
+// as opposed to taken from the digest cache, since the process started.
+func DigestsHashed() uint64 {
+	return digestsHashed.Load()
+}
+
+// FileDigest computes the SHA-256 digest of a file, reusing the cached value
+// while its size and modification time are unchanged.
+func FileDigest(path string, info os.FileInfo) (string, error) {
+	digestCache.Lock()
+	entry, ok := digestCache.entries[path]
+	digestCache.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.digest, nil
+	}
+
+	// Concurrent callers hashing the same unchanged file share one read
+	key := fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())
+	digest, err, _ := digestFlight.Do(key, func() (string, error) {
+		digest, err := hashFile(path)
+		if err != nil {
+			return "", err
+		}
+		digestsHashed.Add(1)
+		digestCache.Lock()
+		digestCache.entries[path] = digestEntry{size: info.Size(), modTime: info.ModTime(), digest: digest}
+		digestCache.Unlock()
+		return digest, nil
+	})
+	return digest, err
+}
+
+// Helper function to compute the SHA-256 digest of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to copy file data to hash: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
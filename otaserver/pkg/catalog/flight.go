@@ -0,0 +1,52 @@
+package catalog
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanicked = errors.New("computation panicked")
+
+// Flight deduplicates concurrent computations of the same value: while a
+// call for a key is running, later calls for that key wait for it and share
+// its result instead of repeating the work, e.g. hashing a freshly published
+// artifact once when the whole fleet checks for updates at the same time.
+// The zero value is ready to use.
+type Flight[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// Do runs fn once for all the concurrent calls with the same key and returns
+// its result, with shared reporting whether the result came from a call made
+// by another caller.
+func (f *Flight[T]) Do(key string, fn func() (T, error)) (value T, err error, shared bool) {
+	f.mu.Lock()
+	if call, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*flightCall[T])
+	}
+	// Callers waiting on a computation that panics get an error
+	call := &flightCall[T]{done: make(chan struct{}), err: errFlightPanicked}
+	f.calls[key] = call
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
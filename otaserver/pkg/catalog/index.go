@@ -0,0 +1,171 @@
+package catalog
+
+import (
+	"sort"
+	"sync"
+)
+
+// Index is an in-memory index of releases, mapping each app and channel to
+// its releases sorted by version. The zero value is an empty index, safe for
+// concurrent use.
+type Index struct {
+	mu   sync.RWMutex
+	apps map[string][]Release // by indexKey, sorted by version ascending
+}
+
+func indexKey(app, channel string) string {
+	return app + "/" + channel
+}
+
+// Set replaces the indexed releases.
+func (x *Index) Set(releases []Release) {
+	apps := make(map[string][]Release)
+	for _, release := range releases {
+		key := indexKey(release.App, release.Channel)
+		apps[key] = append(apps[key], release)
+	}
+	for _, list := range apps {
+		sort.SliceStable(list, func(i, j int) bool { return CompareVersions(list[i].Version, list[j].Version) < 0 })
+	}
+
+	x.mu.Lock()
+	x.apps = apps
+	x.mu.Unlock()
+}
+
+// Latest returns the newest release of an app's channel. Pre-releases are
+// never returned for the default channel.
+func (x *Index) Latest(app, channel string) (Release, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	list := x.apps[indexKey(app, channel)]
+	for i := len(list) - 1; i >= 0; i-- {
+		if channel != DefaultChannel || !IsPrerelease(list[i].Version) {
+			return list[i], true
+		}
+	}
+	return Release{}, false
+}
+
+// Releases returns a copy of the releases of an app's channel, sorted by
+// version ascending.
+func (x *Index) Releases(app, channel string) []Release {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return append([]Release(nil), x.apps[indexKey(app, channel)]...)
+}
+
+// App returns the releases of an app across all channels.
+func (x *Index) App(app string) []Release {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var releases []Release
+	for _, list := range x.apps {
+		for _, release := range list {
+			if release.App == app {
+				releases = append(releases, release)
+			}
+		}
+	}
+	return releases
+}
+
+// All returns every indexed release, sorted by app, channel and version.
+func (x *Index) All() []Release {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	lists := make([][]Release, 0, len(x.apps))
+	for _, list := range x.apps {
+		if len(list) > 0 {
+			lists = append(lists, list)
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		if lists[i][0].App != lists[j][0].App {
+			return lists[i][0].App < lists[j][0].App
+		}
+		return lists[i][0].Channel < lists[j][0].Channel
+	})
+	var releases []Release
+	for _, list := range lists {
+		releases = append(releases, list...)
+	}
+	return releases
+}
+
+// Apps lists the indexed apps, sorted by name.
+func (x *Index) Apps() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	seen := make(map[string]bool)
+	var apps []string
+	for _, list := range x.apps {
+		if len(list) > 0 && !seen[list[0].App] {
+			seen[list[0].App] = true
+			apps = append(apps, list[0].App)
+		}
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+// Version finds a version of an app, looking in the given channel first and
+// then in every other channel.
+func (x *Index) Version(app, channel, version string) (Release, bool) {
+	for _, release := range x.Releases(app, channel) {
+		if CompareVersions(release.Version, version) == 0 {
+			return release, true
+		}
+	}
+	for _, release := range x.App(app) {
+		if CompareVersions(release.Version, version) == 0 {
+			return release, true
+		}
+	}
+	return Release{}, false
+}
+
+// Find finds a release of an app by its exact version string, like Dir.Find
+// does on disk, looking in the default channel first and then in every other
+// channel by name.
+func (x *Index) Find(app, version string) (Release, bool) {
+	for _, release := range x.Releases(app, DefaultChannel) {
+		if release.Version == version {
+			return release, true
+		}
+	}
+	for _, release := range x.All() {
+		if release.App == app && release.Version == version {
+			return release, true
+		}
+	}
+	return Release{}, false
+}
+
+// Versions lists the versions of an app across all channels, sorted ascending.
+func (x *Index) Versions(app string) []string {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, release := range x.App(app) {
+		if !seen[release.Version] {
+			seen[release.Version] = true
+			versions = append(versions, release.Version)
+		}
+	}
+	SortVersions(versions)
+	return versions
+}
+
+// ByID finds an indexed release by its ID.
+func (x *Index) ByID(id string) (Release, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, list := range x.apps {
+		for _, release := range list {
+			if release.ID == id {
+				return release, true
+			}
+		}
+	}
+	return Release{}, false
+}
@@ -0,0 +1,48 @@
+package catalog
+
+import "testing"
+
+func TestIndexFind(t *testing.T) {
+	var x Index
+	x.Set([]Release{
+		{ID: "beta-2", App: "plugin", Channel: "beta", Version: "2.0.0"},
+		{ID: "stable-2", App: "plugin", Channel: DefaultChannel, Version: "2.0.0"},
+		{ID: "stable-1", App: "plugin", Channel: DefaultChannel, Version: "1.0.0"},
+		{ID: "beta-3", App: "plugin", Channel: "beta", Version: "3.0.0-rc.1"},
+		{ID: "runtime-1", App: "runtime", Channel: DefaultChannel, Version: "1.0.0"},
+	})
+
+	tests := []struct {
+		app, version string
+		wantID       string // "" when not found
+	}{
+		{"plugin", "2.0.0", "stable-2"},
+		{"plugin", "1.0.0", "stable-1"},
+		{"plugin", "3.0.0-rc.1", "beta-3"},
+		{"runtime", "1.0.0", "runtime-1"},
+		{"plugin", "2.0", ""},
+		{"plugin", "v2.0.0", ""},
+		{"plugin", "4.0.0", ""},
+		{"other", "1.0.0", ""},
+	}
+	for _, tt := range tests {
+		release, ok := x.Find(tt.app, tt.version)
+		if ok != (tt.wantID != "") || release.ID != tt.wantID {
+			t.Errorf("Find(%q, %q) = %q, %v, want %q", tt.app, tt.version, release.ID, ok, tt.wantID)
+		}
+	}
+
+	var ids []string
+	for _, release := range x.All() {
+		ids = append(ids, release.ID)
+	}
+	want := []string{"beta-2", "beta-3", "stable-1", "stable-2", "runtime-1"}
+	if len(ids) != len(want) {
+		t.Fatalf("All = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("All = %v, want %v", ids, want)
+		}
+	}
+}
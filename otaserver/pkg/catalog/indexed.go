@@ -0,0 +1,117 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A directory can be driven by a pre-generated list of its releases instead
+// of being scanned, for artifacts on read-only media: the files are only
+// stat'ed, never listed or hashed, and the release IDs are the digests the
+// list was generated with.
+
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type releaseList struct {
+	releases []Release
+	byFile   map[string]Release
+}
+
+// UseIndex makes the directory serve the given releases instead of the
+// files found by scanning it; a nil list returns to scanning. Every release
+// must follow the artifact layout under the name it is listed with.
+func (d *Dir) UseIndex(releases []Release) error {
+	if releases == nil {
+		d.index.Store(nil)
+		return nil
+	}
+	list := &releaseList{byFile: make(map[string]Release, len(releases))}
+	for _, release := range releases {
+		if err := checkListed(release); err != nil {
+			return err
+		}
+		if _, ok := list.byFile[release.FileName]; ok {
+			return fmt.Errorf("%s is listed twice", release.FileName)
+		}
+		list.byFile[release.FileName] = release
+		list.releases = append(list.releases, release)
+	}
+	d.index.Store(list)
+	return nil
+}
+
+// Indexed reports whether the directory serves a pre-generated list of
+// releases.
+func (d *Dir) Indexed() bool {
+	return d.index.Load() != nil
+}
+
+// Helper function to check that a listed release names a file in the
+// directory whose path agrees with its app, channel and version
+func checkListed(release Release) error {
+	rel := release.FileName
+	if rel == "" || path.Clean(rel) != rel || strings.HasPrefix(rel, "/") {
+		return fmt.Errorf("invalid file name %q", rel)
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if IgnoredName(part) {
+			return fmt.Errorf("invalid file name %q", rel)
+		}
+	}
+	app, channel, version := ParseArtifactPath(rel)
+	if version == "" || app != release.App || channel != release.Channel || version != release.Version {
+		return fmt.Errorf("%s does not match app %q, channel %q and version %q", rel, release.App, release.Channel, release.Version)
+	}
+	if !digestPattern.MatchString(release.ID) {
+		return fmt.Errorf("%s: release ID must be a SHA-256 digest in hex", rel)
+	}
+	if release.Size < 0 {
+		return fmt.Errorf("%s: negative size", rel)
+	}
+	return nil
+}
+
+// Helper function to visit the listed releases whose files are present with
+// the listed size
+func (d *Dir) walkIndex(list *releaseList, visit func(release Release, info os.FileInfo) error) error {
+	for _, release := range list.releases {
+		info, ok := d.listedFile(release)
+		if !ok {
+			continue
+		}
+		if err := visit(release, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to stat the file of a listed release, which must be a
+// servable regular file of the listed size
+func (d *Dir) listedFile(release Release) (os.FileInfo, bool) {
+	path := d.ArtifactPath(release.FileName)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != release.Size || !d.Servable(path) {
+		return nil, false
+	}
+	return info, true
+}
+
+// MissingFromIndex lists the releases of the index whose files are absent or
+// differ in size from the listed one.
+func (d *Dir) MissingFromIndex() []Release {
+	list := d.index.Load()
+	if list == nil {
+		return nil
+	}
+	var missing []Release
+	for _, release := range list.releases {
+		if _, ok := d.listedFile(release); !ok {
+			missing = append(missing, release)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,93 @@
+// Package catalog finds the releases in an OTA files directory and indexes
+// them by app and channel. Artifacts are named <app>_<version>.<ext> and kept
+// either flat in the directory, where they belong to the default channel, or
+// organized as <app>/<channel>/<app>_<version>.<ext>.
+package catalog
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Release is an immutable artifact in the OTA files directory, identified by
+// the SHA-256 digest of its contents. Re-publishing a file under the same name
+// with different bytes yields a different release ID.
+type Release struct {
+	ID       string `json:"release_id"`
+	App      string `json:"app"`
+	Channel  string `json:"channel"`
+	FileName string `json:"file_name"` // relative to the OTA files directory
+	Version  string `json:"version"`
+	Size     int64  `json:"size"`
+}
+
+// DefaultChannel is the channel of artifacts kept flat in the OTA files directory.
+const DefaultChannel = "stable"
+
+var channelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// ValidChannel reports whether channel is a valid channel name.
+func ValidChannel(channel string) bool {
+	return channelPattern.MatchString(channel)
+}
+
+// VersionFromFile parses the version from a file name (e.g., "app_1.2.0.zip").
+func VersionFromFile(fileName string) string {
+	baseName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) // remove extension
+	parts := strings.Split(baseName, "_")
+	if len(parts) == 2 {
+		return parts[1] // version part
+	}
+	return ""
+}
+
+// AppFromFile parses the app name from a file name (e.g., "app_1.2.0.zip").
+func AppFromFile(fileName string) string {
+	baseName := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	parts := strings.Split(baseName, "_")
+	if len(parts) == 2 {
+		return parts[0]
+	}
+	return ""
+}
+
+// ParseArtifactPath parses the app, channel and version from the path of an
+// artifact relative to the OTA files directory, trying the configured apps
+// (see apps.go) first. The version is empty when the path does not follow
+// either layout.
+func ParseArtifactPath(rel string) (app, channel, version string) {
+	if app, channel, version, ok := parseConfiguredPath(filepath.ToSlash(rel)); ok {
+		return app, channel, version
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	fileName := parts[len(parts)-1]
+	app, version = AppFromFile(fileName), VersionFromFile(fileName)
+
+	switch len(parts) {
+	case 1:
+		return app, DefaultChannel, version
+	case 3:
+		if parts[0] != app || !ValidChannel(parts[1]) {
+			return "", "", ""
+		}
+		return app, parts[1], version
+	}
+	return "", "", ""
+}
+
+// Suffixes of files that are still being written or are left over by editors.
+var temporarySuffixes = []string{".part", ".tmp", ".swp", "~"}
+
+// IgnoredName reports whether a file or directory name is hidden or temporary.
+func IgnoredName(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, suffix := range temporarySuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
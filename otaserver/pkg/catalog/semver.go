@@ -0,0 +1,197 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Versions are compared with semantic versioning precedence: pre-releases
+// ("2.0.0-rc.1") come before their release, their dot-separated identifiers
+// are compared numerically where both are numeric, and build metadata
+// ("+sha.5114f85") is ignored. A leading "v" and missing minor or patch
+// numbers ("1.2") are tolerated. Versions that are not semver at all are
+// ordered after every semver version, by plain string comparison.
+
+// semver is a parsed version; build metadata is dropped.
+type semver struct {
+	core       [3]uint64
+	prerelease []string
+}
+
+// Helper function to parse a version, reporting false when it is not semver
+func parseSemver(version string) (semver, bool) {
+	var v semver
+	version = strings.TrimPrefix(version, "v")
+	version, _, _ = strings.Cut(version, "+")
+	version, pre, hasPre := strings.Cut(version, "-")
+	if hasPre {
+		if pre == "" {
+			return v, false
+		}
+		v.prerelease = strings.Split(pre, ".")
+		for _, id := range v.prerelease {
+			if id == "" {
+				return v, false
+			}
+		}
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	return v, true
+}
+
+// VersionFormats are examples of the version formats NormalizeVersion accepts.
+var VersionFormats = []string{"1.2.3", "v1.2.3", "1.2", "1", "1.2.3-rc1", "1.2.3-rc.1+build5"}
+
+// NormalizeVersion rewrites a version in one of the forms devices commonly
+// report ("v1.2.3", "1.2", "1.2.3-rc1+build5") as MAJOR.MINOR.PATCH, keeping
+// any pre-release and build metadata, or explains why it is not a version.
+func NormalizeVersion(version string) (string, error) {
+	v := strings.TrimSpace(version)
+	if v == "" {
+		return "", errors.New("version is empty")
+	}
+	if v[0] == 'v' || v[0] == 'V' {
+		v = v[1:]
+	}
+	v, build, hasBuild := strings.Cut(v, "+")
+	v, pre, hasPre := strings.Cut(v, "-")
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return "", fmt.Errorf("%q has more than three numbers before any '-' or '+'", version)
+	}
+	var core [3]uint64
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a number in %q", part, version)
+		}
+		core[i] = n
+	}
+
+	normalized := fmt.Sprintf("%d.%d.%d", core[0], core[1], core[2])
+	if hasPre {
+		if !validIdentifiers(pre) {
+			return "", fmt.Errorf("pre-release %q in %q must be dot-separated letters, digits and '-'", pre, version)
+		}
+		normalized += "-" + pre
+	}
+	if hasBuild {
+		if !validIdentifiers(build) {
+			return "", fmt.Errorf("build metadata %q in %q must be dot-separated letters, digits and '-'", build, version)
+		}
+		normalized += "+" + build
+	}
+	return normalized, nil
+}
+
+// Helper function to check the dot-separated identifiers of a pre-release or
+// build metadata
+func validIdentifiers(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, r := range id {
+			if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CompareVersions returns -1, 0 or 1 as a is older than, equal to or newer than b.
+func CompareVersions(a, b string) int {
+	va, okA := parseSemver(a)
+	vb, okB := parseSemver(b)
+	switch {
+	case !okA && !okB:
+		return strings.Compare(a, b)
+	case !okA:
+		return 1
+	case !okB:
+		return -1
+	}
+
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			return compareUint(va.core[i], vb.core[i])
+		}
+	}
+
+	// A release is newer than any of its pre-releases
+	switch {
+	case len(va.prerelease) == 0 && len(vb.prerelease) == 0:
+		return 0
+	case len(va.prerelease) == 0:
+		return 1
+	case len(vb.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		if c := compareIdentifier(va.prerelease[i], vb.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(va.prerelease)), uint64(len(vb.prerelease)))
+}
+
+// Helper function to compare pre-release identifiers; numeric identifiers
+// sort before alphanumeric ones
+func compareIdentifier(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return compareUint(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// IsPrerelease reports whether a version is a semver pre-release.
+func IsPrerelease(version string) bool {
+	v, ok := parseSemver(version)
+	return ok && len(v.prerelease) > 0
+}
+
+// MajorJump reports whether going from one version to a newer one crosses a
+// major version, e.g. 1.9.0 to 2.0.0. Versions that are not semver never do.
+func MajorJump(from, to string) bool {
+	a, okA := parseSemver(from)
+	b, okB := parseSemver(to)
+	return okA && okB && b.core[0] > a.core[0]
+}
+
+// SortVersions sorts versions from oldest to newest.
+func SortVersions(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool { return CompareVersions(versions[i], versions[j]) < 0 })
+}
@@ -0,0 +1,55 @@
+package catalog
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.9.9", "2.0.0", -1},
+
+		// Leading "v" and missing numbers
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1", "1.0.0", 0},
+		{"1.2", "1.2.1", -1},
+
+		// Build metadata is ignored
+		{"1.2.3+build5", "1.2.3", 0},
+		{"1.2.3+a", "1.2.3+b", 0},
+		{"1.2.3-rc.1+sha.5114f85", "1.2.3-rc.1", 0},
+
+		// Pre-releases come before their release
+		{"2.0.0-rc.1", "2.0.0", -1},
+		{"2.0.0-rc.1", "1.9.9", 1},
+		{"2.0.0-alpha", "2.0.0-alpha.1", -1},
+		{"2.0.0-alpha.1", "2.0.0-alpha.beta", -1},
+		{"2.0.0-alpha.beta", "2.0.0-beta", -1},
+		{"2.0.0-beta.2", "2.0.0-beta.11", -1},
+		{"2.0.0-rc.1", "2.0.0-rc1", -1},
+		{"2.0.0-rc-1", "2.0.0-rc-2", -1},
+
+		// Versions that are not semver go after every semver version
+		{"1.0.0", "latest", -1},
+		{"99.0.0-rc.1", "nightly", -1},
+		{"latest", "nightly", -1},
+		{"nightly", "nightly", 0},
+		{"1.2.3.4", "1.2.3", 1},
+		{"1.2.3-", "9.9.9", 1},
+		{"1.2.3-rc..1", "9.9.9", 1},
+		{"", "0.0.0", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Package client is a Go SDK for devices talking to the OTA server: it checks
+// for updates and downloads the offered artifacts.
+//
+// The package also builds for wasm (js/wasm and wasip1) and with TinyGo, so
+// that wasm plugins can update themselves. Where the runtime has no network
+// stack, set Client.HTTPClient to a Doer that forwards requests to the host.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// catalogRevisionHeader carries the catalog revision of every response.
+const catalogRevisionHeader = "X-Catalog-Revision"
+
+// Client talks to one OTA server on behalf of one device.
+type Client struct {
+	// BaseURL is the server's root, e.g. "https://ota.example.com".
+	BaseURL string
+	// DeviceID is sent with every check when set.
+	DeviceID string
+	// Model is the device's hardware model, sent with every check when set
+	// so that the server never offers releases below the model's
+	// anti-rollback floor.
+	Model string
+	// HTTPClient sends the requests. New sets it to an *http.Client with a
+	// one minute timeout per request.
+	HTTPClient Doer
+	// Verifiers check every download after its size and digests, e.g. a
+	// SignatureVerifier or a hardware-backed check; see verify.go.
+	Verifiers []Verifier
+	// ClientClass describes the device's connection, e.g. "cellular" or
+	// "wifi", and is sent with every request so the server can tell the
+	// abort rates of downloads apart.
+	ClientClass string
+	// Timestamps, when set, checks the signed timestamp of every update and
+	// bundle check so that replayed old responses are refused; see
+	// timestamp.go.
+	Timestamps *TimestampVerifier
+}
+
+// updateApp is the app update checks are answered for.
+const updateApp = "plugin"
+
+// Doer sends HTTP requests; *http.Client is one. Requests carry the context
+// of the call that made them.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DoerFunc adapts a function to a Doer, e.g. one bridging requests to the
+// host of a wasm plugin.
+type DoerFunc func(req *http.Request) (*http.Response, error)
+
+// Do calls f(req).
+func (f DoerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Signature is a release signature as served by the server.
+type Signature struct {
+	KeyID string `json:"key_id"`
+	Value string `json:"value"`
+}
+
+// Provenance describes how a release was built, as attested by its publisher.
+type Provenance struct {
+	Builder       string `json:"builder"`
+	SourceRepo    string `json:"source_repo,omitempty"`
+	SourceCommit  string `json:"source_commit,omitempty"`
+	BuildWorkflow string `json:"build_workflow,omitempty"`
+	PredicateType string `json:"predicate_type,omitempty"`
+	Verified      bool   `json:"verified"`
+	KeyID         string `json:"key_id,omitempty"`
+}
+
+// PatchInfo describes a delta patch that can be applied instead of
+// downloading the full image.
+type PatchInfo struct {
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	From   string `json:"from"`
+}
+
+// Update is the response to an update check. DownloadURL is empty when no
+// download is offered.
+type Update struct {
+	LatestVersion string      `json:"latest_version"`
+	DownloadURL   string      `json:"download_url,omitempty"`
+	CheckSum      string      `json:"checksum,omitempty"`
+	ReleaseID     string      `json:"release_id,omitempty"`
+	Size          int64       `json:"size,omitempty"`
+	ReleaseNotes  string      `json:"release_notes,omitempty"`
+	Signature     *Signature  `json:"signature,omitempty"`
+	Provenance    *Provenance `json:"provenance,omitempty"`
+	Patch         *PatchInfo  `json:"patch,omitempty"`
+	AvailableAt   string      `json:"available_at,omitempty"`
+
+	// Mandatory updates can no longer be deferred by reporting
+	// "deferred"; DeferredUntil is set instead of a download while the
+	// update is deferred.
+	Mandatory     bool   `json:"mandatory,omitempty"`
+	DeferredUntil string `json:"deferred_until,omitempty"`
+
+	// SecurityFixes lists the vulnerabilities (e.g. CVE IDs) the update fixes.
+	SecurityFixes []string `json:"security_fixes,omitempty"`
+
+	// Fields are device-specific values of the release, e.g. a config URL
+	// or a content key wrapped for this device (see UnwrapKey).
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// HeldBy explains why a newer release is held back until another app
+	// is updated.
+	HeldBy string `json:"held_by,omitempty"`
+
+	// Reason says why nothing newer than the running version is offered,
+	// e.g. to tell "no release" from "not yet this device's turn" in logs:
+	// "up_to_date", "pinned" (operators pinned the device to its version),
+	// "held" (see HeldBy), "install_window" (see AvailableAt), "deferred"
+	// (see DeferredUntil), "stuck" (the device kept downloading without
+	// installing) or "version_floor" (what could be offered is below the
+	// anti-rollback floor of the device's model). Empty when an update is
+	// offered.
+	Reason string `json:"reason,omitempty"`
+
+	// Timestamp is the server's signed statement of the channel's newest
+	// version, sent when releases are signed.
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+
+	// SizeBytes, SHA256 and CreatedAt describe the offered artifact, also
+	// when its download is held back.
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+
+	// Digests are the artifact's digests in the algorithms configured for
+	// the app, by algorithm name.
+	Digests map[string]string `json:"digests,omitempty"`
+
+	// NextCheckAfter is the number of seconds the server asks the device to
+	// wait before checking again, zero when it gives no hint.
+	NextCheckAfter int `json:"next_check_after,omitempty"`
+
+	// CatalogRevision is the catalog revision the server answered from, to
+	// quote in device logs.
+	CatalogRevision string `json:"-"`
+}
+
+// Artifact returns the offered download as an artifact, or false when none is offered.
+func (u *Update) Artifact(name string) (Artifact, bool) {
+	if u.DownloadURL == "" {
+		return Artifact{}, false
+	}
+	return Artifact{
+		Name:            name,
+		App:             updateApp,
+		Version:         u.LatestVersion,
+		ReleaseID:       u.ReleaseID,
+		Size:            u.Size,
+		DownloadURL:     u.DownloadURL,
+		Signature:       u.Signature,
+		Digests:         u.Digests,
+		CatalogRevision: u.CatalogRevision,
+	}, true
+}
+
+// Artifact is one downloadable file of a manifest. ReleaseID is the SHA-256
+// digest of its contents.
+type Artifact struct {
+	Name           string     `json:"name"`
+	CurrentVersion string     `json:"current_version,omitempty"`
+	Version        string     `json:"version"`
+	ReleaseID      string     `json:"release_id"`
+	Size           int64      `json:"size"`
+	DownloadURL    string     `json:"download_url"`
+	Signature      *Signature `json:"signature,omitempty"`
+	Patch          *PatchInfo `json:"patch,omitempty"`
+
+	// Digests are the artifact's digests by algorithm name.
+	Digests map[string]string `json:"digests,omitempty"`
+
+	// App is the app the release belongs to, which its signature covers;
+	// Name when empty, as for bundle components.
+	App string `json:"-"`
+
+	// CatalogRevision is the catalog revision the artifact was offered
+	// from; downloads failing after it changed return ErrCatalogChanged.
+	CatalogRevision string `json:"-"`
+}
+
+// BundleManifest is the response to a bundle check.
+type BundleManifest struct {
+	Bundle      string     `json:"bundle"`
+	Version     string     `json:"version"`
+	Notes       string     `json:"notes,omitempty"`
+	Manifest    []Artifact `json:"manifest"`
+	Updates     []Artifact `json:"updates"`
+	TotalSize   int64      `json:"total_size"`
+	UpdatesSize int64      `json:"updates_size"`
+
+	NextCheckAfter int `json:"next_check_after,omitempty"`
+
+	// Timestamp is the server's signed statement of the bundle's newest
+	// version, sent when releases are signed.
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+
+	// CatalogRevision is the catalog revision the server answered from.
+	CatalogRevision string `json:"-"`
+}
+
+// Error is an error response from the server.
+type Error struct {
+	Status    int                    `json:"-"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+
+	// RetryAfter is the delay from the response's Retry-After header, if any.
+	RetryAfter time.Duration `json:"-"`
+
+	// CatalogRevision is the catalog revision the server answered from.
+	CatalogRevision string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ota server: %s: %s (status %d)", e.Code, e.Message, e.Status)
+}
+
+// CheckUpdate asks for the newest release of a channel; an empty channel
+// means the server's default.
+func (c *Client) CheckUpdate(ctx context.Context, currentVersion, channel string) (*Update, error) {
+	query := url.Values{"current_version": {currentVersion}}
+	if channel != "" {
+		query.Set("channel", channel)
+	}
+	var update Update
+	revision, err := c.getJSON(ctx, "/check-update", query, &update)
+	update.CatalogRevision = revision
+	if err == nil && c.Timestamps != nil {
+		// Without a channel the server answers for its default one, which
+		// only the timestamp names
+		subject := updateApp + "/" + channel
+		if channel == "" && update.Timestamp != nil && strings.HasPrefix(update.Timestamp.Subject, updateApp+"/") {
+			subject = update.Timestamp.Subject
+		}
+		err = c.Timestamps.Verify(update.Timestamp, subject, OfferDigest(&update))
+	}
+	return &update, err
+}
+
+// CheckBundle asks for the newest version of a bundle, given the versions of
+// the components the device runs.
+func (c *Client) CheckBundle(ctx context.Context, bundle string, components map[string]string) (*BundleManifest, error) {
+	query := url.Values{"bundle": {bundle}}
+	for name, version := range components {
+		query.Set("components["+name+"]", version)
+	}
+	var manifest BundleManifest
+	revision, err := c.getJSON(ctx, "/check-bundle", query, &manifest)
+	manifest.CatalogRevision = revision
+	for i := range manifest.Manifest {
+		manifest.Manifest[i].CatalogRevision = revision
+	}
+	for i := range manifest.Updates {
+		manifest.Updates[i].CatalogRevision = revision
+	}
+	if err == nil && c.Timestamps != nil {
+		err = c.Timestamps.Verify(manifest.Timestamp, "bundle/"+bundle, BundleOfferDigest(&manifest))
+	}
+	return &manifest, err
+}
+
+// Helper function to send a GET request and decode its JSON response,
+// returning the catalog revision it was served from
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) (string, error) {
+	if c.DeviceID != "" {
+		query.Set("device_id", c.DeviceID)
+	}
+	if c.Model != "" {
+		query.Set("model", c.Model)
+	}
+	resp, err := c.get(ctx, path+"?"+query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get(catalogRevisionHeader), json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Helper function to send a GET request, turning error responses into *Error
+func (c *Client) get(ctx context.Context, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClientClass != "" {
+		req.Header.Set("X-OTA-Client-Class", c.ClientClass)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		apiErr := &Error{Status: resp.StatusCode, Code: "HTTP_ERROR", Message: resp.Status}
+		var body struct {
+			Error *Error `json:"error"`
+		}
+		if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); json.Unmarshal(data, &body) == nil && body.Error != nil {
+			apiErr = body.Error
+			apiErr.Status = resp.StatusCode
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		apiErr.CatalogRevision = resp.Header.Get(catalogRevisionHeader)
+		return nil, apiErr
+	}
+	return resp, nil
+}
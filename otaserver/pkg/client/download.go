@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInsufficientSpace is returned when the destination does not have room
+// for the artifacts.
+var ErrInsufficientSpace = errors.New("not enough free space for the download")
+
+// ErrCatalogChanged wraps download failures that happened after the catalog
+// changed since the artifact was offered; check for updates again.
+var ErrCatalogChanged = errors.New("catalog changed since the update was offered")
+
+// DownloadOptions tune DownloadAll.
+type DownloadOptions struct {
+	// Workers is the number of concurrent downloads, 2 when zero.
+	Workers int
+	// CheckFreeSpace makes DownloadAll fail with ErrInsufficientSpace before
+	// downloading anything when the destination has less free space than the
+	// artifacts need. It is skipped where free space cannot be determined.
+	CheckFreeSpace bool
+	// Progress is called with the bytes received so far across all
+	// artifacts and the total to receive. It may be called concurrently.
+	Progress func(done, total int64)
+}
+
+// DownloadAll downloads artifacts into dir, named after the artifacts, and
+// verifies them like Download. Each file is written to a temporary file
+// and renamed into place once verified. On error the remaining downloads are
+// cancelled and the files already completed are left in place.
+func (c *Client) DownloadAll(ctx context.Context, artifacts []Artifact, dir string, opts DownloadOptions) error {
+	var total int64
+	for _, artifact := range artifacts {
+		if artifact.Name == "" || filepath.Base(artifact.Name) != artifact.Name {
+			return fmt.Errorf("invalid artifact name %q", artifact.Name)
+		}
+		total += artifact.Size
+	}
+	if opts.CheckFreeSpace {
+		if free, ok := freeSpace(dir); ok && free < uint64(total) {
+			return fmt.Errorf("%w: need %d bytes, %d available", ErrInsufficientSpace, total, free)
+		}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 2
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		done     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	progress := func(n int64) {
+		if opts.Progress != nil {
+			opts.Progress(done.Add(n), total)
+		} else {
+			done.Add(n)
+		}
+	}
+
+	queue := make(chan Artifact)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for artifact := range queue {
+				if err := c.download(ctx, artifact, filepath.Join(dir, artifact.Name), progress); err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("%s: %w", artifact.Name, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for _, artifact := range artifacts {
+		select {
+		case queue <- artifact:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Download downloads one artifact to path, verifying its size, digests and
+// Client.Verifiers.
+func (c *Client) Download(ctx context.Context, artifact Artifact, path string) error {
+	return c.download(ctx, artifact, path, nil)
+}
+
+func (c *Client) download(ctx context.Context, artifact Artifact, path string, progress func(int64)) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	resp, err := c.get(ctx, artifact.DownloadURL)
+	if err != nil {
+		var apiErr *Error
+		if errors.As(err, &apiErr) {
+			return catalogChanged(artifact, apiErr.CatalogRevision, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	revision := resp.Header.Get(catalogRevisionHeader)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hashes := newDigests(artifact)
+	writers := []io.Writer{tmp}
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = &progressReader{r: body, report: progress}
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	received := Received{Path: tmp.Name(), Size: size, Digests: make(map[string]string, len(hashes))}
+	for algorithm, h := range hashes {
+		received.Digests[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	if err := verifyDigests(artifact, received); err != nil {
+		return catalogChanged(artifact, revision, fmt.Errorf("%w: %w", ErrVerification, err))
+	}
+	for _, verifier := range c.Verifiers {
+		if err := verifier.Verify(ctx, artifact, received); err != nil {
+			return fmt.Errorf("%w: %w", ErrVerification, err)
+		}
+	}
+	// WASI has no file modes, and some runtimes report Chmod as unsupported
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Helper function to wrap a download error with ErrCatalogChanged when the
+// server answered from another catalog revision than the artifact's
+func catalogChanged(artifact Artifact, revision string, err error) error {
+	if artifact.CatalogRevision == "" || revision == "" || revision == artifact.CatalogRevision {
+		return err
+	}
+	return fmt.Errorf("%w (%s, offered from %s): %w", ErrCatalogChanged, revision, artifact.CatalogRevision, err)
+}
+
+// progressReader reports the bytes read through it.
+type progressReader struct {
+	r      io.Reader
+	report func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.report(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package client
+
+// freeSpace cannot be determined on this platform.
+func freeSpace(dir string) (uint64, bool) {
+	return 0, false
+}
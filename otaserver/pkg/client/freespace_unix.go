@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package client
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to unprivileged users under dir.
+func freeSpace(dir string) (uint64, bool) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true
+}
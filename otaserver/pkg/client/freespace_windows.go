@@ -0,0 +1,18 @@
+//go:build windows
+
+package client
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the bytes available to the calling user under dir.
+func freeSpace(dir string) (uint64, bool) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, nil, nil); err != nil {
+		return 0, false
+	}
+	return available, true
+}
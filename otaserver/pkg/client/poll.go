@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PollOptions tune Poll.
+type PollOptions struct {
+	// Channel to check, the server's default when empty.
+	Channel string
+	// Interval is used when the server gives no hint, one hour when zero.
+	Interval time.Duration
+	// MaxInterval caps the server's hints, unlimited when zero.
+	MaxInterval time.Duration
+}
+
+// Poll checks for updates until ctx is done, calling handle with every
+// successful response. Between checks it waits as long as the server's
+// next_check_after hint (or an error response's Retry-After header) asks, and
+// opts.Interval otherwise. currentVersion is called before each check so that
+// installs done by handle are reported. Poll returns ctx's error, or the
+// first error returned by handle.
+func (c *Client) Poll(ctx context.Context, currentVersion func() string, opts PollOptions, handle func(*Update) error) error {
+	fallback := opts.Interval
+	if fallback <= 0 {
+		fallback = time.Hour
+	}
+
+	for {
+		wait := fallback
+		update, err := c.CheckUpdate(ctx, currentVersion(), opts.Channel)
+		var apiErr *Error
+		switch {
+		case err == nil:
+			if update.NextCheckAfter > 0 {
+				wait = time.Duration(update.NextCheckAfter) * time.Second
+			}
+			if err := handle(update); err != nil {
+				return err
+			}
+		case errors.As(err, &apiErr) && apiErr.RetryAfter > 0:
+			wait = apiErr.RetryAfter
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+		if opts.MaxInterval > 0 && wait > opts.MaxInterval {
+			wait = opts.MaxInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A man in the middle who cannot forge updates can still keep a device on an
+// old release by replaying an old "no update" response forever (a freeze
+// attack). Servers that sign releases also sign a timestamp in every
+// check-update and bundle response: the newest version they know, a digest
+// of what the response offers and when the statement expires. With
+// Client.Timestamps set, responses whose timestamp is missing, not signed by
+// a trusted key, expired, about something else or another offer, or older
+// than one already accepted fail with an error wrapping ErrStaleResponse.
+
+// ErrStaleResponse wraps the errors of responses failing the timestamp check.
+var ErrStaleResponse = errors.New("response is stale or its timestamp is not trusted")
+
+// Timestamp is the server's signed statement that Latest was the newest
+// version of Subject at IssuedAt.
+type Timestamp struct {
+	Subject   string    `json:"subject"`
+	Latest    string    `json:"latest,omitempty"`
+	Offer     string    `json:"offer"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	KeyID     string    `json:"key_id"`
+	Value     string    `json:"signature"`
+}
+
+// TimestampVerifier checks response timestamps against keys the device
+// trusts and remembers the newest one accepted per subject. It is safe for
+// concurrent use.
+type TimestampVerifier struct {
+	keys map[string]ed25519.PublicKey // by key ID
+
+	// Now tells the time responses must not have expired at, time.Now when
+	// nil. Devices without a trustworthy clock return the zero time, which
+	// leaves only the check that timestamps never go back.
+	Now func() time.Time
+
+	mu   sync.Mutex
+	last map[string]time.Time // newest accepted IssuedAt by subject
+}
+
+// NewTimestampVerifier returns a verifier trusting the given Ed25519 public
+// keys, those served by /signing-key.
+func NewTimestampVerifier(keys ...ed25519.PublicKey) *TimestampVerifier {
+	v := &TimestampVerifier{keys: make(map[string]ed25519.PublicKey, len(keys)), last: make(map[string]time.Time)}
+	for _, key := range keys {
+		v.keys[KeyID(key)] = key
+	}
+	return v
+}
+
+// Verify checks a timestamp about subject, vouching for the response whose
+// offer digest is offer (see OfferDigest and BundleOfferDigest), and
+// remembers it when it is good.
+func (v *TimestampVerifier) Verify(ts *Timestamp, subject, offer string) error {
+	if ts == nil {
+		return fmt.Errorf("%w: response carries no timestamp", ErrStaleResponse)
+	}
+	if ts.Subject != subject {
+		return fmt.Errorf("%w: timestamp is about %s, expected %s", ErrStaleResponse, ts.Subject, subject)
+	}
+	key, ok := v.keys[ts.KeyID]
+	if !ok {
+		return fmt.Errorf("%w: timestamp signed with untrusted key %s", ErrStaleResponse, ts.KeyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(ts.Value)
+	if err != nil || !ed25519.Verify(key, timestampPayload(ts), raw) {
+		return fmt.Errorf("%w: timestamp signature does not match", ErrStaleResponse)
+	}
+	if ts.Offer != offer {
+		return fmt.Errorf("%w: timestamp does not vouch for this response", ErrStaleResponse)
+	}
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	if !now.IsZero() && now.After(ts.ExpiresAt) {
+		return fmt.Errorf("%w: timestamp expired at %s", ErrStaleResponse, ts.ExpiresAt.Format(time.RFC3339))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if last := v.last[subject]; ts.IssuedAt.Before(last) {
+		return fmt.Errorf("%w: timestamp issued at %s, before the one accepted at %s", ErrStaleResponse, ts.IssuedAt.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	v.last[subject] = ts.IssuedAt
+	return nil
+}
+
+// Last returns the issue time of the newest timestamp accepted about a
+// subject, for devices to persist across restarts.
+func (v *TimestampVerifier) Last(subject string) time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.last[subject]
+}
+
+// SetLast restores the issue time of the newest timestamp accepted about a
+// subject, e.g. after a restart; older timestamps are refused from then on.
+func (v *TimestampVerifier) SetLast(subject string, issuedAt time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.last[subject] = issuedAt
+}
+
+// OfferDigest is the digest of what a check-update response offers, which
+// its timestamp vouches for.
+func OfferDigest(u *Update) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("ota-offer-v1\n%s\n%s\n%s\n", u.LatestVersion, u.ReleaseID, u.Reason)))
+	return hex.EncodeToString(sum[:])
+}
+
+// BundleOfferDigest is the digest of what a bundle check response offers,
+// which its timestamp vouches for.
+func BundleOfferDigest(m *BundleManifest) string {
+	updates := make([]Artifact, len(m.Updates))
+	copy(updates, m.Updates)
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Name < updates[j].Name })
+	hash := sha256.New()
+	fmt.Fprintf(hash, "ota-bundle-offer-v1\n%s\n%s\n", m.Bundle, m.Version)
+	for _, update := range updates {
+		fmt.Fprintf(hash, "%s %s\n", update.Name, update.ReleaseID)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Helper function to build the payload a timestamp signature covers; it must
+// match the server's manifest.TimestampSigningPayload
+func timestampPayload(ts *Timestamp) []byte {
+	return []byte(fmt.Sprintf("ota-timestamp-v2\n%s\n%s\n%s\n%s\n%s\n", ts.Subject, ts.Latest, ts.Offer, ts.IssuedAt.UTC().Format(time.RFC3339), ts.ExpiresAt.UTC().Format(time.RFC3339)))
+}
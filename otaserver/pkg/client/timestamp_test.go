@@ -0,0 +1,153 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"ota-server/pkg/manifest"
+)
+
+// Helper function to seal a timestamp the way the server does
+func sealTimestamp(key ed25519.PrivateKey, subject, latest, offer string, issuedAt time.Time, ttl time.Duration) *Timestamp {
+	sealed := manifest.SealTimestamp(manifest.Timestamp{Subject: subject, Latest: latest, Offer: offer, IssuedAt: issuedAt, ExpiresAt: issuedAt.Add(ttl)}, key)
+	ts := Timestamp(sealed)
+	return &ts
+}
+
+func TestTimestampVerifier(t *testing.T) {
+	trusted, untrusted := testKey('a'), testKey('c')
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	offer := OfferDigest(&Update{LatestVersion: "2.0.0", ReleaseID: strings.Repeat("ab", 32)})
+	seal := func(issuedAt time.Time) *Timestamp {
+		return sealTimestamp(trusted, "plugin/stable", "2.0.0", offer, issuedAt, time.Hour)
+	}
+
+	tests := []struct {
+		name    string
+		ts      func() *Timestamp
+		subject string // "plugin/stable" when empty
+		offer   string // offer when empty
+		now     time.Time
+		wantErr string
+	}{
+		{"fresh", func() *Timestamp { return seal(now) }, "", "", now, ""},
+		{"about to expire", func() *Timestamp { return seal(now.Add(-time.Hour)) }, "", "", now, ""},
+		{"missing", func() *Timestamp { return nil }, "", "", now, "no timestamp"},
+		{"expired", func() *Timestamp { return seal(now.Add(-2 * time.Hour)) }, "", "", now, "expired"},
+		{"expired, device without a clock", func() *Timestamp { return seal(now.Add(-2 * time.Hour)) }, "", "", time.Time{}, ""},
+		{"other subject", func() *Timestamp { return seal(now) }, "plugin/beta", "", now, "is about plugin/stable"},
+		{"other offer", func() *Timestamp { return seal(now) }, "", OfferDigest(&Update{LatestVersion: "2.0.0"}), now, "does not vouch"},
+		{"untrusted key", func() *Timestamp {
+			return sealTimestamp(untrusted, "plugin/stable", "2.0.0", offer, now, time.Hour)
+		}, "", "", now, "untrusted key"},
+		{"latest changed after signing", func() *Timestamp {
+			ts := seal(now)
+			ts.Latest = "1.0.0"
+			return ts
+		}, "", "", now, "signature does not match"},
+		{"expiry extended after signing", func() *Timestamp {
+			ts := seal(now.Add(-2 * time.Hour))
+			ts.ExpiresAt = now.Add(time.Hour)
+			return ts
+		}, "", "", now, "signature does not match"},
+		{"offer swapped after signing", func() *Timestamp {
+			ts := seal(now)
+			ts.Offer = OfferDigest(&Update{LatestVersion: "2.0.0"})
+			return ts
+		}, "", OfferDigest(&Update{LatestVersion: "2.0.0"}), now, "signature does not match"},
+		{"malformed signature", func() *Timestamp {
+			ts := seal(now)
+			ts.Value = "not base64!"
+			return ts
+		}, "", "", now, "signature does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewTimestampVerifier(trusted.Public().(ed25519.PublicKey))
+			v.Now = func() time.Time { return tt.now }
+			subject, want := firstNonEmpty(tt.subject, "plugin/stable"), firstNonEmpty(tt.offer, offer)
+			err := v.Verify(tt.ts(), subject, want)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Verify = %v, want nil", err)
+			case tt.wantErr != "" && (!errors.Is(err, ErrStaleResponse) || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Verify = %v, want %v containing %q", err, ErrStaleResponse, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimestampVerifierNeverGoesBack(t *testing.T) {
+	key := testKey('a')
+	v := NewTimestampVerifier(key.Public().(ed25519.PublicKey))
+	v.Now = func() time.Time { return time.Time{} }
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	seal := func(subject string, issuedAt time.Time) *Timestamp {
+		return sealTimestamp(key, subject, "2.0.0", "offer", issuedAt, time.Hour)
+	}
+
+	steps := []struct {
+		name    string
+		subject string
+		at      time.Time
+		wantErr bool
+	}{
+		{"first", "plugin/stable", start, false},
+		{"same time again", "plugin/stable", start, false},
+		{"newer", "plugin/stable", start.Add(time.Minute), false},
+		{"replayed older", "plugin/stable", start, true},
+		{"older, other subject", "plugin/beta", start.Add(-time.Hour), false},
+		{"newest", "plugin/stable", start.Add(2 * time.Minute), false},
+	}
+	for _, step := range steps {
+		err := v.Verify(seal(step.subject, step.at), step.subject, "offer")
+		if (err != nil) != step.wantErr || (err != nil && !errors.Is(err, ErrStaleResponse)) {
+			t.Errorf("%s: Verify = %v, want error %v", step.name, err, step.wantErr)
+		}
+	}
+	if got, want := v.Last("plugin/stable"), start.Add(2*time.Minute); !got.Equal(want) {
+		t.Errorf("Last = %s, want %s", got, want)
+	}
+
+	// A restarted device restores what it accepted before
+	restarted := NewTimestampVerifier(key.Public().(ed25519.PublicKey))
+	restarted.SetLast("plugin/stable", v.Last("plugin/stable"))
+	if err := restarted.Verify(seal("plugin/stable", start.Add(time.Minute)), "plugin/stable", "offer"); !errors.Is(err, ErrStaleResponse) {
+		t.Errorf("Verify after SetLast = %v, want %v", err, ErrStaleResponse)
+	}
+}
+
+func TestOfferDigestsMatchServer(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	updates := []Update{
+		{LatestVersion: "2.0.0", ReleaseID: id},
+		{LatestVersion: "1.0.0", Reason: "up_to_date"},
+		{},
+	}
+	for _, u := range updates {
+		if got, want := OfferDigest(&u), manifest.OfferDigest(u.LatestVersion, u.ReleaseID, u.Reason); got != want {
+			t.Errorf("OfferDigest(%+v) = %s, server's is %s", u, got, want)
+		}
+	}
+
+	m := &BundleManifest{Bundle: "gateway", Version: "3.0.0", Updates: []Artifact{{Name: "runtime", ReleaseID: "r2"}, {Name: "plugin", ReleaseID: id}}}
+	want := manifest.BundleOfferDigest("gateway", "3.0.0", map[string]string{"plugin": id, "runtime": "r2"})
+	if got := BundleOfferDigest(m); got != want {
+		t.Errorf("BundleOfferDigest = %s, server's is %s", got, want)
+	}
+	if m.Updates[0].Name != "runtime" {
+		t.Error("BundleOfferDigest reordered the manifest's updates")
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Downloads are verified before they are put in place: the size and digests
+// the server offered are always checked, then each of Client.Verifiers in
+// turn. A failed check leaves nothing behind and returns an error wrapping
+// ErrVerification. SignatureVerifier checks release signatures against keys
+// the device trusts; integrators plug a secure element or TPM in by
+// implementing Verifier.
+
+// ErrVerification wraps the errors of downloads that failed verification.
+var ErrVerification = errors.New("download failed verification")
+
+// Received is a downloaded artifact awaiting verification, still in its
+// temporary file.
+type Received struct {
+	// Path is the temporary file holding the content.
+	Path string
+	// Size is the number of bytes received.
+	Size int64
+	// Digests are the hex digests of the content by algorithm name,
+	// "sha256" and those of Artifact.Digests the SDK can compute.
+	Digests map[string]string
+}
+
+// Verifier checks a downloaded artifact before it is put in place,
+// returning an error to reject it. Verifiers may be called concurrently
+// by DownloadAll.
+type Verifier interface {
+	Verify(ctx context.Context, artifact Artifact, received Received) error
+}
+
+// VerifierFunc adapts a function to a Verifier.
+type VerifierFunc func(ctx context.Context, artifact Artifact, received Received) error
+
+// Verify calls f(ctx, artifact, received).
+func (f VerifierFunc) Verify(ctx context.Context, artifact Artifact, received Received) error {
+	return f(ctx, artifact, received)
+}
+
+// Helper function to create the hashes of the digest algorithms the SDK can
+// compute for an artifact, SHA-256 always
+func newDigests(artifact Artifact) map[string]hash.Hash {
+	hashes := map[string]hash.Hash{"sha256": sha256.New()}
+	if _, ok := artifact.Digests["sha512"]; ok {
+		hashes["sha512"] = sha512.New()
+	}
+	return hashes
+}
+
+// Helper function to check the size and digests of a download against the
+// artifact's
+func verifyDigests(artifact Artifact, received Received) error {
+	if artifact.Size > 0 && received.Size != artifact.Size {
+		return fmt.Errorf("received %d bytes, expected %d", received.Size, artifact.Size)
+	}
+	if digest := received.Digests["sha256"]; artifact.ReleaseID != "" && digest != artifact.ReleaseID {
+		return fmt.Errorf("digest %s does not match release %s", digest, artifact.ReleaseID)
+	}
+	for algorithm, want := range artifact.Digests {
+		if got, ok := received.Digests[algorithm]; ok && got != want {
+			return fmt.Errorf("%s digest %s does not match %s", algorithm, got, want)
+		}
+	}
+	return nil
+}
+
+// SignatureVerifier rejects downloads that are unsigned or not signed by one
+// of its keys. The signature covers the release's app, version, SHA-256 and
+// size, which the download has already been checked against.
+type SignatureVerifier struct {
+	keys map[string]ed25519.PublicKey // by key ID
+}
+
+// NewSignatureVerifier returns a verifier trusting the given Ed25519 public
+// keys, e.g. those served by /signing-key.
+func NewSignatureVerifier(keys ...ed25519.PublicKey) *SignatureVerifier {
+	v := &SignatureVerifier{keys: make(map[string]ed25519.PublicKey, len(keys))}
+	for _, key := range keys {
+		v.keys[KeyID(key)] = key
+	}
+	return v
+}
+
+// KeyID returns the server's short identifier of a public key.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Verify checks the artifact's signature.
+func (v *SignatureVerifier) Verify(_ context.Context, artifact Artifact, received Received) error {
+	sig := artifact.Signature
+	if sig == nil {
+		return errors.New("release is not signed")
+	}
+	key, ok := v.keys[sig.KeyID]
+	if !ok {
+		return fmt.Errorf("signed with untrusted key %s", sig.KeyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Value)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	if !ed25519.Verify(key, signingPayload(artifact, received), raw) {
+		return errors.New("signature does not match release")
+	}
+	return nil
+}
+
+// Helper function to build the payload a release signature covers; it must
+// match the server's manifest.SigningPayload
+func signingPayload(artifact Artifact, received Received) []byte {
+	app := artifact.App
+	if app == "" {
+		app = artifact.Name
+	}
+	return []byte(fmt.Sprintf("ota-release-v1\n%s\n%s\n%s\n%d\n", app, artifact.Version, received.Digests["sha256"], received.Size))
+}
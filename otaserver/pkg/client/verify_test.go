@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+var testContent = []byte("plugin 2.0.0 content")
+
+// Helper function to describe what a download of testContent received
+func testReceived() Received {
+	sha256Sum := sha256.Sum256(testContent)
+	sha512Sum := sha512.Sum512(testContent)
+	return Received{
+		Path: "plugin_2.0.0.wasm.part",
+		Size: int64(len(testContent)),
+		Digests: map[string]string{
+			"sha256": hex.EncodeToString(sha256Sum[:]),
+			"sha512": hex.EncodeToString(sha512Sum[:]),
+		},
+	}
+}
+
+func TestVerifyDigests(t *testing.T) {
+	received := testReceived()
+	tests := []struct {
+		name     string
+		artifact Artifact
+		wantErr  string
+	}{
+		{"all match", Artifact{Size: received.Size, ReleaseID: received.Digests["sha256"], Digests: map[string]string{"sha512": received.Digests["sha512"]}}, ""},
+		{"nothing offered", Artifact{}, ""},
+		{"size unknown", Artifact{ReleaseID: received.Digests["sha256"]}, ""},
+		{"size differs", Artifact{Size: received.Size + 1, ReleaseID: received.Digests["sha256"]}, "received 20 bytes, expected 21"},
+		{"release ID differs", Artifact{Size: received.Size, ReleaseID: strings.Repeat("0", 64)}, "does not match release"},
+		{"sha256 digest differs", Artifact{Digests: map[string]string{"sha256": strings.Repeat("0", 64)}}, "sha256 digest"},
+		{"sha512 digest differs", Artifact{ReleaseID: received.Digests["sha256"], Digests: map[string]string{"sha512": strings.Repeat("0", 128)}}, "sha512 digest"},
+		{"digest the SDK cannot compute", Artifact{ReleaseID: received.Digests["sha256"], Digests: map[string]string{"blake3": "00"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDigests(tt.artifact, received)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("verifyDigests = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("verifyDigests = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Helper function to generate a signing key from a seed byte
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// Helper function to sign a release the way the server does
+func signRelease(key ed25519.PrivateKey, app, version, id string, size int64) *Signature {
+	payload := manifest.SigningPayload(catalog.Release{App: app, Version: version, ID: id, Size: size})
+	return &Signature{
+		KeyID: manifest.KeyID(key.Public().(ed25519.PublicKey)),
+		Value: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	trusted, other, untrusted := testKey('a'), testKey('b'), testKey('c')
+	verifier := NewSignatureVerifier(trusted.Public().(ed25519.PublicKey), other.Public().(ed25519.PublicKey))
+	received := testReceived()
+	id, size := received.Digests["sha256"], received.Size
+
+	tests := []struct {
+		name      string
+		artifact  Artifact
+		received  *Received // testReceived when nil
+		wantError string
+	}{
+		{"signed", Artifact{App: "plugin", Version: "2.0.0", Signature: signRelease(trusted, "plugin", "2.0.0", id, size)}, nil, ""},
+		{"signed with the other trusted key", Artifact{App: "plugin", Version: "2.0.0", Signature: signRelease(other, "plugin", "2.0.0", id, size)}, nil, ""},
+		{"bundle component named by Name", Artifact{Name: "runtime", Version: "2.0.0", Signature: signRelease(trusted, "runtime", "2.0.0", id, size)}, nil, ""},
+		{"unsigned", Artifact{App: "plugin", Version: "2.0.0"}, nil, "not signed"},
+		{"untrusted key", Artifact{App: "plugin", Version: "2.0.0", Signature: signRelease(untrusted, "plugin", "2.0.0", id, size)}, nil, "untrusted key"},
+		{"key ID of a trusted key, signed by another", Artifact{App: "plugin", Version: "2.0.0", Signature: &Signature{
+			KeyID: KeyID(trusted.Public().(ed25519.PublicKey)),
+			Value: signRelease(untrusted, "plugin", "2.0.0", id, size).Value,
+		}}, nil, "does not match"},
+		{"malformed signature", Artifact{App: "plugin", Version: "2.0.0", Signature: &Signature{KeyID: KeyID(trusted.Public().(ed25519.PublicKey)), Value: "not base64!"}}, nil, "malformed"},
+		{"signature of another version", Artifact{App: "plugin", Version: "2.0.1", Signature: signRelease(trusted, "plugin", "2.0.0", id, size)}, nil, "does not match"},
+		{"signature of another app", Artifact{App: "runtime", Version: "2.0.0", Signature: signRelease(trusted, "plugin", "2.0.0", id, size)}, nil, "does not match"},
+		{"other content received", Artifact{App: "plugin", Version: "2.0.0", Signature: signRelease(trusted, "plugin", "2.0.0", id, size)}, &Received{Size: size, Digests: map[string]string{"sha256": strings.Repeat("0", 64)}}, "does not match"},
+		{"truncated content received", Artifact{App: "plugin", Version: "2.0.0", Signature: signRelease(trusted, "plugin", "2.0.0", id, size)}, &Received{Size: size - 1, Digests: received.Digests}, "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := received
+			if tt.received != nil {
+				r = *tt.received
+			}
+			err := verifier.Verify(context.Background(), tt.artifact, r)
+			switch {
+			case tt.wantError == "" && err != nil:
+				t.Errorf("Verify = %v, want nil", err)
+			case tt.wantError != "" && (err == nil || !strings.Contains(err.Error(), tt.wantError)):
+				t.Errorf("Verify = %v, want an error containing %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestKeyIDMatchesServer(t *testing.T) {
+	for _, seed := range []byte("abc") {
+		pub := testKey(seed).Public().(ed25519.PublicKey)
+		if got, want := KeyID(pub), manifest.KeyID(pub); got != want {
+			t.Errorf("KeyID = %s, server's is %s", got, want)
+		}
+	}
+}
+
+func TestVerifierFunc(t *testing.T) {
+	errRejected := errors.New("rejected by the secure element")
+	var v Verifier = VerifierFunc(func(context.Context, Artifact, Received) error { return errRejected })
+	if err := v.Verify(context.Background(), Artifact{}, Received{}); !errors.Is(err, errRejected) {
+		t.Errorf("Verify = %v, want %v", err, errRejected)
+	}
+}
@@ -0,0 +1,133 @@
+package httpapi
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/accesslog"
+	"ota-server/pkg/catalog"
+)
+
+// Requests are logged as structured entries (device, app, versions, result,
+// bytes and duration) to the sinks listed in OTA_ACCESS_LOG, by default JSON
+// lines on standard output; see accesslog.Parse for file rotation and syslog.
+// OTA_ACCESS_LOG=console keeps gin's console log instead.
+
+// Context keys under which handlers leave what the access log reports
+const (
+	errorCodeKey      = "ota.error_code"
+	servedReleaseKey  = "ota.served_release"
+	transferResultKey = "ota.transfer_result"
+)
+
+var accessLogger *accesslog.Logger
+
+// Helper function to open the access log sinks configured in the environment
+func initAccessLog() error {
+	spec := os.Getenv("OTA_ACCESS_LOG")
+	if spec == "" {
+		spec = "stdout"
+	}
+	if spec == "console" {
+		return nil
+	}
+	logger, err := accesslog.Open(spec)
+	if err != nil {
+		return err
+	}
+	accessLogger = logger
+	return nil
+}
+
+// requestLogger is the structured access log, or gin's console log when
+// OTA_ACCESS_LOG=console.
+func requestLogger() gin.HandlerFunc {
+	if accessLogger == nil {
+		return consoleLogger()
+	}
+	return AccessLog()
+}
+
+// AccessLog returns middleware writing an entry for every request to the
+// access log sinks configured in OTA_ACCESS_LOG, for applications mounting
+// the API with Register. Device IDs and client addresses are left out in
+// anonymous mode.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		accessLogger.Log(accessEntry(c, start))
+	}
+}
+
+// Helper function to describe a served request, from what the handlers left
+// in its context
+func accessEntry(c *gin.Context, start time.Time) accesslog.Entry {
+	status := c.Writer.Status()
+	entry := accesslog.Entry{
+		Time:           start.UTC(),
+		RequestID:      c.GetString("request_id"),
+		Method:         c.Request.Method,
+		Path:           c.Request.URL.Path,
+		Route:          c.FullPath(),
+		Status:         status,
+		Bytes:          int64(max(c.Writer.Size(), 0)),
+		DurationMS:     accesslog.Milliseconds(time.Since(start)),
+		App:            firstNonEmpty(c.Param("app"), c.Query("app")),
+		CurrentVersion: c.Query("current_version"),
+		Result:         accesslog.StatusResult(status),
+		ErrorCode:      c.GetString(errorCodeKey),
+		Tenant:         c.GetString("tenant"),
+		Principal:      c.GetString("principal"),
+	}
+	deviceID := downloadDeviceID(c)
+
+	if info, ok := CheckResponse(c); ok && entry.ErrorCode == "" {
+		entry.Version = info.LatestVersion
+		switch {
+		case status == http.StatusNotModified:
+			entry.Result = "not_modified"
+		case info.DownloadURL != "":
+			entry.Result = "update_offered"
+		case info.AvailableAt != "" || info.DeferredUntil != "":
+			entry.Result = "deferred"
+		case info.HeldBy != "":
+			entry.Result = "held"
+		default:
+			entry.Result = "up_to_date"
+		}
+	}
+	if response, ok := BundleCheckResponse(c); ok && entry.ErrorCode == "" {
+		entry.App, entry.Version = firstNonEmpty(entry.App, response.Bundle), response.Version
+		entry.Result = "up_to_date"
+		if len(response.Updates) > 0 {
+			entry.Result = "update_offered"
+		}
+	}
+	if value, ok := c.Get(servedReleaseKey); ok {
+		release := value.(catalog.Release)
+		entry.App, entry.Version = firstNonEmpty(entry.App, release.App), release.Version
+	}
+	if value, ok := c.Get(transferResultKey); ok {
+		switch result := value.(transferResult); {
+		case result.Complete:
+			entry.Result = "complete"
+		case result.Status == http.StatusFound:
+			entry.Result = "redirected"
+		case result.Status == http.StatusOK || result.Status == http.StatusPartialContent:
+			entry.Result = "incomplete"
+		}
+	}
+	if reportedID, report, ok := ReportedInstall(c); ok {
+		deviceID, entry.Version = firstNonEmpty(reportedID, deviceID), report.Version
+		entry.Result = "install_" + report.Status
+	}
+
+	if !anonymousMode() {
+		entry.DeviceID = deviceID
+		entry.RemoteIP = c.ClientIP()
+	}
+	return entry
+}
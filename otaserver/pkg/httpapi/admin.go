@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth protects the /admin endpoints with the bearer token from
+// OTA_ADMIN_TOKEN or one of the named tokens of the policy file, and records
+// the token's principal for the policy. Delegated upload tokens are accepted
+// on the routes of their scope only, see uploadtokens.go. Without any token
+// configured the admin API refuses every request, unless OTA_ADMIN_INSECURE=1
+// opens it for local development.
+func adminAuth() gin.HandlerFunc {
+	if os.Getenv("OTA_ADMIN_TOKEN") == "" && !policyHasTokens() {
+		if adminInsecure() {
+			log.Println("OTA_ADMIN_INSECURE is set; admin endpoints are unauthenticated")
+		} else {
+			log.Println("OTA_ADMIN_TOKEN is not set; admin endpoints refuse every request")
+		}
+	}
+
+	return func(c *gin.Context) {
+		if adminCredentials(c) {
+			c.Next()
+			return
+		}
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if upload, ok := uploadTokenFor(provided); ok {
+			if !uploadTokenAllows(c, upload) {
+				respondError(c, http.StatusForbidden, CodeForbidden, "upload tokens may only publish", gin.H{"scope": upload.Scope})
+				return
+			}
+			c.Set("principal", "token:"+upload.ID)
+			c.Set("upload_token", upload)
+			c.Next()
+			return
+		}
+		if os.Getenv("OTA_ADMIN_TOKEN") == "" && !policyHasTokens() {
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, "no admin token is configured; set OTA_ADMIN_TOKEN")
+			return
+		}
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "admin token is missing or invalid")
+	}
+}
+
+// Helper function to tell whether the admin API was explicitly opened to
+// unauthenticated callers for development
+func adminInsecure() bool {
+	return os.Getenv("OTA_ADMIN_INSECURE") == "1"
+}
+
+// Helper function to check the bearer token of a request against
+// OTA_ADMIN_TOKEN and the named tokens of the policy file, setting the
+// principal when it matches. Without any token configured only
+// OTA_ADMIN_INSECURE=1 lets requests through.
+func adminCredentials(c *gin.Context) bool {
+	token := os.Getenv("OTA_ADMIN_TOKEN")
+	if token == "" && !policyHasTokens() {
+		if adminInsecure() {
+			c.Set("principal", principalAdmin)
+			return true
+		}
+		return false
+	}
+	provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if provided == "" {
+		return false
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1 {
+		c.Set("principal", principalAdmin)
+		return true
+	}
+	if name := policyPrincipal(provided); name != "" {
+		c.Set("principal", name)
+		return true
+	}
+	return false
+}
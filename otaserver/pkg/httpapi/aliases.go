@@ -0,0 +1,180 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Aliases such as "lts" or "factory" name a specific version of an app and
+// can be retargeted atomically by an operator, so provisioning scripts and
+// devices can fetch "the factory image" without knowing its version.
+// "latest" is built in and follows the newest release of the default
+// channel unless it is set explicitly.
+
+// latestAlias is resolved from the catalog when it is not set.
+const latestAlias = "latest"
+
+// Alias is the version an alias currently names.
+type Alias struct {
+	Version   string    `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Alias names start with a letter so they cannot be mistaken for versions
+var aliasNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+var aliasState = struct {
+	sync.RWMutex
+	aliases map[string]map[string]Alias // by app, then alias name
+}{aliases: make(map[string]map[string]Alias)}
+
+// Helper function to load the aliases
+func initAliases() error {
+	aliases := make(map[string]map[string]Alias)
+	if err := storage.ReadJSON(aliasesFile, &aliases); err != nil {
+		return err
+	}
+	aliasState.Lock()
+	aliasState.aliases = aliases
+	aliasState.Unlock()
+	return nil
+}
+
+// Helper function to resolve an alias of an app to a version
+func resolveAlias(app, name string) (string, bool) {
+	aliasState.RLock()
+	alias, ok := aliasState.aliases[app][name]
+	aliasState.RUnlock()
+	if ok {
+		return alias.Version, true
+	}
+	if name == latestAlias {
+		if release, ok := catalogIndex.Latest(app, catalog.DefaultChannel); ok {
+			return release.Version, true
+		}
+	}
+	return "", false
+}
+
+// Endpoint resolving an alias to its release, e.g. /aliases/plugin/factory,
+// for provisioning scripts that download by alias
+func getAlias(c *gin.Context) {
+	app, name := c.Param("app"), c.Param("alias")
+	version, ok := resolveAlias(app, name)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "alias not found", gin.H{"app": app, "alias": name})
+		return
+	}
+	release, ok := catalogIndex.Version(app, catalog.DefaultChannel, version)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"alias": name, "version": version})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"app":          app,
+		"alias":        name,
+		"version":      version,
+		"release_id":   release.ID,
+		"size":         release.Size,
+		"download_url": fmt.Sprintf("/download?release_id=%s", release.ID),
+	})
+}
+
+// Admin endpoint listing the aliases of every app
+func listAliases(c *gin.Context) {
+	aliasState.RLock()
+	defer aliasState.RUnlock()
+	c.JSON(http.StatusOK, aliasState.aliases)
+}
+
+// Admin endpoint pointing an alias at a published version, e.g.
+// PUT /admin/aliases/plugin/lts {"version": "2.3.1"}
+func updateAlias(c *gin.Context) {
+	app, name := c.Param("app"), c.Param("alias")
+	var req struct {
+		Version string `json:"version"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Version == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "version is required")
+		return
+	}
+	if !aliasNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "alias names start with a lowercase letter followed by letters, digits or '-'")
+		return
+	}
+	if _, ok := catalogIndex.Version(app, catalog.DefaultChannel, name); ok {
+		respondError(c, http.StatusConflict, CodeConflict, "alias name is a published version", gin.H{"alias": name})
+		return
+	}
+	if _, ok := catalogIndex.Version(app, catalog.DefaultChannel, req.Version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"version": req.Version})
+		return
+	}
+
+	alias := Alias{Version: req.Version, UpdatedAt: time.Now().UTC()}
+	previous, err := saveAlias(app, name, &alias)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save aliases")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"app": app, "alias": name, "version": alias.Version, "previous_version": previous.Version, "updated_at": alias.UpdatedAt})
+}
+
+// Admin endpoint removing an alias
+func deleteAlias(c *gin.Context) {
+	app, name := c.Param("app"), c.Param("alias")
+	previous, err := saveAlias(app, name, nil)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save aliases")
+		return
+	}
+	if previous.Version == "" {
+		respondError(c, http.StatusNotFound, CodeNotFound, "alias not found", gin.H{"app": app, "alias": name})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Helper function to set (or with a nil alias, remove) an alias, persisting
+// the new set of aliases before devices can resolve it. It returns the alias
+// it replaced.
+func saveAlias(app, name string, alias *Alias) (Alias, error) {
+	aliasState.Lock()
+	defer aliasState.Unlock()
+
+	previous := aliasState.aliases[app][name]
+	if alias == nil && previous.Version == "" {
+		return previous, nil
+	}
+	aliases := make(map[string]map[string]Alias, len(aliasState.aliases)+1)
+	for a, names := range aliasState.aliases {
+		aliases[a] = names
+	}
+	names := make(map[string]Alias, len(aliases[app])+1)
+	for n, current := range aliases[app] {
+		names[n] = current
+	}
+	if alias != nil {
+		names[name] = *alias
+	} else {
+		delete(names, name)
+	}
+	aliases[app] = names
+	if len(names) == 0 {
+		delete(aliases, app)
+	}
+
+	if err := storage.WriteJSON(aliasesFile, aliases); err != nil {
+		return previous, err
+	}
+	aliasState.aliases = aliases
+	invalidateCatalog()
+	return previous, nil
+}
@@ -0,0 +1,232 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Anonymous mode (OTA_ANONYMOUS=true) is meant for consumer products. No
+// per-device records are stored: device IDs are only hashed in memory with a
+// salt that is replaced every day and never written to disk, which is enough
+// to count unique devices for the day without being able to recognise a
+// device later. Only the aggregate counts are persisted.
+//
+// Features that need device history (stuck detection, per-device lookups) are
+// unavailable in this mode.
+
+const adoptionFlushInterval = time.Minute
+
+func anonymousMode() bool {
+	v := strings.ToLower(os.Getenv("OTA_ANONYMOUS"))
+	return v == "1" || v == "true"
+}
+
+// AdoptionCounts are the aggregate counters of one day.
+type AdoptionCounts struct {
+	CheckIns      int64                       `json:"check_ins"`
+	Downloads     int64                       `json:"downloads"`
+	UniqueDevices int64                       `json:"unique_devices"`
+	Versions      map[string]int64            `json:"versions"` // unique devices per running version
+	Installs      map[string]map[string]int64 `json:"installs"` // version to report status to count
+}
+
+// adoptionState holds the counters of the current day along with the salt
+// and the salted device hashes seen, which only ever live in memory.
+var adoptionState = struct {
+	sync.Mutex
+	day      string
+	salt     []byte
+	seen     map[string]bool
+	versions map[string]map[string]bool
+	counts   *AdoptionCounts
+	dirty    bool
+}{}
+
+func adoptionFile(day string) string {
+	return filepath.Join(adoptionPath, day+".json")
+}
+
+func currentDay() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Helper function to start the background flusher of the adoption counters
+func initAdoption() {
+	if !anonymousMode() {
+		return
+	}
+	go func() {
+		for range time.Tick(adoptionFlushInterval) {
+			adoptionState.Lock()
+			rolloverAdoptionLocked()
+			if err := flushAdoptionLocked(); err != nil {
+				log.Printf("flushing adoption counts: %v", err)
+			}
+			adoptionState.Unlock()
+		}
+	}()
+}
+
+func flushAdoptionLocked() error {
+	if !adoptionState.dirty {
+		return nil
+	}
+	adoptionState.dirty = false
+	return storage.WriteJSON(adoptionFile(adoptionState.day), adoptionState.counts)
+}
+
+// Helper function to start a new day with a fresh salt, persisting the old
+// counts and forgetting the old hashes. Must be called with adoptionState locked.
+func rolloverAdoptionLocked() {
+	day := currentDay()
+	if day == adoptionState.day {
+		return
+	}
+	if adoptionState.counts != nil {
+		if err := flushAdoptionLocked(); err != nil {
+			log.Printf("flushing adoption counts: %v", err)
+		}
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		log.Printf("generating salt: %v", err)
+	}
+	counts := &AdoptionCounts{}
+	// Continue today's counts after a restart; uniques are then overcounted
+	// since the hashes of the previous run are gone
+	if err := storage.ReadJSON(adoptionFile(day), counts); err != nil {
+		log.Printf("loading adoption counts: %v", err)
+	}
+	if counts.Versions == nil {
+		counts.Versions = make(map[string]int64)
+	}
+	if counts.Installs == nil {
+		counts.Installs = make(map[string]map[string]int64)
+	}
+
+	adoptionState.day = day
+	adoptionState.salt = salt
+	adoptionState.seen = make(map[string]bool)
+	adoptionState.versions = make(map[string]map[string]bool)
+	adoptionState.counts = counts
+	adoptionState.dirty = false
+}
+
+// Helper function to hash a device ID with today's salt. Must be called with
+// adoptionState locked.
+func hashDeviceLocked(id string) string {
+	mac := hmac.New(sha256.New, adoptionState.salt)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Helper function to count an anonymous check-in
+func countCheckIn(id, version string) {
+	adoptionState.Lock()
+	defer adoptionState.Unlock()
+	rolloverAdoptionLocked()
+
+	counts := adoptionState.counts
+	counts.CheckIns++
+	if id != "" {
+		hash := hashDeviceLocked(id)
+		if !adoptionState.seen[hash] {
+			adoptionState.seen[hash] = true
+			counts.UniqueDevices++
+		}
+		if version != "" {
+			if adoptionState.versions[version] == nil {
+				adoptionState.versions[version] = make(map[string]bool)
+			}
+			if !adoptionState.versions[version][hash] {
+				adoptionState.versions[version][hash] = true
+				counts.Versions[version]++
+			}
+		}
+	}
+	adoptionState.dirty = true
+}
+
+// Helper function to count an anonymous download
+func countDownload() {
+	adoptionState.Lock()
+	defer adoptionState.Unlock()
+	rolloverAdoptionLocked()
+	adoptionState.counts.Downloads++
+	adoptionState.dirty = true
+}
+
+// Helper function to count an anonymous install report
+func countInstall(version, status string) {
+	adoptionState.Lock()
+	defer adoptionState.Unlock()
+	rolloverAdoptionLocked()
+	installs := adoptionState.counts.Installs
+	if installs[version] == nil {
+		installs[version] = make(map[string]int64)
+	}
+	installs[version][status]++
+	adoptionState.dirty = true
+}
+
+// consoleLogger is gin's request logger, except that in anonymous mode the
+// query string and client address are left out since they identify devices.
+func consoleLogger() gin.HandlerFunc {
+	if !anonymousMode() {
+		return gin.Logger()
+	}
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		path := param.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		return fmt.Sprintf("[GIN] %v |%3d| %13v |%-7s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			param.Method,
+			path,
+			param.ErrorMessage,
+		)
+	})
+}
+
+// Admin endpoint reporting the anonymous adoption counts of a day
+// (?day=YYYY-MM-DD, default today)
+func getAdoption(c *gin.Context) {
+	day := c.DefaultQuery("day", currentDay())
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "day must be formatted as YYYY-MM-DD")
+		return
+	}
+
+	adoptionState.Lock()
+	if day == adoptionState.day {
+		counts := *adoptionState.counts
+		adoptionState.Unlock()
+		c.JSON(http.StatusOK, gin.H{"day": day, "counts": counts})
+		return
+	}
+	adoptionState.Unlock()
+
+	counts := AdoptionCounts{}
+	if err := storage.ReadJSON(adoptionFile(day), &counts); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load adoption counts")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"day": day, "counts": counts})
+}
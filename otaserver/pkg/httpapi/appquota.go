@@ -0,0 +1,375 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Each app can be given a storage quota, the bytes its published releases
+// may take up across channels, so that one team's huge images cannot fill
+// the disk and block everyone's publishes. A publish that would take the app
+// over its quota is refused with 507, unless the quota allows garbage
+// collection: then, once the new release is in place, the oldest releases
+// are moved to the trash to make room, keeping the newest "keep" releases of
+// each channel (default 3) and any version an alias, cohort, group, device or
+// the fleet targets. If not enough of them can be moved, the new release is
+// moved to the trash instead and the publish fails with 507. Quotas are
+// set with PUT /admin/storage/<app>/quota {"max_bytes": 10737418240,
+// "gc": true}; OTA_APP_QUOTA_BYTES is the quota of apps without one. Usage
+// is shown by GET /admin/storage and the ota_app_storage_bytes metric.
+
+// defaultGCKeep is how many releases of each channel garbage collection keeps.
+const defaultGCKeep = 3
+
+// AppQuota limits the storage the releases of an app take up.
+type AppQuota struct {
+	MaxBytes  int64     `json:"max_bytes"`
+	GC        bool      `json:"gc,omitempty"`   // delete old releases to make room
+	Keep      int       `json:"keep,omitempty"` // newest releases of each channel never collected
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// AppStorage is the storage used by an app.
+type AppStorage struct {
+	App       string    `json:"app"`
+	UsedBytes int64     `json:"used_bytes"`
+	Releases  int       `json:"releases"`
+	Quota     *AppQuota `json:"quota,omitempty"`
+}
+
+var appQuotaState = struct {
+	sync.RWMutex
+	quotas map[string]AppQuota // by app
+}{quotas: make(map[string]AppQuota)}
+
+// appStorageMu serializes publishes from the quota check until the release
+// is in place and old releases are collected, so that two publishes cannot
+// both take the last of an app's room.
+var appStorageMu sync.Mutex
+
+var (
+	appStorageBytes = newLabeledGauge("ota_app_storage_bytes", "Bytes taken up by the releases of each app.", "app", func() map[string]int64 {
+		usage := make(map[string]int64)
+		for _, app := range catalogIndex.Apps() {
+			usage[app], _ = appUsage(app, "")
+		}
+		return usage
+	})
+	appQuotaBytes = newLabeledGauge("ota_app_quota_bytes", "Storage quota of each app with one.", "app", func() map[string]int64 {
+		quotas := make(map[string]int64)
+		for _, app := range catalogIndex.Apps() {
+			if quota, ok := appQuota(app); ok {
+				quotas[app] = quota.MaxBytes
+			}
+		}
+		return quotas
+	})
+	quotaRejections   = newCounter("ota_app_quota_rejections_total", "Publishes refused because the app was over its storage quota.")
+	collectedReleases = newCounter("ota_app_quota_collected_releases_total", "Releases deleted to keep apps within their storage quota.")
+)
+
+// Helper function to load the app quotas
+func initAppQuotas() error {
+	quotas := make(map[string]AppQuota)
+	if err := storage.ReadJSON(appQuotasFile, &quotas); err != nil {
+		return err
+	}
+	appQuotaState.Lock()
+	appQuotaState.quotas = quotas
+	appQuotaState.Unlock()
+	return nil
+}
+
+// Helper function to read the quota of an app, falling back to
+// OTA_APP_QUOTA_BYTES
+func appQuota(app string) (AppQuota, bool) {
+	appQuotaState.RLock()
+	quota, ok := appQuotaState.quotas[app]
+	appQuotaState.RUnlock()
+	if ok {
+		return quota, true
+	}
+	if n, err := strconv.ParseInt(os.Getenv("OTA_APP_QUOTA_BYTES"), 10, 64); err == nil && n > 0 {
+		return AppQuota{MaxBytes: n}, true
+	}
+	return AppQuota{}, false
+}
+
+// Helper function to sum the sizes of the published releases of an app,
+// leaving out the file at except
+func appUsage(app, except string) (int64, int) {
+	var used int64
+	count := 0
+	for _, release := range catalogIndex.App(app) {
+		if release.FileName == except {
+			continue
+		}
+		used += release.Size
+		count++
+	}
+	return used, count
+}
+
+// Helper function to collect the versions of an app something still points
+// at, which garbage collection must keep
+func targetedVersions(app string) (map[string]bool, error) {
+	versions := make(map[string]bool)
+	aliasState.RLock()
+	for _, alias := range aliasState.aliases[app] {
+		versions[alias.Version] = true
+	}
+	aliasState.RUnlock()
+
+	// Desired versions are versions of the plugin
+	if app != "plugin" {
+		return versions, nil
+	}
+	desiredState.RLock()
+	versions[desiredState.state.Version] = true
+	desiredState.RUnlock()
+	cohortState.RLock()
+	for _, cohort := range cohortState.cohorts {
+		versions[cohort.DesiredVersion] = true
+	}
+	cohortState.RUnlock()
+	groups, err := loadGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		versions[group.DesiredVersion] = true
+	}
+	devices, err := listDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		versions[device.DesiredVersion] = true
+	}
+	delete(versions, "")
+	return versions, nil
+}
+
+// Helper function to list the releases of an app garbage collection may
+// delete, oldest first, leaving out the file at except
+func collectableReleases(app, except string, keep int) ([]catalog.Release, error) {
+	targeted, err := targetedVersions(app)
+	if err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		keep = defaultGCKeep
+	}
+	channels := make(map[string][]catalog.Release)
+	for _, release := range catalogIndex.App(app) {
+		channels[release.Channel] = append(channels[release.Channel], release)
+	}
+	var releases []catalog.Release
+	for _, list := range channels {
+		sort.SliceStable(list, func(i, j int) bool { return catalog.CompareVersions(list[i].Version, list[j].Version) < 0 })
+		for _, release := range list[:max(len(list)-keep, 0)] {
+			if release.FileName != except && !targeted[release.Version] {
+				releases = append(releases, release)
+			}
+		}
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		if c := catalog.CompareVersions(releases[i].Version, releases[j].Version); c != 0 {
+			return c < 0
+		}
+		return releases[i].Channel < releases[j].Channel
+	})
+	return releases, nil
+}
+
+// appReservation is the room reserved for a release in its app's storage
+// quota. It holds appStorageMu from reserveAppStorage until done, so that
+// publishes of the same app cannot both count on the same room.
+type appReservation struct {
+	app, rel   string
+	over       int64             // bytes to collect once the release is in place
+	candidates []catalog.Release // releases that may be collected, oldest first
+}
+
+// Helper function to reserve room for a release of size bytes published at
+// rel, replacing what is there, within the quota of its app. When old
+// releases must be collected to make room they are only picked here; the
+// caller collects them once the release is in place and calls done either way.
+func reserveAppStorage(app, rel string, size int64) (*appReservation, error) {
+	appStorageMu.Lock()
+	reservation := &appReservation{app: app, rel: rel}
+
+	quota, ok := appQuota(app)
+	if !ok {
+		return reservation, nil
+	}
+	used, _ := appUsage(app, rel)
+	reservation.over = used + size - quota.MaxBytes
+	if reservation.over <= 0 {
+		return reservation, nil
+	}
+
+	var collectable int64
+	if quota.GC {
+		candidates, err := collectableReleases(app, rel, quota.Keep)
+		if err != nil {
+			appStorageMu.Unlock()
+			return nil, &publishError{http.StatusInternalServerError, CodeInternal, "Could not check the app's storage quota", nil}
+		}
+		reservation.candidates = candidates
+		for _, release := range candidates {
+			collectable += release.Size
+		}
+	}
+	if collectable < reservation.over {
+		appStorageMu.Unlock()
+		quotaRejections.Add(1)
+		return nil, &publishError{http.StatusInsufficientStorage, CodeQuotaExceeded, "the release does not fit in the app's storage quota", gin.H{
+			"app":          app,
+			"quota_bytes":  quota.MaxBytes,
+			"used_bytes":   used,
+			"upload_bytes": size,
+			"gc":           quota.GC,
+		}}
+	}
+	return reservation, nil
+}
+
+// Helper function to move old releases to the trash, oldest first, until the
+// reserved release fits in the quota; a release that cannot be moved is
+// skipped for the next one. When not enough room can be made the collected
+// releases are put back and it fails. The caller refreshes the catalog.
+func (r *appReservation) collect() error {
+	var freed int64
+	var collected []TrashEntry
+	for _, release := range r.candidates {
+		if freed >= r.over {
+			break
+		}
+		entry, err := trashRelease(release, "collected to make room for "+r.rel, "")
+		if err != nil {
+			log.Printf("collecting %s to make room for %s: %v", release.FileName, r.rel, err)
+			continue
+		}
+		collected = append(collected, entry)
+		freed += release.Size
+	}
+	if freed < r.over {
+		trashMu.Lock()
+		for _, entry := range collected {
+			if err := restoreTrashEntry(entry, artifacts.ArtifactPath(entry.Release.FileName)); err != nil {
+				log.Printf("putting back %s after failing to make room for %s: %v", entry.Release.FileName, r.rel, err)
+			}
+		}
+		trashMu.Unlock()
+		quotaRejections.Add(1)
+		return &publishError{http.StatusInsufficientStorage, CodeQuotaExceeded, "could not collect enough old releases to fit the release in the app's storage quota", gin.H{
+			"app":          r.app,
+			"needed_bytes": r.over,
+			"freed_bytes":  freed,
+		}}
+	}
+	for _, entry := range collected {
+		log.Printf("collected %s (%d bytes) to keep %s within its storage quota", entry.Release.FileName, entry.Release.Size, r.app)
+		collectedReleases.Add(1)
+	}
+	return nil
+}
+
+// Helper function to give up the reservation
+func (r *appReservation) done() {
+	appStorageMu.Unlock()
+}
+
+// Admin endpoint showing the storage used by each app against its quota
+func listAppStorage(c *gin.Context) {
+	apps := catalogIndex.Apps()
+	appQuotaState.RLock()
+	for app := range appQuotaState.quotas {
+		if len(catalogIndex.App(app)) == 0 {
+			apps = append(apps, app)
+		}
+	}
+	appQuotaState.RUnlock()
+	sort.Strings(apps)
+
+	var total int64
+	usage := make([]AppStorage, 0, len(apps))
+	for _, app := range apps {
+		entry := AppStorage{App: app}
+		entry.UsedBytes, entry.Releases = appUsage(app, "")
+		if quota, ok := appQuota(app); ok {
+			entry.Quota = &quota
+		}
+		total += entry.UsedBytes
+		usage = append(usage, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"apps": usage, "total_bytes": total})
+}
+
+// Admin endpoint setting the storage quota of an app, e.g. {"max_bytes":
+// 10737418240, "gc": true, "keep": 5}
+func updateAppQuota(c *gin.Context) {
+	app := c.Param("app")
+	var quota AppQuota
+	if err := c.ShouldBindJSON(&quota); err != nil || quota.MaxBytes <= 0 || quota.Keep < 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "give a positive max_bytes and a keep of 0 or more")
+		return
+	}
+	quota.UpdatedAt = time.Now().UTC()
+	if err := saveAppQuota(app, &quota); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save app quotas")
+		return
+	}
+	used, releases := appUsage(app, "")
+	c.JSON(http.StatusOK, AppStorage{App: app, UsedBytes: used, Releases: releases, Quota: &quota})
+}
+
+// Admin endpoint removing the storage quota of an app
+func deleteAppQuota(c *gin.Context) {
+	app := c.Param("app")
+	appQuotaState.RLock()
+	_, ok := appQuotaState.quotas[app]
+	appQuotaState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "app has no quota", gin.H{"app": app})
+		return
+	}
+	if err := saveAppQuota(app, nil); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save app quotas")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Helper function to set (or with a nil quota, remove) the quota of an app
+func saveAppQuota(app string, quota *AppQuota) error {
+	appStorageMu.Lock()
+	defer appStorageMu.Unlock()
+	appQuotaState.Lock()
+	defer appQuotaState.Unlock()
+	quotas := make(map[string]AppQuota, len(appQuotaState.quotas)+1)
+	for name, current := range appQuotaState.quotas {
+		quotas[name] = current
+	}
+	if quota != nil {
+		quotas[app] = *quota
+	} else {
+		delete(quotas, app)
+	}
+	if err := storage.WriteJSON(appQuotasFile, quotas); err != nil {
+		return fmt.Errorf("saving app quotas: %w", err)
+	}
+	appQuotaState.quotas = quotas
+	return nil
+}
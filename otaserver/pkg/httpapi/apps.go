@@ -0,0 +1,118 @@
+package httpapi
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Products whose artifacts do not follow the <app>_<version>.<ext>
+// convention, or that need their own content type or channel layout, are
+// defined as apps in metadata/apps.json (see catalog.AppDef), e.g.
+// {"blink-five": {"files": "five-second-delay_{version}.wasm",
+// "content_type": "application/wasm"}}, or with PUT /admin/apps/<app>.
+// Their releases are then served like any other app's, with ?app=, and on
+// /check-update-<app> and /download-<app> for devices built against
+// per-product URLs.
+
+// appsMu serializes edits of the configured apps.
+var appsMu sync.Mutex
+
+// Helper function to load the configured apps
+func initApps() error {
+	apps := make(map[string]catalog.AppDef)
+	if err := storage.ReadJSON(appsFile, &apps); err != nil {
+		return err
+	}
+	return catalog.SetApps(apps)
+}
+
+// Helper function to reload the configured apps and re-index the artifacts
+// they match
+func reloadApps() error {
+	if err := initApps(); err != nil {
+		return err
+	}
+	return refreshCatalog()
+}
+
+// Helper function to save and apply the configured apps
+func saveApps(apps map[string]catalog.AppDef) error {
+	if err := storage.WriteJSON(appsFile, apps); err != nil {
+		return err
+	}
+	if err := catalog.SetApps(apps); err != nil {
+		return err
+	}
+	return refreshCatalog()
+}
+
+// Middleware refusing the per-product URLs of apps that are not configured
+func configuredApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := catalog.LookupApp(c.Param("app")); !ok {
+			respondError(c, http.StatusNotFound, CodeNotFound, "app not found", gin.H{"app": c.Param("app")})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Helper function to get the app a device request is about, the plugin when
+// it names none
+func requestedApp(c *gin.Context) string {
+	return firstNonEmpty(c.Param("app"), c.Query("app"), "plugin")
+}
+
+// Admin endpoint listing the configured apps
+func listApps(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"apps": catalog.Apps()})
+}
+
+// Admin endpoint defining an app, e.g. PUT /admin/apps/blink-five
+// {"files": "five-second-delay_{version}.wasm", "content_type": "application/wasm",
+// "channels": {"stable": "", "beta": "blink-five/beta"}}
+func updateApp(c *gin.Context) {
+	name := c.Param("app")
+	var def catalog.AppDef
+	if err := c.ShouldBindJSON(&def); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid app definition")
+		return
+	}
+	if err := catalog.CheckApp(name, def); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error(), gin.H{"app": name})
+		return
+	}
+
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	apps := catalog.Apps()
+	apps[name] = def
+	if err := saveApps(apps); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save apps")
+		return
+	}
+	c.JSON(http.StatusOK, def)
+}
+
+// Admin endpoint removing an app definition; its artifacts fall back to the
+// naming convention
+func deleteApp(c *gin.Context) {
+	name := c.Param("app")
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	apps := catalog.Apps()
+	if _, ok := apps[name]; !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "app not found", gin.H{"app": name})
+		return
+	}
+	delete(apps, name)
+	if err := saveApps(apps); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save apps")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
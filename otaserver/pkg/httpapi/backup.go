@@ -0,0 +1,101 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/backup"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// GET /admin/backup streams a backup of the server's state as one archive
+// (see the backup package): the metadata directory with the devices, release
+// metadata and every settings file, the catalog snapshots, and the catalog
+// index of the releases published. With ?keys=true it also holds the files
+// named by OTA_SIGNING_KEY_FILE, OTA_APP_SIGNING_KEYS, OTA_CA_CERT_FILE,
+// OTA_CA_KEY_FILE, OTA_TLS_CERT_FILE and OTA_TLS_KEY_FILE. Artifacts are not
+// included; they are backed up with the files directory. `otactl backup`
+// downloads and checks an archive, and `otactl restore` restores one into
+// the state directory of a stopped server. Files are read as they are while
+// the server runs, each one consistent on its own.
+
+// Helper function to list the key files configured in the environment, by
+// their name in a backup archive
+func backupKeyFiles() []backup.Key {
+	var keys []backup.Key
+	for _, setting := range []struct{ env, name string }{
+		{"OTA_SIGNING_KEY_FILE", "signing_key.pem"},
+		{"OTA_CA_CERT_FILE", "ca_cert.pem"},
+		{"OTA_CA_KEY_FILE", "ca_key.pem"},
+		{"OTA_TLS_CERT_FILE", "tls_cert.pem"},
+		{"OTA_TLS_KEY_FILE", "tls_key.pem"},
+	} {
+		if path := os.Getenv(setting.env); path != "" {
+			keys = append(keys, backup.Key{Name: setting.name, Env: setting.env, Path: path})
+		}
+	}
+	for _, spec := range strings.Split(os.Getenv("OTA_APP_SIGNING_KEYS"), ",") {
+		if app, path, ok := strings.Cut(strings.TrimSpace(spec), "="); ok && aliasNamePattern.MatchString(app) && path != "" {
+			keys = append(keys, backup.Key{Name: "signing_key_" + app + ".pem", Env: "OTA_APP_SIGNING_KEYS", Path: path})
+		}
+	}
+	return keys
+}
+
+// Helper function to list every published release
+func publishedReleases() []catalog.Release {
+	releases := []catalog.Release{}
+	for _, app := range catalogIndex.Apps() {
+		releases = append(releases, catalogIndex.App(app)...)
+	}
+	return releases
+}
+
+// Admin endpoint streaming a backup archive; ?keys=true includes the keys
+func getBackup(c *gin.Context) {
+	now := time.Now().UTC()
+	releases := publishedReleases()
+	index, err := json.MarshalIndent(manifest.CatalogIndex{Releases: releases, GeneratedAt: now}, "", "  ")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not write the catalog index")
+		return
+	}
+	m := backup.Manifest{CreatedAt: now, ServerVersion: Version, CatalogRevision: catalogRevision(), Releases: len(releases)}
+	if c.Query("keys") == "true" {
+		m.Keys = backupKeyFiles()
+	}
+
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="ota-backup-%s.tar.gz"`, now.Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+	archive := backup.NewWriter(c.Writer, m)
+	err = archive.AddBytes(backup.CatalogName, index)
+	if err == nil {
+		err = archive.AddDir(backup.MetadataDir, metadataPath)
+	}
+	if err == nil {
+		err = archive.AddDir(backup.SnapshotsDir, snapshotsPath)
+	}
+	for _, key := range m.Keys {
+		if err == nil {
+			err = archive.AddFile(backup.KeysDir+"/"+key.Name, filepath.Clean(key.Path))
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// The response is under way; without its manifest the archive fails
+		// verification
+		log.Printf("writing backup: %v", err)
+		c.Abort()
+	}
+}
@@ -0,0 +1,47 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Endpoint to download an artifact by the SHA-256 digest of its contents
+func downloadBlob(c *gin.Context) {
+	digest := c.Param("sha256")
+	if !sha256Pattern.MatchString(digest) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "sha256 must be 64 lowercase hex characters")
+		return
+	}
+
+	key := "blob:" + digest
+	release, err := findRelease(key, func() (catalog.Release, error) {
+		if indexed, ok := catalogIndex.ByID(digest); ok {
+			return indexed, nil
+		}
+		return catalog.Release{}, catalog.ErrReleaseGone
+	})
+	if errors.Is(err, catalog.ErrReleaseGone) {
+		respondMiss(c, key, http.StatusNotFound, CodeNotFound, "blob not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not resolve blob")
+		return
+	}
+	if !allowDownloadAboveFloor(c, release.App, release.Version) {
+		return
+	}
+
+	// The content never changes for a given digest, so it can be cached forever
+	c.Header("ETag", fmt.Sprintf("\"%s\"", digest))
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("Content-Type", "application/octet-stream")
+	serveArtifact(c, release)
+}
@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Manufacturing lines flash the designated factory image of an app with
+// GET /bootstrap?app=plugin&channel=factory, without knowing its version.
+// "channel" names an alias (see aliases.go, default "factory"), managed with
+// PUT/DELETE /admin/aliases/<app>/<alias>; without such an alias the newest
+// release of the catalog channel of that name is used. Unlike /check-update
+// the image is returned whatever version the caller runs, outside install
+// windows and deferrals, and never as a patch.
+
+// defaultBootstrapAlias is the alias /bootstrap resolves without a channel.
+const defaultBootstrapAlias = "factory"
+
+// Helper function to find the release a bootstrap channel designates
+func bootstrapOffer(app, name string) (*cachedOffer, error) {
+	if version, ok := resolveAlias(app, name); ok {
+		return versionOffer(app, catalog.DefaultChannel, version)
+	}
+	if catalog.ValidChannel(name) {
+		return latestOffer(app, name)
+	}
+	return nil, errCatalogEmpty
+}
+
+// Endpoint returning the factory image of an app, e.g.
+// /bootstrap?app=plugin&channel=factory
+func getBootstrap(c *gin.Context) {
+	app := c.DefaultQuery("app", "plugin")
+	name := c.DefaultQuery("channel", defaultBootstrapAlias)
+	if !aliasNamePattern.MatchString(name) && !catalog.ValidChannel(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+
+	offer, err := bootstrapOffer(app, name)
+	if errors.Is(err, errCatalogEmpty) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no image is designated for the channel", gin.H{"app": app, "channel": name})
+		return
+	}
+	if errors.Is(err, errVersionUnavailable) {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "the designated image is no longer available", gin.H{"app": app, "channel": name})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not resolve the designated image")
+		return
+	}
+
+	release, meta := offer.release, offer.meta
+	if !allowDownloadAboveFloor(c, release.App, release.Version) {
+		return
+	}
+	info := manifest.VersionInfo{
+		LatestVersion: release.Version,
+		DownloadURL:   fmt.Sprintf("/download?release_id=%s", release.ID),
+		CheckSum:      offer.checksum,
+		ReleaseID:     release.ID,
+		Size:          release.Size,
+		SizeBytes:     release.Size,
+		SHA256:        release.ID,
+		ReleaseNotes:  meta.Notes,
+		Signature:     meta.Signature,
+		Provenance:    meta.Provenance,
+	}
+	setOfferDigests(&info, release.App, offer.digests)
+	if !offer.createdAt.IsZero() {
+		info.CreatedAt = offer.createdAt.Format(time.RFC3339)
+	}
+	respondOffer(c, info)
+}
@@ -0,0 +1,253 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// A bundle is a composite release such as a gateway image made of a
+// bootloader, a kernel and an app. Each component is an app in the catalog,
+// and a bundle version pins one release of each by digest. Devices report the
+// version of every component and are offered only the components that differ.
+
+var bundleNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,63}$`)
+
+var errBundleNotFound = errors.New("bundle not found")
+
+// BundleComponent pins the release of one component.
+type BundleComponent struct {
+	Version   string `json:"version"`
+	ReleaseID string `json:"release_id"`
+}
+
+// Bundle is one version of a composite release.
+type Bundle struct {
+	Name       string                     `json:"name"`
+	Version    string                     `json:"version"`
+	Notes      string                     `json:"notes,omitempty"`
+	Components map[string]BundleComponent `json:"components"`
+	CreatedAt  time.Time                  `json:"created_at"`
+}
+
+func bundleFile(name, version string) string {
+	return filepath.Join(bundlesPath, name+"_"+version+".json")
+}
+
+// Helper function to find the newest version of a bundle
+func latestBundle(name string) (Bundle, error) {
+	var bundle Bundle
+	entries, err := os.ReadDir(bundlesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return bundle, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".json")
+		if catalog.AppFromFile(base+".json") == name {
+			versions = append(versions, catalog.VersionFromFile(base+".json"))
+		}
+	}
+	if len(versions) == 0 {
+		return bundle, errBundleNotFound
+	}
+	catalog.SortVersions(versions)
+
+	err = storage.ReadJSON(bundleFile(name, versions[len(versions)-1]), &bundle)
+	return bundle, err
+}
+
+// Helper function to find the release a bundle pins in the catalog index.
+// The ID alone is not enough since identical files may be published as
+// several versions.
+func pinnedRelease(app string, pinned BundleComponent) (catalog.Release, bool) {
+	for _, release := range catalogIndex.App(app) {
+		if release.Version == pinned.Version && release.ID == pinned.ReleaseID {
+			return release, true
+		}
+	}
+	return catalog.Release{}, false
+}
+
+// Endpoint to check a bundle for updates, e.g.
+// /check-bundle?bundle=gateway&components[kernel]=5.10.1&components[app]=1.0.0
+func checkBundle(c *gin.Context) {
+	name := c.Query("bundle")
+	if !bundleNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "bundle is required")
+		return
+	}
+	current := c.QueryMap("components")
+	for component, version := range current {
+		normalized, ok := requireVersion(c, "components["+component+"]", version)
+		if !ok {
+			return
+		}
+		current[component] = normalized
+	}
+
+	device, err := recordCheckIn(c, "", "")
+	if err == nil {
+		device, err = recordAppVersions(device, current)
+	}
+	if errors.Is(err, errInvalidDeviceID) || errors.Is(err, errInvalidTimezone) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errDeviceMismatch) {
+		respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not record device check-in")
+		return
+	}
+
+	bundle, err := latestBundle(name)
+	if errors.Is(err, errBundleNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, err.Error(), gin.H{"bundle": name})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load bundle")
+		return
+	}
+
+	regionName, region, regional := clientRegion(c)
+	response := manifest.BundleManifest{Bundle: bundle.Name, Version: bundle.Version, Notes: bundle.Notes, Manifest: []manifest.ComponentUpdate{}, Updates: []manifest.ComponentUpdate{}, NextCheckAfter: nextCheckAfter(device)}
+	names := make([]string, 0, len(bundle.Components))
+	for component := range bundle.Components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+
+	for _, component := range names {
+		pinned := bundle.Components[component]
+		release, ok := pinnedRelease(component, pinned)
+		if !ok {
+			respondError(c, http.StatusGone, CodeReleaseGone, "a component of the bundle is no longer available", gin.H{"component": component, "release_id": pinned.ReleaseID})
+			return
+		}
+		meta, err := loadReleaseMeta(release.App, release.Version)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+			return
+		}
+		digests, err := releaseDigests(release, meta)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not compute release digests")
+			return
+		}
+
+		entry := manifest.ComponentUpdate{
+			Name:           component,
+			CurrentVersion: current[component],
+			Version:        release.Version,
+			ReleaseID:      release.ID,
+			Size:           release.Size,
+			DownloadURL:    fmt.Sprintf("/download?release_id=%s", release.ID),
+			Signature:      meta.Signature,
+			Digests:        digests,
+		}
+		if device != nil && device.ID != "" {
+			entry.DownloadURL += "&device_id=" + url.QueryEscape(device.ID)
+		}
+		if regional {
+			entry.DownloadURL = regionalURL(regionName, region, entry.DownloadURL)
+		}
+		response.Manifest = append(response.Manifest, entry)
+		response.TotalSize += entry.Size
+
+		if current[component] != release.Version {
+			if floor, below := belowVersionFloor(deviceModel(device), release.App, release.Version); below {
+				respondError(c, http.StatusConflict, CodeConflict, "a component of the bundle is below the version floor of the device model", gin.H{"component": component, "version": release.Version, "model": floor.Model, "floor": floor.Version})
+				return
+			}
+			if current[component] != "" {
+				entry.Patch = readyPatch(current[component], release)
+				if entry.Patch != nil && regional {
+					entry.Patch.URL = regionalURL(regionName, region, entry.Patch.URL)
+				}
+			}
+			response.Updates = append(response.Updates, entry)
+			response.UpdatesSize += entry.Size
+		}
+	}
+
+	response.Timestamp = bundleTimestamp(response)
+	c.Set(bundleCheckResponseKey, response)
+	c.JSON(http.StatusOK, response)
+}
+
+// Admin endpoint defining a bundle version from component versions, e.g.
+// {"components": {"bootloader": "1.2.0", "kernel": "5.10.1"}, "notes": "..."}
+func putBundle(c *gin.Context) {
+	name, version := c.Param("name"), c.Param("version")
+	if !bundleNamePattern.MatchString(name) || catalog.VersionFromFile(name+"_"+version) == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid bundle name or version")
+		return
+	}
+	var req struct {
+		Components map[string]string `json:"components"`
+		Notes      string            `json:"notes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Components) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "components are required")
+		return
+	}
+	if _, err := os.Stat(bundleFile(name, version)); err == nil {
+		respondError(c, http.StatusConflict, CodeConflict, "bundle version already exists", gin.H{"bundle": name, "version": version})
+		return
+	}
+
+	bundle := Bundle{Name: name, Version: version, Notes: req.Notes, Components: make(map[string]BundleComponent), CreatedAt: time.Now().UTC()}
+	for component, componentVersion := range req.Components {
+		release, ok := catalogIndex.Find(component, componentVersion)
+		if !ok {
+			respondError(c, http.StatusNotFound, CodeVersionNotFound, "component version not found", gin.H{"component": component, "version": componentVersion})
+			return
+		}
+		bundle.Components[component] = BundleComponent{Version: componentVersion, ReleaseID: release.ID}
+	}
+
+	if err := storage.WriteJSON(bundleFile(name, version), bundle); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save bundle")
+		return
+	}
+	c.JSON(http.StatusCreated, bundle)
+}
+
+// Admin endpoint listing every bundle version
+func listBundles(c *gin.Context) {
+	entries, err := os.ReadDir(bundlesPath)
+	if err != nil && !os.IsNotExist(err) {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list bundles")
+		return
+	}
+	bundles := []Bundle{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		var bundle Bundle
+		if err := storage.ReadJSON(filepath.Join(bundlesPath, entry.Name()), &bundle); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load bundle")
+			return
+		}
+		bundles = append(bundles, bundle)
+	}
+	c.JSON(http.StatusOK, gin.H{"bundles": bundles})
+}
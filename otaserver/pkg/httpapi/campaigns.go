@@ -0,0 +1,433 @@
+package httpapi
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Campaigns wrap a rollout in a named, time-boxed object such as "June
+// security patch": between its start and end the devices it targets are
+// given its version as their desired version (see desired.go), taking
+// precedence over their group's and the fleet's but not over a device's own
+// target or its cohort's. A device targeted by several running campaigns
+// follows the one that started first. Progress is tracked per device:
+// updated once it runs the campaign's version or newer, failed when its last
+// install report of that version failed or it got stuck downloading it,
+// unreachable when it has not checked in since the campaign started, and
+// pending otherwise. Once a campaign ends its report is frozen, so that what
+// is handed to customers does not change as devices come and go; reports are
+// exported as JSON, CSV or PDF.
+
+// Campaign progress states of a device.
+const (
+	campaignUpdated     = "updated"
+	campaignFailed      = "failed"
+	campaignUnreachable = "unreachable"
+	campaignPending     = "pending"
+)
+
+// CampaignTarget selects the devices of a campaign; every criterion given
+// must match, and an empty target selects the whole fleet.
+type CampaignTarget struct {
+	Groups     []string          `json:"groups,omitempty"`
+	Cohorts    []string          `json:"cohorts,omitempty"` // member of any of them
+	Devices    []string          `json:"devices,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"` // all must match
+	Tags       []string          `json:"tags,omitempty"`       // all must be set
+}
+
+// Campaign is a rollout of a plugin version to a set of devices over a period.
+type Campaign struct {
+	Title     string          `json:"title"`
+	Version   string          `json:"version"`
+	Target    CampaignTarget  `json:"target"`
+	StartAt   time.Time       `json:"start_at"`
+	EndAt     time.Time       `json:"end_at"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Report    *CampaignReport `json:"report,omitempty"` // frozen when the campaign ended
+}
+
+// CampaignReport is the outcome of a campaign across its devices.
+type CampaignReport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Final       bool             `json:"final"`
+	Counts      map[string]int   `json:"counts"` // devices by progress state
+	Devices     []CampaignDevice `json:"devices"`
+}
+
+// CampaignDevice is the progress of one device in a campaign.
+type CampaignDevice struct {
+	ID       string    `json:"id"`
+	Group    string    `json:"group,omitempty"`
+	Status   string    `json:"status"`
+	Version  string    `json:"version,omitempty"` // the version it runs
+	LastSeen time.Time `json:"last_seen"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var campaignState = struct {
+	sync.RWMutex
+	campaigns map[string]Campaign // by name
+}{campaigns: make(map[string]Campaign)}
+
+// campaignsMu serializes changes to the campaigns.
+var campaignsMu sync.Mutex
+
+// Helper function to load the campaigns
+func initCampaigns() error {
+	campaigns := make(map[string]Campaign)
+	if err := storage.ReadJSON(campaignsFile, &campaigns); err != nil {
+		return err
+	}
+	campaignState.Lock()
+	campaignState.campaigns = campaigns
+	campaignState.Unlock()
+	return nil
+}
+
+// Helper function to check whether a campaign runs at now
+func (c Campaign) active(now time.Time) bool {
+	return !now.Before(c.StartAt) && now.Before(c.EndAt)
+}
+
+// Helper function to check whether a campaign targets a device
+func (t CampaignTarget) matches(device *Device) bool {
+	if len(t.Groups) > 0 && !slices.Contains(t.Groups, device.Group) {
+		return false
+	}
+	if len(t.Devices) > 0 && !slices.Contains(t.Devices, device.ID) {
+		return false
+	}
+	if len(t.Cohorts) > 0 && !slices.ContainsFunc(deviceCohorts(device.ID), func(name string) bool {
+		return slices.Contains(t.Cohorts, name)
+	}) {
+		return false
+	}
+	for key, value := range t.Attributes {
+		if device.Attributes[key] != value {
+			return false
+		}
+	}
+	return hasTags(device, t.Tags)
+}
+
+// Helper function to find the version the running campaigns targeting a
+// device give it, from the campaign that started first
+func campaignDesiredVersion(device *Device, now time.Time) string {
+	campaignState.RLock()
+	defer campaignState.RUnlock()
+	var version string
+	var first time.Time
+	for _, campaign := range campaignState.campaigns {
+		if !campaign.active(now) || !campaign.Target.matches(device) {
+			continue
+		}
+		if version == "" || campaign.StartAt.Before(first) {
+			version, first = campaign.Version, campaign.StartAt
+		}
+	}
+	return version
+}
+
+// Helper function to classify the progress of a device in a campaign
+func (c Campaign) deviceStatus(device *Device) CampaignDevice {
+	progress := CampaignDevice{ID: device.ID, Group: device.Group, Version: device.CurrentVersion, LastSeen: device.LastSeen}
+	switch report := device.LastReport; {
+	case device.CurrentVersion != "" && catalog.CompareVersions(device.CurrentVersion, c.Version) >= 0:
+		progress.Status = campaignUpdated
+	case report != nil && report.Version == c.Version && report.Status == reportFailure && !report.ReportedAt.Before(c.StartAt):
+		progress.Status, progress.Error = campaignFailed, report.Error
+	case device.Stuck && device.PendingVersion == c.Version:
+		progress.Status, progress.Error = campaignFailed, "download retry limit reached"
+	case device.LastSeen.Before(c.StartAt):
+		progress.Status = campaignUnreachable
+	default:
+		progress.Status = campaignPending
+	}
+	return progress
+}
+
+// Helper function to report the progress of a campaign over the known devices
+func (c Campaign) report(devices []Device, now time.Time) *CampaignReport {
+	report := &CampaignReport{
+		GeneratedAt: now.UTC(),
+		Final:       !now.Before(c.EndAt),
+		Counts:      map[string]int{campaignUpdated: 0, campaignFailed: 0, campaignUnreachable: 0, campaignPending: 0},
+		Devices:     []CampaignDevice{},
+	}
+	for i := range devices {
+		if !c.Target.matches(&devices[i]) {
+			continue
+		}
+		progress := c.deviceStatus(&devices[i])
+		report.Counts[progress.Status]++
+		report.Devices = append(report.Devices, progress)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].ID < report.Devices[j].ID })
+	return report
+}
+
+// Helper function to get the report of a campaign: the frozen one once it
+// ended, which is computed and saved the first time it is asked for, and the
+// current progress before that
+func campaignReport(name string) (Campaign, *CampaignReport, error) {
+	campaignState.RLock()
+	campaign, ok := campaignState.campaigns[name]
+	campaignState.RUnlock()
+	if !ok {
+		return campaign, nil, errCampaignNotFound
+	}
+	if campaign.Report != nil {
+		return campaign, campaign.Report, nil
+	}
+
+	var devices []Device
+	if !anonymousMode() {
+		var err error
+		if devices, err = listDevices(); err != nil {
+			return campaign, nil, err
+		}
+	}
+	now := time.Now()
+	report := campaign.report(devices, now)
+	if report.Final {
+		campaign.Report = report
+		if err := saveCampaign(name, &campaign); err != nil {
+			return campaign, nil, err
+		}
+	}
+	return campaign, report, nil
+}
+
+var errCampaignNotFound = errors.New("campaign not found")
+
+// Helper function to set (or with a nil campaign, remove) a campaign,
+// persisting the campaigns before devices follow them
+func saveCampaign(name string, campaign *Campaign) error {
+	campaignsMu.Lock()
+	defer campaignsMu.Unlock()
+	campaignState.RLock()
+	campaigns := make(map[string]Campaign, len(campaignState.campaigns)+1)
+	for n, current := range campaignState.campaigns {
+		campaigns[n] = current
+	}
+	campaignState.RUnlock()
+	if campaign != nil {
+		campaigns[name] = *campaign
+	} else {
+		delete(campaigns, name)
+	}
+	if err := storage.WriteJSON(campaignsFile, campaigns); err != nil {
+		return err
+	}
+	campaignState.Lock()
+	campaignState.campaigns = campaigns
+	campaignState.Unlock()
+	return nil
+}
+
+// Helper function to summarize a campaign with its progress counts
+func campaignSummary(name string, campaign Campaign, report *CampaignReport) gin.H {
+	return gin.H{
+		"name":       name,
+		"title":      campaign.Title,
+		"version":    campaign.Version,
+		"target":     campaign.Target,
+		"start_at":   campaign.StartAt,
+		"end_at":     campaign.EndAt,
+		"active":     campaign.active(time.Now()),
+		"final":      report.Final,
+		"counts":     report.Counts,
+		"created_at": campaign.CreatedAt,
+		"updated_at": campaign.UpdatedAt,
+	}
+}
+
+// Helper function to respond to a failed campaign report lookup
+func respondCampaignError(c *gin.Context, name string, err error) {
+	if err == errCampaignNotFound {
+		respondError(c, http.StatusNotFound, CodeNotFound, "campaign not found", gin.H{"name": name})
+		return
+	}
+	respondError(c, http.StatusInternalServerError, CodeInternal, "Could not report campaign")
+}
+
+// Admin endpoint listing the campaigns with their progress
+func listCampaigns(c *gin.Context) {
+	campaignState.RLock()
+	names := make([]string, 0, len(campaignState.campaigns))
+	for name := range campaignState.campaigns {
+		names = append(names, name)
+	}
+	campaignState.RUnlock()
+	sort.Strings(names)
+
+	campaigns := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		campaign, report, err := campaignReport(name)
+		if err == errCampaignNotFound {
+			continue // removed meanwhile
+		}
+		if err != nil {
+			respondCampaignError(c, name, err)
+			return
+		}
+		campaigns = append(campaigns, campaignSummary(name, campaign, report))
+	}
+	c.JSON(http.StatusOK, gin.H{"campaigns": campaigns})
+}
+
+// Admin endpoint showing a campaign with its progress counts
+func getCampaign(c *gin.Context) {
+	name := c.Param("name")
+	campaign, report, err := campaignReport(name)
+	if err != nil {
+		respondCampaignError(c, name, err)
+		return
+	}
+	c.JSON(http.StatusOK, campaignSummary(name, campaign, report))
+}
+
+// Admin endpoint exporting the report of a campaign with every targeted
+// device, as JSON or, with ?format=csv or ?format=pdf, as a file to hand to
+// customers
+func getCampaignReport(c *gin.Context) {
+	name := c.Param("name")
+	campaign, report, err := campaignReport(name)
+	if err != nil {
+		respondCampaignError(c, name, err)
+		return
+	}
+
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="campaign-%s.csv"`, name))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"device_id", "group", "status", "version", "last_seen", "error"})
+		for _, device := range report.Devices {
+			w.Write([]string{device.ID, device.Group, device.Status, device.Version, device.LastSeen.Format(time.RFC3339), device.Error})
+		}
+		w.Flush()
+	case "pdf":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="campaign-%s.pdf"`, name))
+		c.Header("Content-Type", "application/pdf")
+		c.Status(http.StatusOK)
+		writePDF(c.Writer, campaign.Title, campaignReportLines(name, campaign, report))
+	default:
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "format must be json, csv or pdf", gin.H{"format": format})
+	}
+}
+
+// Helper function to lay out a campaign report as lines of text
+func campaignReportLines(name string, campaign Campaign, report *CampaignReport) []string {
+	state := "in progress"
+	if report.Final {
+		state = "final"
+	}
+	lines := []string{
+		fmt.Sprintf("Update campaign: %s (%s)", campaign.Title, name),
+		fmt.Sprintf("Version:         %s", campaign.Version),
+		fmt.Sprintf("Period:          %s - %s", campaign.StartAt.UTC().Format(time.RFC3339), campaign.EndAt.UTC().Format(time.RFC3339)),
+		fmt.Sprintf("Report:          %s, generated %s", state, report.GeneratedAt.Format(time.RFC3339)),
+		"",
+		fmt.Sprintf("Devices targeted: %d", len(report.Devices)),
+	}
+	for _, status := range []string{campaignUpdated, campaignFailed, campaignUnreachable, campaignPending} {
+		lines = append(lines, fmt.Sprintf("  %-12s %6d", status, report.Counts[status]))
+	}
+	lines = append(lines, "", fmt.Sprintf("%-32s %-12s %-14s %s", "DEVICE", "STATUS", "VERSION", "LAST SEEN"))
+	for _, device := range report.Devices {
+		lastSeen := ""
+		if !device.LastSeen.IsZero() {
+			lastSeen = device.LastSeen.UTC().Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("%-32s %-12s %-14s %s", device.ID, device.Status, device.Version, lastSeen))
+		if device.Error != "" {
+			lines = append(lines, "    "+strconv.Quote(device.Error))
+		}
+	}
+	return lines
+}
+
+// Admin endpoint creating or changing a campaign, e.g. PUT
+// /admin/campaigns/june-patch {"title": "June security patch", "version":
+// "2.4.1", "target": {"groups": ["stores"]}, "start_at": "...", "end_at":
+// "..."}; it starts now when start_at is omitted. A campaign cannot be changed
+// once it ended.
+func updateCampaign(c *gin.Context) {
+	name := c.Param("name")
+	if !aliasNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "campaign names start with a lowercase letter followed by letters, digits or '-'")
+		return
+	}
+	var campaign Campaign
+	if err := c.ShouldBindJSON(&campaign); err != nil || campaign.Version == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "a campaign needs a version")
+		return
+	}
+	if !desiredVersionExists(c, campaign.Version) {
+		return
+	}
+	now := time.Now().UTC()
+	if campaign.StartAt.IsZero() {
+		campaign.StartAt = now
+	}
+	if !campaign.EndAt.After(campaign.StartAt) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "end_at must be after start_at")
+		return
+	}
+	if campaign.Title == "" {
+		campaign.Title = name
+	}
+
+	campaignState.RLock()
+	previous, exists := campaignState.campaigns[name]
+	campaignState.RUnlock()
+	campaign.CreatedAt, campaign.UpdatedAt, campaign.Report = now, now, nil
+	if exists {
+		if !now.Before(previous.EndAt) {
+			respondError(c, http.StatusConflict, CodeConflict, "campaign has ended", gin.H{"name": name})
+			return
+		}
+		campaign.CreatedAt = previous.CreatedAt
+	}
+	if err := saveCampaign(name, &campaign); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save campaigns")
+		return
+	}
+	c.JSON(http.StatusOK, campaign)
+}
+
+// Admin endpoint removing a campaign; devices it targeted return to their
+// other desired versions
+func deleteCampaign(c *gin.Context) {
+	name := c.Param("name")
+	campaignState.RLock()
+	_, ok := campaignState.campaigns[name]
+	campaignState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "campaign not found", gin.H{"name": name})
+		return
+	}
+	if err := saveCampaign(name, nil); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save campaigns")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// The check-update hot path is served from memory. The catalog index maps
+// each app and channel to its releases sorted by version, and the offer of
+// the newest release of a channel is built once per catalog revision, from
+// checksums computed once per release and kept in its metadata.
+// The index is rebuilt whenever the server changes the catalog itself and by
+// a background refresher that notices files changed on disk by other means.
+
+const catalogRefreshInterval = 5 * time.Second
+
+var (
+	errCatalogEmpty       = errors.New("no versions have been published")
+	errVersionUnavailable = errors.New("version is not in the catalog")
+)
+
+// cachedOffer is the device-independent part of a check-update response.
+type cachedOffer struct {
+	release   catalog.Release
+	checksum  string
+	digests   map[string]string // by algorithm, those configured for the app
+	meta      ReleaseMeta
+	createdAt time.Time
+}
+
+var offerCache = struct {
+	sync.RWMutex
+	revision uint64
+	entries  map[string]*cachedOffer // by offerKey
+}{entries: make(map[string]*cachedOffer)}
+
+func offerKey(app, channel string) string {
+	return app + "/" + channel
+}
+
+// offerFlight builds each offer once per catalog revision for concurrent
+// cache misses.
+var offerFlight catalog.Flight[*cachedOffer]
+
+var offerBuildsShared = newCounter("ota_offer_builds_shared_total", "Update checks that waited for an offer another check was computing.")
+
+// catalogIndex is the in-memory index of published releases.
+var catalogIndex catalog.Index
+
+// refreshCatalog rebuilds the catalog index from the OTA files directory and
+// drops every cached offer.
+func refreshCatalog() error {
+	releases, err := artifacts.Releases()
+	if err != nil {
+		return err
+	}
+	catalogIndex.Set(releases)
+	invalidateCatalog()
+	saveDigestIndex()
+	// Patches and bundles of releases that just went away are dropped
+	if _, err := collectDerived(false); err != nil {
+		log.Printf("collecting derived files: %v", err)
+	}
+	return nil
+}
+
+// invalidateCatalog drops every cached offer and starts a new catalog revision.
+func invalidateCatalog() {
+	offerCache.Lock()
+	offerCache.revision++
+	offerCache.entries = make(map[string]*cachedOffer)
+	offerCache.Unlock()
+}
+
+// Helper function to get the newest release of an app's channel, computing
+// and caching it on the first request of a catalog revision
+func latestOffer(app, channel string) (*cachedOffer, error) {
+	return cachedOfferFor(offerKey(app, channel), func() (catalog.Release, error) {
+		release, ok := catalogIndex.Latest(app, channel)
+		if !ok {
+			return release, errCatalogEmpty
+		}
+		return release, nil
+	})
+}
+
+// Helper function to get a specific version of an app, preferring the given
+// channel, computing and caching it on the first request of a catalog revision
+func versionOffer(app, channel, version string) (*cachedOffer, error) {
+	return cachedOfferFor(offerKey(app, channel)+"@"+version, func() (catalog.Release, error) {
+		release, ok := catalogIndex.Version(app, channel, version)
+		if !ok {
+			return release, errVersionUnavailable
+		}
+		return release, nil
+	})
+}
+
+// Helper function to look up an offer in the cache, building it from the
+// release returned by find when it is not cached yet
+func cachedOfferFor(key string, find func() (catalog.Release, error)) (*cachedOffer, error) {
+	offerCache.RLock()
+	offer, ok := offerCache.entries[key]
+	revision := offerCache.revision
+	offerCache.RUnlock()
+	if ok {
+		return offer, nil
+	}
+	if err := cachedMiss("offer:" + key); err != nil {
+		return nil, err
+	}
+
+	// Right after a publish every device misses the cache at once; one of them
+	// computes the offer while the others wait for it
+	offer, err, shared := offerFlight.Do(fmt.Sprintf("%s#%d", key, revision), func() (*cachedOffer, error) {
+		release, err := find()
+		if err != nil {
+			return nil, err
+		}
+
+		path := artifacts.ArtifactPath(release.FileName)
+		meta, err := loadReleaseMeta(release.App, release.Version)
+		if err != nil {
+			return nil, err
+		}
+		checksum, err := releaseChecksum(release, meta)
+		if err != nil {
+			return nil, err
+		}
+		digests, err := releaseDigests(release, meta)
+		if err != nil {
+			return nil, err
+		}
+		offer := &cachedOffer{release: release, checksum: checksum, digests: digests, meta: meta, createdAt: meta.CreatedAt}
+		// Artifacts copied into the directory by hand have no metadata yet
+		if offer.createdAt.IsZero() {
+			if info, err := os.Stat(path); err == nil {
+				offer.createdAt = info.ModTime().UTC()
+			}
+		}
+
+		offerCache.Lock()
+		// Only cache if the catalog did not change while we were computing
+		if offerCache.revision == revision {
+			offerCache.entries[key] = offer
+		}
+		offerCache.Unlock()
+		return offer, nil
+	})
+	if shared {
+		offerBuildsShared.Add(1)
+	}
+	if err != nil {
+		rememberMiss("offer:"+key, err)
+	}
+	return offer, err
+}
+
+// respondOffer writes a check-update response, with download URLs pointed at
+// the device's region and an ETag derived from its body, answering 304 Not
+// Modified when the device already has it.
+func respondOffer(c *gin.Context, info manifest.VersionInfo) {
+	info = regionalOffer(c, info)
+	negotiateDigest(c, &info)
+	c.Set(checkResponseKey, info)
+	body, err := json.Marshal(info)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not encode response")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:12]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// Helper function to fingerprint the paths, sizes and modification times of
+// the artifact files, used to notice changes made outside the server
+func catalogFingerprint() (string, error) {
+	hash := sha256.New()
+	err := artifacts.Walk(func(rel string, info os.FileInfo) error {
+		fmt.Fprintf(hash, "%s %d %d\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Helper function to build the catalog index and start the background
+// refresher that rebuilds it when the artifact directory changes
+func watchCatalog() error {
+	last, _ := catalogFingerprint()
+	if err := timedRefreshCatalog(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(catalogRefreshInterval) {
+			current, err := catalogFingerprint()
+			if err != nil {
+				log.Printf("scanning catalog: %v", err)
+				continue
+			}
+			if current != last {
+				if err := refreshCatalog(); err != nil {
+					log.Printf("refreshing catalog: %v", err)
+					continue
+				}
+				last = current
+			}
+		}
+	}()
+	return nil
+}
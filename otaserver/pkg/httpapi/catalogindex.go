@@ -0,0 +1,176 @@
+package httpapi
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/manifest"
+)
+
+// Artifacts burned to read-only media or mounted from an ISO can be served
+// from a signed catalog index generated with them (otactl catalog-index)
+// instead of scanning and hashing the files directory at startup, which is
+// slow on optical media and impossible to cache when nothing is writable.
+// OTA_CATALOG_INDEX=1 reads catalog.json in the files directory, any other
+// value is the path of the index. Its signature is checked against the
+// Ed25519 public keys in OTA_CATALOG_INDEX_KEYS (a PEM file), or the public
+// half of the signing key, and the server refuses to start on an index it
+// cannot verify. Only the listed files present with their listed size are
+// served; the catalog cannot be changed (uploads, promotions, rollbacks and
+// release sync are refused with 409) until the index is replaced, which a
+// reload picks up. State such as devices and metadata stays in the writable
+// state directory.
+
+// CatalogIndexStatus describes the catalog index in use.
+type CatalogIndexStatus struct {
+	Path        string    `json:"path"`
+	GeneratedAt time.Time `json:"generated_at"`
+	KeyIDs      []string  `json:"key_ids"` // keys that signed it
+	Releases    int       `json:"releases"`
+	Missing     []string  `json:"missing,omitempty"` // listed files absent or of another size
+	LoadedAt    time.Time `json:"loaded_at"`
+}
+
+var catalogIndexState = struct {
+	sync.RWMutex
+	status *CatalogIndexStatus
+}{}
+
+var errCatalogIndexed = errors.New("the catalog is served from a read-only catalog index")
+
+// Helper function to get the path of the catalog index, empty when the
+// catalog is scanned
+func catalogIndexPath() string {
+	v := os.Getenv("OTA_CATALOG_INDEX")
+	switch strings.ToLower(v) {
+	case "", "0", "false":
+		return ""
+	case "1", "true":
+		return filepath.Join(otaFilesPath, manifest.CatalogIndexFile)
+	}
+	return v
+}
+
+// Helper function to collect the keys trusted to sign the catalog index
+func catalogIndexKeys() ([]ed25519.PublicKey, error) {
+	var trusted []ed25519.PublicKey
+	for _, path := range strings.Split(os.Getenv("OTA_CATALOG_INDEX_KEYS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		keys, err := loadPublicKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if pub, ok := key.(ed25519.PublicKey); ok {
+				trusted = append(trusted, pub)
+			}
+		}
+	}
+	if key := currentSigningKey(); key != nil {
+		trusted = append(trusted, key.Public)
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("no key to verify the catalog index with: set OTA_CATALOG_INDEX_KEYS")
+	}
+	return trusted, nil
+}
+
+// Helper function to load and verify the catalog index, if one is
+// configured, and drive the files directory with it
+func initCatalogIndex() error {
+	path := catalogIndexPath()
+	if path == "" {
+		return nil
+	}
+	trusted, err := catalogIndexKeys()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var signed manifest.SignedCatalogIndex
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	index, err := manifest.OpenCatalogIndex(signed, trusted)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := artifacts.UseIndex(index.Releases); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	status := &CatalogIndexStatus{
+		Path:        path,
+		GeneratedAt: index.GeneratedAt,
+		Releases:    len(index.Releases),
+		LoadedAt:    time.Now().UTC(),
+	}
+	for _, sig := range signed.Signatures {
+		status.KeyIDs = append(status.KeyIDs, sig.KeyID)
+	}
+	for _, release := range artifacts.MissingFromIndex() {
+		status.Missing = append(status.Missing, release.FileName)
+	}
+	if len(status.Missing) > 0 {
+		log.Printf("catalog index %s: %d listed files are missing or truncated: %s", path, len(status.Missing), strings.Join(status.Missing, ", "))
+	}
+	catalogIndexState.Lock()
+	catalogIndexState.status = status
+	catalogIndexState.Unlock()
+	return nil
+}
+
+// Helper function to reload the catalog index and re-index the catalog with it
+func reloadCatalogIndex() error {
+	if catalogIndexPath() == "" {
+		return nil
+	}
+	if err := initCatalogIndex(); err != nil {
+		return err
+	}
+	return refreshCatalog()
+}
+
+// Middleware refusing requests that would change the files directory while
+// it is served from a catalog index
+func writableArtifacts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if artifacts.Indexed() {
+			respondError(c, http.StatusConflict, CodeConflict, errCatalogIndexed.Error(), gin.H{"catalog_index": catalogIndexPath()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Admin endpoint describing the catalog index in use
+func getCatalogIndex(c *gin.Context) {
+	catalogIndexState.RLock()
+	status := catalogIndexState.status
+	catalogIndexState.RUnlock()
+	if status == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "the catalog is not served from a catalog index")
+		return
+	}
+	current := *status
+	current.Missing = nil
+	for _, release := range artifacts.MissingFromIndex() {
+		current.Missing = append(current.Missing, release.FileName)
+	}
+	c.JSON(http.StatusOK, current)
+}
@@ -0,0 +1,104 @@
+package httpapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Release notes can be generated from a git repository whose tags follow the
+// release versions. OTA_CHANGELOG_REPO points at the repository and
+// OTA_CHANGELOG_TAG_PREFIX (default "v") is prepended to the version to find
+// the tag, e.g. "v1.2.0".
+func changelogRepo() string {
+	return os.Getenv("OTA_CHANGELOG_REPO")
+}
+
+func changelogTag(version string) string {
+	prefix, ok := os.LookupEnv("OTA_CHANGELOG_TAG_PREFIX")
+	if !ok {
+		prefix = "v"
+	}
+	return prefix + version
+}
+
+// Helper function to run git in the configured changelog repository
+func runGit(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", changelogRepo()}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// generateChangelog builds release notes from the annotated tag message of the
+// version's tag followed by the commits since the previous tag.
+func generateChangelog(version string) (string, error) {
+	if changelogRepo() == "" {
+		return "", fmt.Errorf("OTA_CHANGELOG_REPO is not configured")
+	}
+
+	tag := changelogTag(version)
+	if _, err := runGit("rev-parse", "--verify", "refs/tags/"+tag); err != nil {
+		return "", fmt.Errorf("tag %s not found", tag)
+	}
+
+	// Lightweight tags have no message of their own and report the commit's
+	message, err := runGit("tag", "-l", "--format=%(contents)", tag)
+	if err != nil {
+		return "", err
+	}
+
+	commitRange := tag
+	if previous, err := runGit("describe", "--tags", "--abbrev=0", tag+"^"); err == nil {
+		commitRange = previous + ".." + tag
+	}
+	commits, err := runGit("log", "--no-merges", "--pretty=format:- %s (%h)", commitRange)
+	if err != nil {
+		return "", err
+	}
+
+	var notes strings.Builder
+	if message != "" {
+		notes.WriteString(message)
+		notes.WriteString("\n\n")
+	}
+	if commits != "" {
+		notes.WriteString("Changes:\n")
+		notes.WriteString(commits)
+	}
+	return strings.TrimSpace(notes.String()), nil
+}
+
+// Admin endpoint to (re)generate the release notes of a version from git
+func regenerateChangelog(c *gin.Context) {
+	app := c.Param("app")
+	version := c.Param("version")
+
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+
+	notes, err := generateChangelog(version)
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, CodeValidationFailed, err.Error())
+		return
+	}
+
+	meta, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) { m.Notes = notes })
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save release notes")
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
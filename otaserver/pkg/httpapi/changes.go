@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/rollout"
+)
+
+// Endpoint returning the combined release notes, mandatory flags and upgrade
+// path between two versions (e.g., /changes?from=1.2.0&to=1.6.0). Without
+// "to", the newest version of the channel is used.
+func getChanges(c *gin.Context) {
+	from, ok := requireVersion(c, "from", c.Query("from"))
+	if !ok {
+		return
+	}
+	app := c.DefaultQuery("app", "plugin")
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	if !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+
+	latest, ok := catalogIndex.Latest(app, channel)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeCatalogEmpty, errCatalogEmpty.Error(), gin.H{"channel": channel})
+		return
+	}
+	releases := catalogIndex.Releases(app, channel)
+	to := c.DefaultQuery("to", latest.Version)
+
+	found := false
+	summary := manifest.ChangeSummary{App: app, Channel: channel, From: from, To: to, Releases: []manifest.ReleaseChange{}}
+	var notes []string
+	for _, release := range releases {
+		if catalog.CompareVersions(release.Version, to) == 0 {
+			found = true
+		}
+		if catalog.CompareVersions(release.Version, from) <= 0 || catalog.CompareVersions(release.Version, to) > 0 {
+			continue
+		}
+		// Devices on the default channel only pass through pre-releases they asked for
+		if channel == catalog.DefaultChannel && catalog.IsPrerelease(release.Version) && release.Version != to {
+			continue
+		}
+		meta, err := loadReleaseMeta(app, release.Version)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+			return
+		}
+		summary.Releases = append(summary.Releases, manifest.ReleaseChange{
+			Version:        release.Version,
+			Notes:          meta.Notes,
+			Mandatory:      meta.Mandatory,
+			MinimumVersion: meta.MinimumVersion,
+		})
+		summary.Mandatory = summary.Mandatory || meta.Mandatory
+		if meta.Notes != "" {
+			notes = append(notes, fmt.Sprintf("## %s\n\n%s", release.Version, strings.TrimSpace(meta.Notes)))
+		}
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"version": to})
+		return
+	}
+	summary.Notes = strings.Join(notes, "\n\n")
+
+	path, ok := rollout.UpgradePath(from, summary.Releases)
+	if !ok {
+		respondError(c, http.StatusConflict, CodeConflict, "no upgrade path between the versions", gin.H{"from": from, "to": to})
+		return
+	}
+	summary.UpgradePath = path
+	c.JSON(http.StatusOK, summary)
+}
+
+// RequirementsRequest is the body of the release requirements endpoint.
+type RequirementsRequest struct {
+	Mandatory      bool   `json:"mandatory"`
+	MinimumVersion string `json:"minimum_version"`
+}
+
+// Admin endpoint to mark a release as mandatory and set the oldest version it
+// can be installed over
+func updateRequirements(c *gin.Context) {
+	app := c.Param("app")
+	version := c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+
+	var req RequirementsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid requirements")
+		return
+	}
+	if req.MinimumVersion != "" && catalog.CompareVersions(req.MinimumVersion, version) >= 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidVersion, "minimum_version must be older than the release")
+		return
+	}
+
+	meta, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.Mandatory = req.Mandatory
+		m.MinimumVersion = req.MinimumVersion
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save requirements")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
@@ -0,0 +1,382 @@
+package httpapi
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Helper function to normalize a version a device reported (see
+// catalog.NormalizeVersion), responding 400 with the accepted formats when it
+// is missing or not a version
+func requireVersion(c *gin.Context, field, version string) (string, bool) {
+	if version == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidVersion, field+" is required")
+		return "", false
+	}
+	normalized, err := catalog.NormalizeVersion(version)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidVersion, field+" is not a valid version: "+err.Error(), versionErrorDetails(field, version))
+		return "", false
+	}
+	return normalized, true
+}
+
+// Helper function to describe an invalid version in error details
+func versionErrorDetails(field, version string) gin.H {
+	return gin.H{"field": field, "value": version, "accepted_formats": catalog.VersionFormats}
+}
+
+// Endpoint to check for a new version
+func checkForUpdateold(c *gin.Context) {
+	currentVersion, ok := requireVersion(c, "current_version", c.Query("current_version"))
+	if !ok {
+		return
+	}
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	if !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+
+	device, err := recordCheckIn(c, "plugin", currentVersion)
+	if errors.Is(err, errInvalidDeviceID) || errors.Is(err, errInvalidTimezone) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errDeviceMismatch) {
+		respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not record device check-in")
+		return
+	}
+
+	offer, err := latestOffer("plugin", channel)
+	if errors.Is(err, errCatalogEmpty) {
+		respondMiss(c, "offer:"+offerKey("plugin", channel), http.StatusNotFound, CodeCatalogEmpty, err.Error(), gin.H{"channel": channel})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not resolve latest release")
+		return
+	}
+	latestVersion := offer.release.Version
+
+	if _, below := belowVersionFloor(deviceModel(device), "plugin", latestVersion); below {
+		respondOffer(c, manifest.VersionInfo{LatestVersion: currentVersion})
+	} else if catalog.CompareVersions(latestVersion, currentVersion) > 0 {
+		respondOffer(c, buildOffer(device, currentVersion, offer))
+	} else {
+		respondOffer(c, manifest.VersionInfo{
+			LatestVersion: latestVersion,
+		})
+	}
+}
+
+// Endpoint to check for a new version of the plugin, or of another app with
+// ?app=
+func checkForUpdate(c *gin.Context) {
+	app := requestedApp(c)
+	currentVersion, ok := requireVersion(c, "current_version", c.Query("current_version"))
+	if !ok {
+		return
+	}
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	if !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+
+	device, err := recordCheckIn(c, app, currentVersion)
+	if errors.Is(err, errInvalidDeviceID) || errors.Is(err, errInvalidTimezone) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errDeviceMismatch) {
+		respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not record device check-in")
+		return
+	}
+
+	info, err := resolveUpdate(device, app, channel, currentVersion)
+	if errors.Is(err, errCatalogEmpty) {
+		respondMiss(c, "offer:"+offerKey(app, channel), http.StatusNotFound, CodeCatalogEmpty, err.Error(), gin.H{"channel": channel})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not resolve latest release")
+		return
+	}
+	respondOffer(c, info)
+}
+
+// Helper function to decide what to offer a device running currentVersion
+// of an app, with the reason when that is nothing newer
+func resolveUpdate(device *Device, app, channel, currentVersion string) (manifest.VersionInfo, error) {
+	info, err := resolveOffer(device, app, channel, currentVersion)
+	if err != nil {
+		return info, err
+	}
+	info.Reason = noUpdateReason(device, app, channel, currentVersion, info)
+	info = enforceVersionFloor(device, app, currentVersion, info)
+	info.Timestamp = channelTimestamp(app, channel, info)
+	return info, nil
+}
+
+// Helper function to tell a device why an offer brings it nothing newer,
+// returning "" when it does
+func noUpdateReason(device *Device, app, channel, currentVersion string, info manifest.VersionInfo) string {
+	switch {
+	case catalog.CompareVersions(info.LatestVersion, currentVersion) == 0:
+		if latest, ok := catalogIndex.Latest(app, channel); ok && catalog.CompareVersions(latest.Version, currentVersion) > 0 {
+			if info.HeldBy != "" {
+				return manifest.ReasonHeld
+			}
+			if app == "plugin" && deviceDesiredVersion(device) == currentVersion {
+				return manifest.ReasonPinned
+			}
+		}
+		return manifest.ReasonUpToDate
+	case info.DownloadURL != "":
+		return ""
+	case info.AvailableAt != "":
+		return manifest.ReasonInstallWindow
+	case info.DeferredUntil != "":
+		return manifest.ReasonDeferred
+	default:
+		return manifest.ReasonStuck
+	}
+}
+
+// Helper function to decide what to offer a device running currentVersion
+// of an app: its desired version if it has one (desired versions apply to
+// the plugin), otherwise the newest release of the channel, in both cases
+// held back by the rollout plans
+func resolveOffer(device *Device, app, channel, currentVersion string) (manifest.VersionInfo, error) {
+	// Devices with a desired version are offered exactly that version, unless
+	// it is below the version floor of their model
+	desired := deviceDesiredVersion(device)
+	if floor, below := belowVersionFloor(deviceModel(device), app, desired); below {
+		log.Printf("ignoring desired version %s of %s: below the version floor %s of model %s", desired, device.ID, floor.Version, floor.Model)
+		desired = ""
+	}
+	if desired != "" && app == "plugin" {
+		if catalog.CompareVersions(currentVersion, desired) == 0 {
+			return manifest.VersionInfo{LatestVersion: desired, NextCheckAfter: nextCheckAfter(device)}, nil
+		}
+		offer, err := versionOffer(app, channel, desired)
+		if err == nil {
+			return plannedOffer(device, app, channel, currentVersion, offer)
+		}
+		log.Printf("desired version %s is unavailable, offering the latest release: %v", desired, err)
+	}
+
+	offer, err := latestOffer(app, channel)
+	if err != nil {
+		return manifest.VersionInfo{}, err
+	}
+	return plannedOffer(device, app, channel, currentVersion, offer)
+}
+
+// Helper function to build the offer of a release, or of the newest release
+// below the version a rollout plan holds the device at
+func plannedOffer(device *Device, app, channel, currentVersion string, offer *cachedOffer) (manifest.VersionInfo, error) {
+	limit, reason, held := planLimit(device, app, offer.release.Version)
+	if !held {
+		return buildOffer(device, currentVersion, offer), nil
+	}
+	if release, ok := newestReleaseBelow(app, channel, limit); ok && catalog.CompareVersions(release.Version, currentVersion) > 0 {
+		below, err := versionOffer(app, channel, release.Version)
+		if err != nil {
+			return manifest.VersionInfo{}, err
+		}
+		info := buildOffer(device, currentVersion, below)
+		info.HeldBy = reason
+		return info, nil
+	}
+	return manifest.VersionInfo{LatestVersion: currentVersion, HeldBy: reason, NextCheckAfter: nextCheckAfter(device)}, nil
+}
+
+// Helper function to build the offer of a release to a device, applying the
+// install window and falling back from patches to the full image (and then to
+// no offer) for devices that keep downloading without reporting success
+func buildOffer(device *Device, currentVersion string, offer *cachedOffer) manifest.VersionInfo {
+	release, meta := offer.release, offer.meta
+	info := manifest.VersionInfo{
+		LatestVersion:  release.Version,
+		SizeBytes:      release.Size,
+		SHA256:         release.ID,
+		NextCheckAfter: nextCheckAfter(device),
+	}
+	setOfferDigests(&info, release.App, offer.digests)
+	if !offer.createdAt.IsZero() {
+		info.CreatedAt = offer.createdAt.Format(time.RFC3339)
+	}
+
+	if allowed, availableAt := offerAllowed(meta, device); !allowed {
+		info.AvailableAt = availableAt.Format(time.RFC3339)
+		return info
+	}
+
+	// A running deferral is honored even when it was the device's last one
+	info.Mandatory = meta.Mandatory || snoozesExhausted(device, release.Version)
+	if meta.Security != nil {
+		info.SecurityFixes = meta.Security.CVEs
+	}
+	if until, deferred := activeDeferral(device, release.Version); deferred && !meta.Mandatory {
+		info.DeferredUntil = until.Format(time.RFC3339)
+		return info
+	}
+
+	attempts := downloadAttempts(device, release.Version)
+	if attempts >= stuckThreshold() {
+		return info
+	}
+
+	info.DownloadURL = fmt.Sprintf("/download?release_id=%s", release.ID)
+	if device != nil && device.ID != "" {
+		info.DownloadURL += "&device_id=" + url.QueryEscape(device.ID)
+	}
+	info.CheckSum = offer.checksum
+	info.ReleaseID = release.ID
+	info.Size = release.Size
+	info.ReleaseNotes = meta.Notes
+	info.Signature = meta.Signature
+	info.Provenance = meta.Provenance
+	info.Fields = renderFields(meta.Fields, fieldContext(device, release, currentVersion))
+	if attempts < patchAttemptLimit {
+		info.Patch = readyPatch(currentVersion, release)
+	}
+	return info
+}
+
+// CalculateChecksum computes the hex MD5 checksum of a file, the one devices
+// verify downloads against. Release IDs and signatures use SHA-256.
+func CalculateChecksum(filePath string) (string, error) {
+	// Open the file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	// Create a new MD5 hash
+	hash := md5.New()
+
+	// Copy the file's content into the hash
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to copy file data to hash: %w", err)
+	}
+
+	// Get the checksum as a byte slice and encode it as a hex string
+	checksum := hash.Sum(nil)
+	checksumHex := hex.EncodeToString(checksum)
+
+	return checksumHex, nil
+}
+
+// Endpoint to download the new version file of the plugin, or of another app
+// with ?app=
+func downloadNewVersion(c *gin.Context) {
+	if releaseID := c.Query("release_id"); releaseID != "" {
+		downloadRelease(c, releaseID)
+		return
+	}
+
+	app := requestedApp(c)
+	requestedVersion := c.Query("version")
+	if alias := c.Query("alias"); alias != "" {
+		version, ok := resolveAlias(app, alias)
+		if !ok {
+			respondError(c, http.StatusNotFound, CodeNotFound, "alias not found", gin.H{"alias": alias})
+			return
+		}
+		requestedVersion = version
+	}
+	if requestedVersion == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidVersion, "version, alias or release_id is required")
+		return
+	}
+
+	fileName := fmt.Sprintf("plugin_%s.wasm", requestedVersion)
+	if _, configured := catalog.LookupApp(app); app != "plugin" || configured {
+		// Other apps, and configured ones, are named as the catalog found them
+		indexed, ok := catalogIndex.Version(app, catalog.DefaultChannel, requestedVersion)
+		if !ok {
+			respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"app": app})
+			return
+		}
+		fileName = indexed.FileName
+	}
+	filePath := artifacts.ArtifactPath(fileName)
+
+	key := "file:" + fileName
+	release, err := findRelease(key, func() (catalog.Release, error) {
+		release, err := artifacts.Release(fileName)
+		if err == nil && artifacts.Servable(filePath) {
+			return release, nil
+		}
+		// The OTA files directory may be unavailable while mirrors still hold the artifact
+		indexed, ok := catalogIndex.Version(app, catalog.DefaultChannel, requestedVersion)
+		if !ok || indexed.FileName != fileName {
+			return release, errVersionUnavailable
+		}
+		return indexed, nil
+	})
+	if err != nil {
+		respondMiss(c, key, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	if !allowDownloadAboveFloor(c, app, requestedVersion) {
+		return
+	}
+	recordDownload(c, requestedVersion)
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(fileName)))
+	serveArtifact(c, release)
+}
+
+// Helper function to serve exactly the release that a check-update response described
+func downloadRelease(c *gin.Context, releaseID string) {
+	key := "release:" + releaseID
+	release, err := findRelease(key, func() (catalog.Release, error) {
+		// The index answers without walking the OTA files directory, which
+		// may even be unavailable while mirrors still hold the artifact
+		if indexed, ok := catalogIndex.ByID(releaseID); ok {
+			return indexed, nil
+		}
+		return catalog.Release{}, catalog.ErrReleaseGone
+	})
+	if errors.Is(err, catalog.ErrReleaseGone) {
+		respondMiss(c, key, http.StatusGone, CodeReleaseGone, "release is no longer available", gin.H{"release_id": releaseID})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not resolve release")
+		return
+	}
+	if !allowDownloadAboveFloor(c, release.App, release.Version) {
+		return
+	}
+	recordDownload(c, release.Version)
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(release.FileName)))
+	serveArtifact(c, release)
+}
@@ -0,0 +1,115 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Gateways managing many devices check for all of them in one round trip
+// with POST /check-update/batch. Each entry is answered like a /check-update
+// of that device, and a failing entry does not fail the others. The batch
+// counts as one request against the tenant's quota.
+
+// maxBatchChecks is how many entries a batch may hold.
+const maxBatchChecks = 500
+
+// BatchCheck is one entry of a batch check.
+type BatchCheck struct {
+	checkIn
+	Channel string `json:"channel"`
+}
+
+// BatchCheckResult is the answer to one entry of a batch check: the
+// check-update response, or an error.
+type BatchCheckResult struct {
+	DeviceID string                `json:"device_id,omitempty"`
+	App      string                `json:"app"`
+	Update   *manifest.VersionInfo `json:"update,omitempty"`
+	Error    *APIError             `json:"error,omitempty"`
+}
+
+// Endpoint checking for updates for many devices at once, e.g.
+// [{"device_id": "sensor-1", "app": "plugin", "current_version": "1.0.0"}]
+func checkForUpdateBatch(c *gin.Context) {
+	var checks []BatchCheck
+	if err := c.ShouldBindJSON(&checks); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "body must be an array of checks")
+		return
+	}
+	if len(checks) > maxBatchChecks {
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "too many checks in one batch", gin.H{"max": maxBatchChecks})
+		return
+	}
+
+	results := make([]BatchCheckResult, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, batchCheck(c, check))
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// Helper function to answer one entry of a batch check
+func batchCheck(c *gin.Context, check BatchCheck) BatchCheckResult {
+	if check.App == "" {
+		check.App = "plugin"
+	}
+	if check.Channel == "" {
+		check.Channel = catalog.DefaultChannel
+	}
+	result := BatchCheckResult{DeviceID: check.DeviceID, App: check.App}
+	fail := func(code, message string) BatchCheckResult {
+		result.Error = &APIError{Code: code, Message: message}
+		return result
+	}
+
+	if check.CurrentVersion == "" {
+		return fail(CodeInvalidVersion, "current_version is required")
+	}
+	normalized, err := catalog.NormalizeVersion(check.CurrentVersion)
+	if err != nil {
+		result = fail(CodeInvalidVersion, "current_version is not a valid version: "+err.Error())
+		result.Error.Details = versionErrorDetails("current_version", check.CurrentVersion)
+		return result
+	}
+	check.CurrentVersion = normalized
+	if !catalog.ValidChannel(check.Channel) {
+		return fail(CodeInvalidRequest, "invalid channel")
+	}
+
+	device, err := recordDeviceCheckIn(c, check.checkIn)
+	if errors.Is(err, errInvalidDeviceID) || errors.Is(err, errInvalidTimezone) {
+		return fail(CodeInvalidRequest, err.Error())
+	}
+	if errors.Is(err, errDeviceMismatch) {
+		return fail(CodeForbidden, err.Error())
+	}
+	if err != nil {
+		return fail(CodeInternal, "Could not record device check-in")
+	}
+
+	info, err := resolveUpdate(device, check.App, check.Channel, check.CurrentVersion)
+	if errors.Is(err, errCatalogEmpty) {
+		return fail(CodeCatalogEmpty, err.Error())
+	}
+	if err != nil {
+		return fail(CodeInternal, "Could not resolve latest release")
+	}
+	info = regionalOffer(c, info)
+	if info.DownloadURL != "" {
+		recordHistory(check.DeviceID, HistoryEvent{
+			Time:        time.Now().UTC(),
+			Event:       historyOffer,
+			App:         check.App,
+			FromVersion: check.CurrentVersion,
+			Version:     info.LatestVersion,
+			RequestID:   c.GetString("request_id"),
+		})
+	}
+	result.Update = &info
+	return result
+}
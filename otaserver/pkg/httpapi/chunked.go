@@ -0,0 +1,301 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Chunked uploads let very large artifacts be uploaded in resumable pieces,
+// following the shape of the tus protocol:
+//
+//	POST   /admin/uploads                 declare file_name, size and sha256
+//	PATCH  /admin/uploads/:id             append a chunk at the Upload-Offset header
+//	HEAD   /admin/uploads/:id             read the current Upload-Offset to resume
+//	POST   /admin/uploads/:id/complete    verify the digest and publish
+//	DELETE /admin/uploads/:id             abandon the upload
+//
+// Sessions and their partial data live in uploadsPath until completed.
+
+// Abandoned sessions are removed when new ones are created.
+const uploadSessionTTL = 7 * 24 * time.Hour
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// UploadSession is the declared shape of a chunked upload.
+type UploadSession struct {
+	ID        string    `json:"upload_id"`
+	FileName  string    `json:"file_name"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Checksum  string    `json:"checksum,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Force replaces a published version with different content, see publishArtifact
+	Force       bool   `json:"force,omitempty"`
+	ForceReason string `json:"force_reason,omitempty"`
+
+	// TokenID is the upload token that opened the session, the only one
+	// that may resume it
+	TokenID string `json:"token_id,omitempty"`
+}
+
+// activeUploads guards against two requests writing the same session at once.
+var activeUploads = struct {
+	sync.Mutex
+	busy map[string]bool
+}{busy: make(map[string]bool)}
+
+func uploadSessionFile(id string) string { return filepath.Join(uploadsPath, id+".json") }
+func uploadDataFile(id string) string    { return filepath.Join(uploadsPath, id+".part") }
+
+// Helper function to load a session and its current offset, as if it did not
+// exist when another upload token opened it
+func loadUploadSession(c *gin.Context) (*UploadSession, int64, bool) {
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "upload not found")
+		return nil, 0, false
+	}
+	var session UploadSession
+	if err := storage.ReadJSON(uploadSessionFile(id), &session); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load upload")
+		return nil, 0, false
+	}
+	info, err := os.Stat(uploadDataFile(id))
+	if session.ID == "" || err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "upload not found")
+		return nil, 0, false
+	}
+	if token, ok := requestUploadToken(c); ok && token.ID != session.TokenID {
+		respondError(c, http.StatusNotFound, CodeNotFound, "upload not found")
+		return nil, 0, false
+	}
+	return &session, info.Size(), true
+}
+
+// Helper function to mark a session busy for the duration of a request
+func acquireUpload(c *gin.Context, id string) bool {
+	activeUploads.Lock()
+	defer activeUploads.Unlock()
+	if activeUploads.busy[id] {
+		respondError(c, http.StatusConflict, CodeConflict, "another request is writing this upload")
+		return false
+	}
+	activeUploads.busy[id] = true
+	return true
+}
+
+func releaseUpload(id string) {
+	activeUploads.Lock()
+	delete(activeUploads.busy, id)
+	activeUploads.Unlock()
+}
+
+// Helper function to remove sessions that were abandoned long ago
+func sweepUploadSessions() {
+	entries, err := os.ReadDir(uploadsPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadSessionTTL {
+			continue
+		}
+		os.Remove(filepath.Join(uploadsPath, entry.Name()))
+	}
+}
+
+// Admin endpoint declaring a new chunked upload
+func createUploadSession(c *gin.Context) {
+	var session UploadSession
+	if err := c.ShouldBindJSON(&session); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid upload declaration")
+		return
+	}
+	session.FileName = filepath.Base(session.FileName)
+	session.SHA256 = strings.ToLower(session.SHA256)
+	session.Checksum = strings.ToLower(session.Checksum)
+	if session.FileName == "." || session.Size <= 0 || !sha256Pattern.MatchString(session.SHA256) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "file_name, a positive size and a sha256 digest are required")
+		return
+	}
+	if session.Channel != "" && !catalog.ValidChannel(session.Channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+	if !allowUploadTokenApp(c, session.FileName) {
+		return
+	}
+	if limit := maxUploadBytes(); session.Size > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "upload is too large", gin.H{"max_bytes": limit})
+		return
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not create upload")
+		return
+	}
+	session.ID = hex.EncodeToString(raw)
+	session.CreatedAt = time.Now().UTC()
+	session.TokenID = ""
+	if token, ok := requestUploadToken(c); ok {
+		session.TokenID = token.ID
+	}
+
+	sweepUploadSessions()
+	if err := storage.WriteJSON(uploadSessionFile(session.ID), session); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not create upload")
+		return
+	}
+	if err := os.WriteFile(uploadDataFile(session.ID), nil, 0o644); err != nil {
+		os.Remove(uploadSessionFile(session.ID))
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not create upload")
+		return
+	}
+
+	c.Header("Location", "/admin/uploads/"+session.ID)
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, gin.H{"upload_id": session.ID, "offset": 0})
+}
+
+// Admin endpoint reporting the offset to resume a chunked upload from
+func headUploadSession(c *gin.Context) {
+	session, offset, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+}
+
+// Admin endpoint describing a chunked upload
+func getUploadSession(c *gin.Context) {
+	session, offset, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"upload": session, "offset": offset})
+}
+
+// Admin endpoint appending a chunk to an upload. The Upload-Offset header
+// must equal the number of bytes already received.
+func patchUploadSession(c *gin.Context) {
+	session, offset, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if !acquireUpload(c, session.ID) {
+		return
+	}
+	defer releaseUpload(session.ID)
+
+	claimed, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Upload-Offset header is required")
+		return
+	}
+	if claimed != offset {
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		respondError(c, http.StatusConflict, CodeConflict, "Upload-Offset does not match received bytes", gin.H{"offset": offset})
+		return
+	}
+
+	file, err := os.OpenFile(uploadDataFile(session.ID), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not open upload")
+		return
+	}
+	// Read one byte past the declared size to detect oversized uploads
+	written, copyErr := io.Copy(file, io.LimitReader(c.Request.Body, session.Size-offset+1))
+	closeErr := file.Close()
+	offset += written
+
+	if offset > session.Size {
+		os.Truncate(uploadDataFile(session.ID), session.Size)
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, fmt.Sprintf("upload exceeds declared size of %d bytes", session.Size))
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if copyErr != nil || closeErr != nil {
+		// Whatever arrived is kept; the client resumes from the reported offset
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "chunk was interrupted", gin.H{"offset": offset})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"offset": offset})
+}
+
+// Admin endpoint verifying and publishing a fully received upload
+func completeUploadSession(c *gin.Context) {
+	session, offset, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if !acquireUpload(c, session.ID) {
+		return
+	}
+	defer releaseUpload(session.ID)
+
+	if offset != session.Size {
+		respondError(c, http.StatusConflict, CodeConflict, "upload is incomplete", gin.H{"offset": offset, "size": session.Size})
+		return
+	}
+
+	file, err := os.Open(uploadDataFile(session.ID))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not open upload")
+		return
+	}
+	digests, err := copyAndHash(io.Discard, file)
+	file.Close()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not hash upload")
+		return
+	}
+
+	os.Remove(uploadSessionFile(session.ID))
+	publishUpload(c, uploadDataFile(session.ID), uploadRequest{
+		fileName:    session.FileName,
+		expectedSHA: session.SHA256,
+		expectedMD5: session.Checksum,
+		notes:       session.Notes,
+		channel:     session.Channel,
+		force:       session.Force,
+		forceReason: session.ForceReason,
+	}, digests)
+}
+
+// Admin endpoint abandoning a chunked upload
+func deleteUploadSession(c *gin.Context) {
+	session, _, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if !acquireUpload(c, session.ID) {
+		return
+	}
+	defer releaseUpload(session.ID)
+
+	os.Remove(uploadDataFile(session.ID))
+	os.Remove(uploadSessionFile(session.ID))
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,325 @@
+package httpapi
+
+import (
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/rollout"
+	"ota-server/pkg/storage"
+)
+
+// Cohorts are fixed sets of devices for experiments, such as the two arms of
+// an A/B firmware trial. A cohort is drawn once, when it is created, from the
+// known devices matching a filter: all of them, a random sample of "sample"
+// devices or a "fraction" of them. Its membership is frozen from then on, as
+// devices come and go. A cohort can be given a desired version, which its
+// devices run in preference to their group's and the fleet's; a device in
+// several cohorts follows the oldest one with a target. The fleet view lists
+// the cohorts of every device and ?cohort=<name> keeps only its members.
+
+// CohortFilter selects the devices a cohort is drawn from.
+type CohortFilter struct {
+	Group          string            `json:"group,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"` // all must match
+	Tags           []string          `json:"tags,omitempty"`       // all must be set
+	CurrentVersion string            `json:"current_version,omitempty"`
+	ExcludeCohorts []string          `json:"exclude_cohorts,omitempty"` // e.g. the other arm of an experiment
+}
+
+// Cohort is a frozen set of devices.
+type Cohort struct {
+	Filter         CohortFilter `json:"filter"`
+	Sample         int          `json:"sample,omitempty"`   // devices drawn at random
+	Fraction       float64      `json:"fraction,omitempty"` // share of the matching devices drawn at random
+	Seed           int64        `json:"seed"`               // of the random draw, to reproduce it
+	Devices        []string     `json:"devices"`
+	DesiredVersion string       `json:"desired_version,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+var cohortState = struct {
+	sync.RWMutex
+	cohorts map[string]Cohort   // by name
+	members map[string][]string // cohort names by device ID
+}{cohorts: make(map[string]Cohort), members: make(map[string][]string)}
+
+// Helper function to load the cohorts
+func initCohorts() error {
+	cohorts := make(map[string]Cohort)
+	if err := storage.ReadJSON(cohortsFile, &cohorts); err != nil {
+		return err
+	}
+	setCohorts(cohorts)
+	return nil
+}
+
+// Helper function to replace the cohorts and index their members
+func setCohorts(cohorts map[string]Cohort) {
+	members := make(map[string][]string)
+	for name, cohort := range cohorts {
+		for _, id := range cohort.Devices {
+			members[id] = append(members[id], name)
+		}
+	}
+	for _, names := range members {
+		sort.Strings(names)
+	}
+	cohortState.Lock()
+	cohortState.cohorts = cohorts
+	cohortState.members = members
+	cohortState.Unlock()
+}
+
+// Helper function to list the cohorts a device belongs to
+func deviceCohorts(id string) []string {
+	cohortState.RLock()
+	defer cohortState.RUnlock()
+	return cohortState.members[id]
+}
+
+// Helper function to find the version the cohorts of a device target, from
+// the oldest cohort with a desired version
+func cohortDesiredVersion(id string) string {
+	cohortState.RLock()
+	defer cohortState.RUnlock()
+	var version string
+	var oldest time.Time
+	for _, name := range cohortState.members[id] {
+		cohort := cohortState.cohorts[name]
+		if cohort.DesiredVersion != "" && (version == "" || cohort.CreatedAt.Before(oldest)) {
+			version, oldest = cohort.DesiredVersion, cohort.CreatedAt
+		}
+	}
+	return version
+}
+
+// Helper function to check whether a device matches a cohort filter
+func (f CohortFilter) matches(device Device) bool {
+	if f.Group != "" && device.Group != f.Group {
+		return false
+	}
+	if f.CurrentVersion != "" && catalog.CompareVersions(device.CurrentVersion, f.CurrentVersion) != 0 {
+		return false
+	}
+	for key, value := range f.Attributes {
+		if device.Attributes[key] != value {
+			return false
+		}
+	}
+	if !hasTags(&device, f.Tags) {
+		return false
+	}
+	for _, name := range f.ExcludeCohorts {
+		if slices.Contains(deviceCohorts(device.ID), name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to summarize a cohort without its member list
+func cohortSummary(name string, cohort Cohort) gin.H {
+	return gin.H{
+		"name":            name,
+		"size":            len(cohort.Devices),
+		"filter":          cohort.Filter,
+		"desired_version": cohort.DesiredVersion,
+		"created_at":      cohort.CreatedAt,
+	}
+}
+
+// Admin endpoint listing the cohorts
+func listCohorts(c *gin.Context) {
+	cohortState.RLock()
+	defer cohortState.RUnlock()
+	names := make([]string, 0, len(cohortState.cohorts))
+	for name := range cohortState.cohorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cohorts := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		cohorts = append(cohorts, cohortSummary(name, cohortState.cohorts[name]))
+	}
+	c.JSON(http.StatusOK, gin.H{"cohorts": cohorts})
+}
+
+// Admin endpoint showing a cohort with its members and their convergence to
+// their desired versions
+func getCohort(c *gin.Context) {
+	name := c.Param("name")
+	cohortState.RLock()
+	cohort, ok := cohortState.cohorts[name]
+	cohortState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "cohort not found", gin.H{"name": name})
+		return
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load groups")
+		return
+	}
+	counts := map[string]int{rollout.Converged: 0, rollout.Pending: 0, rollout.Unmanaged: 0}
+	for _, id := range cohort.Devices {
+		device, err := loadDevice(id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+			return
+		}
+		target, _ := desiredVersion(&device, groups)
+		counts[rollout.Convergence(device.CurrentVersion, target)]++
+	}
+	summary := cohortSummary(name, cohort)
+	summary["sample"], summary["fraction"], summary["seed"] = cohort.Sample, cohort.Fraction, cohort.Seed
+	summary["devices"], summary["convergence"] = cohort.Devices, counts
+	c.JSON(http.StatusOK, summary)
+}
+
+// Admin endpoint drawing a new cohort, e.g. PUT /admin/cohorts/exp-a
+// {"filter": {"group": "stores"}, "fraction": 0.1}; a cohort cannot be redrawn
+// once created
+func createCohort(c *gin.Context) {
+	name := c.Param("name")
+	if !aliasNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "cohort names start with a lowercase letter followed by letters, digits or '-'")
+		return
+	}
+	var cohort Cohort
+	if err := c.ShouldBindJSON(&cohort); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid cohort")
+		return
+	}
+	if cohort.Sample < 0 || cohort.Fraction < 0 || cohort.Fraction > 1 || (cohort.Sample > 0 && cohort.Fraction > 0) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "give either a positive sample or a fraction between 0 and 1")
+		return
+	}
+	if !desiredVersionExists(c, cohort.DesiredVersion) {
+		return
+	}
+	cohortState.RLock()
+	_, exists := cohortState.cohorts[name]
+	cohortState.RUnlock()
+	if exists {
+		respondError(c, http.StatusConflict, CodeConflict, "cohort already exists; delete it to draw it again", gin.H{"name": name})
+		return
+	}
+
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	matching := []string{}
+	for _, device := range devices {
+		if cohort.Filter.matches(device) {
+			matching = append(matching, device.ID)
+		}
+	}
+	sort.Strings(matching)
+
+	// The matching devices are shuffled with a recorded seed so that the draw
+	// can be reproduced
+	if cohort.Seed == 0 {
+		cohort.Seed = time.Now().UnixNano()
+	}
+	size := len(matching)
+	switch {
+	case cohort.Sample > 0:
+		size = min(cohort.Sample, len(matching))
+	case cohort.Fraction > 0:
+		size = int(cohort.Fraction*float64(len(matching)) + 0.5)
+	}
+	rand.New(rand.NewSource(cohort.Seed)).Shuffle(len(matching), func(i, j int) {
+		matching[i], matching[j] = matching[j], matching[i]
+	})
+	cohort.Devices = matching[:size]
+	sort.Strings(cohort.Devices)
+	cohort.CreatedAt = time.Now().UTC()
+	cohort.UpdatedAt = cohort.CreatedAt
+
+	if err := saveCohort(name, &cohort); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save cohorts")
+		return
+	}
+	c.JSON(http.StatusCreated, cohort)
+}
+
+// Admin endpoint setting the version the devices of a cohort should run,
+// e.g. {"version": "2.4.0-exp"}; an empty version clears the target
+func updateCohortDesired(c *gin.Context) {
+	name := c.Param("name")
+	var req DesiredState
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid desired state")
+		return
+	}
+	if !desiredVersionExists(c, req.Version) {
+		return
+	}
+	cohortState.RLock()
+	cohort, ok := cohortState.cohorts[name]
+	cohortState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "cohort not found", gin.H{"name": name})
+		return
+	}
+	cohort.DesiredVersion = req.Version
+	cohort.UpdatedAt = time.Now().UTC()
+	if err := saveCohort(name, &cohort); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save cohorts")
+		return
+	}
+	c.JSON(http.StatusOK, cohortSummary(name, cohort))
+}
+
+// Admin endpoint removing a cohort
+func deleteCohort(c *gin.Context) {
+	name := c.Param("name")
+	cohortState.RLock()
+	_, ok := cohortState.cohorts[name]
+	cohortState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "cohort not found", gin.H{"name": name})
+		return
+	}
+	if err := saveCohort(name, nil); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save cohorts")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// cohortsMu serializes changes to the cohorts.
+var cohortsMu sync.Mutex
+
+// Helper function to set (or with a nil cohort, remove) a cohort, persisting
+// the cohorts before devices follow them
+func saveCohort(name string, cohort *Cohort) error {
+	cohortsMu.Lock()
+	defer cohortsMu.Unlock()
+	cohortState.RLock()
+	cohorts := make(map[string]Cohort, len(cohortState.cohorts)+1)
+	for n, current := range cohortState.cohorts {
+		cohorts[n] = current
+	}
+	cohortState.RUnlock()
+	if cohort != nil {
+		cohorts[name] = *cohort
+	} else {
+		delete(cohorts, name)
+	}
+	if err := storage.WriteJSON(cohortsFile, cohorts); err != nil {
+		return err
+	}
+	setCohorts(cohorts)
+	invalidateCatalog()
+	return nil
+}
@@ -0,0 +1,196 @@
+package httpapi
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Devices can keep a WebSocket open on GET /commands?device_id=<id> (signed
+// or with a client certificate like the other device endpoints) to receive
+// commands as JSON messages instead of waiting for their next poll. The only
+// command so far is {"command": "check-update"}, sent when an operator calls
+// POST /admin/devices/<id>/check-now, e.g. to get an urgent fix out; "ping"
+// messages keep idle connections open through NATs and proxies. Devices that
+// only poll are told to check again at the rollout polling interval (see
+// polling.go) for a while after the nudge, "for" in the request (default 1h).
+
+// Commands pushed to devices
+const (
+	CommandCheckUpdate = "check-update"
+	CommandPing        = "ping"
+)
+
+const (
+	commandPingInterval = 30 * time.Second
+	commandSendTimeout  = 10 * time.Second
+	defaultCheckNowFor  = time.Hour
+)
+
+// DeviceCommand is a message pushed to a connected device.
+type DeviceCommand struct {
+	Command  string    `json:"command"`
+	Reason   string    `json:"reason,omitempty"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+var commandState = struct {
+	sync.RWMutex
+	conns map[string]map[chan DeviceCommand]bool // by device ID
+}{conns: make(map[string]map[chan DeviceCommand]bool)}
+
+var (
+	commandConnections = newGauge("ota_command_connections", "Devices connected to the command channel.")
+	commandsSent       = newCounter("ota_commands_sent_total", "Commands pushed to connected devices.")
+)
+
+// Helper function to register a connection of a device to the command channel
+func subscribeCommands(id string) chan DeviceCommand {
+	commands := make(chan DeviceCommand, 4)
+	commandState.Lock()
+	if commandState.conns[id] == nil {
+		commandState.conns[id] = make(map[chan DeviceCommand]bool)
+	}
+	commandState.conns[id][commands] = true
+	commandState.Unlock()
+	commandConnections.Add(1)
+	return commands
+}
+
+// Helper function to remove a connection from the command channel
+func unsubscribeCommands(id string, commands chan DeviceCommand) {
+	commandState.Lock()
+	delete(commandState.conns[id], commands)
+	if len(commandState.conns[id]) == 0 {
+		delete(commandState.conns, id)
+	}
+	commandState.Unlock()
+	commandConnections.Add(-1)
+}
+
+// Helper function to push a command to every connection of a device,
+// returning how many connections it was queued on
+func pushCommand(id string, command DeviceCommand) int {
+	commandState.RLock()
+	defer commandState.RUnlock()
+	delivered := 0
+	for commands := range commandState.conns[id] {
+		select {
+		case commands <- command:
+			delivered++
+		default:
+			// The connection is not keeping up; it already has commands queued
+		}
+	}
+	commandsSent.Add(int64(delivered))
+	return delivered
+}
+
+// Endpoint upgrading a device's request to its WebSocket command channel
+func deviceCommands(c *gin.Context) {
+	id := authenticatedDeviceID(c)
+	if id == "" {
+		id = c.Query("device_id")
+	} else if q := c.Query("device_id"); q != "" && q != id {
+		respondError(c, http.StatusForbidden, CodeForbidden, errDeviceMismatch.Error())
+		return
+	}
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+
+	// Devices send no Origin header, so the handshake does not check it
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		commands := subscribeCommands(id)
+		defer unsubscribeCommands(id, commands)
+
+		// Devices are not expected to send anything; reading only notices
+		// when they hang up
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		ping := time.NewTicker(commandPingInterval)
+		defer ping.Stop()
+		for {
+			var command DeviceCommand
+			select {
+			case <-closed:
+				return
+			case command = <-commands:
+			case now := <-ping.C:
+				command = DeviceCommand{Command: CommandPing, IssuedAt: now.UTC()}
+			}
+			ws.SetWriteDeadline(time.Now().Add(commandSendTimeout))
+			if err := websocket.JSON.Send(ws, command); err != nil {
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// Admin endpoint asking a device to check for updates now, e.g.
+// POST /admin/devices/gw-3/check-now {"reason": "CVE fix", "for": "30m"}.
+// Connected devices are sent a check-update command; polling devices poll
+// at the rollout interval for "for".
+func checkNow(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		For    string `json:"for"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid check-now request")
+			return
+		}
+	}
+	window := defaultCheckNowFor
+	if req.For != "" {
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d <= 0 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "for must be a positive duration such as 30m", gin.H{"field": "for"})
+			return
+		}
+		window = d
+	}
+
+	device, err := loadDevice(id)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load device")
+		return
+	}
+	if device.LastSeen.IsZero() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "device not found")
+		return
+	}
+
+	now := time.Now().UTC()
+	until := now.Add(window)
+	device, err = updateDevice(id, func(d *Device) { d.CheckNowUntil = &until })
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not update device")
+		return
+	}
+	delivered := pushCommand(id, DeviceCommand{Command: CommandCheckUpdate, Reason: req.Reason, IssuedAt: now})
+	c.JSON(http.StatusAccepted, gin.H{
+		"device_id":        id,
+		"pushed":           delivered,
+		"next_check_after": nextCheckAfter(&device),
+		"fast_poll_until":  until,
+	})
+}
@@ -0,0 +1,93 @@
+package httpapi
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Browser-based tools, like a device configurator served from the LAN, can
+// query /check-update and /download directly when their origin is listed in
+// OTA_CORS_ORIGINS (comma-separated, e.g. "https://config.example.com,
+// http://192.168.*"; "*" allows any origin). Patterns use path.Match syntax.
+// Error responses carry the CORS headers too, so the page can read them.
+
+// corsRoutes are the routes answering cross-origin requests.
+var corsRoutes = map[string]bool{
+	"/check-update": true,
+	"/download":     true,
+}
+
+const (
+	corsAllowMethods  = "GET, HEAD, OPTIONS"
+	corsAllowHeaders  = "Authorization, If-None-Match, If-Range, Range, X-Request-ID, X-API-Key, X-OTA-Device, X-OTA-Timestamp, X-OTA-Nonce, X-OTA-Signature, X-OTA-Client-Class"
+	corsExposeHeaders = "Content-Disposition, Content-Length, Content-Range, ETag, X-Request-ID, X-OTA-Mirror, X-Catalog-Revision, Repr-Digest"
+	corsMaxAge        = "600"
+)
+
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("OTA_CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+		}
+	}
+	return origins
+}
+
+// Helper function to find the Access-Control-Allow-Origin value for a
+// request's origin; empty when the origin is not allowed
+func corsAllowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, pattern := range corsOrigins() {
+		if pattern == "*" {
+			return "*"
+		}
+		if ok, _ := path.Match(pattern, strings.ToLower(origin)); ok {
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsHeaders adds the CORS response headers to cross-origin requests of the
+// CORS routes from allowed origins.
+func corsHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !corsRoutes[c.FullPath()] || c.Request.Method == http.MethodOptions {
+			return
+		}
+		if len(corsOrigins()) > 0 {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if allowed := corsAllowedOrigin(c.GetHeader("Origin")); allowed != "" {
+			c.Header("Access-Control-Allow-Origin", allowed)
+			c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+	}
+}
+
+// Endpoint answering CORS preflight requests of the CORS routes
+func corsPreflight(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Origin")
+	allowed := corsAllowedOrigin(c.GetHeader("Origin"))
+	if allowed == "" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "origin not allowed")
+		return
+	}
+	c.Header("Access-Control-Allow-Origin", allowed)
+	c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+	c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+	c.Header("Access-Control-Max-Age", corsMaxAge)
+	// Pages on public origins reaching a server on the LAN need the
+	// server's consent under Private Network Access
+	if c.GetHeader("Access-Control-Request-Private-Network") == "true" {
+		c.Header("Access-Control-Allow-Private-Network", "true")
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// A device can let its user postpone an update by reporting
+// {"status": "deferred", "version": "2.0.0", "deferred_until": "..."}. The
+// version is then not offered to the device until that time, unless the
+// release is mandatory. OTA_MAX_SNOOZES caps how many times a device may
+// defer the same version (default unlimited); once used up, the offer is
+// marked mandatory and further deferrals are ignored.
+
+// maxDeferral is the longest a single deferral may last.
+const maxDeferral = 30 * 24 * time.Hour
+
+func maxSnoozes() int {
+	if n, err := strconv.Atoi(os.Getenv("OTA_MAX_SNOOZES")); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Helper function to check whether a device has used up its deferrals of a version
+func snoozesExhausted(device *Device, version string) bool {
+	limit := maxSnoozes()
+	return limit > 0 && device != nil && device.DeferredVersion == version && device.Snoozes >= limit
+}
+
+// Helper function to get the end of a device's deferral of a version, if the
+// deferral is still running
+func activeDeferral(device *Device, version string) (time.Time, bool) {
+	if device == nil || device.DeferredVersion != version || device.DeferredUntil == nil {
+		return time.Time{}, false
+	}
+	return *device.DeferredUntil, time.Now().Before(*device.DeferredUntil)
+}
+
+// Helper function to record a deferral on a device record, reporting whether
+// it is honored. Mandatory versions and devices out of snoozes are not deferred.
+func deferUpdate(d *Device, version string, until time.Time, mandatory bool) bool {
+	if d.DeferredVersion != version {
+		d.DeferredVersion = version
+		d.DeferredUntil = nil
+		d.Snoozes = 0
+	}
+	if mandatory || snoozesExhausted(d, version) {
+		d.DeferredUntil = nil
+		return false
+	}
+	d.Snoozes++
+	d.DeferredUntil = &until
+	return true
+}
+
+// Helper function to forget a device's deferral once it installed the version
+func clearDeferral(d *Device, version string) {
+	if d.DeferredVersion == version {
+		d.DeferredVersion = ""
+		d.DeferredUntil = nil
+		d.Snoozes = 0
+	}
+}
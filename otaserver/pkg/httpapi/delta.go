@@ -0,0 +1,276 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Patches use a small copy/insert delta format:
+//
+//	"OTAD" | format version (1 byte) | target size (u64) | target sha256 (32 bytes)
+//	then a sequence of operations:
+//	'C' | source offset (u64) | length (u32)   copy bytes from the old image
+//	'I' | length (u32) | data                  insert literal bytes
+//
+// All integers are big-endian. Matching uses an rsync-style rolling checksum
+// over fixed-size blocks of the old image. Both images are streamed: the old
+// one is read at the offsets of candidate blocks, the new one through a
+// window of at most deltaMaxInsert bytes, so images of any size fit in memory.
+
+const (
+	deltaMagic     = "OTAD"
+	deltaVersion   = 1
+	deltaBlockSize = 2048
+
+	// deltaMaxInsert bounds the literal bytes held before they are written
+	deltaMaxInsert = 1 << 20
+	// deltaMaxCopy bounds the length of one copy operation
+	deltaMaxCopy = 1 << 30
+	// deltaMaxCandidates bounds the old blocks compared with one window
+	deltaMaxCandidates = 8
+)
+
+var errDeltaCorrupt = errors.New("corrupt delta")
+
+// deltaHeaderSize is the size of a patch's header.
+const deltaHeaderSize = len(deltaMagic) + 1 + 8 + sha256.Size
+
+// computeDelta writes a patch producing the newSize bytes read from newData,
+// whose SHA-256 is newDigest, from the oldSize bytes of old.
+func computeDelta(w io.Writer, old io.ReaderAt, oldSize int64, newData io.Reader, newSize int64, newDigest [sha256.Size]byte) error {
+	out := bufio.NewWriter(w)
+	out.WriteString(deltaMagic)
+	out.WriteByte(deltaVersion)
+	binary.Write(out, binary.BigEndian, uint64(newSize))
+	out.Write(newDigest[:])
+
+	index, err := indexBlocks(old, oldSize)
+	if err != nil {
+		return err
+	}
+
+	// buf holds the new bytes not yet written, from the pending literal
+	// bytes up to what was read ahead; i is the start of the window in it
+	buf := make([]byte, 0, deltaMaxInsert+2*deltaBlockSize)
+	i := 0
+	eof := false
+	fill := func(need int) error {
+		for !eof && len(buf)-i < need {
+			n, err := newData.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// consume drops the first n bytes of buf once they are written
+	consume := func(n int) {
+		buf = buf[:copy(buf, buf[n:])]
+		i -= n
+	}
+
+	scratch := make([]byte, deltaBlockSize)
+	var a, b uint32
+	rolled := false // a and b hold the checksum of the window
+	for len(index) > 0 {
+		if err := fill(deltaBlockSize + 1); err != nil {
+			return err
+		}
+		if len(buf)-i < deltaBlockSize {
+			break
+		}
+		if !rolled {
+			a, b = weakSums(buf[i : i+deltaBlockSize])
+			rolled = true
+		}
+
+		match, err := findBlock(old, index[a&0xffff|b<<16], buf[i:i+deltaBlockSize], scratch)
+		if err != nil {
+			return err
+		}
+		if match < 0 {
+			// Roll the window forward by one byte
+			if i+deltaBlockSize < len(buf) {
+				leaving, entering := uint32(buf[i]), uint32(buf[i+deltaBlockSize])
+				a = a - leaving + entering
+				b = b - deltaBlockSize*leaving + a
+			} else {
+				rolled = false
+			}
+			i++
+			if i >= deltaMaxInsert {
+				writeInsert(out, buf[:i])
+				consume(i)
+			}
+			continue
+		}
+
+		writeInsert(out, buf[:i])
+		consume(i)
+
+		// Extend the match as far as the bytes keep agreeing
+		n := int64(deltaBlockSize)
+		i = deltaBlockSize
+		for n < deltaMaxCopy && match+n < oldSize {
+			if i == len(buf) {
+				consume(i)
+				if err := fill(1); err != nil {
+					return err
+				}
+				if len(buf) == 0 {
+					break
+				}
+			}
+			m := int(min(int64(len(buf)-i), oldSize-match-n, int64(len(scratch)), deltaMaxCopy-n))
+			if _, err := old.ReadAt(scratch[:m], match+n); err != nil {
+				return err
+			}
+			k := 0
+			for k < m && scratch[k] == buf[i+k] {
+				k++
+			}
+			n += int64(k)
+			i += k
+			if k < m {
+				break
+			}
+		}
+		out.WriteByte('C')
+		binary.Write(out, binary.BigEndian, uint64(match))
+		binary.Write(out, binary.BigEndian, uint32(n))
+		consume(i)
+		rolled = false
+	}
+
+	for {
+		writeInsert(out, buf)
+		buf, i = buf[:0], 0
+		if eof {
+			break
+		}
+		if err := fill(deltaMaxInsert); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// Helper function to index the blocks of the old image by weak checksum
+func indexBlocks(old io.ReaderAt, oldSize int64) (map[uint32][]int64, error) {
+	index := make(map[uint32][]int64)
+	r := bufio.NewReaderSize(io.NewSectionReader(old, 0, oldSize), 64*1024)
+	block := make([]byte, deltaBlockSize)
+	for off := int64(0); off+deltaBlockSize <= oldSize; off += deltaBlockSize {
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		h := weakChecksum(block)
+		index[h] = append(index[h], off)
+	}
+	return index, nil
+}
+
+// Helper function to find the offset of an old block equal to window among
+// the candidates with its checksum, -1 when there is none
+func findBlock(old io.ReaderAt, candidates []int64, window, scratch []byte) (int64, error) {
+	for _, off := range candidates[:min(len(candidates), deltaMaxCandidates)] {
+		if _, err := old.ReadAt(scratch[:len(window)], off); err != nil {
+			return -1, err
+		}
+		if bytes.Equal(scratch[:len(window)], window) {
+			return off, nil
+		}
+	}
+	return -1, nil
+}
+
+func writeInsert(out *bufio.Writer, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 1<<30)
+		out.WriteByte('I')
+		binary.Write(out, binary.BigEndian, uint32(n))
+		out.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+// weakSums computes the two halves of the rolling checksum of a block.
+func weakSums(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, x := range block {
+		a += uint32(x)
+		b += uint32(len(block)-i) * uint32(x)
+	}
+	return a, b
+}
+
+func weakChecksum(block []byte) uint32 {
+	a, b := weakSums(block)
+	return a&0xffff | b<<16
+}
+
+// applyDelta writes the new image rebuilt from the old one and a patch,
+// verifying it against the size and digest recorded in the patch.
+func applyDelta(w io.Writer, old io.ReaderAt, patch io.Reader) error {
+	r := bufio.NewReader(patch)
+	header := make([]byte, deltaHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != deltaMagic || header[4] != deltaVersion {
+		return errDeltaCorrupt
+	}
+	size := binary.BigEndian.Uint64(header[5:13])
+	var want [sha256.Size]byte
+	copy(want[:], header[13:])
+
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+	var written uint64
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var n uint32
+		var src io.Reader
+		switch op {
+		case 'C':
+			var off uint64
+			if binary.Read(r, binary.BigEndian, &off) != nil || binary.Read(r, binary.BigEndian, &n) != nil {
+				return errDeltaCorrupt
+			}
+			src = io.NewSectionReader(old, int64(off), int64(n))
+		case 'I':
+			if binary.Read(r, binary.BigEndian, &n) != nil {
+				return errDeltaCorrupt
+			}
+			src = r
+		default:
+			return errDeltaCorrupt
+		}
+		if written+uint64(n) > size {
+			return errDeltaCorrupt
+		}
+		if copied, err := io.CopyN(out, src, int64(n)); err != nil {
+			if copied < int64(n) && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				return errDeltaCorrupt
+			}
+			return err
+		}
+		written += uint64(n)
+	}
+
+	if written != size || !bytes.Equal(hash.Sum(nil), want[:]) {
+		return fmt.Errorf("%w: result does not match target digest", errDeltaCorrupt)
+	}
+	return nil
+}
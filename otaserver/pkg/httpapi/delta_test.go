@@ -0,0 +1,102 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// Helper function to compute the patch from old to new
+func makeDelta(t *testing.T, old, newData []byte) []byte {
+	t.Helper()
+	var patch bytes.Buffer
+	if err := computeDelta(&patch, bytes.NewReader(old), int64(len(old)), bytes.NewReader(newData), int64(len(newData)), sha256.Sum256(newData)); err != nil {
+		t.Fatalf("computeDelta: %v", err)
+	}
+	return patch.Bytes()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	base := randomBytes(r, 3*deltaMaxInsert)
+	small := randomBytes(r, 100*deltaBlockSize)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name     string
+		old, new []byte
+		maxPatch int // 0 when the patch size does not matter
+	}{
+		{"both empty", nil, nil, deltaHeaderSize},
+		{"empty old", nil, small, 0},
+		{"empty new", small, nil, deltaHeaderSize},
+		{"identical", small, small, 64},
+		{"old shorter than a block", []byte("tiny"), small, 0},
+		{"new shorter than a block", small, []byte("tiny"), 0},
+		{"unrelated", randomBytes(r, 50*deltaBlockSize), small, 0},
+		{"byte inserted", small, join(small[:5000], []byte{0x42}, small[5000:]), 2 * deltaBlockSize},
+		{"byte changed", small, join(small[:5000], []byte{small[5000] ^ 0xff}, small[5001:]), 2 * deltaBlockSize},
+		{"prefix added", small, join([]byte("header"), small), 2 * deltaBlockSize},
+		{"suffix added", small, join(small, []byte("trailer")), 2 * deltaBlockSize},
+		{"blocks reordered", small, join(small[50*deltaBlockSize:], small[:50*deltaBlockSize]), 2 * deltaBlockSize},
+		{"block repeated", small, join(small[:10*deltaBlockSize], small[:10*deltaBlockSize], small), 2 * deltaBlockSize},
+		{"long literal run", small, join(small[:deltaBlockSize], randomBytes(r, deltaMaxInsert+12345), small[deltaBlockSize:]), 0},
+		{"large image with insert", base, join(base[:2*deltaMaxInsert], []byte("x"), base[2*deltaMaxInsert:]), 2 * deltaBlockSize},
+		{"zeros", make([]byte, 20*deltaBlockSize), make([]byte, 21*deltaBlockSize+7), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := makeDelta(t, tt.old, tt.new)
+			if tt.maxPatch > 0 && len(patch) > tt.maxPatch {
+				t.Errorf("patch is %d bytes, want at most %d", len(patch), tt.maxPatch)
+			}
+			var out bytes.Buffer
+			if err := applyDelta(&out, bytes.NewReader(tt.old), bytes.NewReader(patch)); err != nil {
+				t.Fatalf("applyDelta: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.new) {
+				t.Errorf("applyDelta rebuilt %d bytes that differ from the %d expected", out.Len(), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsCorruptPatches(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	old := randomBytes(r, 40*deltaBlockSize)
+	patch := makeDelta(t, old, append(randomBytes(r, 1000), old...))
+
+	tests := []struct {
+		name    string
+		corrupt func(p []byte) []byte
+	}{
+		{"empty", func(p []byte) []byte { return nil }},
+		{"short header", func(p []byte) []byte { return p[:deltaHeaderSize-1] }},
+		{"bad magic", func(p []byte) []byte { p[0] = 'X'; return p }},
+		{"unknown version", func(p []byte) []byte { p[4] = deltaVersion + 1; return p }},
+		{"wrong digest", func(p []byte) []byte { p[13] ^= 0xff; return p }},
+		{"wrong size", func(p []byte) []byte { p[12]++; return p }},
+		{"literal byte changed", func(p []byte) []byte { p[deltaHeaderSize+5+10] ^= 0xff; return p }},
+		{"truncated", func(p []byte) []byte { return p[:len(p)-1] }},
+		{"unknown operation", func(p []byte) []byte { return append(p, 'Z') }},
+		{"trailing copy", func(p []byte) []byte { return append(p, 'C', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupted := tt.corrupt(append([]byte(nil), patch...))
+			err := applyDelta(io.Discard, bytes.NewReader(old), bytes.NewReader(corrupted))
+			if !errors.Is(err, errDeltaCorrupt) {
+				t.Errorf("applyDelta = %v, want %v", err, errDeltaCorrupt)
+			}
+		})
+	}
+}
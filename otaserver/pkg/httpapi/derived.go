@@ -0,0 +1,239 @@
+package httpapi
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Files derived from releases, delta patches and cached offline bundles so
+// far, live outside the files directory and would outlast their releases.
+// Each kind of derived file is registered in derivedKinds with how to tell
+// the releases a file was built from; whenever the catalog is re-indexed,
+// the files whose base releases are gone (deleted, collected to fit a quota,
+// rolled back, or re-published with other bytes) are deleted, as are
+// temporary files abandoned by a crashed build. GET /admin/derived lists the
+// derived files and why any are orphaned, POST /admin/derived/gc?dry_run=true
+// shows what a collection would delete. Patches for a release restored by a
+// rollback can be rebuilt with POST /admin/jobs/delta.
+
+// derivedTempTTL is how old a temporary file left in a derived directory
+// must be before it is considered abandoned.
+const derivedTempTTL = time.Hour
+
+// DerivedFile is a file built from one or more releases.
+type DerivedFile struct {
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Bases      []string  `json:"bases,omitempty"` // app@version or release IDs it was built from
+	Orphaned   bool      `json:"orphaned"`
+	Reason     string    `json:"reason,omitempty"` // why it is orphaned
+}
+
+// liveReleases is what derived files are checked against.
+type liveReleases struct {
+	ids      map[string]bool
+	versions map[string]map[string][]string // release IDs by app and version
+}
+
+// derivedKind is a kind of derived file kept in a directory of its own.
+type derivedKind struct {
+	name string
+	dir  func() string
+	// describe tells the bases of a file of the kind and, if the file is
+	// orphaned, why; ok is false for files that are not of the kind
+	describe func(path, name string, live *liveReleases) (bases []string, orphaned string, ok bool)
+}
+
+var derivedKinds = []derivedKind{
+	{"patch", func() string { return patchesPath }, describePatch},
+	{"offline_bundle", func() string { return offlineBundlesPath }, describeOfflineBundle},
+}
+
+var derivedMu sync.Mutex
+
+var (
+	derivedCollected      = newCounter("ota_derived_collected_total", "Orphaned derived files (patches, offline bundles) deleted.")
+	derivedCollectedBytes = newCounter("ota_derived_collected_bytes_total", "Bytes freed by deleting orphaned derived files.")
+)
+
+// Helper function to gather the releases in the catalog
+func currentLiveReleases() *liveReleases {
+	live := &liveReleases{ids: make(map[string]bool), versions: make(map[string]map[string][]string)}
+	for _, app := range catalogIndex.Apps() {
+		live.versions[app] = make(map[string][]string)
+		for _, release := range catalogIndex.App(app) {
+			live.ids[release.ID] = true
+			live.versions[app][release.Version] = append(live.versions[app][release.Version], release.ID)
+		}
+	}
+	return live
+}
+
+// Helper function to describe a delta patch, named by the release IDs it
+// goes between
+func describePatch(_, name string, live *liveReleases) ([]string, string, bool) {
+	if !patchNamePattern.MatchString(name) {
+		return nil, "", false
+	}
+	from, to, _ := strings.Cut(strings.TrimSuffix(name, ".otad"), "_to_")
+	bases := []string{from, to}
+	for _, id := range bases {
+		if !live.ids[id] {
+			return bases, id + " is no longer published", true
+		}
+	}
+	return bases, "", true
+}
+
+// Helper function to describe a cached offline bundle, named by its release
+// ID and the signing key it was sealed with
+func describeOfflineBundle(_, name string, live *liveReleases) ([]string, string, bool) {
+	id, keyID, found := strings.Cut(strings.TrimSuffix(name, ".json"), "-")
+	if !found || !strings.HasSuffix(name, ".json") || !sha256Pattern.MatchString(id) {
+		return nil, "", false
+	}
+	bases := []string{id}
+	if !live.ids[id] {
+		return bases, "the release is no longer published", true
+	}
+	if !signingKeyInUse(keyID) {
+		return bases, "sealed with a signing key no longer in use", true
+	}
+	return bases, "", true
+}
+
+// Helper function to list the derived files of every kind
+func listDerivedFiles() ([]DerivedFile, error) {
+	live := currentLiveReleases()
+	now := time.Now()
+	var files []DerivedFile
+	for _, kind := range derivedKinds {
+		dir := kind.dir()
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			file := DerivedFile{Kind: kind.name, Name: entry.Name(), Size: info.Size(), ModifiedAt: info.ModTime().UTC()}
+			if catalog.IgnoredName(entry.Name()) {
+				// Builds write to a temporary file renamed into place
+				if now.Sub(info.ModTime()) < derivedTempTTL {
+					continue
+				}
+				file.Orphaned, file.Reason = true, "temporary file of an abandoned build"
+			} else {
+				bases, reason, ok := kind.describe(filepath.Join(dir, entry.Name()), entry.Name(), live)
+				if !ok {
+					continue
+				}
+				file.Bases, file.Orphaned, file.Reason = bases, reason != "", reason
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// Helper function to delete the orphaned derived files, or with dryRun only
+// list them
+func collectDerived(dryRun bool) ([]DerivedFile, error) {
+	derivedMu.Lock()
+	defer derivedMu.Unlock()
+
+	// An empty catalog more likely means the files directory is not mounted
+	// than that every release was deleted
+	if len(catalogIndex.Apps()) == 0 {
+		return []DerivedFile{}, nil
+	}
+	files, err := listDerivedFiles()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string, len(derivedKinds))
+	for _, kind := range derivedKinds {
+		dirs[kind.name] = kind.dir()
+	}
+	collected := []DerivedFile{}
+	for _, file := range files {
+		if !file.Orphaned {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dirs[file.Kind], file.Name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("collecting %s %s: %v", file.Kind, file.Name, err)
+				continue
+			}
+			log.Printf("collected %s %s: %s", file.Kind, file.Name, file.Reason)
+			derivedCollected.Add(1)
+			derivedCollectedBytes.Add(file.Size)
+		}
+		collected = append(collected, file)
+	}
+	return collected, nil
+}
+
+// Admin endpoint listing the derived files with their base releases;
+// ?orphaned=true keeps only those due for collection
+func listDerived(c *gin.Context) {
+	files, err := listDerivedFiles()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list derived files")
+		return
+	}
+	orphanedOnly := c.Query("orphaned") == "true"
+	list := []DerivedFile{}
+	var total, orphaned int64
+	for _, file := range files {
+		total += file.Size
+		if file.Orphaned {
+			orphaned += file.Size
+		} else if orphanedOnly {
+			continue
+		}
+		list = append(list, file)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Name < list[j].Name
+	})
+	c.JSON(http.StatusOK, gin.H{"files": list, "total_bytes": total, "orphaned_bytes": orphaned})
+}
+
+// Admin endpoint deleting the orphaned derived files now; ?dry_run=true only
+// lists them
+func gcDerived(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+	collected, err := collectDerived(dryRun)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not collect derived files")
+		return
+	}
+	var freed int64
+	for _, file := range collected {
+		freed += file.Size
+	}
+	c.JSON(http.StatusOK, gin.H{"dry_run": dryRun, "collected": collected, "freed_bytes": freed})
+}
@@ -0,0 +1,184 @@
+package httpapi
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/rollout"
+	"ota-server/pkg/storage"
+)
+
+// Operators can declare the version devices should run, for a single device,
+// an experiment cohort (see cohorts.go), an update campaign (see
+// campaigns.go), a group or the whole fleet, the most specific taking
+// precedence. A device
+// with a desired version is offered exactly that version, older or newer than
+// what it runs, instead of the newest release of its channel, and nothing
+// once it has converged. The fleet view reports each device's convergence.
+
+// DesiredState is the fleet-wide desired state.
+type DesiredState struct {
+	Version string `json:"version,omitempty"`
+}
+
+var desiredState = struct {
+	sync.RWMutex
+	state DesiredState
+}{}
+
+// Helper function to load the fleet-wide desired state
+func initDesiredState() error {
+	var state DesiredState
+	if err := storage.ReadJSON(desiredStateFile, &state); err != nil {
+		return err
+	}
+	desiredState.Lock()
+	desiredState.state = state
+	desiredState.Unlock()
+	return nil
+}
+
+// Helper function to resolve the version a device should run and where the
+// target comes from ("device", "cohort", "campaign", "group" or "fleet"); empty when there is none
+func desiredVersion(device *Device, groups map[string]GroupSettings) (string, string) {
+	var deviceVersion, cohortVersion, campaignVersion, groupVersion string
+	if device != nil {
+		deviceVersion = device.DesiredVersion
+		cohortVersion = cohortDesiredVersion(device.ID)
+		campaignVersion = campaignDesiredVersion(device, time.Now())
+		groupVersion = groups[device.Group].DesiredVersion
+	}
+	desiredState.RLock()
+	defer desiredState.RUnlock()
+	return rollout.DesiredVersion(deviceVersion, cohortVersion, campaignVersion, groupVersion, desiredState.state.Version)
+}
+
+// Helper function to resolve a device's desired version, looking up the
+// group settings only when the device belongs to a group
+func deviceDesiredVersion(device *Device) string {
+	var groups map[string]GroupSettings
+	if device != nil && device.Group != "" {
+		groups = map[string]GroupSettings{device.Group: loadGroup(device.Group)}
+	}
+	version, _ := desiredVersion(device, groups)
+	return version
+}
+
+// Helper function to check that a desired version has been published,
+// responding 404 when it has not; an empty version clears the target
+func desiredVersionExists(c *gin.Context, version string) bool {
+	if version == "" {
+		return true
+	}
+	if _, ok := catalogIndex.Version("plugin", catalog.DefaultChannel, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"version": version})
+		return false
+	}
+	return true
+}
+
+// Admin endpoint showing the fleet-wide desired version and how many devices
+// have converged
+func getDesiredState(c *gin.Context) {
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load groups")
+		return
+	}
+
+	counts := map[string]int{rollout.Converged: 0, rollout.Pending: 0, rollout.Unmanaged: 0}
+	for i := range devices {
+		desired, _ := desiredVersion(&devices[i], groups)
+		counts[rollout.Convergence(devices[i].CurrentVersion, desired)]++
+	}
+
+	desiredState.RLock()
+	defer desiredState.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"fleet": desiredState.state, "convergence": counts})
+}
+
+// Admin endpoint setting the version the whole fleet should run, e.g.
+// {"version": "2.3.1"}; an empty version returns the fleet to following the
+// newest release of each channel
+func updateDesiredState(c *gin.Context) {
+	var state DesiredState
+	if err := c.ShouldBindJSON(&state); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid desired state")
+		return
+	}
+	if !desiredVersionExists(c, state.Version) {
+		return
+	}
+
+	desiredState.Lock()
+	defer desiredState.Unlock()
+	if err := storage.WriteJSON(desiredStateFile, state); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save desired state")
+		return
+	}
+	if state.Version != desiredState.state.Version {
+		notifyRollout(state.Version, "")
+	}
+	desiredState.state = state
+	c.JSON(http.StatusOK, state)
+}
+
+// Admin endpoint setting the version one device should run, e.g.
+// {"version": "2.3.1"}; an empty version clears the override
+func updateDeviceDesired(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	var req DesiredState
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid desired state")
+		return
+	}
+	if !desiredVersionExists(c, req.Version) {
+		return
+	}
+
+	device, err := updateDevice(id, func(d *Device) { d.DesiredVersion = req.Version })
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not update device")
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// FleetDevice is a device in the fleet view with its convergence status.
+type FleetDevice struct {
+	Device
+	TargetVersion string   `json:"target_version,omitempty"`
+	TargetSource  string   `json:"target_source,omitempty"`
+	Convergence   string   `json:"convergence"`
+	Deferred      bool     `json:"deferred,omitempty"` // the user deferred the update
+	Cohorts       []string `json:"cohorts,omitempty"`
+}
+
+// Helper function to build the fleet view of devices, sorted by ID
+func fleetView(devices []Device) ([]FleetDevice, error) {
+	groups, err := loadGroups()
+	if err != nil {
+		return nil, err
+	}
+	view := make([]FleetDevice, 0, len(devices))
+	for _, device := range devices {
+		target, source := desiredVersion(&device, groups)
+		_, deferred := activeDeferral(&device, device.DeferredVersion)
+		view = append(view, FleetDevice{Device: device, TargetVersion: target, TargetSource: source, Convergence: rollout.Convergence(device.CurrentVersion, target), Deferred: deferred, Cohorts: deviceCohorts(device.ID)})
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].ID < view[j].ID })
+	return view, nil
+}
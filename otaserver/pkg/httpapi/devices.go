@@ -0,0 +1,333 @@
+package httpapi
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// defaultMaxDevices caps the device records unauthenticated requests create.
+const defaultMaxDevices = 100000
+
+var (
+	errInvalidDeviceID  = errors.New("device_id may only contain letters, digits, '.', '_', ':' and '-'")
+	errInvalidTimezone  = errors.New("timezone must be an IANA zone name such as Europe/Berlin")
+	errDeviceUnverified = errors.New("unknown devices must authenticate")
+	errDeviceLimit      = errors.New("the server is not accepting new devices")
+)
+
+var devicesRefused = newCounter("ota_devices_refused_total", "Device records not created because the device did not authenticate or the device limit was reached.")
+
+// Device is the server-side record of a device that has checked in.
+type Device struct {
+	ID             string    `json:"id"`
+	Group          string    `json:"group,omitempty"`
+	Timezone       string    `json:"timezone,omitempty"`
+	Model          string    `json:"model,omitempty"` // hardware model, see versionfloors.go
+	CurrentVersion string    `json:"current_version,omitempty"`
+	Channel        string    `json:"channel,omitempty"` // of the last check, stable when empty
+	LastSeen       time.Time `json:"last_seen"`
+
+	// Apps holds the versions of apps other than the plugin the device
+	// reported, by app
+	Apps map[string]string `json:"apps,omitempty"`
+
+	// Attributes are set by operators for release field templates, see fields.go
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Tags are set by operators in bulk for targeting, see tags.go
+	Tags []string `json:"tags,omitempty"`
+
+	// Download attempts of PendingVersion since the last successful install
+	PendingVersion   string         `json:"pending_version,omitempty"`
+	DownloadAttempts int            `json:"download_attempts,omitempty"`
+	Stuck            bool           `json:"stuck,omitempty"`
+	LastReport       *InstallReport `json:"last_report,omitempty"`
+
+	// DesiredVersion is the version operators want this device to run,
+	// overriding its group's and the fleet's
+	DesiredVersion string `json:"desired_version,omitempty"`
+
+	// Deferral of DeferredVersion by the device's user, and how many times
+	// it was deferred
+	DeferredVersion string     `json:"deferred_version,omitempty"`
+	DeferredUntil   *time.Time `json:"deferred_until,omitempty"`
+	Snoozes         int        `json:"snoozes,omitempty"`
+
+	// CheckNowUntil is when the device goes back to the regular polling
+	// interval after an operator asked it to check now, see commands.go
+	CheckNowUntil *time.Time `json:"check_now_until,omitempty"`
+
+	// Progress is the install in flight the device last reported, see progress.go
+	Progress *InstallProgress `json:"progress,omitempty"`
+}
+
+// GroupSettings are defaults shared by every device in a group.
+type GroupSettings struct {
+	Timezone       string `json:"timezone,omitempty"`
+	DesiredVersion string `json:"desired_version,omitempty"`
+}
+
+func deviceFile(id string) string {
+	return filepath.Join(devicesPath, id+".json")
+}
+
+// Helper function to record a device check-in from the device_id, group,
+// timezone and channel query parameters and the normalized version the device runs. A
+// verified client certificate determines the device ID. Requests without a
+// device_id are anonymous and return a nil device.
+func recordCheckIn(c *gin.Context, app, currentVersion string) (*Device, error) {
+	return recordDeviceCheckIn(c, checkIn{
+		DeviceID:       c.Query("device_id"),
+		Group:          c.Query("group"),
+		Timezone:       c.Query("timezone"),
+		Model:          c.Query("model"),
+		Channel:        c.Query("channel"),
+		CurrentVersion: currentVersion,
+		App:            app,
+	})
+}
+
+// checkIn is what a device tells the server when it checks for updates.
+// CurrentVersion is the version of App, the plugin when empty.
+type checkIn struct {
+	DeviceID       string `json:"device_id"`
+	Group          string `json:"group"`
+	Timezone       string `json:"timezone"`
+	Model          string `json:"model,omitempty"`
+	Channel        string `json:"channel"`
+	CurrentVersion string `json:"current_version"`
+	App            string `json:"app"`
+}
+
+// Helper function to record a check-in on behalf of the device named in it,
+// which must match the device the request is authenticated as, if any
+func recordDeviceCheckIn(c *gin.Context, in checkIn) (*Device, error) {
+	id := in.DeviceID
+	if authID := authenticatedDeviceID(c); authID != "" {
+		if id != "" && id != authID {
+			return nil, errDeviceMismatch
+		}
+		id = authID
+	}
+	if id == "" {
+		return nil, nil
+	}
+	if !deviceIDPattern.MatchString(id) {
+		return nil, errInvalidDeviceID
+	}
+	// The group, time zone and model decide what the device is offered, down
+	// to its version floor; with device auth only the device itself sets them
+	if deviceAuthEnabled() && authenticatedDeviceID(c) == "" {
+		in.Group, in.Timezone, in.Model = "", "", ""
+	}
+
+	if in.Timezone != "" {
+		if _, err := time.LoadLocation(in.Timezone); err != nil {
+			return nil, errInvalidTimezone
+		}
+	}
+
+	// Anonymous devices are only counted; the record lives for this request
+	if anonymousMode() {
+		device := &Device{Group: in.Group, Timezone: in.Timezone, Model: in.Model}
+		setAppVersion(device, in.App, in.CurrentVersion)
+		countCheckIn(id, device.CurrentVersion)
+		return device, nil
+	}
+
+	// Devices that may not get a record are served like anonymous ones
+	if err := admitDevice(c, id); err != nil {
+		return nil, nil
+	}
+	device, _, err := saveDeviceEvent(DeviceEvent{Kind: eventCheckIn, DeviceID: id, At: time.Now().UTC(), CheckIn: &in})
+	if err != nil {
+		log.Printf("recording the check-in of %s: %v", id, err)
+		return nil, err
+	}
+	return &device, nil
+}
+
+func maxDevices() int {
+	if n, err := strconv.Atoi(os.Getenv("OTA_MAX_DEVICES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxDevices
+}
+
+// Helper function to decide whether a request may create the record of the
+// device it names. Authenticated devices always may. With device auth on,
+// unauthenticated requests only reach records that exist; without it anyone
+// can name a device, so at most OTA_MAX_DEVICES (default 100000) records are
+// created that way.
+func admitDevice(c *gin.Context, id string) error {
+	if authenticatedDeviceID(c) != "" || deviceKnown(id) {
+		return nil
+	}
+	if deviceAuthEnabled() {
+		devicesRefused.Add(1)
+		return errDeviceUnverified
+	}
+	if deviceCount() >= maxDevices() {
+		devicesRefused.Add(1)
+		return errDeviceLimit
+	}
+	return nil
+}
+
+// Helper function to tell whether devices authenticate, with client
+// certificates of the enrollment CA or signed requests
+func deviceAuthEnabled() bool {
+	return requireSignedRequests() || (os.Getenv("OTA_CA_CERT_FILE") != "" && os.Getenv("OTA_CA_KEY_FILE") != "")
+}
+
+// Helper function to apply a check-in received at the given time to a
+// device record
+func applyCheckIn(d *Device, in checkIn, at time.Time) {
+	if in.Group != "" {
+		d.Group = in.Group
+	}
+	if in.Timezone != "" {
+		d.Timezone = in.Timezone
+	}
+	if in.Model != "" {
+		d.Model = in.Model
+	}
+	if in.Channel != "" && catalog.ValidChannel(in.Channel) {
+		d.Channel = in.Channel
+	}
+	setAppVersion(d, in.App, in.CurrentVersion)
+	d.LastSeen = at
+}
+
+// Helper function to get the version of an app a device last reported
+func appVersion(device *Device, app string) string {
+	if device == nil {
+		return ""
+	}
+	if app == "" || app == "plugin" {
+		return device.CurrentVersion
+	}
+	return device.Apps[app]
+}
+
+// Helper function to record the version of an app a device runs; empty
+// versions are ignored
+func setAppVersion(d *Device, app, version string) {
+	switch {
+	case version == "":
+	case app == "" || app == "plugin":
+		d.CurrentVersion = version
+	default:
+		if d.Apps == nil {
+			d.Apps = make(map[string]string)
+		}
+		d.Apps[app] = version
+	}
+}
+
+// Helper function to record the versions of several apps a device reported,
+// e.g. the components of a bundle check
+func recordAppVersions(device *Device, versions map[string]string) (*Device, error) {
+	if device == nil || len(versions) == 0 {
+		return device, nil
+	}
+	if device.ID == "" {
+		for app, version := range versions {
+			setAppVersion(device, app, version)
+		}
+		return device, nil
+	}
+	updated, err := updateDevice(device.ID, func(d *Device) {
+		for app, version := range versions {
+			setAppVersion(d, app, version)
+		}
+	})
+	return &updated, err
+}
+
+// Helper function to resolve the time zone of a device: its own reported
+// zone, then its group's configured zone, then UTC
+func deviceLocation(device *Device) *time.Location {
+	if device == nil {
+		return time.UTC
+	}
+
+	timezone := device.Timezone
+	if timezone == "" && device.Group != "" {
+		timezone = loadGroup(device.Group).Timezone
+	}
+	if loc, err := time.LoadLocation(timezone); err == nil && timezone != "" {
+		return loc
+	}
+	return time.UTC
+}
+
+// Admin endpoint to show a device record
+func getDevice(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+
+	device, err := loadDevice(id)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load device")
+		return
+	}
+	if device.LastSeen.IsZero() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "device not found")
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// Admin endpoint to list group settings
+func listGroups(c *gin.Context) {
+	groups, err := loadGroups()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load groups")
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// Admin endpoint to configure a group, e.g. {"timezone": "Europe/Berlin",
+// "desired_version": "2.3.1"}
+func updateGroup(c *gin.Context) {
+	var settings GroupSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid group settings")
+		return
+	}
+	if settings.Timezone != "" {
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidTimezone.Error())
+			return
+		}
+	}
+	if !desiredVersionExists(c, settings.DesiredVersion) {
+		return
+	}
+
+	previous, err := saveGroup(c.Param("group"), settings)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save groups")
+		return
+	}
+	if settings.DesiredVersion != previous.DesiredVersion {
+		notifyRollout(settings.DesiredVersion, c.Param("group"))
+	}
+	c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,116 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to replace the device records for the duration of a test
+func withDevices(t *testing.T, devices ...Device) {
+	t.Helper()
+	withStateDirs(t, nil)
+	for i := range deviceStore {
+		deviceStore[i].devices = make(map[string]Device)
+		deviceStore[i].dirty = make(map[string]bool)
+	}
+	for _, device := range devices {
+		updateDevice(device.ID, func(d *Device) { *d = device })
+	}
+	t.Cleanup(func() {
+		for i := range deviceStore {
+			deviceStore[i].devices = make(map[string]Device)
+			deviceStore[i].dirty = make(map[string]bool)
+		}
+		fleetSummary.Lock()
+		clear(fleetSummary.devices)
+		clear(fleetSummary.counts)
+		fleetSummary.Unlock()
+	})
+}
+
+func TestAdmitDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       string
+		maxDevices string
+		signedAs   string
+		id         string
+		wantErr    error
+	}{
+		{"new device", "", "", "", "pos-3", nil},
+		{"known device", "", "2", "", "pos-1", nil},
+		{"new device beyond the limit", "", "2", "", "pos-3", errDeviceLimit},
+		{"new device below the limit", "", "3", "", "pos-3", nil},
+		{"known device without authenticating", "hmac", "", "", "pos-1", nil},
+		{"new device without authenticating", "hmac", "", "", "pos-3", errDeviceUnverified},
+		{"new device that authenticated", "hmac", "2", "pos-3", "pos-3", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDevices(t, Device{ID: "pos-1"}, Device{ID: "pos-2"})
+			t.Setenv("OTA_DEVICE_AUTH", tt.auth)
+			t.Setenv("OTA_MAX_DEVICES", tt.maxDevices)
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/check-update?device_id="+tt.id, nil)
+			if tt.signedAs != "" {
+				c.Set("signed_device_id", tt.signedAs)
+			}
+			if err := admitDevice(c, tt.id); !errors.Is(err, tt.wantErr) {
+				t.Errorf("admitDevice = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckInsOfRefusedDevicesLeaveNoRecord(t *testing.T) {
+	withDevices(t, Device{ID: "pos-1"})
+	t.Setenv("OTA_MAX_DEVICES", "1")
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/check-update?device_id=made-up-1", nil)
+	device, err := recordCheckIn(c, "plugin", "1.0.0")
+	if err != nil || device != nil {
+		t.Fatalf("recordCheckIn = %v, %v, want an anonymous check", device, err)
+	}
+	if deviceKnown("made-up-1") {
+		t.Error("a record was created beyond OTA_MAX_DEVICES")
+	}
+}
+
+func TestExpireDevices(t *testing.T) {
+	now := time.Now().UTC()
+	old, recent := now.Add(-100*24*time.Hour), now.Add(-time.Hour)
+	withDevices(t,
+		Device{ID: "old", LastSeen: old},
+		Device{ID: "never-seen"},
+		Device{ID: "recent", LastSeen: recent},
+		Device{ID: "old-desired", LastSeen: old, DesiredVersion: "2.0.0"},
+		Device{ID: "old-tagged", LastSeen: old, Tags: []string{"lab"}},
+		Device{ID: "old-attributes", LastSeen: old, Attributes: map[string]string{"model": "m1"}},
+	)
+	if err := flushDevices(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := expireDevices(now.Add(-90 * 24 * time.Hour)); n != 2 {
+		t.Errorf("expireDevices = %d, want 2", n)
+	}
+	for id, want := range map[string]bool{"old": false, "never-seen": false, "recent": true, "old-desired": true, "old-tagged": true, "old-attributes": true} {
+		if got := deviceKnown(id); got != want {
+			t.Errorf("deviceKnown(%q) = %v, want %v", id, got, want)
+		}
+		if _, err := os.Stat(deviceFile(id)); (err == nil) != want {
+			t.Errorf("record file of %q: %v, want kept %v", id, err, want)
+		}
+	}
+	fleetSummary.RLock()
+	_, summarized := fleetSummary.devices["old"]
+	fleetSummary.RUnlock()
+	if summarized {
+		t.Error("the fleet summary still counts an expired device")
+	}
+}
@@ -0,0 +1,355 @@
+package httpapi
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ota-server/pkg/storage"
+)
+
+// Device records live in memory, loaded from metadata/devices at startup and
+// split over deviceShards shards so that check-ins of different devices do
+// not wait for each other. Changed records are written back in batches every
+// OTA_DEVICE_FLUSH_INTERVAL (default 1s) and when the server shuts down; a
+// record that cannot be written stays pending and is tried again with the
+// next batch. Group settings are kept in memory too and re-read on reload.
+//
+// Records of devices that have not been heard from for OTA_DEVICE_EXPIRY
+// (default 90 days) and hold nothing operators set (a desired version,
+// attributes or tags) are dropped, so that device IDs made up by
+// unauthenticated clients do not stay forever; see admitDevice for how many
+// can be created.
+
+const (
+	deviceShards               = 64
+	defaultDeviceFlushInterval = time.Second
+	defaultDeviceExpiry        = 90 * 24 * time.Hour
+	deviceExpiryInterval       = time.Hour
+)
+
+type deviceShard struct {
+	sync.Mutex
+	devices map[string]Device // by ID; records are replaced, never changed in place
+	dirty   map[string]bool   // IDs of records changed since they were written
+}
+
+var deviceStore [deviceShards]deviceShard
+
+// deviceFlush serializes writing the device records back, so that an older
+// copy of a record is never written after a newer one.
+var deviceFlush struct {
+	sync.Mutex
+	lastError string
+	failing   atomic.Bool // the last batch left records unwritten
+}
+
+// groupSettings holds the settings of every group, by group.
+var groupSettings = struct {
+	sync.RWMutex
+	groups map[string]GroupSettings
+}{groups: make(map[string]GroupSettings)}
+
+var devicesUnsaved = newGauge("ota_devices_unsaved", "Device records changed in memory and not yet written to the state directory.")
+
+// Helper function to get the shard of a device
+func deviceShardOf(id string) *deviceShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &deviceStore[h.Sum32()%deviceShards]
+}
+
+// Helper function to load the device records and group settings and start
+// writing changed records back
+func initDevices() error {
+	for i := range deviceStore {
+		deviceStore[i].devices = make(map[string]Device)
+		deviceStore[i].dirty = make(map[string]bool)
+	}
+	entries, err := os.ReadDir(devicesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		device := Device{ID: strings.TrimSuffix(entry.Name(), ".json")}
+		if err := storage.ReadJSON(filepath.Join(devicesPath, entry.Name()), &device); err != nil {
+			return err
+		}
+		deviceShardOf(device.ID).devices[device.ID] = device
+	}
+	if err := initGroups(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(envDuration("OTA_DEVICE_FLUSH_INTERVAL", defaultDeviceFlushInterval)) {
+			flushDevices()
+		}
+	}()
+	go func() {
+		for range time.Tick(deviceExpiryInterval) {
+			expiry := envDuration("OTA_DEVICE_EXPIRY", defaultDeviceExpiry)
+			if n := expireDevices(time.Now().Add(-expiry)); n > 0 {
+				log.Printf("dropped %d device records not seen for %s", n, expiry)
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to load the group settings
+func initGroups() error {
+	groups := make(map[string]GroupSettings)
+	if err := storage.ReadJSON(groupsFile, &groups); err != nil {
+		return err
+	}
+	groupSettings.Lock()
+	groupSettings.groups = groups
+	groupSettings.Unlock()
+	return nil
+}
+
+// Helper function to copy a device record, so that changing the copy leaves
+// the record alone. Telemetry values and percentages are replaced rather than
+// changed in place and are shared.
+func cloneDevice(d Device) Device {
+	if d.Apps != nil {
+		apps := make(map[string]string, len(d.Apps))
+		for app, version := range d.Apps {
+			apps[app] = version
+		}
+		d.Apps = apps
+	}
+	if d.Attributes != nil {
+		attributes := make(map[string]string, len(d.Attributes))
+		for name, value := range d.Attributes {
+			attributes[name] = value
+		}
+		d.Attributes = attributes
+	}
+	if d.Tags != nil {
+		d.Tags = append([]string(nil), d.Tags...)
+	}
+	if d.LastReport != nil {
+		report := *d.LastReport
+		if report.Stages != nil {
+			report.Stages = append([]ProgressStage(nil), report.Stages...)
+		}
+		d.LastReport = &report
+	}
+	if d.Progress != nil {
+		progress := *d.Progress
+		if progress.Stages != nil {
+			progress.Stages = append([]ProgressStage(nil), progress.Stages...)
+		}
+		d.Progress = &progress
+	}
+	if d.DeferredUntil != nil {
+		until := *d.DeferredUntil
+		d.DeferredUntil = &until
+	}
+	if d.CheckNowUntil != nil {
+		until := *d.CheckNowUntil
+		d.CheckNowUntil = &until
+	}
+	return d
+}
+
+// Helper function to write the device records changed since they were last
+// written, returning the last error; records that fail stay pending
+func flushDevices() error {
+	deviceFlush.Lock()
+	defer deviceFlush.Unlock()
+
+	mark := eventWALMark()
+	var lastErr error
+	unsaved := 0
+	for i := range deviceStore {
+		shard := &deviceStore[i]
+		shard.Lock()
+		pending := make([]Device, 0, len(shard.dirty))
+		for id := range shard.dirty {
+			pending = append(pending, shard.devices[id])
+		}
+		clear(shard.dirty)
+		shard.Unlock()
+
+		for _, device := range pending {
+			if err := storage.WriteJSON(deviceFile(device.ID), device); err != nil {
+				lastErr = err
+				shard.Lock()
+				shard.dirty[device.ID] = true
+				shard.Unlock()
+				unsaved++
+			}
+		}
+	}
+	devicesUnsaved.Set(int64(unsaved))
+	deviceFlush.failing.Store(lastErr != nil)
+	eventWALWritten(mark, lastErr)
+
+	msg := ""
+	if lastErr != nil {
+		msg = lastErr.Error()
+	}
+	if msg != deviceFlush.lastError {
+		if lastErr != nil {
+			log.Printf("saving device records: %d pending: %v", unsaved, lastErr)
+		} else {
+			log.Printf("saving device records: all pending records saved")
+		}
+		deviceFlush.lastError = msg
+	}
+	return lastErr
+}
+
+// Helper function to tell whether the last batch could not write every
+// pending device record
+func devicesUnwritable() bool {
+	return deviceFlush.failing.Load()
+}
+
+// Helper function to load a device record; unknown devices yield an empty record
+func loadDevice(id string) (Device, error) {
+	shard := deviceShardOf(id)
+	shard.Lock()
+	defer shard.Unlock()
+	device, ok := shard.devices[id]
+	if !ok {
+		return Device{ID: id}, nil
+	}
+	return cloneDevice(device), nil
+}
+
+// Helper function to tell whether a device has a record
+func deviceKnown(id string) bool {
+	shard := deviceShardOf(id)
+	shard.Lock()
+	defer shard.Unlock()
+	_, ok := shard.devices[id]
+	return ok
+}
+
+// Helper function to count the device records
+func deviceCount() int {
+	n := 0
+	for i := range deviceStore {
+		shard := &deviceStore[i]
+		shard.Lock()
+		n += len(shard.devices)
+		shard.Unlock()
+	}
+	return n
+}
+
+// Helper function to drop the records of devices last seen before a time
+// that hold nothing operators set, returning how many were dropped
+func expireDevices(before time.Time) int {
+	// A batch in flight could otherwise write a dropped record back
+	deviceFlush.Lock()
+	defer deviceFlush.Unlock()
+
+	expired := 0
+	for i := range deviceStore {
+		shard := &deviceStore[i]
+		shard.Lock()
+		var ids []string
+		for id, device := range shard.devices {
+			if device.LastSeen.Before(before) && device.DesiredVersion == "" && len(device.Attributes) == 0 && len(device.Tags) == 0 {
+				delete(shard.devices, id)
+				delete(shard.dirty, id)
+				forgetDevice(id)
+				ids = append(ids, id)
+			}
+		}
+		shard.Unlock()
+
+		for _, id := range ids {
+			if err := os.Remove(deviceFile(id)); err != nil && !os.IsNotExist(err) {
+				log.Printf("removing the expired record of %s: %v", id, err)
+			}
+		}
+		expired += len(ids)
+	}
+	return expired
+}
+
+// Helper function to apply a change to a device record atomically; the
+// record is written to the state directory with the next batch
+func updateDevice(id string, update func(*Device)) (Device, error) {
+	shard := deviceShardOf(id)
+	shard.Lock()
+	defer shard.Unlock()
+
+	device, ok := shard.devices[id]
+	if ok {
+		device = cloneDevice(device)
+	} else {
+		device = Device{ID: id}
+	}
+	update(&device)
+	shard.devices[id] = device
+	shard.dirty[id] = true
+	observeDevice(device)
+	return cloneDevice(device), nil
+}
+
+// Helper function to load every device record, by ID
+func listDevices() ([]Device, error) {
+	devices := []Device{}
+	for i := range deviceStore {
+		shard := &deviceStore[i]
+		shard.Lock()
+		for _, device := range shard.devices {
+			devices = append(devices, cloneDevice(device))
+		}
+		shard.Unlock()
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+// Helper function to load all group settings
+func loadGroups() (map[string]GroupSettings, error) {
+	groupSettings.RLock()
+	defer groupSettings.RUnlock()
+	groups := make(map[string]GroupSettings, len(groupSettings.groups))
+	for name, settings := range groupSettings.groups {
+		groups[name] = settings
+	}
+	return groups, nil
+}
+
+// Helper function to get the settings of one group
+func loadGroup(name string) GroupSettings {
+	groupSettings.RLock()
+	defer groupSettings.RUnlock()
+	return groupSettings.groups[name]
+}
+
+// Helper function to change the settings of a group and save them all,
+// returning the previous settings
+func saveGroup(name string, settings GroupSettings) (GroupSettings, error) {
+	groupSettings.Lock()
+	defer groupSettings.Unlock()
+	groups := make(map[string]GroupSettings, len(groupSettings.groups)+1)
+	for n, s := range groupSettings.groups {
+		groups[n] = s
+	}
+	previous := groups[name]
+	groups[name] = settings
+	if err := storage.WriteJSON(groupsFile, groups); err != nil {
+		return previous, err
+	}
+	groupSettings.groups = groups
+	return previous, nil
+}
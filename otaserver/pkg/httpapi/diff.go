@@ -0,0 +1,217 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// maxWasmDiffSize is the size up to which wasm modules are parsed to compare
+// their sections and symbols.
+const maxWasmDiffSize = 64 << 20
+
+// SectionDiff compares one wasm section between two artifacts.
+type SectionDiff struct {
+	Name     string `json:"name"`
+	FromSize int    `json:"from_size"`
+	ToSize   int    `json:"to_size"`
+	Changed  bool   `json:"changed"`
+}
+
+// WasmDiff holds the wasm-specific part of an artifact comparison.
+type WasmDiff struct {
+	Sections       []SectionDiff `json:"sections"`
+	AddedSymbols   []string      `json:"added_symbols"`
+	RemovedSymbols []string      `json:"removed_symbols"`
+}
+
+// ArtifactDiff is the response of the admin diff endpoint.
+type ArtifactDiff struct {
+	App                string    `json:"app"`
+	From               string    `json:"from"`
+	To                 string    `json:"to"`
+	FromSize           int       `json:"from_size"`
+	ToSize             int       `json:"to_size"`
+	SizeDelta          int       `json:"size_delta"`
+	SizeDeltaPercent   float64   `json:"size_delta_percent"`
+	EstimatedPatchSize int       `json:"estimated_patch_size"`
+	Wasm               *WasmDiff `json:"wasm,omitempty"`
+}
+
+// Admin endpoint comparing two versions of an app's channel (?channel=,
+// stable by default) before publishing
+func diffVersions(c *gin.Context) {
+	app := c.DefaultQuery("app", "plugin")
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	from := c.Query("from")
+	to := c.Query("to")
+	if from == "" || to == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "from and to are required")
+		return
+	}
+
+	fromFile, err := openArtifact(app, channel, from)
+	if err != nil {
+		respondArtifactError(c, from, err)
+		return
+	}
+	defer fromFile.Close()
+	toFile, err := openArtifact(app, channel, to)
+	if err != nil {
+		respondArtifactError(c, to, err)
+		return
+	}
+	defer toFile.Close()
+	fromSize, toSize, err := fileSizes(fromFile, toFile)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read artifact")
+		return
+	}
+
+	estimate, err := estimatePatchSize(fromFile, fromSize, toFile, toSize)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read artifact")
+		return
+	}
+	diff := ArtifactDiff{
+		App:                app,
+		From:               from,
+		To:                 to,
+		FromSize:           int(fromSize),
+		ToSize:             int(toSize),
+		SizeDelta:          int(toSize - fromSize),
+		EstimatedPatchSize: int(estimate),
+	}
+	if fromSize > 0 {
+		diff.SizeDeltaPercent = float64(diff.SizeDelta) * 100 / float64(fromSize)
+	}
+
+	if fromSize <= maxWasmDiffSize && toSize <= maxWasmDiffSize {
+		fromData, err := io.ReadAll(io.NewSectionReader(fromFile, 0, fromSize))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read artifact")
+			return
+		}
+		toData, err := io.ReadAll(io.NewSectionReader(toFile, 0, toSize))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read artifact")
+			return
+		}
+		if isWasm(fromData) && isWasm(toData) {
+			wasmDiff, err := diffWasm(fromData, toData)
+			if err != nil {
+				respondError(c, http.StatusUnprocessableEntity, CodeValidationFailed, "Could not parse wasm module: "+err.Error())
+				return
+			}
+			diff.Wasm = wasmDiff
+		}
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// Helper function to open the artifact of a version of an app's channel
+func openArtifact(app, channel, version string) (*os.File, error) {
+	release, ok := catalogIndex.Version(app, channel, version)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(artifacts.ArtifactPath(release.FileName))
+}
+
+// Helper function to get the sizes of two open files
+func fileSizes(from, to *os.File) (int64, int64, error) {
+	fromInfo, err := from.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	toInfo, err := to.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return fromInfo.Size(), toInfo.Size(), nil
+}
+
+func respondArtifactError(c *gin.Context, version string, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"version": version})
+		return
+	}
+	respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read artifact")
+}
+
+// byteCounter counts the bytes written to it and drops them.
+type byteCounter int64
+
+func (w *byteCounter) Write(p []byte) (int, error) {
+	*w += byteCounter(len(p))
+	return len(p), nil
+}
+
+// estimatePatchSize computes the size of the delta patch between two
+// artifacts, see delta.go, without keeping it; insertions and moves only
+// cost the bytes that actually changed.
+func estimatePatchSize(from io.ReaderAt, fromSize int64, to io.Reader, toSize int64) (int64, error) {
+	var size byteCounter
+	if err := computeDelta(&size, from, fromSize, to, toSize, [sha256.Size]byte{}); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// diffWasm compares the sections and symbols of two wasm modules.
+func diffWasm(fromData, toData []byte) (*WasmDiff, error) {
+	fromModule, err := parseWasm(fromData)
+	if err != nil {
+		return nil, err
+	}
+	toModule, err := parseWasm(toData)
+	if err != nil {
+		return nil, err
+	}
+
+	fromSections := make(map[string]WasmSection)
+	for _, s := range fromModule.Sections {
+		fromSections[s.Name] = s
+	}
+
+	diff := &WasmDiff{AddedSymbols: []string{}, RemovedSymbols: []string{}}
+	seen := make(map[string]bool)
+	for _, s := range toModule.Sections {
+		seen[s.Name] = true
+		old, ok := fromSections[s.Name]
+		diff.Sections = append(diff.Sections, SectionDiff{
+			Name:     s.Name,
+			FromSize: old.Size,
+			ToSize:   s.Size,
+			Changed:  !ok || !bytes.Equal(old.Digest[:], s.Digest[:]),
+		})
+	}
+	for _, s := range fromModule.Sections {
+		if !seen[s.Name] {
+			diff.Sections = append(diff.Sections, SectionDiff{Name: s.Name, FromSize: s.Size, Changed: true})
+		}
+	}
+
+	for symbol := range toModule.Symbols {
+		if !fromModule.Symbols[symbol] {
+			diff.AddedSymbols = append(diff.AddedSymbols, symbol)
+		}
+	}
+	for symbol := range fromModule.Symbols {
+		if !toModule.Symbols[symbol] {
+			diff.RemovedSymbols = append(diff.RemovedSymbols, symbol)
+		}
+	}
+	sort.Strings(diff.AddedSymbols)
+	sort.Strings(diff.RemovedSymbols)
+
+	return diff, nil
+}
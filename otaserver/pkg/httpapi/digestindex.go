@@ -0,0 +1,71 @@
+package httpapi
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"ota-server/pkg/catalog"
+)
+
+// Building the catalog hashes every artifact not hashed before, on
+// OTA_HASH_WORKERS workers (default: one per CPU). The digests are saved to
+// digest_index.json in the state directory whenever new ones were computed
+// and loaded at startup, so a restart only hashes the files added or changed
+// (in size or modification time) since.
+
+var digestIndexState struct {
+	sync.Mutex
+	saved uint64 // catalog.DigestsHashed() when the index was last saved
+}
+
+// Helper function to configure the hashing workers and load the digest
+// index saved by the previous run
+func initDigestIndex() error {
+	if n, err := strconv.Atoi(os.Getenv("OTA_HASH_WORKERS")); err == nil && n > 0 {
+		catalog.SetHashWorkers(n)
+	}
+	loaded, err := artifacts.LoadDigests(digestIndexFile)
+	if err != nil {
+		// The index only saves time; without it every file is hashed again
+		log.Printf("loading digest index: %v", err)
+		return nil
+	}
+	if loaded > 0 {
+		log.Printf("loaded %d artifact digests from %s", loaded, digestIndexFile)
+	}
+	return nil
+}
+
+// Helper function to save the digest index when digests were computed since
+// it was last saved
+func saveDigestIndex() {
+	digestIndexState.Lock()
+	defer digestIndexState.Unlock()
+	hashed := catalog.DigestsHashed()
+	if hashed == digestIndexState.saved {
+		return
+	}
+	if _, err := artifacts.SaveDigests(digestIndexFile); err != nil {
+		log.Printf("saving digest index: %v", err)
+		return
+	}
+	digestIndexState.saved = hashed
+}
+
+// Helper function to build the catalog at startup, logging how long it took
+// and how many files had to be hashed
+func timedRefreshCatalog() error {
+	start, hashed := time.Now(), catalog.DigestsHashed()
+	if err := refreshCatalog(); err != nil {
+		return err
+	}
+	releases := 0
+	for _, app := range catalogIndex.Apps() {
+		releases += len(catalogIndex.App(app))
+	}
+	log.Printf("indexed %d releases in %s, hashing %d files", releases, time.Since(start).Round(time.Millisecond), catalog.DigestsHashed()-hashed)
+	return nil
+}
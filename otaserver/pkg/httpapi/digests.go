@@ -0,0 +1,372 @@
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// Devices verify images with the digest their hardware accelerates, so the
+// digest algorithms are configured per app: PUT /admin/digests/<app>
+// {"algorithms": ["sha512", "sha256"]}, the first being the app's preferred
+// one, or OTA_DIGEST_ALGORITHMS for apps without a setting (default sha256).
+// Offers carry the artifact's digest in every configured algorithm under
+// "digests", and in the preferred one as "digest" with its
+// "digest_algorithm"; a device wanting another of them asks with
+// ?digest=blake3 or a Want-Repr-Digest header (RFC 9530). Downloads answer
+// Want-Repr-Digest with a Repr-Digest header. Digests other than SHA-256,
+// the release ID, are computed once per release and kept in its metadata.
+
+// ReleaseDigests are the digests of a release's content in the algorithms
+// computed so far.
+type ReleaseDigests struct {
+	ReleaseID string            `json:"release_id"` // content they were computed from
+	Values    map[string]string `json:"values"`     // hex, by algorithm
+}
+
+var appDigestState = struct {
+	sync.RWMutex
+	apps map[string][]string // algorithms by app, preferred first
+}{apps: make(map[string][]string)}
+
+// digestFlight computes the digests of a release once for concurrent callers.
+var digestFlight catalog.Flight[map[string]string]
+
+// Helper function to load the digest algorithms of each app
+func initAppDigests() error {
+	apps := make(map[string][]string)
+	if err := storage.ReadJSON(appDigestsFile, &apps); err != nil {
+		return err
+	}
+	for app, algorithms := range apps {
+		if _, err := parseDigestAlgorithms(algorithms); err != nil {
+			return fmt.Errorf("%s: %w", app, err)
+		}
+	}
+	appDigestState.Lock()
+	appDigestState.apps = apps
+	appDigestState.Unlock()
+	return nil
+}
+
+// Helper function to check a list of digest algorithms, normalizing their
+// names and dropping duplicates
+func parseDigestAlgorithms(names []string) ([]string, error) {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		algorithm, ok := manifest.ParseDigestAlgorithm(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported digest algorithm %q", name)
+		}
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms, nil
+}
+
+// Helper function to get the digest algorithms of apps without a setting
+func defaultDigestAlgorithms() []string {
+	if v := os.Getenv("OTA_DIGEST_ALGORITHMS"); v != "" {
+		if algorithms, err := parseDigestAlgorithms(strings.Split(v, ",")); err == nil && len(algorithms) > 0 {
+			return algorithms
+		}
+	}
+	return []string{manifest.DigestSHA256}
+}
+
+// Helper function to get the digest algorithms of an app, preferred first
+func appDigestAlgorithms(app string) []string {
+	appDigestState.RLock()
+	algorithms, ok := appDigestState.apps[app]
+	appDigestState.RUnlock()
+	if ok {
+		return algorithms
+	}
+	return defaultDigestAlgorithms()
+}
+
+// Helper function to get the digests of a release in the algorithms of its
+// app, computing and keeping those not known yet
+func releaseDigests(release catalog.Release, meta ReleaseMeta) (map[string]string, error) {
+	algorithms := appDigestAlgorithms(release.App)
+	digests := make(map[string]string, len(algorithms))
+	var missing []string
+	for _, algorithm := range algorithms {
+		switch {
+		case algorithm == manifest.DigestSHA256:
+			digests[algorithm] = release.ID
+		case meta.Digests != nil && meta.Digests.ReleaseID == release.ID && meta.Digests.Values[algorithm] != "":
+			digests[algorithm] = meta.Digests.Values[algorithm]
+		default:
+			missing = append(missing, algorithm)
+		}
+	}
+	if len(missing) == 0 {
+		return digests, nil
+	}
+
+	computed, err, _ := digestFlight.Do(release.ID+"\x00"+strings.Join(missing, ","), func() (map[string]string, error) {
+		computed, err := computeDigests(artifacts.ArtifactPath(release.FileName), missing)
+		if err != nil {
+			return nil, err
+		}
+		return computed, storeReleaseDigests(release, computed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for algorithm, digest := range computed {
+		digests[algorithm] = digest
+	}
+	return digests, nil
+}
+
+// legacyChecksumKey is the key, among the digests kept in release metadata,
+// of the MD5 "checksum" of offers, which older devices verify.
+const legacyChecksumKey = "md5"
+
+// Helper function to get the legacy checksum of a release, computing and
+// keeping it the first time it is offered
+func releaseChecksum(release catalog.Release, meta ReleaseMeta) (string, error) {
+	if meta.Digests != nil && meta.Digests.ReleaseID == release.ID && meta.Digests.Values[legacyChecksumKey] != "" {
+		return meta.Digests.Values[legacyChecksumKey], nil
+	}
+	computed, err, _ := digestFlight.Do(release.ID+"\x00"+legacyChecksumKey, func() (map[string]string, error) {
+		checksum, err := CalculateChecksum(artifacts.ArtifactPath(release.FileName))
+		if err != nil {
+			return nil, err
+		}
+		computed := map[string]string{legacyChecksumKey: checksum}
+		return computed, storeReleaseDigests(release, computed)
+	})
+	if err != nil {
+		return "", err
+	}
+	return computed[legacyChecksumKey], nil
+}
+
+// Helper function to hash a file in several algorithms in one read
+func computeDigests(path string, algorithms []string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	writers := make([]io.Writer, 0, len(algorithms))
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	for _, algorithm := range algorithms {
+		h, ok := manifest.NewDigest(algorithm)
+		if !ok {
+			return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+		}
+		writers = append(writers, h)
+		hashes[algorithm] = h
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		digests[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// Helper function to keep computed digests in a release's metadata. Offers
+// do not depend on it, so the catalog is not invalidated.
+func storeReleaseDigests(release catalog.Release, computed map[string]string) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	meta, err := loadReleaseMeta(release.App, release.Version)
+	if err != nil {
+		return err
+	}
+	if meta.Digests == nil || meta.Digests.ReleaseID != release.ID {
+		meta.Digests = &ReleaseDigests{ReleaseID: release.ID, Values: make(map[string]string)}
+	}
+	for algorithm, digest := range computed {
+		meta.Digests.Values[algorithm] = digest
+	}
+	return saveReleaseMeta(meta)
+}
+
+// Helper function to set the digests of an offer, in the app's preferred
+// algorithm unless the device asked for another one it has
+func setOfferDigests(info *manifest.VersionInfo, app string, digests map[string]string) {
+	if len(digests) == 0 {
+		return
+	}
+	info.Digests = digests
+	algorithm := appDigestAlgorithms(app)[0]
+	info.DigestAlgorithm, info.Digest = algorithm, digests[algorithm]
+}
+
+// Helper function to read the digest algorithms a request asks for, most
+// wanted first, from ?digest= or Want-Repr-Digest
+func wantedDigests(c *gin.Context) []string {
+	if v := c.Query("digest"); v != "" {
+		algorithms, _ := parseDigestAlgorithms(strings.Split(v, ","))
+		return algorithms
+	}
+	type preference struct {
+		algorithm string
+		weight    int
+	}
+	var wanted []preference
+	for _, field := range strings.Split(c.GetHeader("Want-Repr-Digest"), ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(field), "=")
+		algorithm, ok := manifest.ParseDigestAlgorithm(name)
+		if !ok {
+			continue
+		}
+		w := 1
+		if found {
+			if n, err := strconv.Atoi(strings.TrimSpace(weight)); err == nil {
+				w = n
+			}
+		}
+		// A weight of 0 means "not acceptable"
+		if w > 0 {
+			wanted = append(wanted, preference{algorithm, w})
+		}
+	}
+	sort.SliceStable(wanted, func(i, j int) bool { return wanted[i].weight > wanted[j].weight })
+	algorithms := make([]string, len(wanted))
+	for i, p := range wanted {
+		algorithms[i] = p.algorithm
+	}
+	return algorithms
+}
+
+// Helper function to switch an offer to the digest algorithm the device
+// asked for, when the app has it
+func negotiateDigest(c *gin.Context, info *manifest.VersionInfo) {
+	for _, algorithm := range wantedDigests(c) {
+		if digest, ok := info.Digests[algorithm]; ok {
+			info.DigestAlgorithm, info.Digest = algorithm, digest
+			return
+		}
+	}
+}
+
+// Helper function to answer a download's Want-Repr-Digest with the digests
+// of the release the app has
+func setReprDigest(c *gin.Context, release catalog.Release) {
+	wanted := wantedDigests(c)
+	if len(wanted) == 0 && c.Request.Method == http.MethodHead {
+		// A HEAD request is made to validate the artifact, so it gets the
+		// app's digests unasked
+		wanted = appDigestAlgorithms(release.App)
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	meta, err := loadReleaseMeta(release.App, release.Version)
+	if err != nil {
+		return
+	}
+	digests, err := releaseDigests(release, meta)
+	if err != nil {
+		return
+	}
+	var fields []string
+	for _, algorithm := range wanted {
+		if digest, ok := digests[algorithm]; ok {
+			raw, _ := hex.DecodeString(digest)
+			fields = append(fields, manifest.HTTPDigestName(algorithm)+"=:"+base64.StdEncoding.EncodeToString(raw)+":")
+		}
+	}
+	if len(fields) > 0 {
+		c.Header("Repr-Digest", strings.Join(fields, ", "))
+	}
+}
+
+// Admin endpoint listing the digest algorithms of each app
+func listAppDigests(c *gin.Context) {
+	appDigestState.RLock()
+	apps := make(map[string][]string, len(appDigestState.apps))
+	for app, algorithms := range appDigestState.apps {
+		apps[app] = algorithms
+	}
+	appDigestState.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"default": defaultDigestAlgorithms(), "apps": apps, "supported": manifest.DigestAlgorithms})
+}
+
+// Admin endpoint setting the digest algorithms of an app, preferred first,
+// e.g. {"algorithms": ["sha512", "sha256"]}
+func updateAppDigests(c *gin.Context) {
+	app := c.Param("app")
+	var req struct {
+		Algorithms []string `json:"algorithms"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Algorithms) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "algorithms is required", gin.H{"supported": manifest.DigestAlgorithms})
+		return
+	}
+	algorithms, err := parseDigestAlgorithms(req.Algorithms)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error(), gin.H{"supported": manifest.DigestAlgorithms})
+		return
+	}
+	if err := saveAppDigests(app, algorithms); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save digest settings")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"app": app, "algorithms": algorithms})
+}
+
+// Admin endpoint returning an app to the default digest algorithms
+func deleteAppDigests(c *gin.Context) {
+	app := c.Param("app")
+	appDigestState.RLock()
+	_, ok := appDigestState.apps[app]
+	appDigestState.RUnlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "app has no digest settings", gin.H{"app": app})
+		return
+	}
+	if err := saveAppDigests(app, nil); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save digest settings")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Helper function to set (or with no algorithms, remove) the digest
+// algorithms of an app
+func saveAppDigests(app string, algorithms []string) error {
+	appDigestState.Lock()
+	defer appDigestState.Unlock()
+	apps := make(map[string][]string, len(appDigestState.apps)+1)
+	for name, current := range appDigestState.apps {
+		apps[name] = current
+	}
+	if len(algorithms) > 0 {
+		apps[app] = algorithms
+	} else {
+		delete(apps, app)
+	}
+	if err := storage.WriteJSON(appDigestsFile, apps); err != nil {
+		return fmt.Errorf("saving digest settings: %w", err)
+	}
+	appDigestState.apps = apps
+	// Cached offers carry the previous algorithms
+	invalidateCatalog()
+	return nil
+}
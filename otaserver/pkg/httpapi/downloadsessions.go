@@ -0,0 +1,268 @@
+package httpapi
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Every artifact and patch download is tracked as a session: when it
+// started, the bytes sent, whether it completed or was aborted, how long it
+// took, and the region and client class of the device. The client class is
+// what the device reports in the X-OTA-Client-Class header, e.g. "cellular"
+// or "wifi". A high abort rate is the earliest sign that an artifact is too
+// big for some devices, so the sessions are counted per app, version,
+// region, client class and outcome in ota_download_sessions_total, and
+// GET /admin/downloads/abort-rates ranks them. GET /admin/downloads/sessions
+// lists the most recent sessions.
+
+// downloadSessionsKept is how many recent sessions are kept in memory.
+const downloadSessionsKept = 1000
+
+// Download session outcomes
+const (
+	sessionCompleted  = "completed"
+	sessionAborted    = "aborted"
+	sessionRedirected = "redirected" // sent to a mirror, which the server does not see finish
+)
+
+const (
+	clientClassHeader  = "X-OTA-Client-Class"
+	unknownClientClass = "unknown"
+	noRegion           = "none"
+)
+
+var clientClassPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// DownloadSession is one download of an artifact or patch.
+type DownloadSession struct {
+	ID          string    `json:"id"` // request ID
+	DeviceID    string    `json:"device_id,omitempty"`
+	Kind        string    `json:"kind"` // "artifact" or "patch"
+	App         string    `json:"app"`
+	Version     string    `json:"version"`
+	ReleaseID   string    `json:"release_id,omitempty"`
+	Region      string    `json:"region"`
+	ClientClass string    `json:"client_class"`
+	Resumed     bool      `json:"resumed,omitempty"` // a Range request
+	Outcome     string    `json:"outcome"`
+	BytesSent   int64     `json:"bytes_sent"`
+	Expected    int64     `json:"expected_bytes"`
+	DurationMS  int64     `json:"duration_ms"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// AbortRate summarizes the download sessions of a version in a region and
+// client class.
+type AbortRate struct {
+	App         string  `json:"app"`
+	Version     string  `json:"version"`
+	Region      string  `json:"region"`
+	ClientClass string  `json:"client_class"`
+	Sessions    int64   `json:"sessions"`
+	Completed   int64   `json:"completed"`
+	Aborted     int64   `json:"aborted"`
+	Redirected  int64   `json:"redirected"`
+	BytesSent   int64   `json:"bytes_sent"`
+	AbortRate   float64 `json:"abort_rate"` // aborted / (completed + aborted)
+}
+
+// sessionKey identifies the aggregate a session is counted in.
+type sessionKey struct {
+	app, version, region, class string
+}
+
+var downloadSessions = struct {
+	sync.Mutex
+	recent []DownloadSession
+	counts map[sessionKey]*AbortRate
+	since  time.Time
+}{counts: make(map[sessionKey]*AbortRate), since: time.Now().UTC()}
+
+var downloadSessionCount = newLabeledCounter("ota_download_sessions_total", "Download sessions by app, version, region, client class and outcome.",
+	[]string{"app", "version", "region", "client_class", "outcome"}, func() map[string]int64 {
+		samples := make(map[string]int64)
+		downloadSessions.Lock()
+		defer downloadSessions.Unlock()
+		for key, rate := range downloadSessions.counts {
+			for outcome, n := range map[string]int64{sessionCompleted: rate.Completed, sessionAborted: rate.Aborted, sessionRedirected: rate.Redirected} {
+				if n > 0 {
+					samples[labelValues(key.app, key.version, key.region, key.class, outcome)] = n
+				}
+			}
+		}
+		return samples
+	})
+
+// Middleware recording the download sessions of device requests
+func trackDownloadSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		value, ok := c.Get(transferResultKey)
+		if !ok {
+			return
+		}
+		result := value.(transferResult)
+		session := DownloadSession{
+			ID:          c.GetString("request_id"),
+			Kind:        "artifact",
+			Region:      noRegion,
+			ClientClass: clientClass(c),
+			Resumed:     c.GetHeader("Range") != "",
+			BytesSent:   result.Sent,
+			Expected:    result.Expected,
+			DurationMS:  time.Since(start).Milliseconds(),
+			StartedAt:   start.UTC(),
+		}
+		switch {
+		case result.Complete:
+			session.Outcome = sessionCompleted
+		case result.Status == http.StatusFound:
+			session.Outcome = sessionRedirected
+		case result.Status == http.StatusOK || result.Status == http.StatusPartialContent:
+			session.Outcome = sessionAborted
+		default:
+			return // e.g. 304 or 416, nothing was downloaded
+		}
+		if value, ok := c.Get(servedReleaseKey); ok {
+			release := value.(catalog.Release)
+			session.App, session.Version, session.ReleaseID = release.App, release.Version, release.ID
+		} else if app, version, ok := patchDestination(c.Param("name")); ok {
+			session.Kind, session.App, session.Version = "patch", app, version
+		}
+		if name, _, ok := clientRegion(c); ok {
+			session.Region = name
+		}
+		if !anonymousMode() {
+			session.DeviceID = downloadDeviceID(c)
+		}
+		recordDownloadSession(session)
+	}
+}
+
+// Helper function to read the client class a device reports
+func clientClass(c *gin.Context) string {
+	if class := strings.ToLower(c.GetHeader(clientClassHeader)); clientClassPattern.MatchString(class) {
+		return class
+	}
+	return unknownClientClass
+}
+
+// Helper function to read the app and target version of a patch from its
+// name, <app>_<from>_to_<to>.otad
+func patchDestination(name string) (string, string, bool) {
+	if !patchNamePattern.MatchString(name) {
+		return "", "", false
+	}
+	app, versions, _ := strings.Cut(strings.TrimSuffix(name, ".otad"), "_")
+	_, to, _ := strings.Cut(versions, "_to_")
+	return app, to, true
+}
+
+// Helper function to remember a download session and count it
+func recordDownloadSession(session DownloadSession) {
+	downloadSessions.Lock()
+	defer downloadSessions.Unlock()
+	downloadSessions.recent = append(downloadSessions.recent, session)
+	if len(downloadSessions.recent) > downloadSessionsKept {
+		downloadSessions.recent = downloadSessions.recent[len(downloadSessions.recent)-downloadSessionsKept:]
+	}
+
+	key := sessionKey{session.App, session.Version, session.Region, session.ClientClass}
+	rate, ok := downloadSessions.counts[key]
+	if !ok {
+		rate = &AbortRate{App: key.app, Version: key.version, Region: key.region, ClientClass: key.class}
+		downloadSessions.counts[key] = rate
+	}
+	rate.Sessions++
+	rate.BytesSent += session.BytesSent
+	switch session.Outcome {
+	case sessionCompleted:
+		rate.Completed++
+	case sessionAborted:
+		rate.Aborted++
+	case sessionRedirected:
+		rate.Redirected++
+	}
+	if finished := rate.Completed + rate.Aborted; finished > 0 {
+		rate.AbortRate = float64(rate.Aborted) / float64(finished)
+	}
+}
+
+// Admin endpoint listing recent download sessions, newest first, narrowed by
+// ?app=, ?version=, ?region=, ?client_class= and ?outcome=, at most ?limit=
+// (default 100)
+func listDownloadSessions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive number")
+		return
+	}
+	filters := map[string]string{
+		"app":          c.Query("app"),
+		"version":      c.Query("version"),
+		"region":       c.Query("region"),
+		"client_class": c.Query("client_class"),
+		"outcome":      c.Query("outcome"),
+	}
+	matches := func(s DownloadSession) bool {
+		for name, value := range map[string]string{"app": s.App, "version": s.Version, "region": s.Region, "client_class": s.ClientClass, "outcome": s.Outcome} {
+			if filters[name] != "" && filters[name] != value {
+				return false
+			}
+		}
+		return true
+	}
+
+	sessions := []DownloadSession{}
+	downloadSessions.Lock()
+	for i := len(downloadSessions.recent) - 1; i >= 0 && len(sessions) < limit; i-- {
+		if session := downloadSessions.recent[i]; matches(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	downloadSessions.Unlock()
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// Admin endpoint ranking versions by abort rate per region and client
+// class, since the server started; ?app= and ?version= narrow it and
+// ?min_sessions= (default 1) leaves out rarely downloaded ones
+func getAbortRates(c *gin.Context) {
+	minSessions, err := strconv.ParseInt(c.DefaultQuery("min_sessions", "1"), 10, 64)
+	if err != nil || minSessions < 1 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "min_sessions must be a positive number")
+		return
+	}
+	app, version := c.Query("app"), c.Query("version")
+
+	rates := []AbortRate{}
+	downloadSessions.Lock()
+	for key, rate := range downloadSessions.counts {
+		if (app == "" || key.app == app) && (version == "" || key.version == version) && rate.Sessions >= minSessions {
+			rates = append(rates, *rate)
+		}
+	}
+	since := downloadSessions.since
+	downloadSessions.Unlock()
+
+	sort.Slice(rates, func(i, j int) bool {
+		a, b := rates[i], rates[j]
+		if a.AbortRate != b.AbortRate {
+			return a.AbortRate > b.AbortRate
+		}
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		return labelValues(a.App, a.Version, a.Region, a.ClientClass) < labelValues(b.App, b.Version, b.Region, b.ClientClass)
+	})
+	c.JSON(http.StatusOK, gin.H{"abort_rates": rates, "since": since})
+}
@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Factory-fresh devices exchange a one-time enrollment token for a client
+// certificate issued by a built-in CA, configured with OTA_CA_CERT_FILE and
+// OTA_CA_KEY_FILE (PEM). When the server also has OTA_TLS_CERT_FILE and
+// OTA_TLS_KEY_FILE it serves HTTPS and verifies client certificates issued by
+// that CA. Devices that cannot do TLS client authentication exchange the token
+// for a request signing secret instead, see hmac.go.
+
+const (
+	defaultEnrollmentTTL = 24 * time.Hour
+	deviceCertValidity   = 365 * 24 * time.Hour
+)
+
+var errDeviceMismatch = errors.New("device_id does not match the authenticated device")
+
+// EnrollmentToken is a pending one-time token; only its hash is stored.
+type EnrollmentToken struct {
+	DeviceID  string    `json:"device_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var enrollmentMu sync.Mutex
+
+// certificateAuthority is the CA that issues device client certificates.
+type certificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+// Helper function to load the device CA from the environment, returning nil
+// when enrollment is not configured
+func loadCA() (*certificateAuthority, error) {
+	certFile, keyFile := os.Getenv("OTA_CA_CERT_FILE"), os.Getenv("OTA_CA_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot sign")
+	}
+	return &certificateAuthority{
+		cert: cert,
+		key:  signer,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Admin endpoint minting a one-time enrollment token for a device,
+// e.g. {"device_id": "pos-0042", "ttl": "72h"}
+func createEnrollmentToken(c *gin.Context) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		TTL      string `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !deviceIDPattern.MatchString(req.DeviceID) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "a valid device_id is required")
+		return
+	}
+	ttl := defaultEnrollmentTTL
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "ttl must be a positive duration such as 72h")
+			return
+		}
+		ttl = parsed
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not generate token")
+		return
+	}
+	token := hex.EncodeToString(raw)
+	expiresAt := time.Now().UTC().Add(ttl)
+
+	enrollmentMu.Lock()
+	defer enrollmentMu.Unlock()
+	tokens := make(map[string]EnrollmentToken)
+	if err := storage.ReadJSON(enrollmentFile, &tokens); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load enrollment tokens")
+		return
+	}
+	for hash, t := range tokens {
+		if time.Now().After(t.ExpiresAt) {
+			delete(tokens, hash)
+		}
+	}
+	tokens[hashToken(token)] = EnrollmentToken{DeviceID: req.DeviceID, ExpiresAt: expiresAt}
+	if err := storage.WriteJSON(enrollmentFile, tokens); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save enrollment token")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"token": token, "device_id": req.DeviceID, "expires_at": expiresAt})
+}
+
+// Helper function to consume an enrollment token, returning the device it was minted for
+func redeemEnrollmentToken(token string) (string, error) {
+	enrollmentMu.Lock()
+	defer enrollmentMu.Unlock()
+
+	tokens := make(map[string]EnrollmentToken)
+	if err := storage.ReadJSON(enrollmentFile, &tokens); err != nil {
+		return "", err
+	}
+	hash := hashToken(token)
+	entry, ok := tokens[hash]
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return "", errors.New("enrollment token is invalid, expired or already used")
+	}
+	delete(tokens, hash)
+	return entry.DeviceID, storage.WriteJSON(enrollmentFile, tokens)
+}
+
+// Endpoint where a device exchanges an enrollment token and a PEM encoded
+// certificate signing request for a client certificate, or, with
+// {"token": ..., "hmac": true}, for a secret to sign its requests with
+func enrollDevice(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+		CSR   string `json:"csr"`
+		HMAC  bool   `json:"hmac"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" || (req.CSR == "") == !req.HMAC {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "token and either csr or hmac are required")
+		return
+	}
+	if req.HMAC {
+		enrollSigningDevice(c, req.Token)
+		return
+	}
+
+	ca, err := loadCA()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load CA")
+		return
+	}
+	if ca == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "enrollment is not configured")
+		return
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "csr must be a PEM encoded CERTIFICATE REQUEST")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "csr is malformed or its signature is invalid")
+		return
+	}
+
+	deviceID, err := redeemEnrollmentToken(req.Token)
+	if err != nil {
+		respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not issue certificate")
+		return
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: deviceID},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(deviceCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Could not issue certificate: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"device_id":      deviceID,
+		"certificate":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"ca_certificate": string(ca.pem),
+		"expires_at":     template.NotAfter.UTC(),
+	})
+}
+
+// Helper function to exchange an enrollment token for a request signing secret
+func enrollSigningDevice(c *gin.Context, token string) {
+	deviceID, err := redeemEnrollmentToken(token)
+	if err != nil {
+		respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+	secret, err := issueDeviceSecret(deviceID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not issue signing secret")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"device_id": deviceID, "hmac_secret": secret})
+}
+
+// TLSConfig builds the TLS configuration for mTLS from OTA_TLS_CERT_FILE,
+// OTA_TLS_KEY_FILE and the enrollment CA, or returns nil when the server
+// should serve plain HTTP.
+func TLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("OTA_TLS_CERT_FILE"), os.Getenv("OTA_TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+
+	ca, err := loadCA()
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		config.ClientCAs = x509.NewCertPool()
+		config.ClientCAs.AddCert(ca.cert)
+		// Devices that have not enrolled yet must still reach /enroll
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Helper function to read the device ID from a verified client certificate
+func certDeviceID(c *gin.Context) string {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+}
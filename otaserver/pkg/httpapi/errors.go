@@ -0,0 +1,69 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in the "code" field of error responses. Clients
+// should branch on these rather than on the human readable message.
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeInvalidVersion       = "INVALID_VERSION"
+	CodeVersionNotFound      = "VERSION_NOT_FOUND"
+	CodeCatalogEmpty         = "CATALOG_EMPTY"
+	CodeReleaseGone          = "RELEASE_GONE"
+	CodeNotFound             = "NOT_FOUND"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeConflict             = "CONFLICT"
+	CodePreconditionRequired = "PRECONDITION_REQUIRED"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeQuotaExceeded        = "QUOTA_EXCEEDED"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternal             = "INTERNAL"
+	CodeUnavailable          = "UNAVAILABLE"
+)
+
+// APIError is the body of every error response, wrapped as {"error": {...}}.
+type APIError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// requestID tags every request with an ID, reusing the caller's X-Request-ID
+// when present, so error reports can be matched with server logs.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			raw := make([]byte, 8)
+			rand.Read(raw)
+			id = hex.EncodeToString(raw)
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// respondError aborts the request with a structured error. Optional details
+// are merged into the "details" object.
+func respondError(c *gin.Context, status int, code, message string, details ...gin.H) {
+	apiErr := APIError{Code: code, Message: message, RequestID: c.GetString("request_id")}
+	for _, d := range details {
+		if apiErr.Details == nil {
+			apiErr.Details = make(map[string]interface{})
+		}
+		for k, v := range d {
+			apiErr.Details[k] = v
+		}
+	}
+	c.Set(errorCodeKey, code)
+	c.AbortWithStatusJSON(status, gin.H{"error": apiErr})
+}
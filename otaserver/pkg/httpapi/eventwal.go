@@ -0,0 +1,378 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Device records are written back in batches, see devicestore.go, and a
+// record that cannot be written stays in memory until it can. With
+// OTA_EVENT_WAL set to a file on local disk, the check-ins and reports that
+// arrive while records cannot be written, e.g. while a network volume is
+// remounted during maintenance, are also appended to that write-ahead log, so
+// they survive a restart before the state directory is back. Only the append
+// holds the log's lock; the event is applied to the record outside it. Once a
+// batch writes every pending record, the events logged before it are dropped
+// from the log, and the telemetry and forensics of logged reports recorded.
+// At startup, events left in the log are applied again in batches of
+// eventWALReplayBatch. Beyond OTA_EVENT_WAL_MAX events (default 100000)
+// events are kept in memory only. GET /admin/events/wal shows what is waiting
+// and POST /admin/events/wal/replay writes the records back at once.
+
+const (
+	defaultEventWALMax  = 100000
+	eventWALReplayBatch = 1000
+)
+
+// Device event kinds
+const (
+	eventCheckIn = "check_in"
+	eventReport  = "report"
+)
+
+var errEventWALFull = errors.New("event write-ahead log is full")
+
+// DeviceEvent is a change to a device record as kept in the write-ahead log.
+type DeviceEvent struct {
+	Kind     string        `json:"kind"`
+	DeviceID string        `json:"device_id"`
+	At       time.Time     `json:"at"` // when the server received it
+	CheckIn  *checkIn      `json:"check_in,omitempty"`
+	Report   *deviceReport `json:"report,omitempty"`
+}
+
+// EventWALStatus describes the device events waiting in the write-ahead log.
+type EventWALStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Path       string     `json:"path,omitempty"`
+	Pending    int        `json:"pending"`
+	Devices    int        `json:"devices"`
+	Oldest     *time.Time `json:"oldest,omitempty"`
+	Replayed   int64      `json:"replayed"`
+	LastReplay *time.Time `json:"last_replay,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+var eventWAL = struct {
+	sync.Mutex
+	path    string
+	limit   int
+	events  []DeviceEvent
+	first   uint64         // sequence number of events[0]
+	devices map[string]int // events waiting by device
+	// stale is set when the file could not be rewritten after events were
+	// dropped and still holds them
+	stale      bool
+	replayed   int64
+	lastReplay *time.Time
+	lastError  string
+
+	// applying is held shared from logging an event until it is applied,
+	// and exclusively to take the mark of the events a batch covers
+	applying sync.RWMutex
+}{devices: make(map[string]int)}
+
+var (
+	eventWALPending  = newGauge("ota_event_wal_pending", "Device events waiting in the write-ahead log.")
+	eventWALReplayed = newCounter("ota_event_wal_replayed_total", "Device events dropped from the write-ahead log once their records were written.")
+)
+
+// Helper function to load the events left in the write-ahead log and apply
+// them again to the device records
+func initEventWAL() error {
+	path := os.Getenv("OTA_EVENT_WAL")
+	if path == "" {
+		return nil
+	}
+	limit := defaultEventWALMax
+	if n, err := strconv.Atoi(os.Getenv("OTA_EVENT_WAL_MAX")); err == nil && n > 0 {
+		limit = n
+	}
+	events, err := readEventLog(path)
+	if err != nil {
+		return err
+	}
+
+	eventWAL.Lock()
+	eventWAL.path, eventWAL.limit, eventWAL.events = path, limit, events
+	for _, e := range events {
+		eventWAL.devices[e.DeviceID]++
+	}
+	eventWALPending.Set(int64(len(events)))
+	eventWAL.Unlock()
+	if len(events) > 0 {
+		log.Printf("%d device events left in %s, replaying", len(events), path)
+		replayEvents(len(events))
+	}
+	return nil
+}
+
+// Helper function to tell whether device events are logged while their
+// records cannot be written
+func eventWALEnabled() bool {
+	eventWAL.Lock()
+	defer eventWAL.Unlock()
+	return eventWAL.path != ""
+}
+
+// Helper function to read the events of a write-ahead log, one JSON object
+// per line; a line cut short by a crash is dropped
+func readEventLog(path string) ([]DeviceEvent, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []DeviceEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e DeviceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.DeviceID == "" {
+			log.Printf("skipping unreadable event in %s", path)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Helper function to apply an event to a device record
+func (e DeviceEvent) apply(d *Device) {
+	switch {
+	case e.Kind == eventCheckIn && e.CheckIn != nil:
+		applyCheckIn(d, *e.CheckIn, e.At)
+	case e.Kind == eventReport && e.Report != nil:
+		applyReport(d, *e.Report, e.At)
+	}
+}
+
+// Helper function to apply an event to its device's record, first appending
+// it to the write-ahead log when records cannot be written. It reports
+// whether the event was logged, in which case the telemetry and forensics of
+// a report are recorded once the records are written.
+func saveDeviceEvent(e DeviceEvent) (Device, bool, error) {
+	eventWAL.applying.RLock()
+	defer eventWAL.applying.RUnlock()
+
+	logged := false
+	if devicesUnwritable() {
+		eventWAL.Lock()
+		if eventWAL.path != "" {
+			if err := appendEventLocked(e); err != nil {
+				log.Printf("logging the %s of %s: %v", e.Kind, e.DeviceID, err)
+			} else {
+				logged = true
+			}
+		}
+		eventWAL.Unlock()
+	}
+	device, err := updateDevice(e.DeviceID, e.apply)
+	return device, logged, err
+}
+
+// Helper function to append an event to the write-ahead log, synced to disk
+// before it returns. Must be called with eventWAL locked.
+func appendEventLocked(e DeviceEvent) error {
+	if len(eventWAL.events) >= eventWAL.limit {
+		return errEventWALFull
+	}
+	if eventWAL.stale {
+		if err := writeEventLogLocked(append(eventWAL.events[:len(eventWAL.events):len(eventWAL.events)], e)); err != nil {
+			return err
+		}
+		eventWAL.stale = false
+	} else {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(eventWAL.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	eventWAL.events = append(eventWAL.events, e)
+	eventWAL.devices[e.DeviceID]++
+	eventWALPending.Set(int64(len(eventWAL.events)))
+	return nil
+}
+
+// Helper function to replace the write-ahead log with the given events. Must
+// be called with eventWAL locked.
+func writeEventLogLocked(events []DeviceEvent) error {
+	tmp, err := os.CreateTemp(filepath.Dir(eventWAL.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), eventWAL.path)
+}
+
+// Helper function to apply the first n events of the write-ahead log to the
+// device records again, e.g. after a restart, taking them eventWALReplayBatch
+// at a time without holding the log's lock while they are applied
+func replayEvents(n int) {
+	// Until they are applied, a batch writing the records does not cover them
+	eventWAL.applying.RLock()
+	defer eventWAL.applying.RUnlock()
+	for done := 0; done < n; {
+		eventWAL.Lock()
+		batch := eventWAL.events[done:min(n, done+eventWALReplayBatch, len(eventWAL.events))]
+		eventWAL.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		for _, e := range batch {
+			updateDevice(e.DeviceID, e.apply)
+		}
+		done += len(batch)
+	}
+}
+
+// Helper function to take the mark of the events logged and applied so far,
+// which a batch writing every pending record covers
+func eventWALMark() uint64 {
+	eventWAL.applying.Lock()
+	defer eventWAL.applying.Unlock()
+	eventWAL.Lock()
+	defer eventWAL.Unlock()
+	return eventWAL.first + uint64(len(eventWAL.events))
+}
+
+// Helper function to record the outcome of a batch writing the device
+// records, dropping the events before mark from the log when it wrote them all
+func eventWALWritten(mark uint64, err error) {
+	eventWAL.Lock()
+	if eventWAL.path == "" {
+		eventWAL.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	eventWAL.lastReplay = &now
+	if err != nil {
+		eventWAL.lastError = err.Error()
+		eventWAL.Unlock()
+		return
+	}
+	eventWAL.lastError = ""
+	n := int(mark - eventWAL.first)
+	if n <= 0 {
+		eventWAL.Unlock()
+		return
+	}
+	written := eventWAL.events[:n]
+	eventWAL.events = eventWAL.events[n:len(eventWAL.events):len(eventWAL.events)]
+	eventWAL.first = mark
+	for _, e := range written {
+		if eventWAL.devices[e.DeviceID]--; eventWAL.devices[e.DeviceID] <= 0 {
+			delete(eventWAL.devices, e.DeviceID)
+		}
+	}
+	eventWAL.replayed += int64(n)
+	eventWALReplayed.Add(int64(n))
+	eventWALPending.Set(int64(len(eventWAL.events)))
+	if err := writeEventLogLocked(eventWAL.events); err != nil {
+		log.Printf("rewriting %s: %v", eventWAL.path, err)
+		eventWAL.stale = true
+	} else {
+		eventWAL.stale = false
+	}
+	eventWAL.Unlock()
+
+	for _, e := range written {
+		if r := e.Report; r != nil && r.pluginInstall() {
+			report := r.installReport(e.At)
+			if err := recordReportDetails(e.DeviceID, *r, &report); err != nil {
+				log.Printf("recording telemetry of %s: %v", e.DeviceID, err)
+			}
+		}
+	}
+}
+
+// Helper function to describe the write-ahead log
+func eventWALStatus() EventWALStatus {
+	eventWAL.Lock()
+	defer eventWAL.Unlock()
+	status := EventWALStatus{
+		Enabled:    eventWAL.path != "",
+		Path:       eventWAL.path,
+		Pending:    len(eventWAL.events),
+		Devices:    len(eventWAL.devices),
+		Replayed:   eventWAL.replayed,
+		LastReplay: eventWAL.lastReplay,
+		LastError:  eventWAL.lastError,
+	}
+	if len(eventWAL.events) > 0 {
+		oldest := eventWAL.events[0].At
+		status.Oldest = &oldest
+	}
+	return status
+}
+
+// Admin endpoint showing the device events waiting in the write-ahead log
+func getEventWAL(c *gin.Context) {
+	c.JSON(http.StatusOK, eventWALStatus())
+}
+
+// Admin endpoint writing the device records back without waiting for the
+// next batch, e.g. right after maintenance of the state directory
+func replayEventWAL(c *gin.Context) {
+	if !eventWALEnabled() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "OTA_EVENT_WAL is not set")
+		return
+	}
+	flushDevices()
+	c.JSON(http.StatusOK, eventWALStatus())
+}
@@ -0,0 +1,212 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Releases can carry device-specific fields, Go text/template strings
+// rendered for each device at check time and returned as "fields" of the
+// offer, e.g.
+//
+//	PUT /admin/releases/plugin/2.0.0/fields
+//	{"config_url": "https://cfg.example.com/{{.Group}}/{{.DeviceID}}.json",
+//	 "install_window": "{{if eq .Group \"stores\"}}02:00-05:00{{end}}",
+//	 "content_key": "{{wrapKey \"<base64 key>\"}}"}
+//
+// Templates see the device's ID, Group, Timezone and Attributes (set with
+// PUT /admin/devices/<id>/attributes) and the App, Channel, Version offered
+// and CurrentVersion. wrapKey encrypts a key for the device with AES-256-GCM
+// under a key derived from its signing secret (see hmac.go), so only that
+// device can unwrap it. A field that fails to render is left out.
+
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// maxFields is how many templated fields a release can have.
+const maxFields = 32
+
+// wrapKeyLabel separates the key-wrapping key from other uses of the secret.
+const wrapKeyLabel = "ota-server key wrap v1"
+
+var errNoDeviceSecret = errors.New("device has no signing secret")
+
+// FieldContext is what field templates are rendered with.
+type FieldContext struct {
+	DeviceID       string
+	Group          string
+	Timezone       string
+	Attributes     map[string]string
+	App            string
+	Channel        string
+	Version        string
+	CurrentVersion string
+}
+
+// Helper function to parse a field template; secret is the device secret
+// wrapKey uses
+func parseField(name, text string, secret func() (string, error)) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(template.FuncMap{
+		"wrapKey": func(key string) (string, error) {
+			s, err := secret()
+			if err != nil {
+				return "", err
+			}
+			return wrapKey(s, key)
+		},
+	}).Parse(text)
+}
+
+// Helper function to encrypt a base64 key for a device. The nonce is derived
+// from the key so that the offer, and its ETag, stay the same between checks.
+func wrapKey(secret, key string) (string, error) {
+	plain, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("wrapKey needs a base64 key: %w", err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(wrapKeyLabel))
+	kek := mac.Sum(nil)
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonceMAC := hmac.New(sha256.New, kek)
+	nonceMAC.Write(plain)
+	nonce := nonceMAC.Sum(nil)[:gcm.NonceSize()]
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// Helper function to describe a device and the offered release to field templates
+func fieldContext(device *Device, release catalog.Release, currentVersion string) FieldContext {
+	ctx := FieldContext{App: release.App, Channel: release.Channel, Version: release.Version, CurrentVersion: currentVersion}
+	if device != nil {
+		ctx.DeviceID, ctx.Group, ctx.Timezone, ctx.Attributes = device.ID, device.Group, device.Timezone, device.Attributes
+	}
+	return ctx
+}
+
+// Helper function to render the fields of a release for a device
+func renderFields(fields map[string]string, ctx FieldContext) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+	secret := func() (string, error) {
+		if ctx.DeviceID == "" {
+			return "", errNoDeviceSecret
+		}
+		s, ok, err := deviceSecret(ctx.DeviceID)
+		if err == nil && !ok {
+			err = errNoDeviceSecret
+		}
+		return s, err
+	}
+	rendered := make(map[string]string, len(fields))
+	for name, text := range fields {
+		tmpl, err := parseField(name, text, secret)
+		var out bytes.Buffer
+		if err == nil {
+			err = tmpl.Execute(&out, ctx)
+		}
+		if err != nil {
+			log.Printf("rendering field %s of %s %s for %q: %v", name, ctx.App, ctx.Version, ctx.DeviceID, err)
+			continue
+		}
+		rendered[name] = out.String()
+	}
+	return rendered
+}
+
+// Admin endpoint replacing the templated fields of a release, e.g.
+// {"config_url": "https://cfg.example.com/{{.DeviceID}}.json"}; an empty
+// object removes them
+func updateFields(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	var fields map[string]string
+	if err := c.ShouldBindJSON(&fields); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "fields must be an object of template strings")
+		return
+	}
+	if len(fields) > maxFields {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "too many fields", gin.H{"max": maxFields})
+		return
+	}
+
+	// Templates are tried on a sample device so mistakes show up now rather
+	// than as fields missing from offers
+	sample := FieldContext{DeviceID: "device", Attributes: map[string]string{}, App: app, Version: version}
+	sampleSecret := func() (string, error) { return "secret", nil }
+	for name, text := range fields {
+		if !fieldNamePattern.MatchString(name) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "field names are lowercase letters, digits and '_'", gin.H{"field": name})
+			return
+		}
+		tmpl, err := parseField(name, text, sampleSecret)
+		if err == nil {
+			err = tmpl.Execute(&bytes.Buffer{}, sample)
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error(), gin.H{"field": name})
+			return
+		}
+	}
+
+	meta, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.Fields = fields
+		if len(fields) == 0 {
+			m.Fields = nil
+		}
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save fields")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// Admin endpoint replacing the attributes of a device that field templates
+// can use, e.g. {"serial": "SN-0042", "site": "berlin-3"}
+func updateDeviceAttributes(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	var attributes map[string]string
+	if err := c.ShouldBindJSON(&attributes); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "attributes must be an object of strings")
+		return
+	}
+	device, err := updateDevice(id, func(d *Device) {
+		d.Attributes = attributes
+		if len(attributes) == 0 {
+			d.Attributes = nil
+		}
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not update device")
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
@@ -0,0 +1,179 @@
+package httpapi
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// The fleet dashboard asks how many devices run each version, which reading
+// every device record would make slow at 100k devices. The server keeps the
+// summary in memory instead: it is built from the device records at startup
+// and updated with every device record written. GET /admin/fleet/summary
+// returns the devices per app, channel (the one the device last checked)
+// and version, and how many of them have not checked in for
+// OTA_STALE_AFTER (default 7 days).
+
+const defaultStaleAfter = 7 * 24 * time.Hour
+
+// FleetVersionCount is the number of devices running a version.
+type FleetVersionCount struct {
+	App     string `json:"app"`
+	Channel string `json:"channel"`
+	Version string `json:"version"`
+	Devices int    `json:"devices"`
+	Stale   int    `json:"stale"`
+}
+
+// summaryKey identifies a row of the fleet summary.
+type summaryKey struct {
+	app, channel, version string
+}
+
+// summaryDevice is what the fleet summary keeps of a device.
+type summaryDevice struct {
+	keys     []summaryKey
+	lastSeen time.Time
+}
+
+var fleetSummary = struct {
+	sync.RWMutex
+	devices   map[string]summaryDevice // by device ID
+	counts    map[summaryKey]int
+	updatedAt time.Time
+}{devices: make(map[string]summaryDevice), counts: make(map[summaryKey]int)}
+
+var fleetDevices = newLabeledGauge("ota_fleet_devices", "Devices known to run each app.", "app", func() map[string]int64 {
+	devices := make(map[string]int64)
+	fleetSummary.RLock()
+	for key, n := range fleetSummary.counts {
+		devices[key.app] += int64(n)
+	}
+	fleetSummary.RUnlock()
+	return devices
+})
+
+func staleAfter() time.Duration {
+	return envDuration("OTA_STALE_AFTER", defaultStaleAfter)
+}
+
+// Helper function to build the fleet summary from the device records
+func initFleetSummary() error {
+	devices, err := listDevices()
+	if err != nil {
+		return err
+	}
+	fleetSummary.Lock()
+	defer fleetSummary.Unlock()
+	fleetSummary.devices = make(map[string]summaryDevice, len(devices))
+	fleetSummary.counts = make(map[summaryKey]int)
+	for _, device := range devices {
+		observeDeviceLocked(device)
+	}
+	fleetSummary.updatedAt = time.Now().UTC()
+	return nil
+}
+
+// Helper function to update the fleet summary with a device record just
+// written
+func observeDevice(device Device) {
+	fleetSummary.Lock()
+	defer fleetSummary.Unlock()
+	observeDeviceLocked(device)
+	fleetSummary.updatedAt = time.Now().UTC()
+}
+
+func observeDeviceLocked(device Device) {
+	if old, ok := fleetSummary.devices[device.ID]; ok {
+		for _, key := range old.keys {
+			if fleetSummary.counts[key]--; fleetSummary.counts[key] <= 0 {
+				delete(fleetSummary.counts, key)
+			}
+		}
+	}
+	channel := device.Channel
+	if channel == "" {
+		channel = catalog.DefaultChannel
+	}
+	entry := summaryDevice{lastSeen: device.LastSeen}
+	if device.CurrentVersion != "" {
+		entry.keys = append(entry.keys, summaryKey{"plugin", channel, device.CurrentVersion})
+	}
+	for app, version := range device.Apps {
+		entry.keys = append(entry.keys, summaryKey{app, channel, version})
+	}
+	for _, key := range entry.keys {
+		fleetSummary.counts[key]++
+	}
+	fleetSummary.devices[device.ID] = entry
+}
+
+// Helper function to drop an expired device from the fleet summary
+func forgetDevice(id string) {
+	fleetSummary.Lock()
+	defer fleetSummary.Unlock()
+	if old, ok := fleetSummary.devices[id]; ok {
+		for _, key := range old.keys {
+			if fleetSummary.counts[key]--; fleetSummary.counts[key] <= 0 {
+				delete(fleetSummary.counts, key)
+			}
+		}
+		delete(fleetSummary.devices, id)
+	}
+	fleetSummary.updatedAt = time.Now().UTC()
+}
+
+// Admin endpoint summarizing the versions the fleet runs, from memory;
+// ?app= narrows it to one app
+func getFleetSummary(c *gin.Context) {
+	app := c.Query("app")
+	staleBefore := time.Now().Add(-staleAfter())
+
+	fleetSummary.RLock()
+	rows := make(map[summaryKey]*FleetVersionCount, len(fleetSummary.counts))
+	for key, n := range fleetSummary.counts {
+		if app == "" || key.app == app {
+			rows[key] = &FleetVersionCount{App: key.app, Channel: key.channel, Version: key.version, Devices: n}
+		}
+	}
+	total, stale := len(fleetSummary.devices), 0
+	for _, device := range fleetSummary.devices {
+		if !device.lastSeen.Before(staleBefore) {
+			continue
+		}
+		stale++
+		for _, key := range device.keys {
+			if row, ok := rows[key]; ok {
+				row.Stale++
+			}
+		}
+	}
+	updatedAt := fleetSummary.updatedAt
+	fleetSummary.RUnlock()
+
+	versions := make([]FleetVersionCount, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, *row)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		return catalog.CompareVersions(a.Version, b.Version) > 0
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"devices":     total,
+		"stale":       stale,
+		"stale_after": staleAfter().String(),
+		"versions":    versions,
+		"updated_at":  updatedAt,
+	})
+}
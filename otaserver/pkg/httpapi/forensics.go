@@ -0,0 +1,265 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// The server remembers the last few artifact transfers of each device: the
+// range requested, the bytes sent, the digest of what was served and the
+// storage backend it came from. When a device reports a failed install, the
+// transfers of that version are captured in a forensic record, together with
+// a fresh digest of the artifact and the digest the device received, so that
+// transport corruption can be told apart from a bad publish.
+
+// transfersPerDevice is how many recent transfers are kept for each device.
+const transfersPerDevice = 8
+
+// Findings of a forensic record
+const (
+	findingNoTransfers     = "no_transfers"     // nothing was served to the device
+	findingIncomplete      = "incomplete"       // no transfer sent every byte
+	findingServedMismatch  = "served_mismatch"  // the bytes served did not match the release
+	findingArtifactChanged = "artifact_changed" // the artifact no longer matches the release
+	findingTransport       = "transport"        // intact bytes were served, the device got others
+	findingServedIntact    = "served_intact"    // intact bytes were served
+	findingRedirected      = "served_by_mirror" // the device was sent to a mirror
+)
+
+// ServedTransfer is what the server sent for one download request.
+type ServedTransfer struct {
+	ReleaseID string    `json:"release_id"`
+	Version   string    `json:"version"`
+	FileName  string    `json:"file_name"`
+	Backend   string    `json:"backend"`
+	Range     string    `json:"range,omitempty"`
+	Status    int       `json:"status"`
+	BytesSent int64     `json:"bytes_sent"`
+	Expected  int64     `json:"expected_bytes"`
+	Complete  bool      `json:"complete"`
+	Digest    string    `json:"served_sha256,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	RequestID string    `json:"request_id,omitempty"`
+	ServedAt  time.Time `json:"served_at"`
+}
+
+// ForensicRecord is captured when a device reports a failed install.
+type ForensicRecord struct {
+	ID             string           `json:"id"`
+	DeviceID       string           `json:"device_id"`
+	Version        string           `json:"version"`
+	Error          string           `json:"error,omitempty"`
+	ReceivedSHA256 string           `json:"received_sha256,omitempty"`
+	ReleaseID      string           `json:"release_id,omitempty"`
+	ArtifactSHA256 string           `json:"artifact_sha256,omitempty"`
+	Transfers      []ServedTransfer `json:"transfers"`
+	Finding        string           `json:"finding"`
+	ReportedAt     time.Time        `json:"reported_at"`
+}
+
+var recentTransfers = struct {
+	sync.Mutex
+	devices map[string][]ServedTransfer
+}{devices: make(map[string][]ServedTransfer)}
+
+// Helper function to remember a transfer to an identified device, and what
+// was served for the access log. path is the file that was served, digest
+// the known digest of a redirect target.
+func recordTransfer(c *gin.Context, release catalog.Release, backend, path, digest string, result transferResult) {
+	c.Set(servedReleaseKey, release)
+	c.Set(transferResultKey, result)
+	id := downloadDeviceID(c)
+	if anonymousMode() || !deviceIDPattern.MatchString(id) {
+		return
+	}
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			digest, _ = catalog.FileDigest(path, info)
+		}
+	}
+
+	transfer := ServedTransfer{
+		ReleaseID: release.ID,
+		Version:   release.Version,
+		FileName:  release.FileName,
+		Backend:   backend,
+		Range:     c.GetHeader("Range"),
+		Status:    result.Status,
+		BytesSent: result.Sent,
+		Expected:  result.Expected,
+		Complete:  result.Complete,
+		Digest:    digest,
+		ClientIP:  c.ClientIP(),
+		RequestID: c.GetString("request_id"),
+		ServedAt:  time.Now().UTC(),
+	}
+
+	recentTransfers.Lock()
+	defer recentTransfers.Unlock()
+	transfers := append(recentTransfers.devices[id], transfer)
+	if len(transfers) > transfersPerDevice {
+		transfers = transfers[len(transfers)-transfersPerDevice:]
+	}
+	recentTransfers.devices[id] = transfers
+}
+
+// Helper function to save a forensic record of the transfers behind a failed
+// install report
+func captureForensics(deviceID string, report InstallReport, received string) error {
+	record := ForensicRecord{
+		DeviceID:       deviceID,
+		Version:        report.Version,
+		Error:          report.Error,
+		ReceivedSHA256: received,
+		Transfers:      []ServedTransfer{},
+		ReportedAt:     report.ReportedAt,
+	}
+	recentTransfers.Lock()
+	for _, transfer := range recentTransfers.devices[deviceID] {
+		if transfer.Version == report.Version {
+			record.Transfers = append(record.Transfers, transfer)
+		}
+	}
+	recentTransfers.Unlock()
+
+	if n := len(record.Transfers); n > 0 {
+		record.ReleaseID = record.Transfers[n-1].ReleaseID
+		// Hash the artifact again, bypassing the digest cache, in case it
+		// was modified in place
+		if digest, err := hashFile(artifacts.ArtifactPath(record.Transfers[n-1].FileName)); err == nil {
+			record.ArtifactSHA256 = digest
+		}
+	}
+	record.Finding = forensicFinding(record)
+
+	raw := make([]byte, 6)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	record.ID = fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(raw))
+	if err := os.MkdirAll(forensicsPath, 0o755); err != nil {
+		return err
+	}
+	return storage.WriteJSON(filepath.Join(forensicsPath, record.ID+".json"), record)
+}
+
+// Helper function to tell what most likely went wrong from a forensic record
+func forensicFinding(record ForensicRecord) string {
+	if len(record.Transfers) == 0 {
+		return findingNoTransfers
+	}
+	if record.ArtifactSHA256 != "" && record.ArtifactSHA256 != record.ReleaseID {
+		return findingArtifactChanged
+	}
+	complete, redirected := false, false
+	for _, transfer := range record.Transfers {
+		if transfer.Digest != "" && transfer.Digest != transfer.ReleaseID {
+			return findingServedMismatch
+		}
+		complete = complete || transfer.Complete
+		redirected = redirected || transfer.Status == http.StatusFound
+	}
+	switch {
+	case redirected && !complete:
+		return findingRedirected
+	case !complete:
+		return findingIncomplete
+	case record.ReceivedSHA256 != "" && record.ReceivedSHA256 != record.ReleaseID:
+		return findingTransport
+	}
+	return findingServedIntact
+}
+
+// Helper function to compute the SHA-256 digest of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Helper function to read the forensic records, newest first
+func listForensicRecords() ([]ForensicRecord, error) {
+	entries, err := os.ReadDir(forensicsPath)
+	if os.IsNotExist(err) {
+		return []ForensicRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []ForensicRecord{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		var record ForensicRecord
+		if err := storage.ReadJSON(filepath.Join(forensicsPath, entry.Name()), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ReportedAt.After(records[j].ReportedAt)
+	})
+	return records, nil
+}
+
+// Admin endpoint listing forensic records of failed installs, optionally
+// filtered by ?device_id=, ?version= and ?finding=
+func listForensics(c *gin.Context) {
+	records, err := listForensicRecords()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read forensic records")
+		return
+	}
+	device, version, finding := c.Query("device_id"), c.Query("version"), c.Query("finding")
+	filtered := []ForensicRecord{}
+	for _, record := range records {
+		if (device != "" && record.DeviceID != device) || (version != "" && record.Version != version) || (finding != "" && record.Finding != finding) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+	c.JSON(http.StatusOK, gin.H{"records": filtered})
+}
+
+// Admin endpoint showing one forensic record
+func getForensics(c *gin.Context) {
+	id := c.Param("id")
+	if strings.ContainsAny(id, `/\.`) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid id")
+		return
+	}
+	var record ForensicRecord
+	path := filepath.Join(forensicsPath, id+".json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "forensic record not found")
+		return
+	}
+	if err := storage.ReadJSON(path, &record); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read forensic record")
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,42 @@
+package httpapi
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to run the storage checks behind the health endpoint,
+// returning a description of every failed check
+func healthChecks() map[string]string {
+	failed := make(map[string]string)
+
+	if _, err := os.ReadDir(otaFilesPath); err != nil {
+		failed["artifacts"] = err.Error()
+	}
+
+	// The state directory must accept writes, unlike the artifact directory
+	// which may be read-only
+	if probe, err := os.CreateTemp(stateDir, ".healthcheck-*"); err != nil {
+		failed["state"] = err.Error()
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	if divergence := mirrorVerifyHealth(); divergence != "" {
+		failed["upstream"] = divergence
+	}
+
+	return failed
+}
+
+// Endpoint for load balancer and container health probes
+func getHealth(c *gin.Context) {
+	if failed := healthChecks(); len(failed) > 0 {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "server is unhealthy", gin.H{"checks": failed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,282 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Every offer, download and install report of a device is appended to its
+// history, one JSON line per event under metadata/device_history, so support
+// can reconstruct what a field unit did: GET /admin/devices/<id>/history.
+// Events older than OTA_DEVICE_HISTORY_DAYS (default 180) are dropped when a
+// history file is compacted. Nothing is recorded in anonymous mode.
+
+// History event kinds
+const (
+	historyOffer    = "offer"
+	historyDownload = "download"
+	historyReport   = "report"
+)
+
+const (
+	// maxHistoryFileSize is the size at which a history file is compacted.
+	maxHistoryFileSize = 2 << 20
+	// maxHistoryEvents is how many events compaction keeps at most.
+	maxHistoryEvents = 5000
+	// defaultHistoryLimit is how many events the history endpoint returns by default.
+	defaultHistoryLimit = 1000
+)
+
+// HistoryEvent is one entry of a device's history.
+type HistoryEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"` // "offer", "download" or "report"
+	App         string    `json:"app,omitempty"`
+	FromVersion string    `json:"from_version,omitempty"` // the version the device ran, for offers
+	Version     string    `json:"version"`
+	Result      string    `json:"result,omitempty"` // complete, incomplete or redirected downloads; install status of reports
+	Bytes       int64     `json:"bytes,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+// historyMu serializes writes to history files.
+var historyMu sync.Mutex
+
+func historyFile(id string) string {
+	return filepath.Join(deviceHistoryPath, id+".jsonl")
+}
+
+func historyRetention() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("OTA_DEVICE_HISTORY_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return 180 * 24 * time.Hour
+}
+
+// Middleware recording the offers, downloads and install reports of device
+// requests in the device's history
+func deviceHistory() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if anonymousMode() {
+			return
+		}
+		event := HistoryEvent{Time: time.Now().UTC(), RequestID: c.GetString("request_id")}
+		deviceID := downloadDeviceID(c)
+
+		if info, ok := CheckResponse(c); ok && info.DownloadURL != "" && c.Writer.Status() == http.StatusOK {
+			event.Event, event.App = historyOffer, requestedApp(c)
+			event.FromVersion, event.Version = c.Query("current_version"), info.LatestVersion
+			recordHistory(deviceID, event)
+		}
+		if response, ok := BundleCheckResponse(c); ok && c.Writer.Status() == http.StatusOK {
+			for _, update := range response.Updates {
+				event.Event, event.App = historyOffer, update.Name
+				event.FromVersion, event.Version = update.CurrentVersion, update.Version
+				recordHistory(deviceID, event)
+			}
+		}
+		if value, ok := c.Get(transferResultKey); ok {
+			result := value.(transferResult)
+			event.Event, event.Bytes = historyDownload, result.Sent
+			if value, ok := c.Get(servedReleaseKey); ok {
+				release := value.(catalog.Release)
+				event.App, event.Version = release.App, release.Version
+			}
+			switch {
+			case result.Complete:
+				event.Result = "complete"
+			case result.Status == http.StatusFound:
+				event.Result = "redirected"
+			default:
+				event.Result = "incomplete"
+			}
+			recordHistory(deviceID, event)
+		}
+		if reportedID, report, ok := ReportedInstall(c); ok {
+			event.Event, event.App, event.Version = historyReport, "plugin", report.Version
+			event.Result, event.Error = report.Status, report.Error
+			recordHistory(reportedID, event)
+		}
+	}
+}
+
+// Helper function to append an event to a device's history, logging failures
+// rather than failing the request
+func recordHistory(deviceID string, event HistoryEvent) {
+	if deviceID == "" || !deviceIDPattern.MatchString(deviceID) || anonymousMode() {
+		return
+	}
+	if err := appendHistory(deviceID, event); err != nil {
+		log.Printf("recording history of %s: %v", deviceID, err)
+	}
+}
+
+// Helper function to append an event to a history file, compacting the file
+// once it grows past maxHistoryFileSize
+func appendHistory(deviceID string, event HistoryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if err := os.MkdirAll(deviceHistoryPath, 0o755); err != nil {
+		return err
+	}
+	path := historyFile(deviceID)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size() > maxHistoryFileSize {
+		return compactHistory(path)
+	}
+	return nil
+}
+
+// Helper function to drop the events past the retention period, keeping at
+// most maxHistoryEvents
+func compactHistory(path string) error {
+	events, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-historyRetention())
+	kept := events[:0]
+	for _, event := range events {
+		if event.Time.After(cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	if len(kept) > maxHistoryEvents {
+		kept = kept[len(kept)-maxHistoryEvents:]
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".history-*.tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, event := range kept {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Helper function to read a history file, oldest event first; a missing file
+// is an empty history
+func readHistory(path string) ([]HistoryEvent, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []HistoryEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := []HistoryEvent{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var event HistoryEvent
+		// A line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Admin endpoint listing a device's history, oldest first, e.g.
+// ?since=2024-03-01T00:00:00Z&event=report&limit=100 (the newest events
+// within the filters are kept)
+func getDeviceHistory(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	var since, until time.Time
+	for name, target := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, CodeInvalidRequest, name+" must be an RFC 3339 time")
+				return
+			}
+			*target = t
+		}
+	}
+	kind := c.Query("event")
+	if kind != "" && kind != historyOffer && kind != historyDownload && kind != historyReport {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "event must be offer, download or report")
+		return
+	}
+	limit := defaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	historyMu.Lock()
+	events, err := readHistory(historyFile(id))
+	historyMu.Unlock()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read device history")
+		return
+	}
+	filtered := []HistoryEvent{}
+	for _, event := range events {
+		if (!since.IsZero() && event.Time.Before(since)) || (!until.IsZero() && event.Time.After(until)) {
+			continue
+		}
+		if kind != "" && event.Event != kind {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	truncated := len(filtered) > limit
+	if truncated {
+		filtered = filtered[len(filtered)-limit:]
+	}
+	c.JSON(http.StatusOK, gin.H{"device_id": id, "events": filtered, "truncated": truncated})
+}
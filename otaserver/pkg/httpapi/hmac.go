@@ -0,0 +1,269 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Devices too constrained for TLS client certificates can sign their requests
+// with a per-device secret obtained at enrollment instead. A signed request
+// carries the headers
+//
+//	X-OTA-Device:    device ID
+//	X-OTA-Timestamp: Unix time in seconds
+//	X-OTA-Nonce:     8 to 64 random letters, digits, '-' or '_', never reused
+//	X-OTA-Signature: hex HMAC-SHA256 of the canonical request
+//
+// where the canonical request is the method, the request URI (path and query),
+// the timestamp, the nonce and the hex SHA-256 of the body, joined by newlines.
+// Requests older or newer than signatureMaxSkew and nonces seen before are
+// rejected. Signatures are verified whenever present; with
+// OTA_DEVICE_AUTH=hmac devices without a client certificate must sign.
+
+const (
+	signatureMaxSkew  = 5 * time.Minute
+	maxSignedBodySize = 1 << 20
+)
+
+var (
+	noncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+	errSignatureMissing = errors.New("request must be signed")
+	errSignatureInvalid = errors.New("request signature is invalid")
+	errSignatureExpired = errors.New("request timestamp is outside the allowed clock skew")
+	errNonceReused      = errors.New("request nonce has already been used")
+)
+
+// nonceBucket is the span of expiry times whose nonces are forgotten together.
+const nonceBucket = time.Minute
+
+// deviceSecrets caches the signing secrets by device, loaded from
+// deviceSecretsFile on first use and kept in step with it by enrollment and
+// revocation.
+var deviceSecrets = struct {
+	sync.RWMutex
+	secrets map[string]string // nil until loaded
+}{}
+
+// seenNonces remembers the nonces of recently accepted requests, by device
+// and nonce, until their timestamps fall out of the allowed skew. They are
+// grouped by the nonceBucket their expiry falls in, so that forgetting them
+// drops whole buckets instead of going through every nonce.
+var seenNonces = struct {
+	sync.Mutex
+	buckets map[int64]map[string]bool // nonce keys by expiry bucket
+}{buckets: make(map[int64]map[string]bool)}
+
+func requireSignedRequests() bool {
+	return os.Getenv("OTA_DEVICE_AUTH") == "hmac"
+}
+
+// Helper function to generate and store a new signing secret for a device,
+// replacing any previous one
+func issueDeviceSecret(deviceID string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(raw)
+
+	deviceSecrets.Lock()
+	defer deviceSecrets.Unlock()
+	secrets, err := loadDeviceSecretsLocked()
+	if err != nil {
+		return "", err
+	}
+	secrets[deviceID] = secret
+	if err := storage.WriteJSONMode(deviceSecretsFile, secrets, 0o600); err != nil {
+		return "", err
+	}
+	deviceSecrets.secrets = secrets
+	return secret, nil
+}
+
+// Helper function to get a copy of the cached secrets, loading them first if
+// needed. Must be called with deviceSecrets locked.
+func loadDeviceSecretsLocked() (map[string]string, error) {
+	if deviceSecrets.secrets == nil {
+		secrets := make(map[string]string)
+		if err := storage.ReadJSON(deviceSecretsFile, &secrets); err != nil {
+			return nil, err
+		}
+		deviceSecrets.secrets = secrets
+	}
+	secrets := make(map[string]string, len(deviceSecrets.secrets)+1)
+	for id, secret := range deviceSecrets.secrets {
+		secrets[id] = secret
+	}
+	return secrets, nil
+}
+
+// Helper function to look up the signing secret of a device
+func deviceSecret(deviceID string) (string, bool, error) {
+	deviceSecrets.RLock()
+	if deviceSecrets.secrets != nil {
+		secret, ok := deviceSecrets.secrets[deviceID]
+		deviceSecrets.RUnlock()
+		return secret, ok, nil
+	}
+	deviceSecrets.RUnlock()
+
+	deviceSecrets.Lock()
+	defer deviceSecrets.Unlock()
+	if _, err := loadDeviceSecretsLocked(); err != nil {
+		return "", false, err
+	}
+	secret, ok := deviceSecrets.secrets[deviceID]
+	return secret, ok, nil
+}
+
+// Admin endpoint revoking a device's signing secret; the device has to enroll again
+func revokeDeviceSecret(c *gin.Context) {
+	deviceSecrets.Lock()
+	defer deviceSecrets.Unlock()
+	secrets, err := loadDeviceSecretsLocked()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load device secrets")
+		return
+	}
+	if _, ok := secrets[c.Param("id")]; !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "device has no signing secret")
+		return
+	}
+	delete(secrets, c.Param("id"))
+	if err := storage.WriteJSONMode(deviceSecretsFile, secrets, 0o600); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save device secrets")
+		return
+	}
+	deviceSecrets.secrets = secrets
+	c.Status(http.StatusNoContent)
+}
+
+// Helper function to compute the signature of a request
+func requestSignature(secret, method, uri, timestamp, nonce string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(bodySum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Helper function to verify the signature headers of a request, returning
+// the signing device. The body is restored for the handlers.
+func verifySignedRequest(c *gin.Context) (string, error) {
+	deviceID := c.GetHeader("X-OTA-Device")
+	timestamp := c.GetHeader("X-OTA-Timestamp")
+	nonce := c.GetHeader("X-OTA-Nonce")
+	signature := c.GetHeader("X-OTA-Signature")
+	if !deviceIDPattern.MatchString(deviceID) || !noncePattern.MatchString(nonce) || signature == "" {
+		return "", errSignatureInvalid
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errSignatureInvalid
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return "", errSignatureExpired
+	}
+
+	secret, ok, err := deviceSecret(deviceID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errSignatureInvalid
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBodySize+1))
+	if err != nil || len(body) > maxSignedBodySize {
+		return "", errSignatureInvalid
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := requestSignature(secret, c.Request.Method, c.Request.RequestURI, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", errSignatureInvalid
+	}
+
+	// Only accepted requests use up their nonce
+	if !useNonce(deviceID+" "+nonce, signedAt.Add(signatureMaxSkew)) {
+		return "", errNonceReused
+	}
+	return deviceID, nil
+}
+
+// Helper function to record a nonce, reporting false if it was already used
+func useNonce(key string, expires time.Time) bool {
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+
+	now := time.Now()
+	span := int64(nonceBucket / time.Second)
+	for bucket, keys := range seenNonces.buckets {
+		if now.Unix() >= (bucket+1)*span {
+			delete(seenNonces.buckets, bucket)
+			continue
+		}
+		if keys[key] {
+			return false
+		}
+	}
+	bucket := expires.Unix() / span
+	if seenNonces.buckets[bucket] == nil {
+		seenNonces.buckets[bucket] = make(map[string]bool)
+	}
+	seenNonces.buckets[bucket][key] = true
+	return true
+}
+
+// deviceSignature verifies HMAC signed device requests and records the
+// signing device for the handlers and the policy.
+func deviceSignature() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("X-OTA-Signature") == "" {
+			if requireSignedRequests() && certDeviceID(c) == "" {
+				respondError(c, http.StatusUnauthorized, CodeUnauthorized, errSignatureMissing.Error())
+				return
+			}
+			c.Next()
+			return
+		}
+
+		deviceID, err := verifySignedRequest(c)
+		switch {
+		case errors.Is(err, errSignatureInvalid), errors.Is(err, errSignatureExpired), errors.Is(err, errNonceReused):
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, err.Error())
+			return
+		case err != nil:
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not verify request signature")
+			return
+		}
+		c.Set("signed_device_id", deviceID)
+		c.Next()
+	}
+}
+
+// Helper function to read the device ID a request is authenticated as, by a
+// verified client certificate or a request signature
+func authenticatedDeviceID(c *gin.Context) string {
+	if id := certDeviceID(c); id != "" {
+		return id
+	}
+	return c.GetString("signed_device_id")
+}
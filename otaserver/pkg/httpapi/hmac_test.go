@@ -0,0 +1,228 @@
+package httpapi
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Helper function to replace the cached device secrets and the seen nonces
+// for the duration of a test
+func withDeviceSecrets(t *testing.T, secrets map[string]string) {
+	t.Helper()
+	deviceSecrets.Lock()
+	previous := deviceSecrets.secrets
+	deviceSecrets.secrets = secrets
+	deviceSecrets.Unlock()
+	seenNonces.Lock()
+	clear(seenNonces.buckets)
+	seenNonces.Unlock()
+	t.Cleanup(func() {
+		deviceSecrets.Lock()
+		deviceSecrets.secrets = previous
+		deviceSecrets.Unlock()
+	})
+}
+
+// signedRequest describes the headers and body of a signed request.
+type signedRequest struct {
+	method, uri, body string
+	device, nonce     string
+	timestamp         string
+	signature         string
+}
+
+// Helper function to sign a request with a secret, filling in what is unset
+func (r signedRequest) sign(secret string) signedRequest {
+	if r.method == "" {
+		r.method = "POST"
+	}
+	if r.uri == "" {
+		r.uri = "/report?app=plugin"
+	}
+	if r.device == "" {
+		r.device = "pos-1"
+	}
+	if r.nonce == "" {
+		r.nonce = "nonce-0001"
+	}
+	if r.timestamp == "" {
+		r.timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	r.signature = requestSignature(secret, r.method, r.uri, r.timestamp, r.nonce, []byte(r.body))
+	return r
+}
+
+// Helper function to build the gin context of a request
+func (r signedRequest) context() *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(r.method, r.uri, strings.NewReader(r.body))
+	for name, value := range map[string]string{"X-OTA-Device": r.device, "X-OTA-Timestamp": r.timestamp, "X-OTA-Nonce": r.nonce, "X-OTA-Signature": r.signature} {
+		if value != "" {
+			c.Request.Header.Set(name, value)
+		}
+	}
+	return c
+}
+
+func TestVerifySignedRequest(t *testing.T) {
+	const secret = "00112233445566778899aabbccddeeff"
+	now := time.Now().Unix()
+	ts := func(offset time.Duration) string { return strconv.FormatInt(now+int64(offset/time.Second), 10) }
+
+	tests := []struct {
+		name    string
+		req     func() signedRequest
+		wantErr error
+	}{
+		{"valid", func() signedRequest {
+			return signedRequest{body: `{"status":"success"}`}.sign(secret)
+		}, nil},
+		{"valid GET without body", func() signedRequest {
+			return signedRequest{method: "GET", uri: "/check-update?current_version=1.0.0"}.sign(secret)
+		}, nil},
+		{"within the skew", func() signedRequest {
+			return signedRequest{timestamp: ts(-signatureMaxSkew + time.Minute)}.sign(secret)
+		}, nil},
+		{"wrong secret", func() signedRequest {
+			return signedRequest{}.sign("ffeeddccbbaa99887766554433221100")
+		}, errSignatureInvalid},
+		{"unknown device", func() signedRequest {
+			return signedRequest{device: "pos-2"}.sign(secret)
+		}, errSignatureInvalid},
+		{"body changed", func() signedRequest {
+			r := signedRequest{body: `{"status":"success"}`}.sign(secret)
+			r.body = `{"status":"failure"}`
+			return r
+		}, errSignatureInvalid},
+		{"query changed", func() signedRequest {
+			r := signedRequest{}.sign(secret)
+			r.uri = "/report?app=runtime"
+			return r
+		}, errSignatureInvalid},
+		{"method changed", func() signedRequest {
+			r := signedRequest{}.sign(secret)
+			r.method = "PUT"
+			return r
+		}, errSignatureInvalid},
+		{"timestamp changed", func() signedRequest {
+			r := signedRequest{timestamp: ts(0)}.sign(secret)
+			r.timestamp = ts(time.Second)
+			return r
+		}, errSignatureInvalid},
+		{"signature uppercase", func() signedRequest {
+			r := signedRequest{}.sign(secret)
+			r.signature = strings.ToUpper(r.signature)
+			return r
+		}, errSignatureInvalid},
+		{"signature missing", func() signedRequest {
+			r := signedRequest{}.sign(secret)
+			r.signature = ""
+			return r
+		}, errSignatureInvalid},
+		{"nonce too short", func() signedRequest {
+			return signedRequest{nonce: "short"}.sign(secret)
+		}, errSignatureInvalid},
+		{"nonce with spaces", func() signedRequest {
+			return signedRequest{nonce: "nonce 0001"}.sign(secret)
+		}, errSignatureInvalid},
+		{"invalid device ID", func() signedRequest {
+			return signedRequest{device: "../pos-1"}.sign(secret)
+		}, errSignatureInvalid},
+		{"timestamp not a number", func() signedRequest {
+			return signedRequest{timestamp: "yesterday"}.sign(secret)
+		}, errSignatureInvalid},
+		{"timestamp too old", func() signedRequest {
+			return signedRequest{timestamp: ts(-signatureMaxSkew - time.Minute)}.sign(secret)
+		}, errSignatureExpired},
+		{"timestamp in the future", func() signedRequest {
+			return signedRequest{timestamp: ts(signatureMaxSkew + time.Minute)}.sign(secret)
+		}, errSignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDeviceSecrets(t, map[string]string{"pos-1": secret})
+			r := tt.req()
+			c := r.context()
+			device, err := verifySignedRequest(c)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verifySignedRequest = %q, %v, want error %v", device, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if device != r.device {
+				t.Errorf("verifySignedRequest = %q, want %q", device, r.device)
+			}
+			if body, _ := io.ReadAll(c.Request.Body); string(body) != r.body {
+				t.Errorf("body left for the handlers = %q, want %q", body, r.body)
+			}
+		})
+	}
+}
+
+func TestVerifySignedRequestNonces(t *testing.T) {
+	secrets := map[string]string{"pos-1": "secret-1", "pos-2": "secret-2"}
+	withDeviceSecrets(t, secrets)
+	verify := func(r signedRequest) error {
+		_, err := verifySignedRequest(r.sign(secrets[r.device]).context())
+		return err
+	}
+
+	steps := []struct {
+		name    string
+		req     signedRequest
+		wantErr error
+	}{
+		{"first use", signedRequest{device: "pos-1", nonce: "nonce-0001"}, nil},
+		{"replayed", signedRequest{device: "pos-1", nonce: "nonce-0001"}, errNonceReused},
+		{"replayed on another URI", signedRequest{device: "pos-1", nonce: "nonce-0001", uri: "/progress"}, errNonceReused},
+		{"replayed with a later timestamp", signedRequest{device: "pos-1", nonce: "nonce-0001", timestamp: strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10)}, errNonceReused},
+		{"same nonce, other device", signedRequest{device: "pos-2", nonce: "nonce-0001"}, nil},
+		{"other nonce", signedRequest{device: "pos-1", nonce: "nonce-0002"}, nil},
+		{"rejected request", signedRequest{device: "pos-1", nonce: "nonce-0003", timestamp: "0"}, errSignatureExpired},
+		{"nonce of a rejected request", signedRequest{device: "pos-1", nonce: "nonce-0003"}, nil},
+	}
+	for _, step := range steps {
+		if err := verify(step.req); !errors.Is(err, step.wantErr) {
+			t.Errorf("%s: verifySignedRequest = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+}
+
+func TestUseNonceForgetsExpiredBuckets(t *testing.T) {
+	withDeviceSecrets(t, nil)
+	now := time.Now()
+
+	if !useNonce("pos-1 old", now.Add(-2*nonceBucket)) {
+		t.Fatal("useNonce of a new nonce = false")
+	}
+	if !useNonce("pos-1 fresh", now.Add(signatureMaxSkew)) {
+		t.Fatal("useNonce of a new nonce = false")
+	}
+	// Using any nonce drops the buckets that have expired
+	if !useNonce("pos-1 old", now.Add(signatureMaxSkew)) {
+		t.Error("useNonce of an expired nonce = false, want it forgotten")
+	}
+	if useNonce("pos-1 fresh", now.Add(signatureMaxSkew)) {
+		t.Error("useNonce of a remembered nonce = true")
+	}
+
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+	for bucket := range seenNonces.buckets {
+		if end := time.Unix((bucket+1)*int64(nonceBucket/time.Second), 0); !end.After(now) {
+			t.Errorf("bucket ending at %s was kept", end)
+		}
+	}
+}
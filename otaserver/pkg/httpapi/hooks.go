@@ -0,0 +1,100 @@
+package httpapi
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/manifest"
+)
+
+// Deployments that embed the server can run their own code at fixed points of
+// the device API, e.g. to bill checks, add authentication or rewrite
+// requests, without forking it. Hooks are gin handlers. Pre-hooks run after
+// the built-in authentication, quota and policy checks and before the
+// endpoint; they can change c.Request or abort with a response of their own.
+// Post-hooks run once the endpoint has responded successfully (error
+// responses abort the chain) and can read what was sent with CheckResponse,
+// BundleCheckResponse and ReportedInstall. Hooks must not call c.Next.
+
+// HookPoint names a point of the device API where hooks run.
+type HookPoint string
+
+// Hook points
+const (
+	PreCheck    HookPoint = "pre-check"    // before /check-update, /checkupdate and /check-bundle
+	PostCheck   HookPoint = "post-check"   // after a check was answered
+	PreDownload HookPoint = "pre-download" // before /download, /blobs and /patches
+	PostReport  HookPoint = "post-report"  // after an install report was recorded
+)
+
+// Context keys under which endpoints leave their result for post-hooks
+const (
+	checkResponseKey       = "ota.check_response"
+	bundleCheckResponseKey = "ota.bundle_check_response"
+	reportedInstallKey     = "ota.reported_install"
+)
+
+var hooks = struct {
+	sync.RWMutex
+	handlers map[HookPoint][]gin.HandlerFunc
+}{handlers: make(map[HookPoint][]gin.HandlerFunc)}
+
+// AddHook registers a handler to run at a hook point. Hooks of a point run in
+// the order they were added, until one aborts the request.
+func AddHook(point HookPoint, hook gin.HandlerFunc) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.handlers[point] = append(hooks.handlers[point], hook)
+}
+
+// Helper function to build the handler running the hooks of a point
+func runHooks(point HookPoint) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hooks.RLock()
+		handlers := hooks.handlers[point]
+		hooks.RUnlock()
+		for _, hook := range handlers {
+			hook(c)
+			if c.IsAborted() {
+				return
+			}
+		}
+	}
+}
+
+// CheckResponse returns the check-update response sent to the device, for
+// post-check hooks.
+func CheckResponse(c *gin.Context) (manifest.VersionInfo, bool) {
+	info, ok := c.Get(checkResponseKey)
+	if !ok {
+		return manifest.VersionInfo{}, false
+	}
+	return info.(manifest.VersionInfo), true
+}
+
+// BundleCheckResponse returns the bundle manifest sent to the device, for
+// post-check hooks.
+func BundleCheckResponse(c *gin.Context) (manifest.BundleManifest, bool) {
+	response, ok := c.Get(bundleCheckResponseKey)
+	if !ok {
+		return manifest.BundleManifest{}, false
+	}
+	return response.(manifest.BundleManifest), true
+}
+
+// reportedInstall is what an install report left for post-report hooks.
+type reportedInstall struct {
+	deviceID string
+	report   InstallReport
+}
+
+// ReportedInstall returns the device and the install report just recorded,
+// for post-report hooks. The device ID is empty in anonymous mode.
+func ReportedInstall(c *gin.Context) (string, InstallReport, bool) {
+	value, ok := c.Get(reportedInstallKey)
+	if !ok {
+		return "", InstallReport{}, false
+	}
+	reported := value.(reportedInstall)
+	return reported.deviceID, reported.report, true
+}
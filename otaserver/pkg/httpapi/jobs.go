@@ -0,0 +1,200 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Long-running work such as delta generation runs in a bounded pool of
+// workers fed by a queue. The pool size is OTA_JOB_WORKERS (default 2).
+// Failed jobs are retried with a growing delay up to jobMaxAttempts times,
+// unless the queue is full by then. Finished jobs are listed for
+// jobRetention, and at most jobMaxFinished of them.
+
+const (
+	jobQueueSize   = 256
+	jobMaxAttempts = 3
+	jobRetryDelay  = 10 * time.Second
+	jobRetention   = 24 * time.Hour
+	jobMaxFinished = 1000
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// Job is one unit of background work and its progress.
+type Job struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	run func() error
+}
+
+var jobState = struct {
+	sync.Mutex
+	nextID  int
+	jobs    map[int]*Job
+	pending map[string]*Job // queued or running jobs by kind+target, to avoid duplicates
+	queue   chan *Job
+}{
+	jobs:    make(map[int]*Job),
+	pending: make(map[string]*Job),
+	queue:   make(chan *Job, jobQueueSize),
+}
+
+// Helper function to start the job workers
+func initJobs() {
+	workers := 2
+	if n, err := strconv.Atoi(os.Getenv("OTA_JOB_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+	for i := 0; i < workers; i++ {
+		go jobWorker()
+	}
+}
+
+// enqueueJob schedules work unless an identical job is already pending.
+// It returns the queued (or already pending) job.
+func enqueueJob(kind, target string, run func() error) (*Job, error) {
+	jobState.Lock()
+	defer jobState.Unlock()
+
+	key := kind + " " + target
+	if job, ok := jobState.pending[key]; ok {
+		return job, nil
+	}
+	pruneJobsLocked()
+
+	jobState.nextID++
+	now := time.Now().UTC()
+	job := &Job{ID: jobState.nextID, Kind: kind, Target: target, State: jobQueued, CreatedAt: now, UpdatedAt: now, run: run}
+	select {
+	case jobState.queue <- job:
+	default:
+		return nil, fmt.Errorf("job queue is full")
+	}
+	jobState.jobs[job.ID] = job
+	jobState.pending[key] = job
+	return job, nil
+}
+
+func jobWorker() {
+	for job := range jobState.queue {
+		setJobState(job, jobRunning, "")
+		err := job.run()
+
+		jobState.Lock()
+		job.Attempts++
+		retry := err != nil && job.Attempts < jobMaxAttempts
+		jobState.Unlock()
+
+		switch {
+		case err == nil:
+			setJobState(job, jobSucceeded, "")
+		case retry:
+			setJobState(job, jobQueued, err.Error())
+			delay := jobRetryDelay * time.Duration(job.Attempts)
+			time.AfterFunc(delay, func() { requeueJob(job) })
+		default:
+			setJobState(job, jobFailed, err.Error())
+			log.Printf("job %d (%s %s) failed: %v", job.ID, job.Kind, job.Target, err)
+		}
+	}
+}
+
+// Helper function to put a job back in the queue for another attempt,
+// failing it when the queue is full rather than waiting for room
+func requeueJob(job *Job) {
+	select {
+	case jobState.queue <- job:
+	default:
+		setJobState(job, jobFailed, "job queue is full, not retried: "+job.Error)
+		log.Printf("job %d (%s %s) not retried: job queue is full", job.ID, job.Kind, job.Target)
+	}
+}
+
+// Helper function to forget the jobs finished more than jobRetention ago and
+// the oldest finished jobs beyond jobMaxFinished. Must be called with
+// jobState locked.
+func pruneJobsLocked() {
+	cutoff := time.Now().Add(-jobRetention)
+	var finished []*Job
+	for id, job := range jobState.jobs {
+		if job.State != jobSucceeded && job.State != jobFailed {
+			continue
+		}
+		if job.UpdatedAt.Before(cutoff) {
+			delete(jobState.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) > jobMaxFinished {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].UpdatedAt.Before(finished[j].UpdatedAt) })
+		for _, job := range finished[:len(finished)-jobMaxFinished] {
+			delete(jobState.jobs, job.ID)
+		}
+	}
+}
+
+func setJobState(job *Job, state, errMsg string) {
+	jobState.Lock()
+	defer jobState.Unlock()
+	job.State = state
+	job.Error = errMsg
+	job.UpdatedAt = time.Now().UTC()
+	if state == jobSucceeded || state == jobFailed {
+		delete(jobState.pending, job.Kind+" "+job.Target)
+	}
+}
+
+// Admin endpoint listing background jobs, newest first
+func listJobs(c *gin.Context) {
+	jobState.Lock()
+	jobs := make([]Job, 0, len(jobState.jobs))
+	for _, job := range jobState.jobs {
+		jobs = append(jobs, *job)
+	}
+	jobState.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// Admin endpoint showing one background job
+func getJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	jobState.Lock()
+	job, ok := jobState.jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	jobState.Unlock()
+
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "job not found")
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
@@ -0,0 +1,237 @@
+package httpapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A few slow clients must not be able to tie up the server's connections, so
+// every connection and request is bounded. Listeners limit how long a client
+// may take to send its request headers (OTA_READ_HEADER_TIMEOUT, default
+// 10s), how large they may be (OTA_MAX_HEADER_BYTES, default 64 KiB) and how
+// long an idle keep-alive connection stays open (OTA_IDLE_TIMEOUT, default
+// 2m); each can be set for one listener of the otaserver command by naming
+// it, e.g. OTA_HTTPS_IDLE_TIMEOUT. Request bodies are limited by route: the
+// upload routes accept OTA_MAX_UPLOAD_BYTES (default 8 GiB) as long as data
+// keeps arriving (OTA_UPLOAD_IDLE_TIMEOUT, default 1m), every other route
+// OTA_MAX_BODY_BYTES (default 8 MiB) sent within OTA_BODY_TIMEOUT (default
+// 30s). Responses may not stall for more than OTA_WRITE_IDLE_TIMEOUT (default
+// 1m) on a client that stopped reading, which bounds downloads without
+// limiting how long a large artifact takes on a slow link. The WebSocket
+// command channel is exempt.
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+	defaultMaxBodyBytes      = 8 << 20
+	defaultMaxUploadBytes    = 8 << 30
+	defaultBodyTimeout       = 30 * time.Second
+	defaultUploadIdleTimeout = time.Minute
+	defaultWriteIdleTimeout  = time.Minute
+)
+
+// ListenerLimits bound the connections of a listener.
+type ListenerLimits struct {
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// ListenerLimitsFromEnv reads the limits of the named listener (e.g.
+// "https") from OTA_<NAME>_READ_HEADER_TIMEOUT, OTA_<NAME>_IDLE_TIMEOUT and
+// OTA_<NAME>_MAX_HEADER_BYTES, falling back to the same variables without
+// the name and then to the defaults.
+func ListenerLimitsFromEnv(name string) ListenerLimits {
+	limits := ListenerLimits{
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+		MaxHeaderBytes:    defaultMaxHeaderBytes,
+	}
+	if d, ok := listenerDuration(name, "READ_HEADER_TIMEOUT"); ok {
+		limits.ReadHeaderTimeout = d
+	}
+	if d, ok := listenerDuration(name, "IDLE_TIMEOUT"); ok {
+		limits.IdleTimeout = d
+	}
+	if n, err := strconv.Atoi(listenerEnv(name, "MAX_HEADER_BYTES")); err == nil && n > 0 {
+		limits.MaxHeaderBytes = n
+	}
+	return limits
+}
+
+// Apply sets the limits on a server. Whole-request read and write timeouts
+// stay off: they would cut large uploads and downloads short, and the
+// request limits middleware bounds stalls instead.
+func (l ListenerLimits) Apply(server *http.Server) {
+	server.ReadHeaderTimeout = l.ReadHeaderTimeout
+	server.IdleTimeout = l.IdleTimeout
+	server.MaxHeaderBytes = l.MaxHeaderBytes
+}
+
+// Helper function to read a listener setting, preferring the listener's own
+func listenerEnv(name, key string) string {
+	if name != "" {
+		if v := os.Getenv("OTA_" + strings.ToUpper(name) + "_" + key); v != "" {
+			return v
+		}
+	}
+	return os.Getenv("OTA_" + key)
+}
+
+func listenerDuration(name, key string) (time.Duration, bool) {
+	d, err := time.ParseDuration(listenerEnv(name, key))
+	return d, err == nil && d > 0
+}
+
+// uploadRoutes take artifact uploads, with their own body size limit and an
+// idle timeout instead of a deadline.
+var uploadRoutes = map[string]bool{
+	"/admin/upload":       true,
+	"/admin/upload/:file": true,
+	"/admin/uploads/:id":  true,
+}
+
+// largeBodyRoutes accept bodies larger than OTA_MAX_BODY_BYTES.
+var largeBodyRoutes = map[string]int64{
+	"/admin/releases/:app/:version/sbom": maxSBOMSize,
+}
+
+// longLivedRoutes hold their connection open on purpose.
+var longLivedRoutes = map[string]bool{
+	"/commands": true,
+}
+
+// Helper function to read a byte size setting
+func envBytes(key string, fallback int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// Helper function to read a duration setting
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func maxUploadBytes() int64 {
+	return envBytes("OTA_MAX_UPLOAD_BYTES", defaultMaxUploadBytes)
+}
+
+// Helper function to get the body size limit of a route
+func maxBodyBytes(route string) int64 {
+	if uploadRoutes[route] {
+		return maxUploadBytes()
+	}
+	limit := envBytes("OTA_MAX_BODY_BYTES", defaultMaxBodyBytes)
+	if n, ok := largeBodyRoutes[route]; ok && n > limit {
+		limit = n
+	}
+	return limit
+}
+
+// bodyTooLarge reports whether reading a request body failed on its size
+// limit.
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// Middleware bounding the size of request bodies, how long clients may take
+// to send them and how long a response may stall
+func requestLimits() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rc := http.NewResponseController(c.Writer)
+		route := c.FullPath()
+		if longLivedRoutes[route] {
+			// Clear what an earlier request on the connection left
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+			c.Next()
+			return
+		}
+
+		limit := maxBodyBytes(route)
+		if c.Request.ContentLength > limit {
+			respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "request body is too large", gin.H{"max_bytes": limit})
+			return
+		}
+		// Requests without a body are left alone: the server is already
+		// watching their connection for the client going away
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			body := http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+			if uploadRoutes[route] {
+				idle := envDuration("OTA_UPLOAD_IDLE_TIMEOUT", defaultUploadIdleTimeout)
+				rc.SetReadDeadline(time.Now().Add(idle))
+				c.Request.Body = &idleBody{ReadCloser: body, rc: rc, idle: idle}
+			} else {
+				rc.SetReadDeadline(time.Now().Add(envDuration("OTA_BODY_TIMEOUT", defaultBodyTimeout)))
+				c.Request.Body = body
+			}
+		}
+
+		writer := &idleWriter{ResponseWriter: c.Writer, rc: rc, idle: envDuration("OTA_WRITE_IDLE_TIMEOUT", defaultWriteIdleTimeout)}
+		c.Writer = writer
+		c.Next()
+		// The response may still be buffered, and is sent after the handlers
+		writer.extend()
+	}
+}
+
+// idleBody is a request body whose read deadline moves on with every read,
+// so a client may take as long as it needs as long as it keeps sending.
+type idleBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+	done bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	// Once the body is read the server watches the connection itself
+	if err == nil && !b.done {
+		b.rc.SetReadDeadline(time.Now().Add(b.idle))
+	} else if err != nil {
+		b.done = true
+	}
+	return n, err
+}
+
+// idleWriter moves the write deadline of the connection on before every
+// write, so only a response that stalls is cut off.
+type idleWriter struct {
+	gin.ResponseWriter
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func (w *idleWriter) extend() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.idle))
+}
+
+func (w *idleWriter) Write(data []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idleWriter) WriteString(s string) (int, error) {
+	w.extend()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *idleWriter) Flush() {
+	w.extend()
+	w.ResponseWriter.Flush()
+}
@@ -0,0 +1,121 @@
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ota-server/pkg/mdns"
+)
+
+// With OTA_MDNS=true the server advertises itself on the local network over
+// multicast DNS as an "_ota._tcp" service (DNS-SD), so devices on the LAN can
+// find a local mirror instead of being provisioned with its address. The
+// instance is named by OTA_MDNS_NAME (default "ota-server on <hostname>") and
+// its TXT record carries the base URL (OTA_PUBLIC_URL, or the host's .local
+// name and port), the update check path, the catalog revision and the server
+// version. The service is announced again when the catalog revision changes,
+// so devices can tell a mirror has new releases without polling it.
+
+const (
+	mdnsServiceType   = "_ota._tcp"
+	mdnsCheckInterval = 5 * time.Second
+)
+
+// Helper function to tell whether mDNS advertisement is enabled
+func mdnsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("OTA_MDNS"))
+	return enabled
+}
+
+// Helper function to read the catalog revision
+func currentCatalogRevision() uint64 {
+	offerCache.RLock()
+	defer offerCache.RUnlock()
+	return offerCache.revision
+}
+
+// mdnsAdvertisement stops the advertisement and its revision watcher.
+type mdnsAdvertisement struct {
+	responder *mdns.Responder
+	stop      chan struct{}
+}
+
+func (a *mdnsAdvertisement) Close() error {
+	close(a.stop)
+	return a.responder.Close()
+}
+
+// StartMDNS advertises the server listening on addr over multicast DNS when
+// OTA_MDNS is set, with an https base URL if secure. It returns nil when
+// advertisement is disabled; closing the result withdraws the service.
+func StartMDNS(addr net.Addr, secure bool) (io.Closer, error) {
+	if !mdnsEnabled() {
+		return nil, nil
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("cannot advertise a %s listener", addr.Network())
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("reading host name: %w", err)
+	}
+	host, _, _ := strings.Cut(hostname, ".")
+	name := os.Getenv("OTA_MDNS_NAME")
+	if name == "" {
+		name = "ota-server on " + host
+	}
+	baseURL := strings.TrimSuffix(os.Getenv("OTA_PUBLIC_URL"), "/")
+	if baseURL == "" {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s.local:%d", scheme, host, tcpAddr.Port)
+	}
+
+	responder, err := mdns.Advertise(mdns.Service{
+		Instance: name,
+		Type:     mdnsServiceType,
+		Host:     host,
+		Port:     tcpAddr.Port,
+		Text: func() []string {
+			return []string{
+				"txtvers=1",
+				"url=" + baseURL,
+				"path=/check-update",
+				"revision=" + strconv.FormatUint(currentCatalogRevision(), 10),
+				"version=" + Version,
+			}
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting mDNS responder: %w", err)
+	}
+	log.Printf("Advertising %q over mDNS as %s", name, baseURL)
+
+	advertisement := &mdnsAdvertisement{responder: responder, stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(mdnsCheckInterval)
+		defer ticker.Stop()
+		announced := currentCatalogRevision()
+		for {
+			select {
+			case <-advertisement.stop:
+				return
+			case <-ticker.C:
+			}
+			if revision := currentCatalogRevision(); revision != announced {
+				announced = revision
+				responder.Announce()
+			}
+		}
+	}()
+	return advertisement, nil
+}
@@ -0,0 +1,126 @@
+package httpapi
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/rollout"
+	"ota-server/pkg/storage"
+)
+
+// ReleaseMeta holds the information about a release that cannot be derived
+// from the artifact file itself.
+type ReleaseMeta struct {
+	App       string    `json:"app"`
+	Version   string    `json:"version"`
+	Notes     string    `json:"notes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// InstallWindow restricts offering the release to a daily window in the
+	// device's local time.
+	InstallWindow *rollout.InstallWindow `json:"install_window,omitempty"`
+
+	// Signature covers the release digest, see manifest.SigningPayload.
+	Signature *manifest.Signature `json:"signature,omitempty"`
+
+	// Mandatory releases must be installed by devices passing through them.
+	Mandatory bool `json:"mandatory,omitempty"`
+
+	// MinimumVersion is the oldest version the release can be installed
+	// over; older devices must first step through an intermediate release.
+	MinimumVersion string `json:"minimum_version,omitempty"`
+
+	// Provenance records how the release was built, see provenance.go.
+	Provenance *manifest.Provenance `json:"provenance,omitempty"`
+
+	// SBOM summarizes the bill of materials attached to the release, see sbom.go.
+	SBOM *SBOMInfo `json:"sbom,omitempty"`
+
+	// Security marks the release as fixing vulnerabilities, see security.go.
+	Security *SecurityFix `json:"security,omitempty"`
+
+	// Fields are templates rendered for each device into its offer, see fields.go.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// Scan is the result of the malware scan done at upload.
+	Scan *ScanResult `json:"scan,omitempty"`
+
+	// Mirrors records the verified copies of the artifact by mirror name.
+	Mirrors map[string]MirrorCopy `json:"mirrors,omitempty"`
+
+	// Prewarm records the release's copies to mirrors and fetches through
+	// edges by "<kind>:<target>", see prewarm.go.
+	Prewarm map[string]PrewarmStatus `json:"prewarm,omitempty"`
+
+	// Issues flagged against the release; P1 issues block its promotion, see promotion.go.
+	Issues []ReleaseIssue `json:"issues,omitempty"`
+
+	// PromotionBlock keeps the release from being promoted automatically.
+	PromotionBlock *PromotionBlock `json:"promotion_block,omitempty"`
+
+	// Overwrites are the forced uploads that replaced the release's content.
+	Overwrites []ReleaseOverwrite `json:"overwrites,omitempty"`
+
+	// Digests of the content in algorithms other than SHA-256, see digests.go.
+	Digests *ReleaseDigests `json:"digests,omitempty"`
+}
+
+// metadataMu serializes read-modify-write cycles on metadata files.
+var metadataMu sync.Mutex
+
+func metadataFile(app, version string) string {
+	return filepath.Join(metadataPath, app+"_"+version+".json")
+}
+
+// Helper function to load the metadata of a release; a missing file yields
+// an empty record rather than an error
+func loadReleaseMeta(app, version string) (ReleaseMeta, error) {
+	meta := ReleaseMeta{App: app, Version: version}
+	err := storage.ReadJSON(metadataFile(app, version), &meta)
+	return meta, err
+}
+
+// Helper function to persist the metadata of a release
+func saveReleaseMeta(meta ReleaseMeta) error {
+	return storage.WriteJSON(metadataFile(meta.App, meta.Version), meta)
+}
+
+// Helper function to put back the metadata of a release as it was before a
+// failed publish, removing it when there was none
+func restoreReleaseMeta(previous ReleaseMeta, existed bool) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	var err error
+	if existed {
+		err = saveReleaseMeta(previous)
+	} else if err = os.Remove(metadataFile(previous.App, previous.Version)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("restoring metadata of %s %s: %v", previous.App, previous.Version, err)
+	}
+	invalidateCatalog()
+}
+
+// Helper function to apply a change to a release's metadata atomically
+func updateReleaseMeta(app, version string, update func(*ReleaseMeta)) (ReleaseMeta, error) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	meta, err := loadReleaseMeta(app, version)
+	if err != nil {
+		return meta, err
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+	update(&meta)
+	err = saveReleaseMeta(meta)
+	invalidateCatalog()
+	return meta, err
+}
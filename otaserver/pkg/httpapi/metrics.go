@@ -0,0 +1,110 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Process metrics in the Prometheus text exposition format, served on
+// /metrics behind the admin token.
+
+// metric is a single counter or gauge.
+type metric struct {
+	name  string
+	help  string
+	kind  string // "counter" or "gauge"
+	value atomic.Int64
+
+	// labels and collect give a metric one sample per label value, read when
+	// the metrics are served, instead of its single value; the values of a
+	// metric with several labels are joined by labelSeparator
+	labels  []string
+	collect func() map[string]int64
+}
+
+const labelSeparator = "\x00"
+
+func (m *metric) Add(n int64) { m.value.Add(n) }
+
+func (m *metric) Set(n int64) { m.value.Store(n) }
+
+var metricsRegistry = struct {
+	sync.Mutex
+	metrics []*metric
+}{}
+
+func registerMetric(name, kind, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind}
+	metricsRegistry.Lock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	metricsRegistry.Unlock()
+	return m
+}
+
+func newCounter(name, help string) *metric { return registerMetric(name, "counter", help) }
+
+func newGauge(name, help string) *metric { return registerMetric(name, "gauge", help) }
+
+// Helper function to register a gauge with one sample per value of a label,
+// collected when the metrics are served
+func newLabeledGauge(name, help, label string, collect func() map[string]int64) *metric {
+	m := registerMetric(name, "gauge", help)
+	m.labels, m.collect = []string{label}, collect
+	return m
+}
+
+// Helper function to register a counter with one sample per combination of
+// label values, collected when the metrics are served
+func newLabeledCounter(name, help string, labels []string, collect func() map[string]int64) *metric {
+	m := registerMetric(name, "counter", help)
+	m.labels, m.collect = labels, collect
+	return m
+}
+
+// Helper function to join the label values of a sample
+func labelValues(values ...string) string { return strings.Join(values, labelSeparator) }
+
+// Endpoint exposing the metrics to Prometheus
+func getMetrics(c *gin.Context) {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metricsRegistry.metrics {
+		if m.collect == nil {
+			fmt.Fprintf(c.Writer, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value.Load())
+			continue
+		}
+		fmt.Fprintf(c.Writer, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		samples := m.collect()
+		values := make([]string, 0, len(samples))
+		for value := range samples {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			fmt.Fprintf(c.Writer, "%s{%s} %d\n", m.name, formatLabels(m.labels, value), samples[value])
+		}
+	}
+}
+
+// Helper function to format the labels of a sample, e.g. app="plugin",region="eu"
+func formatLabels(labels []string, value string) string {
+	values := strings.SplitN(value, labelSeparator, len(labels))
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", label, v)
+	}
+	return strings.Join(pairs, ",")
+}
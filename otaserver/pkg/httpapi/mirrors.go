@@ -0,0 +1,337 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Every published artifact can be replicated to the backends listed in
+// OTA_MIRRORS (comma-separated, e.g. "s3://ota-eu/artifacts?region=eu-west-1,
+// s3://ota-us/artifacts?region=us-east-1,file:///mnt/replica"). Each copy is
+// verified against the release digest before it is recorded in the release
+// metadata. The backends and the OTA files directory are probed periodically,
+// and downloads are served from the healthiest one holding the artifact,
+// preferring the lowest latency, so an outage of one location does not stop
+// the fleet from updating.
+
+// localMirror is the name of the OTA files directory among the mirrors.
+const localMirror = "local"
+
+const (
+	mirrorProbeInterval = 30 * time.Second
+	mirrorProbeTimeout  = 5 * time.Second
+	mirrorURLExpiry     = 15 * time.Minute
+)
+
+// MirrorCopy is a verified copy of an artifact on a mirror.
+type MirrorCopy struct {
+	SHA256     string    `json:"sha256"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// MirrorHealth is the result of the last probe of a mirror.
+type MirrorHealth struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+var mirrorState = struct {
+	sync.RWMutex
+	backends []storage.Backend
+	health   map[string]MirrorHealth
+}{health: make(map[string]MirrorHealth)}
+
+var mirrorCopies = newCounter("ota_mirror_copies_total", "Artifact copies replicated and verified on mirrors.")
+
+// Helper function to set up the mirrors configured in the environment and
+// start probing them
+func initMirrors() error {
+	creds := awsCredentialsFromEnv()
+	var backends []storage.Backend
+	seen := map[string]bool{localMirror: true}
+	for _, spec := range strings.Split(os.Getenv("OTA_MIRRORS"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		backend, err := storage.ParseBackend(spec, creds)
+		if err != nil {
+			return err
+		}
+		if seen[backend.Name()] {
+			return fmt.Errorf("duplicate mirror name %q", backend.Name())
+		}
+		seen[backend.Name()] = true
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+
+	mirrorState.Lock()
+	mirrorState.backends = backends
+	mirrorState.Unlock()
+	probeMirrors()
+	go func() {
+		for range time.Tick(mirrorProbeInterval) {
+			probeMirrors()
+		}
+	}()
+	return nil
+}
+
+func mirrorBackends() []storage.Backend {
+	mirrorState.RLock()
+	defer mirrorState.RUnlock()
+	return mirrorState.backends
+}
+
+// Helper function to check that a mirror name is configured
+func mirrorConfigured(name string) bool {
+	for _, backend := range mirrorBackends() {
+		if backend.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to probe the OTA files directory and every mirror
+func probeMirrors() {
+	backends := mirrorBackends()
+	results := make([]MirrorHealth, len(backends)+1)
+	var wg sync.WaitGroup
+	probe := func(i int, name string, check func(context.Context) error) {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorProbeTimeout)
+		defer cancel()
+		start := time.Now()
+		err := check(ctx)
+		results[i] = MirrorHealth{Name: name, Healthy: err == nil, LatencyMS: time.Since(start).Milliseconds(), CheckedAt: time.Now().UTC()}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	wg.Add(len(results))
+	go probe(0, localMirror, probeLocal)
+	for i, backend := range backends {
+		go probe(i+1, backend.Name(), backend.Probe)
+	}
+	wg.Wait()
+
+	mirrorState.Lock()
+	defer mirrorState.Unlock()
+	for _, result := range results {
+		if previous, ok := mirrorState.health[result.Name]; ok && previous.Healthy != result.Healthy {
+			log.Printf("mirror %s healthy=%t %s", result.Name, result.Healthy, result.Error)
+		}
+		mirrorState.health[result.Name] = result
+	}
+}
+
+// Helper function to check that the OTA files directory can be listed
+func probeLocal(ctx context.Context) error {
+	dir, err := os.Open(otaFilesPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func mirrorHealth(name string) (MirrorHealth, bool) {
+	mirrorState.RLock()
+	defer mirrorState.RUnlock()
+	health, ok := mirrorState.health[name]
+	return health, ok
+}
+
+// Helper function to replicate a release to every mirror in the background
+func enqueueMirroring(release catalog.Release) error {
+	for _, backend := range mirrorBackends() {
+		if _, err := enqueueMirror(backend, release); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to queue a job copying a release to a mirror, verifying
+// the copy and recording it in the release metadata
+func enqueueMirror(backend storage.Backend, release catalog.Release) (*Job, error) {
+	recordPrewarm(release, PrewarmStatus{Kind: prewarmMirror, Target: backend.Name(), State: prewarmQueued})
+	return enqueueJob("mirror", backend.Name()+" "+release.FileName, func() error {
+		start := time.Now()
+		err := copyToMirror(backend, release)
+		status := PrewarmStatus{Kind: prewarmMirror, Target: backend.Name(), State: prewarmWarm, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			status.State, status.Error = prewarmFailed, err.Error()
+		}
+		recordPrewarm(release, status)
+		return err
+	})
+}
+
+// Helper function to copy a release to a mirror and verify the copy
+func copyToMirror(backend storage.Backend, release catalog.Release) error {
+	ctx := context.Background()
+	path := artifacts.ArtifactPath(release.FileName)
+	if err := backend.Put(ctx, release.FileName, path, release.ID); err != nil {
+		return err
+	}
+	if err := backend.Verify(ctx, release.FileName, release.Size, release.ID); err != nil {
+		return err
+	}
+	_, err := updateReleaseMeta(release.App, release.Version, func(m *ReleaseMeta) {
+		if m.Mirrors == nil {
+			m.Mirrors = make(map[string]MirrorCopy)
+		}
+		m.Mirrors[backend.Name()] = MirrorCopy{SHA256: release.ID, VerifiedAt: time.Now().UTC()}
+	})
+	if err == nil {
+		mirrorCopies.Add(1)
+	}
+	return err
+}
+
+// Helper function to send an artifact from the healthiest location holding
+// it: the OTA files directory is streamed directly, other mirrors are
+// reached through a redirect. What was sent is kept for download forensics.
+func serveArtifact(c *gin.Context, release catalog.Release) {
+	setReprDigest(c, release)
+	c.Header("ETag", releaseETag(release))
+	if def, ok := catalog.LookupApp(release.App); ok && def.ContentType != "" {
+		c.Header("Content-Type", def.ContentType)
+	}
+	if c.Request.Method == http.MethodHead {
+		headArtifact(c, release)
+		return
+	}
+	localPath := artifacts.ArtifactPath(release.FileName)
+	backends := mirrorBackends()
+	if len(backends) == 0 {
+		recordTransfer(c, release, localMirror, localPath, "", serveTransfer(c, localPath))
+		return
+	}
+
+	type candidate struct {
+		backend storage.Backend // nil for the OTA files directory
+		health  MirrorHealth
+	}
+	var candidates []candidate
+	if health, ok := mirrorHealth(localMirror); ok && health.Healthy {
+		if _, err := os.Stat(localPath); err == nil {
+			candidates = append(candidates, candidate{health: health})
+		}
+	}
+	meta, _ := loadReleaseMeta(release.App, release.Version)
+	for _, backend := range backends {
+		health, _ := mirrorHealth(backend.Name())
+		if mirrored, ok := meta.Mirrors[backend.Name()]; ok && mirrored.SHA256 == release.ID && health.Healthy {
+			candidates = append(candidates, candidate{backend: backend, health: health})
+		}
+	}
+	// The mirror of the device's region goes first, then the fastest
+	preferred := regionMirror(c)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		pi := candidates[i].backend != nil && candidates[i].backend.Name() == preferred
+		pj := candidates[j].backend != nil && candidates[j].backend.Name() == preferred
+		if pi != pj {
+			return pi
+		}
+		return candidates[i].health.LatencyMS < candidates[j].health.LatencyMS
+	})
+
+	for _, candidate := range candidates {
+		if candidate.backend == nil {
+			recordTransfer(c, release, localMirror, localPath, "", serveTransfer(c, localPath))
+			return
+		}
+		name := candidate.backend.Name()
+		location, err := candidate.backend.Locate(release.FileName, mirrorURLExpiry)
+		if err != nil {
+			continue
+		}
+		c.Header("X-OTA-Mirror", name)
+		if location.Path != "" {
+			recordTransfer(c, release, name, location.Path, "", serveTransfer(c, location.Path))
+		} else {
+			c.Redirect(http.StatusFound, location.URL)
+			recordTransfer(c, release, name, "", meta.Mirrors[name].SHA256, transferResult{Status: http.StatusFound})
+		}
+		return
+	}
+
+	// Without a healthy candidate, try the OTA files directory anyway
+	recordTransfer(c, release, localMirror, localPath, "", serveTransfer(c, localPath))
+}
+
+// Admin endpoint listing the mirrors and the result of their last probe
+func listMirrors(c *gin.Context) {
+	names := []string{localMirror}
+	for _, backend := range mirrorBackends() {
+		names = append(names, backend.Name())
+	}
+	mirrors := make([]MirrorHealth, 0, len(names))
+	for _, name := range names {
+		health, ok := mirrorHealth(name)
+		if !ok {
+			health = MirrorHealth{Name: name}
+		}
+		mirrors = append(mirrors, health)
+	}
+	c.JSON(http.StatusOK, gin.H{"mirrors": mirrors})
+}
+
+// Admin endpoint queueing the copies missing from the mirrors, e.g. after a
+// mirror is added or was unavailable during a publish
+func syncMirrors(c *gin.Context) {
+	backends := mirrorBackends()
+	if len(backends) == 0 {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no mirrors configured")
+		return
+	}
+	releases, err := artifacts.Releases()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list releases")
+		return
+	}
+
+	jobs := []*Job{}
+	for _, release := range releases {
+		meta, err := loadReleaseMeta(release.App, release.Version)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+			return
+		}
+		for _, backend := range backends {
+			if mirrored, ok := meta.Mirrors[backend.Name()]; ok && mirrored.SHA256 == release.ID {
+				continue
+			}
+			job, err := enqueueMirror(backend, release)
+			if err != nil {
+				respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+				return
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"jobs": jobs})
+}
@@ -0,0 +1,251 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// An edge server can keep its OTA files directory as a verified cache of an
+// upstream ota-server: OTA_UPSTREAM_URL is the upstream's base URL and
+// OTA_UPSTREAM_TOKEN its admin token, if any. Every OTA_UPSTREAM_VERIFY_INTERVAL
+// (default 1h) a job lists the upstream catalog, re-hashes the local copy of
+// every release and re-fetches those missing or differing from the upstream
+// digest through its /blobs endpoint. Releases that still diverge afterwards
+// are reported by GET /admin/mirrors/verify, the metrics and /healthz.
+
+// MirrorVerification is the result of the last verification against the upstream.
+type MirrorVerification struct {
+	Upstream   string            `json:"upstream"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Checked    int               `json:"checked"`
+	Missing    []string          `json:"missing,omitempty"` // files absent locally
+	Corrupt    []string          `json:"corrupt,omitempty"` // files whose digest differed
+	Refetched  []string          `json:"refetched,omitempty"`
+	Divergent  map[string]string `json:"divergent,omitempty"` // files still differing, with the reason
+	Error      string            `json:"error,omitempty"`
+}
+
+var mirrorVerifyState = struct {
+	sync.RWMutex
+	last *MirrorVerification
+}{}
+
+var (
+	mirrorVerifications = newCounter("ota_mirror_verifications_total", "Verifications of the local artifacts against the upstream.")
+	mirrorRefetches     = newCounter("ota_mirror_refetched_total", "Artifacts re-fetched from the upstream because they were missing or corrupt.")
+	mirrorDivergent     = newGauge("ota_mirror_divergent_artifacts", "Artifacts differing from the upstream after the last verification.")
+)
+
+func upstreamURL() string {
+	return strings.TrimSuffix(os.Getenv("OTA_UPSTREAM_URL"), "/")
+}
+
+func upstreamHeaders() map[string]string {
+	headers := map[string]string{"Accept": "application/json"}
+	if token := os.Getenv("OTA_UPSTREAM_TOKEN"); token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers
+}
+
+// Helper function to load the last verification and start verifying the
+// artifacts periodically, if an upstream is configured
+func initMirrorVerify() error {
+	if upstreamURL() == "" {
+		return nil
+	}
+	interval := time.Hour
+	if value := os.Getenv("OTA_UPSTREAM_VERIFY_INTERVAL"); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < time.Minute {
+			return fmt.Errorf("OTA_UPSTREAM_VERIFY_INTERVAL must be a duration of at least 1m")
+		}
+	}
+	var last *MirrorVerification
+	if err := storage.ReadJSON(mirrorVerifyFile, &last); err != nil {
+		return err
+	}
+	setMirrorVerification(last)
+
+	go func() {
+		if !ReadOnly() {
+			enqueueMirrorVerify()
+		}
+		for range time.Tick(interval) {
+			if !ReadOnly() {
+				enqueueMirrorVerify()
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to queue a verification unless one is already pending
+func enqueueMirrorVerify() (*Job, error) {
+	job, err := enqueueJob("mirror-verify", upstreamURL(), runMirrorVerify)
+	if err != nil {
+		log.Printf("queueing mirror verification: %v", err)
+	}
+	return job, err
+}
+
+func setMirrorVerification(result *MirrorVerification) {
+	mirrorVerifyState.Lock()
+	mirrorVerifyState.last = result
+	mirrorVerifyState.Unlock()
+	if result != nil {
+		mirrorDivergent.Set(int64(len(result.Divergent)))
+	}
+}
+
+func lastMirrorVerification() *MirrorVerification {
+	mirrorVerifyState.RLock()
+	defer mirrorVerifyState.RUnlock()
+	return mirrorVerifyState.last
+}
+
+// Helper function to compare the local artifacts with the upstream catalog,
+// re-fetching the missing and corrupt ones
+func runMirrorVerify() error {
+	result := &MirrorVerification{Upstream: upstreamURL(), StartedAt: time.Now().UTC(), Divergent: make(map[string]string)}
+	err := verifyAgainstUpstream(result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.FinishedAt = time.Now().UTC()
+	mirrorVerifications.Add(1)
+	if len(result.Refetched) > 0 {
+		if err := refreshCatalog(); err != nil {
+			log.Printf("refreshing catalog after mirror verification: %v", err)
+		}
+	}
+	if len(result.Divergent) > 0 {
+		log.Printf("mirror verification: %d artifacts differ from %s", len(result.Divergent), result.Upstream)
+	}
+
+	setMirrorVerification(result)
+	if saveErr := storage.WriteJSON(mirrorVerifyFile, result); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Helper function to check every release of the upstream catalog against the
+// local copy, recording the outcome in result
+func verifyAgainstUpstream(result *MirrorVerification) error {
+	var upstream struct {
+		Releases []catalog.Release `json:"releases"`
+	}
+	if err := getReleaseSyncJSON(result.Upstream+"/admin/catalog", upstreamHeaders(), &upstream); err != nil {
+		return fmt.Errorf("listing upstream releases: %w", err)
+	}
+
+	for _, release := range upstream.Releases {
+		localPath := artifacts.ArtifactPath(release.FileName)
+		if _, _, version := catalog.ParseArtifactPath(release.FileName); version == "" || !sha256Pattern.MatchString(release.ID) || !storage.InsideDir(otaFilesPath, localPath) {
+			result.Divergent[release.FileName] = "invalid upstream release"
+			continue
+		}
+		result.Checked++
+
+		digest, err := hashFile(localPath)
+		switch {
+		case os.IsNotExist(err):
+			result.Missing = append(result.Missing, release.FileName)
+		case err != nil:
+			result.Divergent[release.FileName] = err.Error()
+			continue
+		case digest == release.ID:
+			continue
+		default:
+			result.Corrupt = append(result.Corrupt, release.FileName)
+		}
+
+		if err := refetchArtifact(release, localPath); err != nil {
+			result.Divergent[release.FileName] = "re-fetching: " + err.Error()
+			continue
+		}
+		result.Refetched = append(result.Refetched, release.FileName)
+		mirrorRefetches.Add(1)
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Corrupt)
+	sort.Strings(result.Refetched)
+	return nil
+}
+
+// Helper function to download a release from the upstream and, once its
+// digest checks out, put it in place of the local copy
+func refetchArtifact(release catalog.Release, localPath string) error {
+	tmpPath, digests, err := fetchArtifact(context.Background(), sourceClient, upstreamURL()+"/blobs/"+release.ID, upstreamHeaders())
+	if err != nil {
+		return err
+	}
+	if digests.sha256 != release.ID {
+		os.Remove(tmpPath)
+		return fmt.Errorf("upstream sent sha256 %s", digests.sha256)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := storage.SyncFile(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := storage.MoveFile(tmpPath, localPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Helper function to report, for the health endpoint, artifacts the last
+// verification could not bring in line with the upstream
+func mirrorVerifyHealth() string {
+	if last := lastMirrorVerification(); last != nil && len(last.Divergent) > 0 {
+		return fmt.Sprintf("%d artifacts differ from the upstream", len(last.Divergent))
+	}
+	return ""
+}
+
+// Admin endpoint showing the result of the last verification against the upstream
+func getMirrorVerify(c *gin.Context) {
+	if upstreamURL() == "" {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no upstream is configured")
+		return
+	}
+	last := lastMirrorVerification()
+	if last == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no verification has finished yet")
+		return
+	}
+	c.JSON(http.StatusOK, last)
+}
+
+// Admin endpoint queueing a verification against the upstream now
+func startMirrorVerify(c *gin.Context) {
+	if upstreamURL() == "" {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no upstream is configured")
+		return
+	}
+	job, err := enqueueMirrorVerify()
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
@@ -0,0 +1,166 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// A fleet misconfigured to ask for a deleted version would otherwise make
+// every request stat the artifact directory or walk it for a release ID.
+// Failed lookups are remembered for OTA_NEGATIVE_CACHE_TTL (default 10s), or
+// until the catalog changes, and concurrent identical lookups share one walk.
+// A device repeating the same failing lookup more than
+// OTA_NEGATIVE_REPEAT_LIMIT times (default 10) within a minute gets 429 with
+// Retry-After until the minute is over. Only requests with an authenticated
+// or declared device ID are counted: a whole site of devices can sit behind
+// one NAT address, and throttling by address would refuse all of them.
+
+const (
+	defaultNegativeTTL         = 10 * time.Second
+	defaultNegativeRepeatLimit = 10
+	negativeRepeatWindow       = time.Minute
+
+	// negativeCacheMax bounds the remembered lookups and repeat counters;
+	// expired ones are swept when it is reached
+	negativeCacheMax = 10000
+)
+
+var (
+	negativeHits      = newCounter("ota_negative_cache_hits_total", "Failed lookups answered from the negative cache.")
+	negativeThrottled = newCounter("ota_negative_lookups_throttled_total", "Repeated failing lookups refused with 429.")
+)
+
+// negativeEntry is a remembered failed lookup.
+type negativeEntry struct {
+	err      error
+	revision uint64 // catalog revision it was observed at
+	expires  time.Time
+}
+
+// repeatCount counts a device's failing lookups of one key.
+type repeatCount struct {
+	count int
+	since time.Time
+}
+
+var negativeCache = struct {
+	sync.Mutex
+	entries map[string]negativeEntry // by lookup key
+	repeats map[string]*repeatCount  // by device and lookup key
+}{entries: make(map[string]negativeEntry), repeats: make(map[string]*repeatCount)}
+
+// lookupFlight deduplicates concurrent lookups of the same release.
+var lookupFlight catalog.Flight[catalog.Release]
+
+func negativeTTL() time.Duration {
+	return envDuration("OTA_NEGATIVE_CACHE_TTL", defaultNegativeTTL)
+}
+
+func negativeRepeatLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("OTA_NEGATIVE_REPEAT_LIMIT")); err == nil && n > 0 {
+		return n
+	}
+	return defaultNegativeRepeatLimit
+}
+
+// Helper function to tell whether an error means the thing looked up does
+// not exist, as opposed to a failure worth retrying
+func isMiss(err error) bool {
+	return errors.Is(err, catalog.ErrReleaseGone) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, errCatalogEmpty) || errors.Is(err, errVersionUnavailable)
+}
+
+// Helper function to get the remembered failure of a lookup, if it is fresh
+func cachedMiss(key string) error {
+	revision := currentCatalogRevision()
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+	entry, ok := negativeCache.entries[key]
+	if !ok || entry.revision != revision || time.Now().After(entry.expires) {
+		return nil
+	}
+	negativeHits.Add(1)
+	return entry.err
+}
+
+// Helper function to remember a failed lookup; other errors are not cached
+func rememberMiss(key string, err error) {
+	if !isMiss(err) {
+		return
+	}
+	revision := currentCatalogRevision()
+	now := time.Now()
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+	if len(negativeCache.entries) >= negativeCacheMax {
+		for k, entry := range negativeCache.entries {
+			if now.After(entry.expires) || entry.revision != revision {
+				delete(negativeCache.entries, k)
+			}
+		}
+		if len(negativeCache.entries) >= negativeCacheMax {
+			return
+		}
+	}
+	negativeCache.entries[key] = negativeEntry{err: err, revision: revision, expires: now.Add(negativeTTL())}
+}
+
+// Helper function to look up a release, answering repeated misses from the
+// negative cache and sharing concurrent lookups of the same key
+func findRelease(key string, find func() (catalog.Release, error)) (catalog.Release, error) {
+	if err := cachedMiss(key); err != nil {
+		return catalog.Release{}, err
+	}
+	release, err, _ := lookupFlight.Do(key, find)
+	if err != nil {
+		rememberMiss(key, err)
+	}
+	return release, err
+}
+
+// Helper function to respond to a failed lookup, or with 429 when the device
+// keeps repeating it
+func respondMiss(c *gin.Context, key string, status int, code, message string, details ...gin.H) {
+	client := downloadDeviceID(c)
+	if client == "" {
+		respondError(c, status, code, message, details...)
+		return
+	}
+	repeatKey := client + " " + key
+	now := time.Now()
+
+	negativeCache.Lock()
+	repeat, ok := negativeCache.repeats[repeatKey]
+	if !ok || now.Sub(repeat.since) >= negativeRepeatWindow {
+		if len(negativeCache.repeats) >= negativeCacheMax {
+			for k, r := range negativeCache.repeats {
+				if now.Sub(r.since) >= negativeRepeatWindow {
+					delete(negativeCache.repeats, k)
+				}
+			}
+		}
+		repeat = &repeatCount{since: now}
+		if len(negativeCache.repeats) < negativeCacheMax {
+			negativeCache.repeats[repeatKey] = repeat
+		}
+	}
+	repeat.count++
+	count, retryAfter := repeat.count, repeat.since.Add(negativeRepeatWindow).Sub(now)
+	negativeCache.Unlock()
+
+	if count > negativeRepeatLimit() {
+		negativeThrottled.Add(1)
+		c.Header("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		respondError(c, http.StatusTooManyRequests, CodeRateLimited, "the same lookup keeps failing; retry later", details...)
+		return
+	}
+	respondError(c, status, code, message, details...)
+}
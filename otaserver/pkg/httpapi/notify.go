@@ -0,0 +1,130 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"ota-server/pkg/catalog"
+)
+
+// Rollouts can additionally be pushed to devices through cloud IoT
+// platforms. When the fleet's or a group's desired version is set, every
+// configured connector creates a job on its platform whose document points
+// the devices at this server's download URL; the server stays the source of
+// truth for the artifacts. Connectors are enabled by their settings:
+//
+//	AWS IoT Jobs:   OTA_AWS_IOT_REGION, OTA_AWS_IOT_TARGETS (comma-separated
+//	                thing or thing group ARNs for fleet rollouts),
+//	                OTA_AWS_IOT_GROUP_ARN_PREFIX (group rollouts target the
+//	                prefix followed by the group name) and the usual
+//	                AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_SESSION_TOKEN;
+//	                OTA_AWS_IOT_ENDPOINT overrides the endpoint, e.g. for a VPC endpoint
+//	Azure IoT Hub:  OTA_AZURE_IOTHUB_CONNECTION_STRING and
+//	                OTA_AZURE_IOTHUB_QUERY (the devices of fleet rollouts, e.g.
+//	                "tags.ota = 'enabled'"); group rollouts add
+//	                "tags.otaGroup = '<group>'"
+//
+// Download URLs are made absolute with OTA_PUBLIC_URL.
+
+// Rollout is a desired version being pushed to the fleet or one group.
+type Rollout struct {
+	ID        string `json:"id"` // stable across retries, used as the platform's job ID
+	Version   string `json:"version"`
+	Group     string `json:"group,omitempty"` // empty for the whole fleet
+	ReleaseID string `json:"release_id"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	URL       string `json:"url"`
+}
+
+// rolloutDocument is what devices receive through the platforms.
+func (r Rollout) document() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"operation":  "ota-update",
+		"version":    r.Version,
+		"release_id": r.ReleaseID,
+		"sha256":     r.SHA256,
+		"size":       r.Size,
+		"url":        r.URL,
+	})
+}
+
+// notifier pushes rollouts through one platform. notify must be idempotent
+// for a rollout ID since failed jobs are retried.
+type notifier interface {
+	name() string
+	notify(r Rollout) error
+}
+
+// Helper function to build the connectors enabled in the environment
+func configuredNotifiers() ([]notifier, error) {
+	var notifiers []notifier
+	if n, err := awsIoTNotifierFromEnv(); err != nil || n != nil {
+		if err != nil {
+			return nil, fmt.Errorf("AWS IoT Jobs: %w", err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	if n, err := azureIoTHubNotifierFromEnv(); err != nil || n != nil {
+		if err != nil {
+			return nil, fmt.Errorf("Azure IoT Hub: %w", err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+var rolloutIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Helper function to queue notification jobs for a rollout of a desired
+// version to the fleet (empty group) or a group
+func notifyRollout(version, group string) {
+	notifiers, err := configuredNotifiers()
+	if err != nil {
+		log.Printf("rollout notifications: %v", err)
+		return
+	}
+	if len(notifiers) == 0 || version == "" {
+		return
+	}
+
+	release, ok := catalogIndex.Version("plugin", catalog.DefaultChannel, version)
+	if !ok {
+		log.Printf("rollout notifications: version %s is not in the catalog", version)
+		return
+	}
+	scope := "fleet"
+	if group != "" {
+		scope = "group-" + group
+	}
+	id := fmt.Sprintf("ota-%s-%s-%d", version, scope, time.Now().Unix())
+	rollout := Rollout{
+		ID:        rolloutIDUnsafe.ReplaceAllString(id, "-"),
+		Version:   release.Version,
+		Group:     group,
+		ReleaseID: release.ID,
+		SHA256:    release.ID,
+		Size:      release.Size,
+		URL:       strings.TrimSuffix(os.Getenv("OTA_PUBLIC_URL"), "/") + "/download?release_id=" + release.ID,
+	}
+
+	for _, n := range notifiers {
+		n := n
+		if _, err := enqueueJob("notify", n.name()+" "+rollout.ID, func() error { return n.notify(rollout) }); err != nil {
+			log.Printf("queueing %s notification for %s: %v", n.name(), rollout.ID, err)
+		}
+	}
+}
+
+// Helper function to read a platform's error response for an error message
+func platformError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
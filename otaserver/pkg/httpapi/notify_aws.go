@@ -0,0 +1,104 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"ota-server/pkg/storage"
+)
+
+// awsIoTNotifier creates AWS IoT Jobs through the CreateJob API, signing
+// requests with Signature Version 4.
+type awsIoTNotifier struct {
+	region      string
+	targets     []string
+	groupPrefix string
+	creds       storage.AWSCredentials
+	endpoint    string // https://iot.<region>.amazonaws.com
+	client      *http.Client
+}
+
+func awsIoTNotifierFromEnv() (*awsIoTNotifier, error) {
+	region := os.Getenv("OTA_AWS_IOT_REGION")
+	if region == "" {
+		return nil, nil
+	}
+	n := &awsIoTNotifier{
+		region:      region,
+		groupPrefix: os.Getenv("OTA_AWS_IOT_GROUP_ARN_PREFIX"),
+		creds:       awsCredentialsFromEnv(),
+		endpoint:    envOr("OTA_AWS_IOT_ENDPOINT", "https://iot."+region+".amazonaws.com"),
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, target := range strings.Split(os.Getenv("OTA_AWS_IOT_TARGETS"), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			n.targets = append(n.targets, target)
+		}
+	}
+	if n.creds.AccessKey == "" || n.creds.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return n, nil
+}
+
+func (n *awsIoTNotifier) name() string { return "aws-iot-jobs" }
+
+func (n *awsIoTNotifier) notify(r Rollout) error {
+	targets := n.targets
+	if r.Group != "" {
+		if n.groupPrefix == "" {
+			return nil // group rollouts are not mapped to thing groups
+		}
+		targets = []string{n.groupPrefix + r.Group}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	document, err := r.document()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"targets":         targets,
+		"document":        string(document),
+		"description":     fmt.Sprintf("OTA update to %s", r.Version),
+		"targetSelection": "SNAPSHOT",
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, n.endpoint+"/jobs/"+r.ID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	storage.SignAWSRequest(req, storage.SHA256Hex(body), n.creds, n.region, "iot", time.Now())
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A conflict means an earlier attempt already created the job
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusConflict {
+		return platformError(resp)
+	}
+	return nil
+}
+
+// Helper function to read the AWS credentials from the standard variables
+func awsCredentialsFromEnv() storage.AWSCredentials {
+	return storage.AWSCredentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
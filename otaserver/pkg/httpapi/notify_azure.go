@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureIoTHubNotifier schedules IoT Hub jobs that set the "ota" desired
+// property of the selected device twins to the rollout document.
+type azureIoTHubNotifier struct {
+	host    string
+	keyName string
+	key     []byte
+	query   string
+	client  *http.Client
+}
+
+const azureIoTHubAPIVersion = "2021-04-12"
+
+func azureIoTHubNotifierFromEnv() (*azureIoTHubNotifier, error) {
+	connection := os.Getenv("OTA_AZURE_IOTHUB_CONNECTION_STRING")
+	if connection == "" {
+		return nil, nil
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(connection, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			fields[k] = v
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(fields["SharedAccessKey"])
+	if err != nil || fields["HostName"] == "" || fields["SharedAccessKeyName"] == "" {
+		return nil, errors.New("connection string needs HostName, SharedAccessKeyName and SharedAccessKey")
+	}
+	query := os.Getenv("OTA_AZURE_IOTHUB_QUERY")
+	if query == "" {
+		return nil, errors.New("OTA_AZURE_IOTHUB_QUERY is required")
+	}
+	return &azureIoTHubNotifier{
+		host:    fields["HostName"],
+		keyName: fields["SharedAccessKeyName"],
+		key:     key,
+		query:   query,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (n *azureIoTHubNotifier) name() string { return "azure-iothub" }
+
+func (n *azureIoTHubNotifier) notify(r Rollout) error {
+	query := n.query
+	if r.Group != "" {
+		query = fmt.Sprintf("(%s) AND tags.otaGroup = '%s'", query, strings.ReplaceAll(r.Group, "'", "''"))
+	}
+	var document map[string]interface{}
+	raw, err := r.document()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jobId":          r.ID,
+		"type":           "scheduleUpdateTwin",
+		"queryCondition": query,
+		"startTime":      time.Now().UTC().Format(time.RFC3339),
+		"updateTwin": map[string]interface{}{
+			"etag":       "*",
+			"properties": map[string]interface{}{"desired": map[string]interface{}{"ota": document}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://%s/jobs/v2/%s?api-version=%s", n.host, url.PathEscape(r.ID), azureIoTHubAPIVersion)
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", n.sasToken(time.Now().Add(time.Hour)))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A conflict means an earlier attempt already created the job
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusConflict {
+		return platformError(resp)
+	}
+	return nil
+}
+
+// Helper function to build a shared access signature for the hub
+func (n *azureIoTHubNotifier) sasToken(expiry time.Time) string {
+	resource := url.QueryEscape(n.host)
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write([]byte(resource + "\n" + expires))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s",
+		resource, url.QueryEscape(signature), expires, url.QueryEscape(n.keyName))
+}
@@ -0,0 +1,109 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// Each release can be downloaded as a signed offline bundle for installers
+// without network access, see manifest.ReleaseBundle. Bundles are built on
+// first request and kept per release and signing key, since hashing a large
+// artifact takes a while.
+
+// Endpoint to download the signed offline bundle of a release, e.g.
+// /releases/plugin/2.3.1/bundle
+func getOfflineBundle(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	key := signingKeyFor(app)
+	if key == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, errNoSigningKey.Error())
+		return
+	}
+	release, ok := catalogIndex.Find(app, version)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+
+	signed, err := offlineBundle(release, key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not build offline bundle")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s.otabundle.json\"", app, version))
+	c.JSON(http.StatusOK, signed)
+}
+
+// Helper function to load the cached offline bundle of a release or build it
+func offlineBundle(release catalog.Release, key *SigningKey) (manifest.SignedReleaseBundle, error) {
+	cacheFile := filepath.Join(offlineBundlesPath, release.ID+"-"+key.ID+".json")
+	// Devices asking for the same new bundle at once wait for a single build
+	signed, err, _ := offlineBundleFlight.Do(cacheFile, func() (manifest.SignedReleaseBundle, error) {
+		return buildOfflineBundle(release, key, cacheFile)
+	})
+	return signed, err
+}
+
+var offlineBundleFlight catalog.Flight[manifest.SignedReleaseBundle]
+
+// Helper function to build the offline bundle of a release and cache it in
+// cacheFile
+func buildOfflineBundle(release catalog.Release, key *SigningKey, cacheFile string) (manifest.SignedReleaseBundle, error) {
+	var signed manifest.SignedReleaseBundle
+	if _, err := os.Stat(cacheFile); err == nil {
+		return signed, storage.ReadJSON(cacheFile, &signed)
+	}
+
+	meta, err := loadReleaseMeta(release.App, release.Version)
+	if err != nil {
+		return signed, err
+	}
+	// Sign the release now if it was published before the key was configured
+	sig := meta.Signature
+	if sig == nil || sig.KeyID != key.ID {
+		if sig, err = signRelease(release); err != nil {
+			return signed, err
+		}
+	}
+
+	file, err := os.Open(artifacts.ArtifactPath(release.FileName))
+	if err != nil {
+		return signed, err
+	}
+	hashes, err := manifest.HashArtifact(file)
+	file.Close()
+	if err != nil {
+		return signed, err
+	}
+	if hashes.SHA256 != release.ID {
+		return signed, errors.New("artifact changed while building its bundle")
+	}
+
+	signed, err = manifest.SealReleaseBundle(manifest.ReleaseBundle{
+		Release:        release,
+		Hashes:         hashes,
+		Notes:          meta.Notes,
+		Mandatory:      meta.Mandatory,
+		MinimumVersion: meta.MinimumVersion,
+		CreatedAt:      meta.CreatedAt,
+		Signature:      sig,
+		Provenance:     meta.Provenance,
+		GeneratedAt:    time.Now().UTC(),
+	}, key.Private)
+	if err != nil {
+		return signed, err
+	}
+	if err := os.MkdirAll(offlineBundlesPath, 0o755); err != nil {
+		return signed, err
+	}
+	return signed, storage.WriteJSON(cacheFile, signed)
+}
@@ -0,0 +1,195 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Delta patches between versions of an app are generated in the background
+// after each publish and stored in patchesPath, named by the release IDs
+// (content digests) they go between, so that a version re-published with
+// other bytes or published with other bytes on another channel never gets
+// the wrong patch. Until a patch is ready, check-update only offers the full
+// image.
+
+// patchBaseVersions is how many earlier versions get a patch to a new release.
+const patchBaseVersions = 3
+
+var patchNamePattern = regexp.MustCompile(`^[0-9a-f]{64}_to_[0-9a-f]{64}\.otad$`)
+
+func patchFileName(fromID, toID string) string {
+	return fmt.Sprintf("%s_to_%s.otad", fromID, toID)
+}
+
+// Helper function to generate, verify and store the patch between two releases
+func generatePatch(from, to catalog.Release) error {
+	digest, err := hex.DecodeString(to.ID)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("release %s has no digest", to.ID)
+	}
+	oldFile, err := os.Open(artifacts.ArtifactPath(from.FileName))
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", from.Version, err)
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(artifacts.ArtifactPath(to.FileName))
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", to.Version, err)
+	}
+	defer newFile.Close()
+	oldInfo, err := oldFile.Stat()
+	if err != nil {
+		return err
+	}
+	newInfo, err := newFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(patchesPath, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(patchesPath, ".patch-*")
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := computeDelta(tmp, oldFile, oldInfo.Size(), newFile, newInfo.Size(), [sha256.Size]byte(digest)); err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	if err := applyDelta(io.Discard, oldFile, tmp); err != nil {
+		return fail(fmt.Errorf("verifying patch: %w", err))
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(patchesPath, patchFileName(from.ID, to.ID)))
+}
+
+// enqueuePatch schedules the generation of one patch.
+func enqueuePatch(from, to catalog.Release) (*Job, error) {
+	return enqueueJob("delta", fmt.Sprintf("%s %s->%s", to.App, from.Version, to.Version), func() error {
+		return generatePatch(from, to)
+	})
+}
+
+// Helper function to queue patches from the most recent earlier versions of
+// its channel to a new release
+func enqueuePatchesFor(release catalog.Release) error {
+	var bases []catalog.Release
+	for _, base := range catalogIndex.Releases(release.App, release.Channel) {
+		if catalog.CompareVersions(base.Version, release.Version) < 0 {
+			bases = append(bases, base)
+		}
+	}
+	if len(bases) > patchBaseVersions {
+		bases = bases[len(bases)-patchBaseVersions:]
+	}
+	for _, from := range bases {
+		if _, err := enqueuePatch(from, release); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to describe the patch from the version a device runs to a
+// release if it is ready and actually smaller than the full image
+func readyPatch(from string, to catalog.Release) *manifest.PatchInfo {
+	base, ok := catalogIndex.Version(to.App, to.Channel, from)
+	if !ok {
+		return nil
+	}
+	name := patchFileName(base.ID, to.ID)
+	path := filepath.Join(patchesPath, name)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() >= to.Size {
+		return nil
+	}
+	digest, err := catalog.FileDigest(path, info)
+	if err != nil {
+		return nil
+	}
+	return &manifest.PatchInfo{URL: "/patches/" + name, Size: info.Size(), SHA256: digest, From: from}
+}
+
+// Admin endpoint queueing a patch between two versions of a channel (stable
+// by default), e.g. {"app": "plugin", "from": "1.0.0", "to": "2.0.0"}
+func createDeltaJob(c *gin.Context) {
+	var req struct {
+		App     string `json:"app"`
+		Channel string `json:"channel"`
+		From    string `json:"from"`
+		To      string `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.App == "" || req.From == "" || req.To == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "app, from and to are required")
+		return
+	}
+	channel := firstNonEmpty(req.Channel, catalog.DefaultChannel)
+	var releases []catalog.Release
+	for _, v := range []string{req.From, req.To} {
+		release, ok := catalogIndex.Version(req.App, channel, v)
+		if !ok {
+			respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"version": v})
+			return
+		}
+		releases = append(releases, release)
+	}
+
+	job, err := enqueuePatch(releases[0], releases[1])
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+// Endpoint to download a generated patch
+func downloadPatch(c *gin.Context) {
+	name := c.Param("name")
+	if !patchNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid patch name")
+		return
+	}
+	path := filepath.Join(patchesPath, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "patch not found")
+		return
+	}
+	// A patch installs the release it leads to, so the floor applies to it
+	_, toID, _ := strings.Cut(strings.TrimSuffix(name, ".otad"), "_to_")
+	to, ok := catalogIndex.ByID(toID)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "patch not found")
+		return
+	}
+	if !allowDownloadAboveFloor(c, to.App, to.Version) {
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	serveTransfer(c, path)
+}
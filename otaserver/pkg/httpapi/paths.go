@@ -0,0 +1,138 @@
+package httpapi
+
+import (
+	"os"
+	"path/filepath"
+
+	"ota-server/pkg/catalog"
+)
+
+// Config locates the directories the server reads and writes. Empty fields
+// fall back to OTA_FILES_DIR and OTA_STATE_DIR, and then to "./ota_files/"
+// and the working directory.
+type Config struct {
+	// FilesDir holds the published artifacts. It is only written by
+	// uploads, so it can live on a read-only filesystem when publishing
+	// happens elsewhere.
+	FilesDir string
+
+	// StateDir holds everything the server writes at runtime (metadata,
+	// devices, uploads, quarantine and patches), separately from the
+	// artifacts so that embedded deployments can keep the artifacts on a
+	// read-only root filesystem and point it at a writable volume.
+	StateDir string
+}
+
+// stateLockFile is held for the lifetime of the process so that two servers
+// never share one state directory.
+const stateLockFile = "ota-server.lock"
+
+// Locations of the artifacts and of the files under the state directory,
+// derived from the Config by setDirs.
+var (
+	otaFilesPath string
+	artifacts    *catalog.Dir
+	stateDir     string
+
+	metadataPath       string
+	adoptionPath       string
+	bundlesPath        string
+	offlineBundlesPath string
+	devicesPath        string
+	groupsFile         string
+	desiredStateFile   string
+	regionsFile        string
+	aliasesFile        string
+	releaseSyncFile    string
+	plansFile          string
+	securityFile       string
+	mirrorVerifyFile   string
+	enrollmentFile     string
+	uploadTokensFile   string
+	deviceSecretsFile  string
+	pollingFile        string
+	tenantsFile        string
+	promotionFile      string
+	appQuotasFile      string
+	appDigestsFile     string
+	appsFile           string
+	cohortsFile        string
+	campaignsFile      string
+	versionFloorsFile  string
+	usagePath          string
+	telemetryFile      string
+	forensicsPath      string
+	deviceHistoryPath  string
+
+	uploadsPath    string
+	quarantinePath string
+	patchesPath    string
+	snapshotsPath  string
+	retiredPath    string
+	trashPath      string
+
+	digestIndexFile string
+)
+
+func init() {
+	setDirs(Config{})
+}
+
+// Helper function to point the server at the directories of cfg
+func setDirs(cfg Config) {
+	otaFilesPath = firstNonEmpty(cfg.FilesDir, os.Getenv("OTA_FILES_DIR"), "./ota_files/")
+	artifacts = catalog.NewDir(otaFilesPath)
+	stateDir = firstNonEmpty(cfg.StateDir, os.Getenv("OTA_STATE_DIR"), ".")
+
+	metadataPath = filepath.Join(stateDir, "metadata")
+	adoptionPath = filepath.Join(metadataPath, "adoption")
+	bundlesPath = filepath.Join(metadataPath, "bundles")
+	offlineBundlesPath = filepath.Join(metadataPath, "offline_bundles")
+	devicesPath = filepath.Join(metadataPath, "devices")
+	groupsFile = filepath.Join(metadataPath, "groups.json")
+	desiredStateFile = filepath.Join(metadataPath, "desired_state.json")
+	regionsFile = filepath.Join(metadataPath, "regions.json")
+	aliasesFile = filepath.Join(metadataPath, "aliases.json")
+	releaseSyncFile = filepath.Join(metadataPath, "release_sync.json")
+	plansFile = filepath.Join(metadataPath, "rollout_plans.json")
+	securityFile = filepath.Join(metadataPath, "security.json")
+	mirrorVerifyFile = filepath.Join(metadataPath, "mirror_verify.json")
+	enrollmentFile = filepath.Join(metadataPath, "enrollment_tokens.json")
+	uploadTokensFile = filepath.Join(metadataPath, "upload_tokens.json")
+	deviceSecretsFile = filepath.Join(metadataPath, "device_secrets.json")
+	pollingFile = filepath.Join(metadataPath, "polling.json")
+	tenantsFile = filepath.Join(metadataPath, "tenants.json")
+	promotionFile = filepath.Join(metadataPath, "promotion.json")
+	appQuotasFile = filepath.Join(metadataPath, "app_quotas.json")
+	appDigestsFile = filepath.Join(metadataPath, "app_digests.json")
+	appsFile = filepath.Join(metadataPath, "apps.json")
+	cohortsFile = filepath.Join(metadataPath, "cohorts.json")
+	campaignsFile = filepath.Join(metadataPath, "campaigns.json")
+	versionFloorsFile = filepath.Join(metadataPath, "version_floors.json")
+	usagePath = filepath.Join(metadataPath, "usage")
+	telemetryFile = filepath.Join(metadataPath, "telemetry.json")
+	forensicsPath = filepath.Join(metadataPath, "forensics")
+	deviceHistoryPath = filepath.Join(metadataPath, "device_history")
+
+	uploadsPath = filepath.Join(stateDir, "uploads")
+	quarantinePath = filepath.Join(stateDir, "quarantine")
+	patchesPath = filepath.Join(stateDir, "patches")
+	snapshotsPath = filepath.Join(stateDir, "snapshots")
+	retiredPath = filepath.Join(stateDir, "retired")
+	trashPath = filepath.Join(stateDir, "trash")
+	digestIndexFile = filepath.Join(stateDir, "digest_index.json")
+}
+
+// Helper function to read a setting from the environment with a default
+func envOr(key, fallback string) string {
+	return firstNonEmpty(os.Getenv(key), fallback)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Reports meant for customers are also exported as PDF. They are plain
+// monospaced text, so a minimal writer for PDF 1.4 with the standard Courier
+// font is enough and spares the server a layout dependency.
+
+const (
+	pdfLinesPerPage = 60
+	pdfFontSize     = 9
+	pdfLeading      = 12
+	pdfMaxLine      = 100 // characters that fit an A4 line at pdfFontSize
+)
+
+// Helper function to escape a line of text for a PDF string literal,
+// replacing characters outside printable ASCII, which Courier lacks
+func pdfEscape(line string) string {
+	var b strings.Builder
+	for i, r := range line {
+		if i >= pdfMaxLine {
+			break
+		}
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Helper function to write lines of text as an A4 PDF document, starting a
+// new page every pdfLinesPerPage lines
+func writePDF(w io.Writer, title string, lines []string) error {
+	var pages [][]string
+	for start := 0; start < len(lines) || start == 0; start += pdfLinesPerPage {
+		pages = append(pages, lines[start:min(start+pdfLinesPerPage, len(lines))])
+	}
+
+	// Objects 1-3 are the catalog, the page tree and the font, followed by a
+	// page and its content stream for every page
+	var buf bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL 40 800 Td\n", pdfFontSize, pdfLeading)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		fmt.Fprintf(&content, "ET\nBT /F1 8 Tf 40 30 Td (%s - page %d of %d) Tj ET\n", pdfEscape(title), i+1, len(pages))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
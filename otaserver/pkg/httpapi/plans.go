@@ -0,0 +1,224 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Rollout plans order the releases of dependent apps, e.g. runtime 1.5.0
+// before plugin 2.0.0: a device is only offered a step's release, or anything
+// newer of that app, once it reported running at least the versions of all
+// earlier steps. Until then it is offered the newest release below the step,
+// if that is newer than what it runs. Devices report the versions of their
+// apps in batch checks, bundle checks and install reports; devices whose
+// versions are unknown are held. Plans can be limited to device groups.
+
+// RolloutPlan is an ordered list of releases of several apps.
+type RolloutPlan struct {
+	Steps     []PlanStep `json:"steps"`
+	Groups    []string   `json:"groups,omitempty"` // device groups held to the plan, all when empty
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// PlanStep is one release of a rollout plan.
+type PlanStep struct {
+	App     string `json:"app"`
+	Version string `json:"version"`
+}
+
+// PlanStepStatus is how far the fleet got with a step of a plan.
+type PlanStepStatus struct {
+	PlanStep
+	Reached int `json:"reached"` // devices running the step's version or newer
+	Waiting int `json:"waiting"` // devices held at this step by an earlier one
+}
+
+var planState = struct {
+	sync.RWMutex
+	plans map[string]RolloutPlan // by name
+}{plans: make(map[string]RolloutPlan)}
+
+// Helper function to load the rollout plans
+func initPlans() error {
+	plans := make(map[string]RolloutPlan)
+	if err := storage.ReadJSON(plansFile, &plans); err != nil {
+		return err
+	}
+	planState.Lock()
+	planState.plans = plans
+	planState.Unlock()
+	return nil
+}
+
+// Helper function to check whether a plan holds the devices of a group
+func (p RolloutPlan) appliesTo(device *Device) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	return device != nil && slices.Contains(p.Groups, device.Group)
+}
+
+// Helper function to find the step a device is held at, if any: the first
+// step whose app it runs below the step's version while an earlier step is
+// not yet done
+func (p RolloutPlan) heldAt(device *Device) (int, bool) {
+	for i, step := range p.Steps {
+		current := appVersion(device, step.App)
+		if current == "" || catalog.CompareVersions(current, step.Version) < 0 {
+			return i, true
+		}
+	}
+	return len(p.Steps), false
+}
+
+// Helper function to check whether the rollout plans allow offering a
+// version of an app to a device. When they do not, it returns the version
+// the offer must stay below and the reason.
+func planLimit(device *Device, app, version string) (string, string, bool) {
+	planState.RLock()
+	defer planState.RUnlock()
+
+	limit, reason := "", ""
+	for name, plan := range planState.plans {
+		if !plan.appliesTo(device) {
+			continue
+		}
+		held, _ := plan.heldAt(device)
+		for i := held + 1; i < len(plan.Steps); i++ {
+			step := plan.Steps[i]
+			if step.App != app || catalog.CompareVersions(version, step.Version) < 0 {
+				continue
+			}
+			if limit == "" || catalog.CompareVersions(step.Version, limit) < 0 {
+				prereq := plan.Steps[held]
+				limit = step.Version
+				reason = fmt.Sprintf("rollout plan %s: %s %s is required first", name, prereq.App, prereq.Version)
+			}
+		}
+	}
+	return limit, reason, limit != ""
+}
+
+// Helper function to find the newest release of an app in a channel below a version
+func newestReleaseBelow(app, channel, limit string) (catalog.Release, bool) {
+	releases := catalogIndex.Releases(app, channel)
+	for i := len(releases) - 1; i >= 0; i-- {
+		if catalog.CompareVersions(releases[i].Version, limit) < 0 {
+			return releases[i], true
+		}
+	}
+	return catalog.Release{}, false
+}
+
+// Admin endpoint listing the rollout plans with the progress of each step
+func listPlans(c *gin.Context) {
+	var devices []Device
+	if !anonymousMode() {
+		var err error
+		if devices, err = listDevices(); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+			return
+		}
+	}
+
+	planState.RLock()
+	defer planState.RUnlock()
+	names := make([]string, 0, len(planState.plans))
+	for name := range planState.plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	plans := []gin.H{}
+	for _, name := range names {
+		plan := planState.plans[name]
+		steps := make([]PlanStepStatus, len(plan.Steps))
+		for i, step := range plan.Steps {
+			steps[i].PlanStep = step
+		}
+		for i := range devices {
+			device := &devices[i]
+			if !plan.appliesTo(device) {
+				continue
+			}
+			held, _ := plan.heldAt(device)
+			for j, step := range plan.Steps {
+				if current := appVersion(device, step.App); current != "" && catalog.CompareVersions(current, step.Version) >= 0 {
+					steps[j].Reached++
+				} else if held < j {
+					steps[j].Waiting++
+				}
+			}
+		}
+		plans = append(plans, gin.H{"name": name, "groups": plan.Groups, "updated_at": plan.UpdatedAt, "steps": steps})
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// Admin endpoint creating or replacing a rollout plan, e.g.
+// PUT /admin/rollout-plans/plugin-2 {"steps": [{"app": "runtime", "version":
+// "1.5.0"}, {"app": "plugin", "version": "2.0.0"}]}
+func updatePlan(c *gin.Context) {
+	name := c.Param("name")
+	if !aliasNamePattern.MatchString(name) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "plan names start with a lowercase letter followed by letters, digits or '-'")
+		return
+	}
+	var plan RolloutPlan
+	if err := c.ShouldBindJSON(&plan); err != nil || len(plan.Steps) < 2 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "a plan needs at least two steps")
+		return
+	}
+	for _, step := range plan.Steps {
+		if _, ok := catalogIndex.Version(step.App, catalog.DefaultChannel, step.Version); !ok {
+			respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"app": step.App, "version": step.Version})
+			return
+		}
+	}
+	plan.UpdatedAt = time.Now().UTC()
+
+	planState.Lock()
+	defer planState.Unlock()
+	plans := make(map[string]RolloutPlan, len(planState.plans)+1)
+	for n, p := range planState.plans {
+		plans[n] = p
+	}
+	plans[name] = plan
+	if err := storage.WriteJSON(plansFile, plans); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save rollout plans")
+		return
+	}
+	planState.plans = plans
+	c.JSON(http.StatusOK, plan)
+}
+
+// Admin endpoint removing a rollout plan
+func deletePlan(c *gin.Context) {
+	name := c.Param("name")
+	planState.Lock()
+	defer planState.Unlock()
+	if _, ok := planState.plans[name]; !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "rollout plan not found", gin.H{"name": name})
+		return
+	}
+	plans := make(map[string]RolloutPlan, len(planState.plans))
+	for n, p := range planState.plans {
+		if n != name {
+			plans[n] = p
+		}
+	}
+	if err := storage.WriteJSON(plansFile, plans); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save rollout plans")
+		return
+	}
+	planState.plans = plans
+	c.Status(http.StatusNoContent)
+}
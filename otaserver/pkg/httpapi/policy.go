@@ -0,0 +1,244 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Authorization policy. OTA_POLICY_FILE names an optional JSON file with
+// named admin tokens and an ordered list of rules. Every admin and device
+// request is checked against the rules, and so are actions on a specific
+// resource such as publishing a release to a channel. The first rule whose
+// conditions all match decides; without a match the policy default applies.
+//
+// For example, to let only the "ci" token publish to the stable channel:
+//
+//	{
+//	  "tokens": {"ci": "<sha256 hex of the token>"},
+//	  "rules": [
+//	    {"name": "ci-publishes-stable", "effect": "allow",
+//	     "when": {"action": ["publish"], "channel": ["stable"], "principal": ["ci"]}},
+//	    {"name": "nobody-else-publishes-stable", "effect": "deny",
+//	     "when": {"action": ["publish"], "channel": ["stable"]}}
+//	  ]
+//	}
+//
+// Conditions are glob patterns (as in path.Match) on these attributes:
+var policyAttributes = map[string]bool{
+	"action":    true, // "request", or the resource action such as "publish"
+	"method":    true, // HTTP method
+	"route":     true, // route pattern, e.g. /admin/releases/:app/:version/schedule
+	"path":      true, // request path
+	"principal": true, // name of the admin token ("admin" for OTA_ADMIN_TOKEN)
+	"tenant":    true, // tenant of a device request
+	"device_id": true, // device making the request
+	"app":       true,
+	"channel":   true,
+}
+
+// Policy effects
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// principalAdmin is the principal of the OTA_ADMIN_TOKEN token.
+const principalAdmin = "admin"
+
+// Policy is the contents of the policy file.
+type Policy struct {
+	Default string            `json:"default,omitempty"` // effect without a matching rule, allow by default
+	Tokens  map[string]string `json:"tokens,omitempty"`  // principal name to SHA-256 hex of its admin token
+	Rules   []PolicyRule      `json:"rules"`
+}
+
+// PolicyRule applies its effect when every condition matches.
+type PolicyRule struct {
+	Name   string              `json:"name"`
+	Effect string              `json:"effect"`
+	When   map[string][]string `json:"when"`
+}
+
+var policyState = struct {
+	sync.RWMutex
+	policy Policy
+}{}
+
+func policyFile() string {
+	return os.Getenv("OTA_POLICY_FILE")
+}
+
+// Helper function to load and validate the policy file; without one every
+// request is allowed
+func loadPolicy() (Policy, error) {
+	policy := Policy{Default: effectAllow}
+	if policyFile() == "" {
+		return policy, nil
+	}
+	if _, err := os.Stat(policyFile()); err != nil {
+		return policy, err
+	}
+	if err := storage.ReadJSON(policyFile(), &policy); err != nil {
+		return policy, err
+	}
+	if policy.Default == "" {
+		policy.Default = effectAllow
+	}
+	if policy.Default != effectAllow && policy.Default != effectDeny {
+		return policy, fmt.Errorf("default must be %q or %q", effectAllow, effectDeny)
+	}
+	for i, rule := range policy.Rules {
+		if rule.Effect != effectAllow && rule.Effect != effectDeny {
+			return policy, fmt.Errorf("rule %d: effect must be %q or %q", i, effectAllow, effectDeny)
+		}
+		for attr, patterns := range rule.When {
+			if !policyAttributes[attr] {
+				return policy, fmt.Errorf("rule %d: unknown attribute %q", i, attr)
+			}
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return policy, fmt.Errorf("rule %d: invalid pattern %q", i, pattern)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Helper function to load the policy at startup or on reload
+func initPolicy() error {
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	policyState.Lock()
+	policyState.policy = policy
+	policyState.Unlock()
+	return nil
+}
+
+// Helper function to find the principal owning an admin token from the policy
+func policyPrincipal(token string) string {
+	hash := hashToken(token)
+	policyState.RLock()
+	defer policyState.RUnlock()
+	for name, want := range policyState.policy.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+func policyHasTokens() bool {
+	policyState.RLock()
+	defer policyState.RUnlock()
+	return len(policyState.policy.Tokens) > 0
+}
+
+func (r PolicyRule) matches(attrs map[string]string) bool {
+	for attr, patterns := range r.When {
+		matched := false
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, attrs[attr]); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to evaluate the policy, returning whether the attributes
+// are allowed and the name of the deciding rule (empty for the default)
+func evaluatePolicy(attrs map[string]string) (bool, string) {
+	policyState.RLock()
+	defer policyState.RUnlock()
+	for _, rule := range policyState.policy.Rules {
+		if rule.matches(attrs) {
+			return rule.Effect == effectAllow, rule.Name
+		}
+	}
+	return policyState.policy.Default == effectAllow, ""
+}
+
+// Helper function to collect the policy attributes of a request
+func requestAttributes(c *gin.Context) map[string]string {
+	deviceID := c.Query("device_id")
+	if authID := authenticatedDeviceID(c); authID != "" {
+		deviceID = authID
+	}
+	app := c.Param("app")
+	if app == "" {
+		app = c.Query("app")
+	}
+	return map[string]string{
+		"action":    "request",
+		"method":    c.Request.Method,
+		"route":     c.FullPath(),
+		"path":      c.Request.URL.Path,
+		"principal": c.GetString("principal"),
+		"tenant":    c.GetString("tenant"),
+		"device_id": deviceID,
+		"app":       app,
+		"channel":   c.Query("channel"),
+	}
+}
+
+// Helper function to check an action on a resource against the policy,
+// responding 403 when it is denied
+func authorize(c *gin.Context, action string, resource map[string]string) bool {
+	attrs := requestAttributes(c)
+	attrs["action"] = action
+	for k, v := range resource {
+		attrs[k] = v
+	}
+	allowed, rule := evaluatePolicy(attrs)
+	if !allowed {
+		respondError(c, http.StatusForbidden, CodeForbidden, "denied by policy", gin.H{"action": action, "rule": rule})
+	}
+	return allowed
+}
+
+// policyCheck rejects requests that the policy denies.
+func policyCheck() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, "request", nil) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Admin endpoint showing the active policy, without the token hashes
+func getPolicy(c *gin.Context) {
+	policyState.RLock()
+	policy := policyState.policy
+	policyState.RUnlock()
+
+	principals := []string{}
+	for name := range policy.Tokens {
+		principals = append(principals, name)
+	}
+	c.JSON(http.StatusOK, gin.H{"file": policyFile(), "default": policy.Default, "principals": principals, "rules": policy.Rules})
+}
+
+// Admin endpoint reloading the policy file; an invalid file leaves the
+// active policy in place
+func reloadPolicy(c *gin.Context) {
+	if err := initPolicy(); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid policy: "+err.Error())
+		return
+	}
+	getPolicy(c)
+}
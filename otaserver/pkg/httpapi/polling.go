@@ -0,0 +1,111 @@
+package httpapi
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/rollout"
+	"ota-server/pkg/storage"
+)
+
+// Check responses tell devices when to check again (next_check_after, in
+// seconds), see rollout.PollingSettings. The per-device spread keeps the
+// response (and its ETag) the same from one check to the next. A device an
+// operator asked to check now polls as if a rollout were active until its
+// CheckNowUntil.
+
+var pollingState = struct {
+	sync.RWMutex
+	settings rollout.PollingSettings
+}{settings: rollout.DefaultPollingSettings()}
+
+// Helper function to load the polling settings saved by the admin API
+func initPolling() error {
+	settings := rollout.DefaultPollingSettings()
+	if err := storage.ReadJSON(pollingFile, &settings); err != nil {
+		return err
+	}
+	pollingState.Lock()
+	pollingState.settings = settings
+	pollingState.Unlock()
+	return nil
+}
+
+// Helper function to compute a device's next_check_after hint in seconds
+func nextCheckAfter(device *Device) int {
+	pollingState.RLock()
+	settings := pollingState.settings
+	pollingState.RUnlock()
+
+	deviceID := ""
+	if device != nil {
+		deviceID = device.ID
+		if device.CheckNowUntil != nil && device.CheckNowUntil.After(settings.RolloutUntil) {
+			settings.RolloutUntil = *device.CheckNowUntil
+		}
+	}
+	return settings.NextCheckAfter(deviceID, time.Now())
+}
+
+// Admin endpoint showing the polling settings
+func getPolling(c *gin.Context) {
+	pollingState.RLock()
+	defer pollingState.RUnlock()
+	c.JSON(http.StatusOK, gin.H{
+		"settings":       pollingState.settings,
+		"rollout_active": pollingState.settings.RolloutActive(time.Now()),
+	})
+}
+
+// Admin endpoint changing the polling settings, e.g. {"interval": "1h",
+// "rollout_interval": "1m", "rollout_for": "6h"}. "rollout_for" starts a
+// rollout (or ends it with "0s"); omitted fields are left unchanged.
+func updatePolling(c *gin.Context) {
+	var req struct {
+		Interval        string `json:"interval"`
+		RolloutInterval string `json:"rollout_interval"`
+		RolloutFor      string `json:"rollout_for"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid polling settings")
+		return
+	}
+	for field, value := range map[string]string{"interval": req.Interval, "rollout_interval": req.RolloutInterval} {
+		if d, err := time.ParseDuration(value); value != "" && (err != nil || d < time.Second) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, field+" must be a duration of at least 1s", gin.H{"field": field})
+			return
+		}
+	}
+	var rolloutFor time.Duration
+	if req.RolloutFor != "" {
+		var err error
+		if rolloutFor, err = time.ParseDuration(req.RolloutFor); err != nil || rolloutFor < 0 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "rollout_for must be a duration such as 6h", gin.H{"field": "rollout_for"})
+			return
+		}
+	}
+
+	pollingState.Lock()
+	defer pollingState.Unlock()
+	settings := pollingState.settings
+	if req.Interval != "" {
+		settings.Interval = req.Interval
+	}
+	if req.RolloutInterval != "" {
+		settings.RolloutInterval = req.RolloutInterval
+	}
+	if req.RolloutFor != "" {
+		settings.RolloutUntil = time.Now().UTC().Add(rolloutFor)
+		if rolloutFor == 0 {
+			settings.RolloutUntil = time.Time{}
+		}
+	}
+	if err := storage.WriteJSON(pollingFile, settings); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save polling settings")
+		return
+	}
+	pollingState.settings = settings
+	c.JSON(http.StatusOK, settings)
+}
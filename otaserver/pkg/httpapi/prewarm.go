@@ -0,0 +1,189 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// A release that is published or promoted is pushed to every mirror of
+// OTA_MIRRORS, and fetched once through the base URL of every region
+// registered with "prewarm": true, so that the edge cache of a remote site
+// already holds it when the first device asks. Each copy and fetch is
+// recorded per target in the release metadata, with the cache status the
+// edge reported; GET /admin/releases/<app>/<version>/prewarm shows them and
+// POST runs them again.
+
+const prewarmTimeout = 10 * time.Minute
+
+// Pre-warm target kinds
+const (
+	prewarmMirror = "mirror"
+	prewarmEdge   = "edge"
+)
+
+// Pre-warm states
+const (
+	prewarmQueued = "queued"
+	prewarmWarm   = "warm"
+	prewarmFailed = "failed"
+)
+
+// PrewarmStatus is the state of a release on one mirror or edge.
+type PrewarmStatus struct {
+	Kind       string    `json:"kind"`
+	Target     string    `json:"target"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	Cache      string    `json:"cache,omitempty"` // cache status reported by the edge
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+var prewarmFailures = newCounter("ota_prewarm_failures_total", "Mirror copies and edge fetches of new releases that failed.")
+
+var prewarmClient = &http.Client{Timeout: prewarmTimeout}
+
+// Helper function to record the state of a release on a target
+func recordPrewarm(release catalog.Release, status PrewarmStatus) {
+	status.UpdatedAt = time.Now().UTC()
+	if status.State == prewarmFailed {
+		prewarmFailures.Add(1)
+		log.Printf("pre-warming %s on %s %s: %s", release.FileName, status.Kind, status.Target, status.Error)
+	}
+	if _, err := updateReleaseMeta(release.App, release.Version, func(m *ReleaseMeta) {
+		if m.Prewarm == nil {
+			m.Prewarm = make(map[string]PrewarmStatus)
+		}
+		m.Prewarm[status.Kind+":"+status.Target] = status
+	}); err != nil {
+		log.Printf("recording pre-warm of %s: %v", release.FileName, err)
+	}
+}
+
+// Helper function to push a new release to the mirrors and fetch it through
+// the edges that want it
+func prewarmRelease(release catalog.Release) error {
+	if err := enqueueMirroring(release); err != nil {
+		return err
+	}
+	regionState.RLock()
+	edges := make(map[string]Region)
+	for name, region := range regionState.regions {
+		if region.Prewarm && region.BaseURL != "" {
+			edges[name] = region
+		}
+	}
+	regionState.RUnlock()
+	for name, region := range edges {
+		if err := enqueueEdgeWarm(name, region, release); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to queue a fetch of a release through a region's base URL,
+// verifying what the edge returns
+func enqueueEdgeWarm(name string, region Region, release catalog.Release) error {
+	recordPrewarm(release, PrewarmStatus{Kind: prewarmEdge, Target: name, State: prewarmQueued})
+	_, err := enqueueJob("prewarm", name+" "+release.FileName, func() error {
+		start := time.Now()
+		cache, err := fetchThroughEdge(regionalURL(name, region, "/download?release_id="+release.ID), release)
+		status := PrewarmStatus{Kind: prewarmEdge, Target: name, State: prewarmWarm, Cache: cache, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			status.State, status.Error = prewarmFailed, err.Error()
+		}
+		recordPrewarm(release, status)
+		return err
+	})
+	return err
+}
+
+// Helper function to download a release through an edge, returning the
+// cache status it reported
+func fetchThroughEdge(url string, release catalog.Release) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "ota-server-prewarm")
+	resp, err := prewarmClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	cache := edgeCacheStatus(resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		return cache, fmt.Errorf("edge answered %s", resp.Status)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, resp.Body)
+	if err != nil {
+		return cache, err
+	}
+	if digest := hex.EncodeToString(hash.Sum(nil)); size != release.Size || digest != release.ID {
+		return cache, fmt.Errorf("edge returned %d bytes with digest %s", size, digest)
+	}
+	return cache, nil
+}
+
+// Admin endpoint showing where a release has been pre-warmed
+func getPrewarm(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	release, ok := catalogIndex.Version(app, c.DefaultQuery("channel", catalog.DefaultChannel), version)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	meta, err := loadReleaseMeta(app, version)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+		return
+	}
+	targets := make([]PrewarmStatus, 0, len(meta.Prewarm))
+	for _, status := range meta.Prewarm {
+		targets = append(targets, status)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Kind != targets[j].Kind {
+			return targets[i].Kind > targets[j].Kind
+		}
+		return targets[i].Target < targets[j].Target
+	})
+	c.JSON(http.StatusOK, gin.H{"release_id": release.ID, "targets": targets})
+}
+
+// Admin endpoint pre-warming a release again, e.g. after an edge was added
+func startPrewarm(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	release, ok := catalogIndex.Version(app, c.DefaultQuery("channel", catalog.DefaultChannel), version)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	if err := prewarmRelease(release); err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"release_id": release.ID})
+}
+
+// Helper function to read the cache status an edge reported, in the header
+// of the usual CDNs and caching proxies
+func edgeCacheStatus(header http.Header) string {
+	for _, name := range []string{"X-Cache", "CF-Cache-Status", "X-Cache-Status"} {
+		if status := header.Get(name); status != "" {
+			return status
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package httpapi
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Between being offered an update and reporting its outcome, devices can
+// report the stage they are in through /report, e.g. {"device_id": "pos-1",
+// "version": "2.0.0", "status": "downloading", "progress": 40}, then
+// "verifying", "flashing" and "rebooting", optionally with the time "at"
+// which they entered the stage. The stages are kept on the device record and
+// GET /admin/progress shows every install in flight, so operators can follow
+// a rollout instead of waiting for success or failure reports. The final
+// report carries the stages and the install duration, from the first stage
+// to the outcome unless the device reports "duration_ms" itself.
+
+// Install progress states
+const (
+	progressDownloading = "downloading"
+	progressVerifying   = "verifying"
+	progressFlashing    = "flashing"
+	progressRebooting   = "rebooting"
+)
+
+var progressStates = []string{progressDownloading, progressVerifying, progressFlashing, progressRebooting}
+
+const (
+	// maxProgressStages bounds the stage trail of an install, which devices
+	// retrying a stage could otherwise grow without limit
+	maxProgressStages = 32
+	// progressStaleAfter is how long an install may go without a progress
+	// report before the progress view flags it
+	progressStaleAfter = 15 * time.Minute
+)
+
+// ProgressStage is a stage an install entered.
+type ProgressStage struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// InstallProgress is the state of an install in flight.
+type InstallProgress struct {
+	App       string          `json:"app,omitempty"` // the plugin when empty
+	Version   string          `json:"version"`
+	State     string          `json:"state"`
+	Percent   *int            `json:"percent,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Stages    []ProgressStage `json:"stages"`
+}
+
+// Helper function to tell whether a report status is a progress state
+func isProgressState(status string) bool {
+	return slices.Contains(progressStates, status)
+}
+
+// Helper function to record that a device entered a stage of an install, or
+// moved on within it
+func advanceProgress(d *Device, app, version, state string, percent *int, at time.Time) {
+	if app == "plugin" {
+		app = ""
+	}
+	p := d.Progress
+	if p == nil || p.App != app || p.Version != version {
+		p = &InstallProgress{App: app, Version: version, StartedAt: at}
+	}
+	if p.State != state && len(p.Stages) < maxProgressStages {
+		p.Stages = append(p.Stages, ProgressStage{State: state, At: at})
+	}
+	p.State, p.Percent, p.UpdatedAt = state, percent, at
+	d.Progress = p
+}
+
+// Helper function to end the install of a version, returning its stages and
+// how long it took up to at
+func finishProgress(d *Device, app, version string, at time.Time) ([]ProgressStage, time.Duration) {
+	if app == "plugin" {
+		app = ""
+	}
+	p := d.Progress
+	if p == nil || p.App != app || p.Version != version {
+		return nil, 0
+	}
+	d.Progress = nil
+	return p.Stages, at.Sub(p.StartedAt)
+}
+
+// Admin endpoint listing the installs in flight, longest running first;
+// ?version= and ?group= narrow the list and ?stale=true keeps only installs
+// that stopped reporting progress
+func listProgress(c *gin.Context) {
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	version, group, staleOnly := c.Query("version"), c.Query("group"), c.Query("stale") == "true"
+
+	now := time.Now()
+	installs := []gin.H{}
+	counts := make(map[string]int, len(progressStates))
+	for _, state := range progressStates {
+		counts[state] = 0
+	}
+	for _, device := range devices {
+		p := device.Progress
+		if p == nil || (version != "" && p.Version != version) || (group != "" && device.Group != group) {
+			continue
+		}
+		stale := now.Sub(p.UpdatedAt) > progressStaleAfter
+		if staleOnly && !stale {
+			continue
+		}
+		counts[p.State]++
+		installs = append(installs, gin.H{
+			"device_id":       device.ID,
+			"group":           device.Group,
+			"current_version": device.CurrentVersion,
+			"progress":        p,
+			"elapsed_seconds": int(now.Sub(p.StartedAt).Seconds()),
+			"stale":           stale,
+		})
+	}
+	sort.SliceStable(installs, func(i, j int) bool {
+		return installs[i]["progress"].(*InstallProgress).StartedAt.Before(installs[j]["progress"].(*InstallProgress).StartedAt)
+	})
+	c.JSON(http.StatusOK, gin.H{"installs": installs, "states": counts})
+}
@@ -0,0 +1,712 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Releases can be promoted from one channel to another once they proved
+// themselves, with a policy per app set by PUT /admin/promotion/<app>, e.g.
+// {"from": "beta", "to": "stable", "after": "168h", "min_success_rate": 0.99}:
+// a release that has been on "from" for "after", whose install reports
+// succeed at least min_success_rate of the time (over at least min_reports
+// devices, default 1) and that has no open P1 issue is copied to "to". Every
+// OTA_PROMOTION_INTERVAL (default 1h) a job promotes the eligible releases and
+// POSTs each promotion to OTA_PROMOTION_WEBHOOK_URL, if set.
+//
+// Issues are flagged with PUT /admin/releases/<app>/<version>/issues
+// [{"id": "BUG-123", "priority": "P1", "summary": "..."}] and an operator
+// keeps a release where it is with PUT /admin/releases/<app>/<version>/promotion
+// {"blocked": true, "reason": "..."}. The success rate is measured on the
+// last install report of every device, which only the plugin keeps.
+//
+// Releases are promoted by hand with POST /admin/releases/<app>/<version>/promote
+// {"to": "stable"}; GET on the same path previews the change for the target
+// channel. Major version jumps are never promoted automatically and need
+// "confirm": true by hand.
+
+// PromotionPolicy promotes the releases of an app from one channel to another.
+type PromotionPolicy struct {
+	From           string    `json:"from"`
+	To             string    `json:"to"`
+	After          string    `json:"after"`            // time on From, e.g. "168h"
+	MinSuccessRate float64   `json:"min_success_rate"` // of install reports, e.g. 0.99
+	MinReports     int       `json:"min_reports"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ReleaseIssue is a problem flagged against a release; P1 issues block its promotion.
+type ReleaseIssue struct {
+	ID        string    `json:"id"`
+	Priority  string    `json:"priority"` // P1 to P4
+	Summary   string    `json:"summary,omitempty"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// PromotionBlock keeps a release from being promoted automatically.
+type PromotionBlock struct {
+	Reason    string    `json:"reason,omitempty"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// PromotionCandidate is a release of a policy's From channel and what keeps
+// it from being promoted.
+type PromotionCandidate struct {
+	App         string    `json:"app"`
+	Version     string    `json:"version"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Since       time.Time `json:"since"`
+	Successes   int       `json:"successes"`
+	Failures    int       `json:"failures"`
+	SuccessRate float64   `json:"success_rate"`
+	Eligible    bool      `json:"eligible"`
+	Pending     []string  `json:"pending,omitempty"` // unmet conditions
+}
+
+var (
+	issueIDPattern       = regexp.MustCompile(`^[A-Za-z0-9._:#-]{1,64}$`)
+	issuePriorityPattern = regexp.MustCompile(`^P[1-4]$`)
+)
+
+// maxReleaseIssues is how many issues can be flagged against a release.
+const maxReleaseIssues = 100
+
+var promotionState = struct {
+	sync.RWMutex
+	policies map[string]PromotionPolicy // by app
+}{policies: make(map[string]PromotionPolicy)}
+
+var (
+	promotions     = newCounter("ota_promotions_total", "Releases promoted to another channel.")
+	webhookClient  = &http.Client{Timeout: 30 * time.Second}
+	promotionsTick sync.Once
+)
+
+// installCounts are the successful and failed installs of a version.
+type installCounts struct {
+	successes, failures int
+}
+
+// Helper function to load the promotion policies
+func initPromotion() error {
+	policies := make(map[string]PromotionPolicy)
+	if err := storage.ReadJSON(promotionFile, &policies); err != nil {
+		return err
+	}
+	promotionState.Lock()
+	promotionState.policies = policies
+	promotionState.Unlock()
+	return nil
+}
+
+// Helper function to start evaluating the promotion policies periodically
+func startPromotions() error {
+	interval := time.Hour
+	if value := os.Getenv("OTA_PROMOTION_INTERVAL"); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < time.Minute {
+			return fmt.Errorf("OTA_PROMOTION_INTERVAL must be a duration of at least 1m")
+		}
+	}
+	promotionsTick.Do(func() {
+		go func() {
+			for range time.Tick(interval) {
+				if !ReadOnly() && hasPromotionPolicies() {
+					enqueuePromotions()
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+func hasPromotionPolicies() bool {
+	promotionState.RLock()
+	defer promotionState.RUnlock()
+	return len(promotionState.policies) > 0
+}
+
+func promotionPolicies() map[string]PromotionPolicy {
+	promotionState.RLock()
+	defer promotionState.RUnlock()
+	return promotionState.policies
+}
+
+// Helper function to queue a promotion run unless one is already pending
+func enqueuePromotions() (*Job, error) {
+	job, err := enqueueJob("promotion", "policies", runPromotions)
+	if err != nil {
+		log.Printf("queueing promotions: %v", err)
+	}
+	return job, err
+}
+
+// Helper function to count the last install reports of the devices by version
+func installStats() (map[string]installCounts, error) {
+	devices, err := listDevices()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]installCounts)
+	for _, device := range devices {
+		report := device.LastReport
+		if report == nil {
+			continue
+		}
+		counts := stats[report.Version]
+		switch report.Status {
+		case reportSuccess:
+			counts.successes++
+		case reportFailure:
+			counts.failures++
+		}
+		stats[report.Version] = counts
+	}
+	return stats, nil
+}
+
+// Helper function to list the releases of the policies' From channels with
+// what keeps each of them from being promoted. Releases already in the To
+// channel are left out.
+func promotionCandidates(policies map[string]PromotionPolicy) ([]PromotionCandidate, error) {
+	stats, err := installStats()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]string, 0, len(policies))
+	for app := range policies {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+
+	candidates := []PromotionCandidate{}
+	for _, app := range apps {
+		policy := policies[app]
+		after, _ := time.ParseDuration(policy.After)
+		latest, hasLatest := catalogIndex.Latest(app, policy.To)
+		for _, release := range catalogIndex.Releases(app, policy.From) {
+			if promoted, ok := catalogIndex.Version(app, policy.To, release.Version); ok && promoted.Channel == policy.To {
+				continue
+			}
+			meta, err := loadReleaseMeta(app, release.Version)
+			if err != nil {
+				return nil, err
+			}
+			candidate := PromotionCandidate{App: app, Version: release.Version, From: policy.From, To: policy.To, Since: releaseCreatedAt(release, meta)}
+
+			if hasLatest && catalog.CompareVersions(release.Version, latest.Version) <= 0 {
+				candidate.Pending = append(candidate.Pending, fmt.Sprintf("not newer than %s on %s", latest.Version, policy.To))
+			}
+			if hasLatest && catalog.MajorJump(latest.Version, release.Version) {
+				candidate.Pending = append(candidate.Pending, fmt.Sprintf("a major version jump from %s needs a manual promotion", latest.Version))
+			}
+			if wait := time.Until(candidate.Since.Add(after)); wait > 0 {
+				candidate.Pending = append(candidate.Pending, fmt.Sprintf("on %s for another %s", policy.From, wait.Round(time.Minute)))
+			}
+			if app == "plugin" {
+				counts := stats[release.Version]
+				candidate.Successes, candidate.Failures = counts.successes, counts.failures
+			}
+			reports := candidate.Successes + candidate.Failures
+			if reports > 0 {
+				candidate.SuccessRate = float64(candidate.Successes) / float64(reports)
+			}
+			if reports < policy.MinReports {
+				candidate.Pending = append(candidate.Pending, fmt.Sprintf("%d of %d install reports", reports, policy.MinReports))
+			} else if reports > 0 && candidate.SuccessRate < policy.MinSuccessRate {
+				candidate.Pending = append(candidate.Pending, fmt.Sprintf("success rate %.2f%% below %.2f%%", candidate.SuccessRate*100, policy.MinSuccessRate*100))
+			}
+			for _, issue := range meta.Issues {
+				if issue.Priority == "P1" {
+					candidate.Pending = append(candidate.Pending, "P1 issue "+issue.ID)
+				}
+			}
+			if meta.PromotionBlock != nil {
+				candidate.Pending = append(candidate.Pending, "blocked: "+firstNonEmpty(meta.PromotionBlock.Reason, "by an operator"))
+			}
+			candidate.Eligible = len(candidate.Pending) == 0
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, nil
+}
+
+// Helper function to tell when a release was published
+func releaseCreatedAt(release catalog.Release, meta ReleaseMeta) time.Time {
+	if !meta.CreatedAt.IsZero() {
+		return meta.CreatedAt
+	}
+	if info, err := os.Stat(artifacts.ArtifactPath(release.FileName)); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// Helper function to promote the eligible releases of every policy
+func runPromotions() error {
+	candidates, err := promotionCandidates(promotionPolicies())
+	if err != nil {
+		return err
+	}
+	var failed []string
+	promoted := 0
+	for _, candidate := range candidates {
+		if !candidate.Eligible {
+			continue
+		}
+		if err := promoteRelease(candidate); err != nil {
+			log.Printf("promoting %s %s to %s: %v", candidate.App, candidate.Version, candidate.To, err)
+			failed = append(failed, candidate.App+"@"+candidate.Version)
+			continue
+		}
+		promoted++
+	}
+	if promoted > 0 {
+		if err := refreshCatalog(); err != nil {
+			log.Printf("refreshing catalog after promotions: %v", err)
+		}
+		if _, err := takeSnapshot("promotion"); err != nil {
+			log.Printf("snapshotting catalog: %v", err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not promote %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Helper function to copy a release into the To channel and announce it
+func promoteRelease(candidate PromotionCandidate) error {
+	release, ok := catalogIndex.Version(candidate.App, candidate.From, candidate.Version)
+	if !ok || release.Channel != candidate.From {
+		return errVersionUnavailable
+	}
+	if artifacts.Indexed() {
+		return errCatalogIndexed
+	}
+	fileName := path.Base(filepath.ToSlash(release.FileName))
+	dir, ok := catalog.ChannelDir(candidate.App, candidate.To)
+	if !ok {
+		return fmt.Errorf("%s has no channel %s", candidate.App, candidate.To)
+	}
+	rel := path.Join(dir, fileName)
+	destPath := artifacts.ArtifactPath(rel)
+	if !storage.InsideDir(otaFilesPath, destPath) {
+		return fmt.Errorf("invalid destination %s", rel)
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("%s already exists", rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return err
+	}
+	if err := storage.CopyFile(artifacts.ArtifactPath(release.FileName), destPath); err != nil {
+		return err
+	}
+	promotions.Add(1)
+	log.Printf("promoted %s %s from %s to %s", candidate.App, candidate.Version, candidate.From, candidate.To)
+	notifyPromotion(candidate, release)
+	promoted := release
+	promoted.Channel, promoted.FileName = candidate.To, rel
+	if err := prewarmRelease(promoted); err != nil {
+		log.Printf("queueing pre-warm of %s: %v", rel, err)
+	}
+	return nil
+}
+
+// Helper function to queue the webhook call announcing a promotion
+func notifyPromotion(candidate PromotionCandidate, release catalog.Release) {
+	url := os.Getenv("OTA_PROMOTION_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(gin.H{
+		"event":        "promotion",
+		"app":          candidate.App,
+		"version":      candidate.Version,
+		"from":         candidate.From,
+		"to":           candidate.To,
+		"release_id":   release.ID,
+		"successes":    candidate.Successes,
+		"failures":     candidate.Failures,
+		"success_rate": candidate.SuccessRate,
+		"promoted_at":  time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("promotion webhook: %v", err)
+		return
+	}
+	post := func() error {
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return platformError(resp)
+		}
+		return nil
+	}
+	if _, err := enqueueJob("promotion-webhook", candidate.App+"@"+candidate.Version, post); err != nil {
+		log.Printf("queueing promotion webhook for %s %s: %v", candidate.App, candidate.Version, err)
+	}
+}
+
+// Admin endpoint listing the promotion policies and the releases waiting for promotion
+func getPromotion(c *gin.Context) {
+	policies := promotionPolicies()
+	candidates, err := promotionCandidates(policies)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not evaluate promotion policies")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": policies, "candidates": candidates})
+}
+
+// Admin endpoint creating or replacing the promotion policy of an app, e.g.
+// PUT /admin/promotion/plugin {"from": "beta", "to": "stable", "after": "168h",
+// "min_success_rate": 0.99, "min_reports": 50}
+func updatePromotionPolicy(c *gin.Context) {
+	app := c.Param("app")
+	var req struct {
+		From           string   `json:"from"`
+		To             string   `json:"to"`
+		After          string   `json:"after"`
+		MinSuccessRate *float64 `json:"min_success_rate"`
+		MinReports     *int     `json:"min_reports"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid promotion policy")
+		return
+	}
+	policy := PromotionPolicy{From: req.From, To: firstNonEmpty(req.To, catalog.DefaultChannel), After: firstNonEmpty(req.After, "168h"), MinSuccessRate: 0.99, MinReports: 1}
+	if !catalog.ValidChannel(policy.From) || !catalog.ValidChannel(policy.To) || policy.From == policy.To {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "from and to must be two different channels")
+		return
+	}
+	if d, err := time.ParseDuration(policy.After); err != nil || d < 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "after must be a duration such as 168h", gin.H{"field": "after"})
+		return
+	}
+	if req.MinSuccessRate != nil {
+		if *req.MinSuccessRate < 0 || *req.MinSuccessRate > 1 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "min_success_rate must be between 0 and 1", gin.H{"field": "min_success_rate"})
+			return
+		}
+		policy.MinSuccessRate = *req.MinSuccessRate
+	}
+	if req.MinReports != nil {
+		if *req.MinReports < 0 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "min_reports must not be negative", gin.H{"field": "min_reports"})
+			return
+		}
+		policy.MinReports = *req.MinReports
+	}
+	policy.UpdatedAt = time.Now().UTC()
+
+	if err := savePromotionPolicy(app, &policy); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save promotion policies")
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// Admin endpoint removing the promotion policy of an app
+func deletePromotionPolicy(c *gin.Context) {
+	app := c.Param("app")
+	if _, ok := promotionPolicies()[app]; !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "promotion policy not found", gin.H{"app": app})
+		return
+	}
+	if err := savePromotionPolicy(app, nil); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save promotion policies")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Helper function to set (or with a nil policy, remove) the promotion policy
+// of an app
+func savePromotionPolicy(app string, policy *PromotionPolicy) error {
+	promotionState.Lock()
+	defer promotionState.Unlock()
+	policies := make(map[string]PromotionPolicy, len(promotionState.policies)+1)
+	for a, p := range promotionState.policies {
+		policies[a] = p
+	}
+	if policy != nil {
+		policies[app] = *policy
+	} else {
+		delete(policies, app)
+	}
+	if err := storage.WriteJSON(promotionFile, policies); err != nil {
+		return err
+	}
+	promotionState.policies = policies
+	return nil
+}
+
+// Admin endpoint queueing a promotion run now
+func startPromotionRun(c *gin.Context) {
+	job, err := enqueuePromotions()
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+// Admin endpoint replacing the issues flagged against a release, e.g.
+// [{"id": "BUG-123", "priority": "P1", "summary": "boot loop on rev B"}]; an
+// empty list clears them
+func updateReleaseIssues(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	var issues []ReleaseIssue
+	if err := c.ShouldBindJSON(&issues); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "issues must be a list of {id, priority, summary}")
+		return
+	}
+	if len(issues) > maxReleaseIssues {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "too many issues", gin.H{"max": maxReleaseIssues})
+		return
+	}
+
+	meta, err := loadReleaseMeta(app, version)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+		return
+	}
+	flagged := make(map[string]time.Time, len(meta.Issues))
+	for _, issue := range meta.Issues {
+		flagged[issue.ID] = issue.FlaggedAt
+	}
+	now := time.Now().UTC()
+	for i := range issues {
+		issues[i].Priority = strings.ToUpper(issues[i].Priority)
+		if !issueIDPattern.MatchString(issues[i].ID) || !issuePriorityPattern.MatchString(issues[i].Priority) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "issues need an id and a priority from P1 to P4", gin.H{"id": issues[i].ID})
+			return
+		}
+		// Issues keep the time they were first flagged
+		issues[i].FlaggedAt = now
+		if at, ok := flagged[issues[i].ID]; ok {
+			issues[i].FlaggedAt = at
+		}
+	}
+
+	meta, err = updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.Issues = issues
+		if len(issues) == 0 {
+			m.Issues = nil
+		}
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save issues")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// Admin endpoint blocking or unblocking the automatic promotion of a
+// release, e.g. {"blocked": true, "reason": "waiting for field trial"}
+func updatePromotionBlock(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	var req struct {
+		Blocked *bool  `json:"blocked"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Blocked == nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "blocked is required")
+		return
+	}
+	meta, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.PromotionBlock = nil
+		if *req.Blocked {
+			m.PromotionBlock = &PromotionBlock{Reason: req.Reason, BlockedAt: time.Now().UTC()}
+		}
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save release metadata")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// PromotionPreview is what promoting a release changes for its target channel.
+type PromotionPreview struct {
+	App            string `json:"app"`
+	Version        string `json:"version"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	CurrentVersion string `json:"current_version,omitempty"` // newest release of To
+	MajorJump      bool   `json:"major_jump"`
+	Size           int64  `json:"size"`
+	SizeDelta      int64  `json:"size_delta"` // against CurrentVersion
+	Mandatory      bool   `json:"mandatory"`
+	MinimumVersion string `json:"minimum_version,omitempty"`
+
+	// Devices running an older version: those that follow the newest
+	// release, those held by a desired version and those too old to install
+	// the release directly
+	AffectedDevices     int `json:"affected_devices"`
+	PinnedDevices       int `json:"pinned_devices"`
+	BelowMinimumDevices int `json:"below_minimum_devices"`
+
+	// ConfirmationRequired is set for major version jumps
+	ConfirmationRequired bool `json:"confirmation_required"`
+}
+
+// Helper function to find the channel a release would be promoted from: the
+// given one, or the channel other than to it is published in. Releases
+// already in to have no source.
+func promotionSource(app, version, from, to string) (catalog.Release, bool) {
+	if promoted, ok := catalogIndex.Version(app, to, version); ok && promoted.Channel == to {
+		return catalog.Release{}, false
+	}
+	for _, release := range catalogIndex.App(app) {
+		if release.Version != version || release.Channel == to {
+			continue
+		}
+		if from == "" || release.Channel == from {
+			return release, true
+		}
+	}
+	return catalog.Release{}, false
+}
+
+// Helper function to describe what promoting a release to a channel changes
+func previewPromotion(release catalog.Release, to string) (PromotionPreview, error) {
+	meta, err := loadReleaseMeta(release.App, release.Version)
+	if err != nil {
+		return PromotionPreview{}, err
+	}
+	preview := PromotionPreview{
+		App:            release.App,
+		Version:        release.Version,
+		From:           release.Channel,
+		To:             to,
+		Size:           release.Size,
+		SizeDelta:      release.Size,
+		Mandatory:      meta.Mandatory,
+		MinimumVersion: meta.MinimumVersion,
+	}
+	if current, ok := catalogIndex.Latest(release.App, to); ok {
+		preview.CurrentVersion = current.Version
+		preview.SizeDelta = release.Size - current.Size
+		preview.MajorJump = catalog.MajorJump(current.Version, release.Version)
+	}
+	preview.ConfirmationRequired = preview.MajorJump
+
+	devices, err := listDevices()
+	if err != nil {
+		return PromotionPreview{}, err
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		return PromotionPreview{}, err
+	}
+	for i := range devices {
+		running := appVersion(&devices[i], release.App)
+		if running == "" || catalog.CompareVersions(running, release.Version) >= 0 {
+			continue
+		}
+		// Desired versions only apply to the plugin
+		if target, _ := desiredVersion(&devices[i], groups); target != "" && release.App == "plugin" {
+			preview.PinnedDevices++
+			continue
+		}
+		preview.AffectedDevices++
+		if meta.MinimumVersion != "" && catalog.CompareVersions(running, meta.MinimumVersion) < 0 {
+			preview.BelowMinimumDevices++
+		}
+	}
+	return preview, nil
+}
+
+// Admin endpoint showing what promoting a release would change, e.g.
+// GET /admin/releases/plugin/2.0.0/promote?to=stable
+func getPromotionPreview(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	to := c.DefaultQuery("to", catalog.DefaultChannel)
+	release, ok := promotionSource(app, version, c.Query("from"), to)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found, or already in the target channel", gin.H{"version": version, "to": to})
+		return
+	}
+	preview, err := previewPromotion(release, to)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not preview promotion")
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// Admin endpoint promoting a release to another channel, e.g.
+// {"to": "stable"}. Major version jumps are refused with the preview of the
+// change until repeated with "confirm": true.
+func promoteReleaseNow(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	var req struct {
+		From    string `json:"from"`
+		To      string `json:"to"`
+		Confirm bool   `json:"confirm"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid promotion")
+		return
+	}
+	req.To = firstNonEmpty(req.To, catalog.DefaultChannel)
+	if !catalog.ValidChannel(req.To) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+	release, ok := promotionSource(app, version, req.From, req.To)
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found, or already in the target channel", gin.H{"version": version, "to": req.To})
+		return
+	}
+	preview, err := previewPromotion(release, req.To)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not preview promotion")
+		return
+	}
+	if preview.ConfirmationRequired && !req.Confirm {
+		respondError(c, http.StatusConflict, CodeConflict, "promoting across a major version needs \"confirm\": true", gin.H{"preview": preview})
+		return
+	}
+
+	candidate := PromotionCandidate{App: app, Version: version, From: release.Channel, To: req.To}
+	if err := promoteRelease(candidate); err != nil {
+		log.Printf("promoting %s %s to %s: %v", app, version, req.To, err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not promote release")
+		return
+	}
+	if err := refreshCatalog(); err != nil {
+		log.Printf("refreshing catalog after promotion: %v", err)
+	}
+	c.JSON(http.StatusOK, preview)
+}
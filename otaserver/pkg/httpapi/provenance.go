@@ -0,0 +1,214 @@
+package httpapi
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/manifest"
+)
+
+// Publishers can attach the build provenance of a release: an in-toto SLSA
+// provenance attestation (the "attestation" form field or file, or the
+// "attestation" of a pull request), or plain "builder", "source_repo",
+// "source_commit" and "build_workflow" fields. The provenance is stored with
+// the release metadata and offered to devices with the release; the original
+// attestation is served at /releases/<app>/<version>/attestation.
+//
+// OTA_PROVENANCE_KEYS names PEM files (comma-separated) of the public keys
+// trusted to sign attestations. When set, attestations must be DSSE envelopes
+// signed by one of them. OTA_PROVENANCE_BUILDERS restricts the builder IDs
+// accepted (comma-separated prefixes), and OTA_REQUIRE_PROVENANCE=1 refuses
+// uploads without a verified attestation. Rejected uploads are quarantined.
+
+const reasonProvenanceRejected = "provenance_rejected"
+
+// maxAttestationSize is the largest attestation accepted with an upload.
+const maxAttestationSize = 1 << 20
+
+var provenanceKeys = struct {
+	sync.RWMutex
+	trusted []crypto.PublicKey
+}{}
+
+func requireProvenance() bool {
+	v := strings.ToLower(os.Getenv("OTA_REQUIRE_PROVENANCE"))
+	return v == "1" || v == "true"
+}
+
+func trustedBuilders() []string {
+	var builders []string
+	for _, builder := range strings.Split(os.Getenv("OTA_PROVENANCE_BUILDERS"), ",") {
+		if builder = strings.TrimSpace(builder); builder != "" {
+			builders = append(builders, builder)
+		}
+	}
+	return builders
+}
+
+// Helper function to load the public keys trusted to sign attestations
+func initProvenance() error {
+	var trusted []crypto.PublicKey
+	for _, path := range strings.Split(os.Getenv("OTA_PROVENANCE_KEYS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		keys, err := loadPublicKeys(path)
+		if err != nil {
+			return err
+		}
+		trusted = append(trusted, keys...)
+	}
+	provenanceKeys.Lock()
+	provenanceKeys.trusted = trusted
+	provenanceKeys.Unlock()
+	return nil
+}
+
+// Helper function to read every PKIX public key of a PEM file
+func loadPublicKeys(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", path)
+	}
+	return keys, nil
+}
+
+func trustedProvenanceKeys() []crypto.PublicKey {
+	provenanceKeys.RLock()
+	defer provenanceKeys.RUnlock()
+	return provenanceKeys.trusted
+}
+
+func attestationFile(app, version string) string {
+	return filepath.Join(metadataPath, app+"_"+version+".intoto.json")
+}
+
+// Helper function to read the provenance fields of an upload form
+func uploadProvenance(c *gin.Context) ([]byte, *manifest.Provenance, error) {
+	attestation := []byte(c.PostForm("attestation"))
+	if header, err := c.FormFile("attestation"); err == nil {
+		if header.Size > maxAttestationSize {
+			return nil, nil, fmt.Errorf("attestation is larger than %d bytes", maxAttestationSize)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+		if attestation, err = io.ReadAll(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(attestation) > maxAttestationSize {
+		return nil, nil, fmt.Errorf("attestation is larger than %d bytes", maxAttestationSize)
+	}
+
+	var stated *manifest.Provenance
+	if builder := c.PostForm("builder"); builder != "" {
+		stated = &manifest.Provenance{
+			Builder:       builder,
+			SourceRepo:    c.PostForm("source_repo"),
+			SourceCommit:  c.PostForm("source_commit"),
+			BuildWorkflow: c.PostForm("build_workflow"),
+		}
+	}
+	return attestation, stated, nil
+}
+
+// Helper function to determine the provenance of an upload with the given
+// SHA-256 digest from its attestation, or else the provenance the publisher
+// stated. A non-empty detail explains why the upload must be rejected.
+func checkProvenance(req uploadRequest, sha256Hex string) (*manifest.Provenance, string) {
+	if len(req.attestation) == 0 {
+		if requireProvenance() {
+			return nil, "a verified provenance attestation is required"
+		}
+		return req.provenance, ""
+	}
+
+	statement, envelope, err := manifest.ParseAttestation(req.attestation)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if !statement.Covers(sha256Hex) {
+		return nil, "attestation is not about this artifact"
+	}
+	prov, err := statement.Provenance()
+	if err != nil {
+		return nil, err.Error()
+	}
+	if builders := trustedBuilders(); len(builders) > 0 && !hasAnyPrefix(prov.Builder, builders) {
+		return nil, "builder is not trusted: " + prov.Builder
+	}
+
+	if trusted := trustedProvenanceKeys(); len(trusted) > 0 {
+		if envelope == nil {
+			return nil, "attestation must be a signed DSSE envelope"
+		}
+		keyID, err := envelope.Verify(trusted)
+		if err != nil {
+			return nil, "attestation signature: " + err.Error()
+		}
+		prov.Verified, prov.KeyID = true, keyID
+	}
+	if !prov.Verified && requireProvenance() {
+		return nil, "a verified provenance attestation is required"
+	}
+	return &prov, ""
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Device endpoint serving the provenance attestation a release was published with
+func getAttestation(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	data, err := os.ReadFile(attestationFile(app, version))
+	if os.IsNotExist(err) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "release has no attestation")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read attestation")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s.intoto.json\"", app, version))
+	c.Data(http.StatusOK, "application/json", data)
+}
@@ -0,0 +1,264 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/sbom"
+)
+
+// Instead of streaming an artifact through the publisher, CI can ask the
+// server to fetch it from an artifact store. The download goes through the
+// same validation, scan and quarantine as an upload, and the expected SHA-256
+// digest is mandatory. OTA_PULL_ALLOWED_HOSTS (comma-separated) lists the
+// hosts the server may fetch from, checked again at every redirect; pulling
+// is refused while it is unset. Loopback, private and link-local addresses
+// are refused when connecting, whatever name resolved to them, unless
+// OTA_PULL_ALLOW_PRIVATE=1 (e.g. for an artifact store on the LAN), so that
+// pulls cannot be turned against the server's own network.
+
+// pullMaxRedirects bounds the redirects a pull follows.
+const pullMaxRedirects = 10
+
+var errPullAddressForbidden = errors.New("pulling from a loopback, private or link-local address is not allowed")
+
+// sourceClient fetches from the sources operators configure, the release
+// sync provider and the upstream server, following any redirect.
+var sourceClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// pullClient fetches the URLs given to the pull endpoint. It follows
+// redirects to allowed hosts, which artifact stores use to hand out signed
+// storage URLs, but gives up on servers that do not answer.
+var pullClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: pullDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= pullMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", pullMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirected to a %s URL", req.URL.Scheme)
+		}
+		if !pullHostAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirected to %s, which is not an allowed host", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// Helper function to refuse connecting a pull to an address inside the
+// server's network, checked on the resolved address
+func pullDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !pullAddressAllowed(ip) {
+		return fmt.Errorf("%w: %s", errPullAddressForbidden, host)
+	}
+	return nil
+}
+
+// Helper function to check whether a pull may connect to an address
+func pullAddressAllowed(ip net.IP) bool {
+	if os.Getenv("OTA_PULL_ALLOW_PRIVATE") == "1" {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// PullRequest is the body of the pull endpoint.
+type PullRequest struct {
+	URL       string            `json:"url"`
+	SHA256    string            `json:"sha256"`
+	Checksum  string            `json:"checksum"`  // optional MD5
+	FileName  string            `json:"file_name"` // defaults to the last segment of the URL path
+	Headers   map[string]string `json:"headers"`   // e.g. {"Authorization": "Bearer ..."}
+	Notes     string            `json:"notes"`
+	Channel   string            `json:"channel"`
+	CreatedAt *time.Time        `json:"created_at"`
+
+	// Attestation is an in-toto provenance attestation; Provenance is the
+	// build provenance stated without one
+	Attestation json.RawMessage      `json:"attestation"`
+	Provenance  *manifest.Provenance `json:"provenance"`
+
+	// SBOM is an SPDX or CycloneDX JSON document
+	SBOM json.RawMessage `json:"sbom"`
+
+	// Force replaces a published version with different content, see publishArtifact
+	Force       bool   `json:"force"`
+	ForceReason string `json:"force_reason"`
+}
+
+// Admin endpoint publishing an artifact fetched from a URL, e.g.
+// {"url": "https://ci.example.com/artifacts/plugin_2.4.0.wasm", "sha256": "..."}
+func pullRelease(c *gin.Context) {
+	var req PullRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid pull request")
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if !sha256Pattern.MatchString(req.SHA256) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "sha256 must be 64 lowercase hex characters")
+		return
+	}
+	if req.Channel != "" && !catalog.ValidChannel(req.Channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+	if req.Provenance != nil && req.Provenance.Builder == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "provenance must name the builder")
+		return
+	}
+	if string(req.Attestation) == "null" {
+		req.Attestation = nil
+	}
+	if string(req.SBOM) == "null" {
+		req.SBOM = nil
+	}
+	if len(req.SBOM) > 0 {
+		if _, err := sbom.Parse(req.SBOM); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	source, err := url.Parse(req.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "url must be an http or https URL")
+		return
+	}
+	if os.Getenv("OTA_PULL_ALLOWED_HOSTS") == "" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "pulling is disabled until OTA_PULL_ALLOWED_HOSTS lists the hosts to pull from")
+		return
+	}
+	if !pullHostAllowed(source.Hostname()) {
+		respondError(c, http.StatusForbidden, CodeForbidden, "pulling from this host is not allowed", gin.H{"host": source.Hostname()})
+		return
+	}
+	if req.FileName == "" {
+		req.FileName = path.Base(source.Path)
+	}
+	if !allowUploadTokenApp(c, req.FileName) {
+		return
+	}
+
+	tmpPath, digests, err := fetchArtifact(c.Request.Context(), pullClient, source.String(), req.Headers)
+	if err != nil {
+		log.Printf("pulling %s: %v", source.Redacted(), err)
+		respondError(c, http.StatusBadGateway, CodeUnavailable, "Could not fetch artifact: "+err.Error())
+		return
+	}
+
+	var createdAt time.Time
+	if req.CreatedAt != nil {
+		createdAt = *req.CreatedAt
+	}
+	// Only the publisher's statement is taken from the body, not a verification
+	provenance := req.Provenance
+	if provenance != nil {
+		provenance.Verified, provenance.KeyID, provenance.PredicateType = false, "", ""
+	}
+	publishUpload(c, tmpPath, uploadRequest{
+		fileName:    path.Base(req.FileName),
+		expectedSHA: req.SHA256,
+		expectedMD5: strings.ToLower(req.Checksum),
+		notes:       req.Notes,
+		channel:     req.Channel,
+		createdAt:   createdAt,
+		attestation: req.Attestation,
+		provenance:  provenance,
+		sbom:        req.SBOM,
+		force:       req.Force,
+		forceReason: req.ForceReason,
+	}, digests)
+}
+
+// Helper function to check a host against OTA_PULL_ALLOWED_HOSTS; entries
+// starting with "." also match subdomains. No host is allowed while it is unset.
+func pullHostAllowed(host string) bool {
+	allowed := os.Getenv("OTA_PULL_ALLOWED_HOSTS")
+	if allowed == "" {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(allowed, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to download an artifact with client into a temporary file
+// next to the quarantine, computing its digests on the way
+func fetchArtifact(ctx context.Context, client *http.Client, rawURL string, headers map[string]string) (string, uploadDigests, error) {
+	fetch, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", uploadDigests{}, err
+	}
+	for name, value := range headers {
+		fetch.Header.Set(name, value)
+	}
+	resp, err := client.Do(fetch)
+	if err != nil {
+		return "", uploadDigests{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", uploadDigests{}, fmt.Errorf("%s", resp.Status)
+	}
+
+	if err := os.MkdirAll(quarantinePath, 0o755); err != nil {
+		return "", uploadDigests{}, err
+	}
+	tmp, err := os.CreateTemp(quarantinePath, "pull-*.part")
+	if err != nil {
+		return "", uploadDigests{}, err
+	}
+	digests, err := copyAndHash(tmp, resp.Body)
+	tmp.Close()
+	if err == nil && resp.ContentLength >= 0 && digests.size != resp.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", digests.size, resp.ContentLength)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", uploadDigests{}, err
+	}
+	return tmp.Name(), digests, nil
+}
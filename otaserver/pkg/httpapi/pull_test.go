@@ -0,0 +1,136 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPullHostAllowed(t *testing.T) {
+	tests := []struct {
+		allowed string
+		host    string
+		want    bool
+	}{
+		{"", "ci.example.com", false},
+		{"", "localhost", false},
+		{"ci.example.com", "ci.example.com", true},
+		{"ci.example.com", "CI.Example.com", true},
+		{"ci.example.com", "evil.example.com", false},
+		{"ci.example.com", "ci.example.com.evil.net", false},
+		{" ci.example.com , .storage.example.net", "bucket.storage.example.net", true},
+		{".storage.example.net", "storage.example.net", false},
+		{".storage.example.net", "evilstorage.example.net", false},
+		{",,", "ci.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTA_PULL_ALLOWED_HOSTS", tt.allowed)
+		if got := pullHostAllowed(tt.host); got != tt.want {
+			t.Errorf("with %q, pullHostAllowed(%q) = %v, want %v", tt.allowed, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestPullAddressAllowed(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.10.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.251", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := pullAddressAllowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("pullAddressAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	t.Setenv("OTA_PULL_ALLOW_PRIVATE", "1")
+	if !pullAddressAllowed(net.ParseIP("10.1.2.3")) {
+		t.Error("pullAddressAllowed(10.1.2.3) = false with OTA_PULL_ALLOW_PRIVATE=1")
+	}
+}
+
+func TestPullClientRedirects(t *testing.T) {
+	previous := quarantinePath
+	quarantinePath = t.TempDir()
+	t.Cleanup(func() { quarantinePath = previous })
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("artifact"))
+	}))
+	defer target.Close()
+	// The same server reached under another name, which is not allowed
+	other := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/allowed":
+			http.Redirect(w, r, target.URL+"/plugin_1.0.0.wasm", http.StatusFound)
+		case "/other-host":
+			http.Redirect(w, r, other+"/plugin_1.0.0.wasm", http.StatusFound)
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer redirect.Close()
+	host, _ := url.Parse(target.URL)
+
+	tests := []struct {
+		name         string
+		allowPrivate bool
+		path         string
+		wantErr      string // "" for success
+	}{
+		{"loopback refused", false, "/allowed", errPullAddressForbidden.Error()},
+		{"redirect to an allowed host", true, "/allowed", ""},
+		{"redirect to another host", true, "/other-host", "not an allowed host"},
+		{"redirect to another scheme", true, "/file", "redirected to a file URL"},
+		{"redirect loop", true, "/loop", "redirects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTA_PULL_ALLOWED_HOSTS", host.Hostname())
+			if tt.allowPrivate {
+				t.Setenv("OTA_PULL_ALLOW_PRIVATE", "1")
+			}
+			tmpPath, digests, err := fetchArtifact(context.Background(), pullClient, redirect.URL+tt.path, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("fetchArtifact = %v", err)
+				}
+				defer os.Remove(tmpPath)
+				if digests.size != int64(len("artifact")) {
+					t.Errorf("fetched %d bytes, want %d", digests.size, len("artifact"))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("fetchArtifact = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if tt.wantErr == errPullAddressForbidden.Error() && !errors.Is(err, errPullAddressForbidden) {
+				t.Errorf("fetchArtifact = %v, want %v", err, errPullAddressForbidden)
+			}
+		})
+	}
+}
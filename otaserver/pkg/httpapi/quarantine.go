@@ -0,0 +1,197 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploads failing validation are kept in quarantine for inspection with GET
+// /admin/quarantine. Records older than OTA_QUARANTINE_RETENTION (default 30
+// days) are pruned, and so are the oldest records once the quarantined files
+// exceed OTA_QUARANTINE_MAX_BYTES (default 10 GiB), so that repeated bad
+// uploads cannot fill the disk.
+
+const (
+	defaultQuarantineRetention = 30 * 24 * time.Hour
+	defaultQuarantineMaxBytes  = 10 << 30
+	quarantinePruneInterval    = time.Hour
+)
+
+// quarantineMu serializes adding records to the quarantine and pruning it.
+var quarantineMu sync.Mutex
+
+var prunedQuarantine = newCounter("ota_quarantine_pruned_total", "Quarantined uploads pruned by age or size.")
+
+func quarantineRetention() time.Duration {
+	return envDuration("OTA_QUARANTINE_RETENTION", defaultQuarantineRetention)
+}
+
+func quarantineMaxBytes() int64 {
+	return envBytes("OTA_QUARANTINE_MAX_BYTES", defaultQuarantineMaxBytes)
+}
+
+// Reasons an uploaded file can be quarantined for
+const (
+	reasonInvalidFileName  = "invalid_filename"
+	reasonChecksumMismatch = "checksum_mismatch"
+	reasonInvalidArtifact  = "invalid_artifact"
+	reasonMalwareDetected  = "malware_detected"
+)
+
+// QuarantineRecord describes a rejected upload kept for inspection.
+type QuarantineRecord struct {
+	ID            string    `json:"id"`
+	FileName      string    `json:"file_name"`
+	Reason        string    `json:"reason"`
+	Detail        string    `json:"detail"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	UploadedBy    string    `json:"uploaded_by"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Helper function to move a rejected upload into quarantine with a reason record
+func quarantineFile(tmpPath string, record QuarantineRecord) error {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	if err := os.MkdirAll(quarantinePath, 0o755); err != nil {
+		return err
+	}
+
+	record.ID = fmt.Sprintf("%d-%s", time.Now().UnixNano(), record.SHA256[:12])
+	record.QuarantinedAt = time.Now().UTC()
+
+	if err := os.Rename(tmpPath, filepath.Join(quarantinePath, record.ID+".bin")); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(quarantinePath, record.ID+".json"), data, 0o644); err != nil {
+		return err
+	}
+	if err := pruneQuarantine(time.Now()); err != nil {
+		log.Printf("pruning quarantine: %v", err)
+	}
+	return nil
+}
+
+// Helper function to prune the quarantine now and then
+func initQuarantine() error {
+	quarantineMu.Lock()
+	err := pruneQuarantine(time.Now())
+	quarantineMu.Unlock()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(quarantinePruneInterval) {
+			quarantineMu.Lock()
+			err := pruneQuarantine(time.Now())
+			quarantineMu.Unlock()
+			if err != nil {
+				log.Printf("pruning quarantine: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to remove quarantine records past the retention, and the
+// oldest records beyond the size limit. The caller holds quarantineMu.
+func pruneQuarantine(now time.Time) error {
+	records, err := listQuarantine()
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-quarantineRetention())
+	limit := quarantineMaxBytes()
+	var kept int64
+	for _, record := range records {
+		kept += record.Size
+		if record.QuarantinedAt.After(cutoff) && kept <= limit {
+			continue
+		}
+		if err := os.Remove(filepath.Join(quarantinePath, record.ID+".bin")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(quarantinePath, record.ID+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		prunedQuarantine.Add(1)
+		log.Printf("pruned %s (%s) from quarantine", record.ID, record.FileName)
+	}
+	return nil
+}
+
+// Helper function to read all quarantine records, newest first
+func listQuarantine() ([]QuarantineRecord, error) {
+	entries, err := os.ReadDir(quarantinePath)
+	if os.IsNotExist(err) {
+		return []QuarantineRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []QuarantineRecord{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(quarantinePath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var record QuarantineRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].QuarantinedAt.After(records[j].QuarantinedAt)
+	})
+	return records, nil
+}
+
+// Admin endpoint listing quarantined uploads
+func listQuarantined(c *gin.Context) {
+	records, err := listQuarantine()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read quarantine")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quarantined": records})
+}
+
+// Admin endpoint downloading a quarantined file for inspection
+func downloadQuarantined(c *gin.Context) {
+	id := c.Param("id")
+	if strings.ContainsAny(id, `/\`) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid id")
+		return
+	}
+
+	filePath := filepath.Join(quarantinePath, id+".bin")
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "quarantine record not found")
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.bin\"", id))
+	c.File(filePath)
+}
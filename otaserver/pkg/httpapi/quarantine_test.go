@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+func TestPruneQuarantine(t *testing.T) {
+	withStateDirs(t, nil)
+	t.Setenv("OTA_QUARANTINE_RETENTION", "720h")
+	t.Setenv("OTA_QUARANTINE_MAX_BYTES", "250")
+	if err := os.MkdirAll(quarantinePath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, record := range []QuarantineRecord{
+		{ID: "newest", Size: 100, QuarantinedAt: now.Add(-time.Minute)},
+		{ID: "recent", Size: 100, QuarantinedAt: now.Add(-time.Hour)},
+		{ID: "beyond-size", Size: 100, QuarantinedAt: now.Add(-2 * time.Hour)},
+		{ID: "expired", Size: 1, QuarantinedAt: now.Add(-31 * 24 * time.Hour)},
+	} {
+		if err := storage.WriteJSON(filepath.Join(quarantinePath, record.ID+".json"), record); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(quarantinePath, record.ID+".bin"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneQuarantine(now); err != nil {
+		t.Fatalf("pruneQuarantine: %v", err)
+	}
+	for id, want := range map[string]bool{"newest": true, "recent": true, "beyond-size": false, "expired": false} {
+		for _, ext := range []string{".json", ".bin"} {
+			if _, err := os.Stat(filepath.Join(quarantinePath, id+ext)); (err == nil) != want {
+				t.Errorf("%s%s: %v, want kept %v", id, ext, err, want)
+			}
+		}
+	}
+}
+
+func TestUploadsOfOtherAppsAreNotQuarantined(t *testing.T) {
+	withStateDirs(t, nil)
+	withUploadTokens(t, map[string]UploadToken{
+		"plugin-ci": {ID: "plugin-ci", App: "plugin", Scope: "publish", ExpiresAt: time.Now().Add(time.Hour)},
+	})
+	r := gin.New()
+	admin := r.Group("/admin", adminAuth())
+	admin.PUT("/upload/:file", streamUpload)
+	admin.POST("/uploads", createUploadSession)
+
+	tests := []struct {
+		name, method, url, body string
+	}{
+		{"streamed", http.MethodPut, "/admin/upload/runtime_1.0.0.wasm?sha256=" + strings.Repeat("ab", 32), "not a wasm module"},
+		{"chunked", http.MethodPost, "/admin/uploads", `{"file_name": "runtime_1.0.0.wasm", "size": 4, "sha256": "` + strings.Repeat("ab", 32) + `"}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer plugin-ci")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403: %s", tt.name, w.Code, w.Body)
+		}
+	}
+
+	// The publish check also precedes validation for the other publish paths
+	tmp := filepath.Join(t.TempDir(), "upload.part")
+	if err := os.WriteFile(tmp, []byte("not a wasm module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := publishArtifact(tmp, uploadRequest{fileName: "runtime_1.0.0.wasm", expectedSHA: strings.Repeat("ab", 32)},
+		uploadDigests{size: 17, sha256: strings.Repeat("cd", 32), magic: []byte("not a")}, "ci", func(app, channel string) bool { return false })
+	if !errors.Is(err, errPublishDenied) {
+		t.Errorf("publishArtifact = %v, want %v", err, errPublishDenied)
+	}
+
+	records, err := listQuarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("quarantined %d uploads the token may not make", len(records))
+	}
+}
@@ -0,0 +1,214 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Tenant is a customer of a hosted deployment, identified by its API token.
+// A zero quota means unlimited.
+type Tenant struct {
+	Name         string           `json:"name"`
+	Token        string           `json:"token"`
+	MonthlyQuota int64            `json:"monthly_quota,omitempty"`
+	RouteQuotas  map[string]int64 `json:"route_quotas,omitempty"`
+}
+
+// TenantUsage counts the requests of one tenant during one month.
+type TenantUsage struct {
+	Total  int64            `json:"total"`
+	Routes map[string]int64 `json:"routes"`
+}
+
+// quotaState holds the tenants and the usage counters of the current month.
+// Counters are flushed to disk periodically so a restart loses at most one
+// flush interval of usage.
+var quotaState = struct {
+	sync.Mutex
+	tenants map[string]Tenant // by token
+	month   string
+	usage   map[string]*TenantUsage // by tenant name
+	dirty   bool
+}{}
+
+const usageFlushInterval = time.Minute
+
+func usageFile(month string) string {
+	return filepath.Join(usagePath, month+".json")
+}
+
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// Helper function to load the tenants and their quotas, keeping the usage
+// counted so far
+func loadTenants() error {
+	var tenants []Tenant
+	if err := storage.ReadJSON(tenantsFile, &tenants); err != nil {
+		return err
+	}
+	byToken := make(map[string]Tenant, len(tenants))
+	for _, t := range tenants {
+		byToken[t.Token] = t
+	}
+	quotaState.Lock()
+	quotaState.tenants = byToken
+	quotaState.Unlock()
+	return nil
+}
+
+// Helper function to load tenants and this month's usage at startup and start
+// the background flusher
+func initQuotas() error {
+	if err := loadTenants(); err != nil {
+		return err
+	}
+	usage := make(map[string]*TenantUsage)
+	month := currentMonth()
+	if err := storage.ReadJSON(usageFile(month), &usage); err != nil {
+		return err
+	}
+
+	quotaState.Lock()
+	quotaState.month = month
+	quotaState.usage = usage
+	quotaState.Unlock()
+
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			if err := flushUsage(); err != nil {
+				log.Printf("flushing usage: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to persist the usage counters if they changed
+func flushUsage() error {
+	quotaState.Lock()
+	defer quotaState.Unlock()
+	if !quotaState.dirty {
+		return nil
+	}
+	quotaState.dirty = false
+	return storage.WriteJSON(usageFile(quotaState.month), quotaState.usage)
+}
+
+// Helper function to start a new month's counters, persisting the old ones.
+// Must be called with quotaState locked.
+func rolloverUsageLocked() {
+	month := currentMonth()
+	if month == quotaState.month {
+		return
+	}
+	if quotaState.dirty {
+		if err := storage.WriteJSON(usageFile(quotaState.month), quotaState.usage); err != nil {
+			log.Printf("flushing usage: %v", err)
+		}
+	}
+	quotaState.month = month
+	quotaState.usage = make(map[string]*TenantUsage)
+	quotaState.dirty = false
+}
+
+// Helper function to read the tenant token of a request
+func tenantToken(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// tenantQuota identifies the tenant of a device request by its API token,
+// counts the request, and rejects it once the tenant's monthly or per-route
+// quota is used up. Without any configured tenants the server runs in
+// single-tenant mode and requests pass through uncounted.
+func tenantQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		quotaState.Lock()
+		if len(quotaState.tenants) == 0 {
+			quotaState.Unlock()
+			c.Next()
+			return
+		}
+
+		tenant, ok := quotaState.tenants[tenantToken(c)]
+		if !ok {
+			quotaState.Unlock()
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, "API token is missing or invalid")
+			return
+		}
+
+		rolloverUsageLocked()
+		usage := quotaState.usage[tenant.Name]
+		if usage == nil {
+			usage = &TenantUsage{Routes: make(map[string]int64)}
+			quotaState.usage[tenant.Name] = usage
+		}
+
+		route := c.FullPath()
+		if (tenant.MonthlyQuota > 0 && usage.Total >= tenant.MonthlyQuota) ||
+			(tenant.RouteQuotas[route] > 0 && usage.Routes[route] >= tenant.RouteQuotas[route]) {
+			quotaState.Unlock()
+			now := time.Now().UTC()
+			nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			c.Header("Retry-After", fmt.Sprintf("%d", int(nextMonth.Sub(now).Seconds())))
+			respondError(c, http.StatusTooManyRequests, CodeQuotaExceeded, "monthly quota exceeded", gin.H{"tenant": tenant.Name})
+			return
+		}
+
+		usage.Total++
+		usage.Routes[route]++
+		quotaState.dirty = true
+		quotaState.Unlock()
+
+		c.Set("tenant", tenant.Name)
+		c.Next()
+	}
+}
+
+// Admin endpoint reporting per-tenant usage for a month (?month=YYYY-MM, default current)
+func getUsage(c *gin.Context) {
+	month := c.DefaultQuery("month", currentMonth())
+	if _, err := time.Parse("2006-01", month); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "month must be formatted as YYYY-MM")
+		return
+	}
+
+	quotaState.Lock()
+	rolloverUsageLocked()
+	usage := make(map[string]TenantUsage)
+	if month == quotaState.month {
+		for name, u := range quotaState.usage {
+			routes := make(map[string]int64, len(u.Routes))
+			for route, n := range u.Routes {
+				routes[route] = n
+			}
+			usage[name] = TenantUsage{Total: u.Total, Routes: routes}
+		}
+	}
+	quotas := make(map[string]int64)
+	for _, t := range quotaState.tenants {
+		quotas[t.Name] = t.MonthlyQuota
+	}
+	quotaState.Unlock()
+
+	if month != currentMonth() {
+		if err := storage.ReadJSON(usageFile(month), &usage); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read usage")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"month": month, "usage": usage, "monthly_quotas": quotas})
+}
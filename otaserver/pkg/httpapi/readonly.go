@@ -0,0 +1,98 @@
+package httpapi
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Read-only mode, for storage migrations and maintenance windows: the admin
+// API (uploads included) answers 503 while devices keep checking for and
+// downloading updates, and the periodic release sync and vulnerability feed
+// pause. OTA_READ_ONLY=1 starts the server in read-only mode; at runtime it is
+// switched with PUT /admin/read-only {"enabled": true, "reason": "..."}, which
+// stays reachable, or by the otaserver command on SIGUSR1 (on) and SIGUSR2
+// (off).
+
+// ReadOnlyStatus is whether the server is in read-only mode.
+type ReadOnlyStatus struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var readOnlyState = struct {
+	sync.RWMutex
+	status ReadOnlyStatus
+}{}
+
+// Helper function to apply OTA_READ_ONLY at startup
+func initReadOnly() {
+	v := strings.ToLower(os.Getenv("OTA_READ_ONLY"))
+	if v == "1" || v == "true" {
+		SetReadOnly(true, "OTA_READ_ONLY")
+	}
+}
+
+// SetReadOnly switches read-only mode on or off; the reason is shown to
+// admin clients refused meanwhile.
+func SetReadOnly(enabled bool, reason string) {
+	readOnlyState.Lock()
+	defer readOnlyState.Unlock()
+	if !enabled {
+		readOnlyState.status = ReadOnlyStatus{}
+		return
+	}
+	if !readOnlyState.status.Enabled {
+		now := time.Now().UTC()
+		readOnlyState.status.Since = &now
+	}
+	readOnlyState.status.Enabled = true
+	readOnlyState.status.Reason = reason
+}
+
+// ReadOnly reports whether the server is in read-only mode.
+func ReadOnly() bool {
+	return readOnlyStatus().Enabled
+}
+
+func readOnlyStatus() ReadOnlyStatus {
+	readOnlyState.RLock()
+	defer readOnlyState.RUnlock()
+	return readOnlyState.status
+}
+
+// Middleware refusing requests with 503 while in read-only mode
+func readOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if status := readOnlyStatus(); status.Enabled {
+			respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "server is in read-only mode", gin.H{"reason": status.Reason, "since": status.Since})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Admin endpoint showing whether the server is in read-only mode
+func getReadOnly(c *gin.Context) {
+	c.JSON(http.StatusOK, readOnlyStatus())
+}
+
+// Admin endpoint switching read-only mode, e.g.
+// {"enabled": true, "reason": "storage migration"}
+func updateReadOnly(c *gin.Context) {
+	var req struct {
+		Enabled *bool  `json:"enabled"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "enabled is required")
+		return
+	}
+	SetReadOnly(*req.Enabled, req.Reason)
+	c.JSON(http.StatusOK, readOnlyStatus())
+}
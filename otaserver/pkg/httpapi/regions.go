@@ -0,0 +1,228 @@
+package httpapi
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// Deployments can register regions (e.g. "eu", "apac") so that devices
+// download from a location close to them. A region either has its own base
+// URL, such as a regional server or CDN in front of this one, which is put in
+// front of the download URLs of check responses, or names one of the mirrors
+// of OTA_MIRRORS, which downloads are then served from. Devices are placed
+// in a region by an explicit region parameter, then by their IP address
+// against the region's networks, then by the country a CDN or load balancer
+// reports in the header named by OTA_GEO_COUNTRY_HEADER (default
+// CF-IPCountry). Devices outside every region get root-relative URLs.
+
+// Region is a registered download region.
+type Region struct {
+	BaseURL   string   `json:"base_url,omitempty"`  // e.g. https://eu.ota.example.com
+	Mirror    string   `json:"mirror,omitempty"`    // name of a mirror from OTA_MIRRORS
+	Countries []string `json:"countries,omitempty"` // ISO 3166-1 alpha-2 codes
+	Networks  []string `json:"networks,omitempty"`  // CIDR ranges, e.g. 10.20.0.0/16
+	Prewarm   bool     `json:"prewarm,omitempty"`   // fetch new releases through base_url
+
+	networks []*net.IPNet
+}
+
+var errInvalidRegion = errors.New("a region needs a lowercase name, an http(s) base_url and valid CIDR networks")
+
+var regionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var regionState = struct {
+	sync.RWMutex
+	regions map[string]Region
+}{regions: make(map[string]Region)}
+
+// Helper function to load the registered regions
+func initRegions() error {
+	regions := make(map[string]Region)
+	if err := storage.ReadJSON(regionsFile, &regions); err != nil {
+		return err
+	}
+	for name, region := range regions {
+		if err := region.parse(); err != nil {
+			return err
+		}
+		regions[name] = region
+	}
+	regionState.Lock()
+	regionState.regions = regions
+	regionState.Unlock()
+	return nil
+}
+
+// Helper function to validate a region and parse its networks
+func (r *Region) parse() error {
+	if r.BaseURL != "" {
+		u, err := url.Parse(r.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errInvalidRegion
+		}
+		r.BaseURL = strings.TrimSuffix(r.BaseURL, "/")
+	}
+	for i, country := range r.Countries {
+		r.Countries[i] = strings.ToUpper(country)
+	}
+	r.networks = nil
+	for _, cidr := range r.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errInvalidRegion
+		}
+		r.networks = append(r.networks, network)
+	}
+	return nil
+}
+
+// Helper function to find the region of the requesting device
+func clientRegion(c *gin.Context) (string, Region, bool) {
+	regionState.RLock()
+	defer regionState.RUnlock()
+
+	if name := c.Query("region"); name != "" {
+		if region, ok := regionState.regions[name]; ok {
+			return name, region, true
+		}
+	}
+
+	names := make([]string, 0, len(regionState.regions))
+	for name := range regionState.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if ip := net.ParseIP(c.ClientIP()); ip != nil {
+		for _, name := range names {
+			for _, network := range regionState.regions[name].networks {
+				if network.Contains(ip) {
+					return name, regionState.regions[name], true
+				}
+			}
+		}
+	}
+	if country := strings.ToUpper(c.GetHeader(envOr("OTA_GEO_COUNTRY_HEADER", "CF-IPCountry"))); country != "" {
+		for _, name := range names {
+			for _, code := range regionState.regions[name].Countries {
+				if code == country {
+					return name, regionState.regions[name], true
+				}
+			}
+		}
+	}
+	return "", Region{}, false
+}
+
+// Helper function to point a root-relative download URL at a region
+func regionalURL(name string, region Region, rawURL string) string {
+	if rawURL == "" {
+		return rawURL
+	}
+	if region.Mirror != "" && strings.HasPrefix(rawURL, "/download?") {
+		rawURL += "&region=" + url.QueryEscape(name)
+	}
+	return region.BaseURL + rawURL
+}
+
+// Helper function to point the download URLs of a check response at the
+// requesting device's region
+func regionalOffer(c *gin.Context, info manifest.VersionInfo) manifest.VersionInfo {
+	name, region, ok := clientRegion(c)
+	if !ok {
+		return info
+	}
+	info.DownloadURL = regionalURL(name, region, info.DownloadURL)
+	if info.Patch != nil {
+		patch := *info.Patch
+		patch.URL = regionalURL(name, region, patch.URL)
+		info.Patch = &patch
+	}
+	return info
+}
+
+// Helper function to find the mirror preferred by the region a download URL
+// was issued for
+func regionMirror(c *gin.Context) string {
+	name := c.Query("region")
+	if name == "" {
+		return ""
+	}
+	regionState.RLock()
+	defer regionState.RUnlock()
+	return regionState.regions[name].Mirror
+}
+
+// Admin endpoint listing the registered regions
+func listRegions(c *gin.Context) {
+	regionState.RLock()
+	defer regionState.RUnlock()
+	c.JSON(http.StatusOK, regionState.regions)
+}
+
+// Admin endpoint to register or update a region, e.g.
+// {"base_url": "https://eu.ota.example.com", "countries": ["DE", "FR"]} or
+// {"mirror": "s3:ota-apac@ap-southeast-1", "networks": ["10.40.0.0/16"]}
+func updateRegion(c *gin.Context) {
+	name := c.Param("region")
+	var region Region
+	if err := c.ShouldBindJSON(&region); err != nil || !regionNamePattern.MatchString(name) || region.parse() != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidRegion.Error())
+		return
+	}
+	if region.BaseURL == "" && region.Mirror == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "base_url or mirror is required")
+		return
+	}
+	if region.Mirror != "" && !mirrorConfigured(region.Mirror) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "unknown mirror", gin.H{"mirror": region.Mirror})
+		return
+	}
+
+	regionState.Lock()
+	defer regionState.Unlock()
+	regions := make(map[string]Region, len(regionState.regions)+1)
+	for n, r := range regionState.regions {
+		regions[n] = r
+	}
+	regions[name] = region
+	if err := storage.WriteJSON(regionsFile, regions); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save regions")
+		return
+	}
+	regionState.regions = regions
+	c.JSON(http.StatusOK, region)
+}
+
+// Admin endpoint to remove a region
+func deleteRegion(c *gin.Context) {
+	name := c.Param("region")
+	regionState.Lock()
+	defer regionState.Unlock()
+	if _, ok := regionState.regions[name]; !ok {
+		respondError(c, http.StatusNotFound, CodeNotFound, "region not found")
+		return
+	}
+	regions := make(map[string]Region, len(regionState.regions))
+	for n, r := range regionState.regions {
+		if n != name {
+			regions[n] = r
+		}
+	}
+	if err := storage.WriteJSON(regionsFile, regions); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save regions")
+		return
+	}
+	regionState.regions = regions
+	c.Status(http.StatusNoContent)
+}
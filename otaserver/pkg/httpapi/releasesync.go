@@ -0,0 +1,407 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Releases of a GitHub or GitLab repository can be published automatically.
+// OTA_RELEASE_SYNC_REPO names the repository ("github:owner/repo" or
+// "gitlab:group/project"); it is polled every OTA_RELEASE_SYNC_INTERVAL
+// (default 5m) and the assets of new releases matching
+// OTA_RELEASE_SYNC_ASSET (a glob, default "*.wasm") are published into
+// OTA_RELEASE_SYNC_CHANNEL (default the flat default channel) like uploads.
+// Tags map to versions by dropping OTA_RELEASE_SYNC_TAG_PREFIX (default "v"),
+// and assets are named <app>_<version><ext>, the app being
+// OTA_RELEASE_SYNC_APP or else taken from the asset name. Drafts are
+// skipped. OTA_RELEASE_SYNC_TOKEN authenticates against the API, and
+// OTA_RELEASE_SYNC_GITHUB_URL (an API base such as
+// https://github.example.com/api/v3) or OTA_RELEASE_SYNC_GITLAB_URL point at
+// a self-hosted instance.
+
+// ReleaseSyncConfig is the release sync configuration.
+type ReleaseSyncConfig struct {
+	Provider  string        `json:"provider"` // "github" or "gitlab"
+	Repo      string        `json:"repo"`
+	Asset     string        `json:"asset"`
+	App       string        `json:"app,omitempty"`
+	Channel   string        `json:"channel,omitempty"`
+	TagPrefix string        `json:"tag_prefix"`
+	Interval  time.Duration `json:"-"`
+	APIURL    string        `json:"api_url"`
+	token     string
+}
+
+// SyncedRelease records a release tag that has been published.
+type SyncedRelease struct {
+	Version   string    `json:"version"`
+	ReleaseID string    `json:"release_id"`
+	Asset     string    `json:"asset"`
+	SyncedAt  time.Time `json:"synced_at"`
+}
+
+// ReleaseSyncState is what the sync remembers between runs.
+type ReleaseSyncState struct {
+	Synced    map[string]SyncedRelease `json:"synced"`             // by tag
+	Rejected  map[string]string        `json:"rejected,omitempty"` // validation failures by tag, not retried
+	LastRun   time.Time                `json:"last_run"`
+	LastError string                   `json:"last_error,omitempty"`
+}
+
+// remoteRelease is a release of the repository with its matching asset.
+type remoteRelease struct {
+	tag      string
+	asset    string
+	url      string
+	headers  map[string]string
+	sha256   string // when the provider publishes asset digests
+	notes    string
+	released time.Time
+}
+
+var releaseSync = struct {
+	sync.Mutex
+	config *ReleaseSyncConfig
+}{}
+
+// Helper function to read the release sync configuration and start polling
+func initReleaseSync() error {
+	spec := os.Getenv("OTA_RELEASE_SYNC_REPO")
+	if spec == "" {
+		return nil
+	}
+	provider, repo, ok := strings.Cut(spec, ":")
+	if !ok || repo == "" || (provider != "github" && provider != "gitlab") {
+		return fmt.Errorf("OTA_RELEASE_SYNC_REPO must look like github:owner/repo or gitlab:group/project")
+	}
+	config := &ReleaseSyncConfig{
+		Provider: provider,
+		Repo:     repo,
+		Asset:    envOr("OTA_RELEASE_SYNC_ASSET", "*.wasm"),
+		App:      os.Getenv("OTA_RELEASE_SYNC_APP"),
+		Channel:  os.Getenv("OTA_RELEASE_SYNC_CHANNEL"),
+		token:    os.Getenv("OTA_RELEASE_SYNC_TOKEN"),
+		Interval: 5 * time.Minute,
+	}
+	if _, err := path.Match(config.Asset, ""); err != nil {
+		return fmt.Errorf("OTA_RELEASE_SYNC_ASSET: %w", err)
+	}
+	if config.Channel != "" && !catalog.ValidChannel(config.Channel) {
+		return fmt.Errorf("OTA_RELEASE_SYNC_CHANNEL: invalid channel %q", config.Channel)
+	}
+	if prefix, ok := os.LookupEnv("OTA_RELEASE_SYNC_TAG_PREFIX"); ok {
+		config.TagPrefix = prefix
+	} else {
+		config.TagPrefix = "v"
+	}
+	if value := os.Getenv("OTA_RELEASE_SYNC_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < time.Minute {
+			return fmt.Errorf("OTA_RELEASE_SYNC_INTERVAL must be a duration of at least 1m")
+		}
+		config.Interval = interval
+	}
+	if provider == "github" {
+		config.APIURL = strings.TrimSuffix(envOr("OTA_RELEASE_SYNC_GITHUB_URL", "https://api.github.com"), "/")
+	} else {
+		config.APIURL = strings.TrimSuffix(envOr("OTA_RELEASE_SYNC_GITLAB_URL", "https://gitlab.com"), "/") + "/api/v4"
+	}
+
+	releaseSync.Lock()
+	releaseSync.config = config
+	releaseSync.Unlock()
+	go func() {
+		if !ReadOnly() {
+			enqueueReleaseSync()
+		}
+		for range time.Tick(config.Interval) {
+			if !ReadOnly() {
+				enqueueReleaseSync()
+			}
+		}
+	}()
+	return nil
+}
+
+func releaseSyncConfig() *ReleaseSyncConfig {
+	releaseSync.Lock()
+	defer releaseSync.Unlock()
+	return releaseSync.config
+}
+
+// Helper function to queue a sync run unless one is already pending
+func enqueueReleaseSync() (*Job, error) {
+	config := releaseSyncConfig()
+	job, err := enqueueJob("release-sync", config.Provider+":"+config.Repo, func() error {
+		return runReleaseSync(config)
+	})
+	if err != nil {
+		log.Printf("queueing release sync: %v", err)
+	}
+	return job, err
+}
+
+// Helper function to publish the releases of the repository that have not
+// been synced yet
+func runReleaseSync(config *ReleaseSyncConfig) error {
+	var state ReleaseSyncState
+	if err := storage.ReadJSON(releaseSyncFile, &state); err != nil {
+		return err
+	}
+	if state.Synced == nil {
+		state.Synced = make(map[string]SyncedRelease)
+	}
+	if state.Rejected == nil {
+		state.Rejected = make(map[string]string)
+	}
+
+	releases, err := listRemoteReleases(config)
+	var failures []string
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+	published := 0
+	for _, remote := range releases {
+		if _, done := state.Synced[remote.tag]; done {
+			continue
+		}
+		if _, rejected := state.Rejected[remote.tag]; rejected {
+			continue
+		}
+		synced, err := syncRelease(config, remote)
+		var perr *publishError
+		if errors.As(err, &perr) && perr.status == http.StatusUnprocessableEntity {
+			// The asset was quarantined; fetching it again would not help
+			log.Printf("release sync of %s rejected: %v", remote.tag, err)
+			state.Rejected[remote.tag] = err.Error()
+			continue
+		}
+		if err != nil {
+			log.Printf("release sync of %s: %v", remote.tag, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", remote.tag, err))
+			continue
+		}
+		state.Synced[remote.tag] = synced
+		published++
+	}
+	if published > 0 {
+		if _, err := takeSnapshot(fmt.Sprintf("release sync of %s:%s", config.Provider, config.Repo)); err != nil {
+			log.Printf("snapshotting catalog: %v", err)
+		}
+	}
+
+	state.LastRun = time.Now().UTC()
+	state.LastError = strings.Join(failures, "; ")
+	if err := storage.WriteJSON(releaseSyncFile, state); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", state.LastError)
+	}
+	return nil
+}
+
+// Helper function to publish one release, or record it as synced when its
+// version is already in the catalog
+func syncRelease(config *ReleaseSyncConfig, remote remoteRelease) (SyncedRelease, error) {
+	version := strings.TrimPrefix(remote.tag, config.TagPrefix)
+	app := config.App
+	if app == "" {
+		app = catalog.AppFromFile(remote.asset)
+	}
+	fileName := app + "_" + version + filepath.Ext(remote.asset)
+	if def, ok := catalog.LookupApp(app); ok && def.Files != "" {
+		fileName = def.FileName(version)
+	}
+	if _, parsed := catalog.ParseFileName(fileName); app == "" || parsed == "" {
+		return SyncedRelease{}, fmt.Errorf("cannot map asset %s of tag %s to an <app>_<version> file name", remote.asset, remote.tag)
+	}
+	synced := SyncedRelease{Version: version, Asset: remote.asset, SyncedAt: time.Now().UTC()}
+	if release, ok := catalogIndex.Version(app, firstNonEmpty(config.Channel, catalog.DefaultChannel), version); ok {
+		synced.ReleaseID = release.ID
+		return synced, nil
+	}
+
+	tmpPath, digests, err := fetchArtifact(context.Background(), sourceClient, remote.url, remote.headers)
+	if err != nil {
+		return SyncedRelease{}, fmt.Errorf("downloading %s: %w", remote.asset, err)
+	}
+	release, err := publishArtifact(tmpPath, uploadRequest{
+		fileName:    fileName,
+		expectedSHA: remote.sha256,
+		notes:       remote.notes,
+		channel:     config.Channel,
+		createdAt:   remote.released,
+	}, digests, "release-sync", func(app, channel string) bool { return true })
+	if err != nil {
+		return SyncedRelease{}, err
+	}
+	synced.ReleaseID = release.ID
+	return synced, nil
+}
+
+// Helper function to list the releases of the repository that have an asset
+// matching the configured pattern
+func listRemoteReleases(config *ReleaseSyncConfig) ([]remoteRelease, error) {
+	if config.Provider == "github" {
+		return listGitHubReleases(config)
+	}
+	return listGitLabReleases(config)
+}
+
+func listGitHubReleases(config *ReleaseSyncConfig) ([]remoteRelease, error) {
+	headers := map[string]string{"Accept": "application/vnd.github+json"}
+	if config.token != "" {
+		headers["Authorization"] = "Bearer " + config.token
+	}
+	var releases []struct {
+		TagName     string    `json:"tag_name"`
+		Body        string    `json:"body"`
+		Draft       bool      `json:"draft"`
+		PublishedAt time.Time `json:"published_at"`
+		Assets      []struct {
+			Name   string `json:"name"`
+			URL    string `json:"url"`
+			Digest string `json:"digest"` // "sha256:<hex>"
+		} `json:"assets"`
+	}
+	if err := getReleaseSyncJSON(config.APIURL+"/repos/"+config.Repo+"/releases?per_page=30", headers, &releases); err != nil {
+		return nil, err
+	}
+
+	var matched []remoteRelease
+	for _, release := range releases {
+		if release.Draft {
+			continue
+		}
+		for _, asset := range release.Assets {
+			if ok, _ := path.Match(config.Asset, asset.Name); !ok {
+				continue
+			}
+			download := map[string]string{"Accept": "application/octet-stream"}
+			if config.token != "" {
+				download["Authorization"] = headers["Authorization"]
+			}
+			matched = append(matched, remoteRelease{
+				tag:      release.TagName,
+				asset:    asset.Name,
+				url:      asset.URL,
+				headers:  download,
+				sha256:   strings.TrimPrefix(asset.Digest, "sha256:"),
+				notes:    release.Body,
+				released: release.PublishedAt,
+			})
+			break
+		}
+	}
+	return matched, nil
+}
+
+func listGitLabReleases(config *ReleaseSyncConfig) ([]remoteRelease, error) {
+	headers := map[string]string{}
+	if config.token != "" {
+		headers["PRIVATE-TOKEN"] = config.token
+	}
+	var releases []struct {
+		TagName     string    `json:"tag_name"`
+		Description string    `json:"description"`
+		Upcoming    bool      `json:"upcoming_release"`
+		ReleasedAt  time.Time `json:"released_at"`
+		Assets      struct {
+			Links []struct {
+				Name           string `json:"name"`
+				URL            string `json:"url"`
+				DirectAssetURL string `json:"direct_asset_url"`
+			} `json:"links"`
+		} `json:"assets"`
+	}
+	if err := getReleaseSyncJSON(config.APIURL+"/projects/"+url.PathEscape(config.Repo)+"/releases?per_page=30", headers, &releases); err != nil {
+		return nil, err
+	}
+
+	var matched []remoteRelease
+	for _, release := range releases {
+		if release.Upcoming {
+			continue
+		}
+		for _, link := range release.Assets.Links {
+			if ok, _ := path.Match(config.Asset, link.Name); !ok {
+				continue
+			}
+			matched = append(matched, remoteRelease{
+				tag:      release.TagName,
+				asset:    link.Name,
+				url:      firstNonEmpty(link.DirectAssetURL, link.URL),
+				headers:  headers,
+				notes:    release.Description,
+				released: release.ReleasedAt,
+			})
+			break
+		}
+	}
+	return matched, nil
+}
+
+// Helper function to fetch a JSON document from the provider's API
+func getReleaseSyncJSON(rawURL string, headers map[string]string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := sourceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return platformError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Admin endpoint showing the release sync configuration and progress
+func getReleaseSync(c *gin.Context) {
+	config := releaseSyncConfig()
+	if config == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "release sync is not configured")
+		return
+	}
+	var state ReleaseSyncState
+	if err := storage.ReadJSON(releaseSyncFile, &state); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release sync state")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"config": config, "interval": config.Interval.String(), "state": state})
+}
+
+// Admin endpoint starting a sync run now
+func startReleaseSync(c *gin.Context) {
+	if releaseSyncConfig() == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "release sync is not configured")
+		return
+	}
+	job, err := enqueueReleaseSync()
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
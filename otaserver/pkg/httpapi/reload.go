@@ -0,0 +1,75 @@
+package httpapi
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The settings the server reads from files can be reloaded without a restart,
+// so downloads in progress are not dropped: POST /admin/reload, or SIGHUP to
+// the otaserver command. A file that fails to load keeps its previous
+// settings. Settings from environment variables still need a restart.
+
+// reloadable lists the settings Reload re-reads, in the order of initState.
+var reloadable = []struct {
+	name string
+	load func() error
+}{
+	{"signing_key", initSigning},
+	{"provenance_keys", initProvenance},
+	{"tenants", loadTenants},
+	{"policy", initPolicy},
+	{"polling", initPolling},
+	{"groups", initGroups},
+	{"desired_state", initDesiredState},
+	{"regions", initRegions},
+	{"aliases", initAliases},
+	{"apps", reloadApps},
+	{"catalog_index", reloadCatalogIndex},
+	{"rollout_plans", initPlans},
+	{"cohorts", initCohorts},
+	{"campaigns", initCampaigns},
+	{"promotion", initPromotion},
+	{"app_quotas", initAppQuotas},
+	{"app_digests", initAppDigests},
+}
+
+// Reload re-reads the settings files (signing and provenance keys, tenant
+// quotas, policy, polling and rollout settings, group settings, desired state, regions,
+// aliases, configured apps, the catalog index, rollout plans, cohorts,
+// campaigns and promotion policies) and returns the names of those that
+// failed to load with their errors.
+func Reload() map[string]error {
+	failed := make(map[string]error)
+	for _, r := range reloadable {
+		if err := r.load(); err != nil {
+			failed[r.name] = err
+			log.Printf("reloading %s: %v", r.name, err)
+		}
+	}
+	// Cached offers may depend on any of them
+	invalidateCatalog()
+	return failed
+}
+
+// Admin endpoint reloading the settings files
+func reloadConfig(c *gin.Context) {
+	failed := Reload()
+	reloaded := []string{}
+	for _, r := range reloadable {
+		if failed[r.name] == nil {
+			reloaded = append(reloaded, r.name)
+		}
+	}
+	if len(failed) > 0 {
+		errs := gin.H{}
+		for name, err := range failed {
+			errs[name] = err.Error()
+		}
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "some settings could not be reloaded", gin.H{"reloaded": reloaded, "failed": errs})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reloaded": reloaded})
+}
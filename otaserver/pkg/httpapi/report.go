@@ -0,0 +1,417 @@
+package httpapi
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A device that downloads the same version over and over without reporting
+// a successful install is probably crash-looping. After patchAttemptLimit
+// downloads it is offered the full image instead of a patch, and after
+// OTA_STUCK_THRESHOLD downloads (default 5) the update is no longer offered
+// and the device is flagged as stuck until an operator resets it.
+
+const (
+	defaultStuckThreshold = 5
+	patchAttemptLimit     = 2
+)
+
+// Install report statuses
+const (
+	reportSuccess  = "success"
+	reportFailure  = "failure"
+	reportDeferred = "deferred"
+)
+
+// InstallReport is the outcome of an update as reported by a device.
+type InstallReport struct {
+	Version    string     `json:"version"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Telemetry  *Telemetry `json:"telemetry,omitempty"`
+	ReportedAt time.Time  `json:"reported_at"`
+
+	// DurationMS is how long the install took, as reported by the device or
+	// from its first progress report, see progress.go
+	DurationMS int64           `json:"duration_ms,omitempty"`
+	Stages     []ProgressStage `json:"stages,omitempty"`
+}
+
+func stuckThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("OTA_STUCK_THRESHOLD")); err == nil && n > 0 {
+		return n
+	}
+	return defaultStuckThreshold
+}
+
+// Helper function to count the downloads of a version by a device
+func downloadAttempts(device *Device, version string) int {
+	if device == nil || device.PendingVersion != version {
+		return 0
+	}
+	return device.DownloadAttempts
+}
+
+// Helper function to count a download by the device named in the request.
+// Anonymous downloads are not tracked.
+func recordDownload(c *gin.Context, version string) {
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	id := downloadDeviceID(c)
+	if anonymousMode() {
+		countDownload()
+		return
+	}
+	if !deviceIDPattern.MatchString(id) || admitDevice(c, id) != nil {
+		return
+	}
+
+	updateDevice(id, func(d *Device) {
+		if d.PendingVersion != version {
+			d.PendingVersion = version
+			d.DownloadAttempts = 0
+			d.Stuck = false
+		}
+		d.DownloadAttempts++
+		d.Stuck = d.DownloadAttempts >= stuckThreshold()
+		d.LastSeen = time.Now().UTC()
+	})
+}
+
+// Helper function to get the device named in a download request, preferring
+// the authenticated identity
+func downloadDeviceID(c *gin.Context) string {
+	if authID := authenticatedDeviceID(c); authID != "" {
+		return authID
+	}
+	return c.Query("device_id")
+}
+
+// Endpoint where devices report the outcome of an install,
+// e.g. {"device_id": "pos-1", "version": "2.0.0", "status": "success",
+// "telemetry": {"boot_time_delta_ms": 120, "crash_count": 0}}, or that the
+// user deferred it, e.g. {"status": "deferred", "deferred_until": "..."}.
+// Reports about other apps than the plugin, e.g. {"app": "runtime", ...},
+// only record the version installed. Progress reports between the offer and
+// the outcome are described in progress.go.
+func reportInstall(c *gin.Context) {
+	var req struct {
+		DeviceID  string     `json:"device_id"`
+		App       string     `json:"app"` // the plugin when empty
+		Version   string     `json:"version"`
+		Status    string     `json:"status"`
+		Error     string     `json:"error"`
+		SHA256    string     `json:"sha256"` // digest of what the device received
+		Telemetry *Telemetry `json:"telemetry"`
+
+		DeferredUntil *time.Time `json:"deferred_until"`
+
+		Progress   *int       `json:"progress"` // percent, while downloading
+		At         *time.Time `json:"at"`       // when the device entered the state
+		DurationMS int64      `json:"duration_ms"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid report")
+		return
+	}
+	if authID := authenticatedDeviceID(c); authID != "" {
+		if req.DeviceID != "" && req.DeviceID != authID {
+			respondError(c, http.StatusForbidden, CodeForbidden, errDeviceMismatch.Error())
+			return
+		}
+		req.DeviceID = authID
+	}
+	if !deviceIDPattern.MatchString(req.DeviceID) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	if req.Version == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidVersion, "version is required")
+		return
+	}
+	if req.Status != reportSuccess && req.Status != reportFailure && req.Status != reportDeferred && !isProgressState(req.Status) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "status must be success, failure, deferred or a progress state", gin.H{"progress_states": progressStates})
+		return
+	}
+	if req.Progress != nil && (*req.Progress < 0 || *req.Progress > 100) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "progress must be a percentage between 0 and 100")
+		return
+	}
+	if req.DurationMS < 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "duration_ms must not be negative")
+		return
+	}
+	at := time.Now().UTC()
+	if req.At != nil {
+		// Device clocks drift; a minute of skew is tolerated
+		if req.At.After(at.Add(time.Minute)) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "at must not be in the future")
+			return
+		}
+		at = req.At.UTC()
+	}
+	if req.Status == reportDeferred {
+		if req.DeferredUntil == nil || !req.DeferredUntil.After(time.Now()) || time.Until(*req.DeferredUntil) > maxDeferral {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "deferred_until must be a time in the next 30 days")
+			return
+		}
+	}
+	if req.Telemetry != nil {
+		if err := req.Telemetry.validate(); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	if !anonymousMode() {
+		switch err := admitDevice(c, req.DeviceID); {
+		case errors.Is(err, errDeviceUnverified):
+			respondError(c, http.StatusForbidden, CodeForbidden, err.Error())
+			return
+		case err != nil:
+			respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+			return
+		}
+	}
+
+	r := deviceReport{
+		App:           req.App,
+		Version:       req.Version,
+		Status:        req.Status,
+		Error:         req.Error,
+		SHA256:        strings.ToLower(req.SHA256),
+		Telemetry:     req.Telemetry,
+		DeferredUntil: req.DeferredUntil,
+		Progress:      req.Progress,
+		At:            at,
+		DurationMS:    req.DurationMS,
+	}
+	event := DeviceEvent{Kind: eventReport, DeviceID: req.DeviceID, At: time.Now().UTC(), Report: &r}
+
+	if isProgressState(req.Status) {
+		if anonymousMode() {
+			c.JSON(http.StatusOK, gin.H{"version": req.Version, "status": req.Status})
+			return
+		}
+		device, _, err := saveDeviceEvent(event)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save progress")
+			return
+		}
+		c.JSON(http.StatusOK, device.Progress)
+		return
+	}
+
+	if !r.pluginInstall() {
+		recordHistory(req.DeviceID, HistoryEvent{
+			Time:      time.Now().UTC(),
+			Event:     historyReport,
+			App:       req.App,
+			Version:   req.Version,
+			Result:    req.Status,
+			Error:     req.Error,
+			RequestID: c.GetString("request_id"),
+		})
+		if req.Status != reportDeferred && !anonymousMode() {
+			if _, _, err := saveDeviceEvent(event); err != nil {
+				respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save report")
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"app": req.App, "version": req.Version, "status": req.Status})
+		return
+	}
+
+	reported := reportedInstall{report: r.installReport(event.At)}
+	if !anonymousMode() {
+		reported.deviceID = req.DeviceID
+	}
+	c.Set(reportedInstallKey, reported)
+
+	if anonymousMode() {
+		countInstall(req.Version, req.Status)
+		if req.Telemetry != nil {
+			if err := recordTelemetry(req.Version, req.Telemetry); err != nil {
+				respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save telemetry")
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"version": req.Version, "status": req.Status})
+		return
+	}
+
+	if req.Status == reportDeferred {
+		// While the state directory is away, see eventwal.go, the version
+		// is taken to be mandatory rather than deferred unchecked
+		meta, err := loadReleaseMeta("plugin", req.Version)
+		if err != nil && !eventWALEnabled() {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+			return
+		}
+		mandatory := err != nil || meta.Mandatory
+		r.Mandatory = &mandatory
+	}
+
+	device, logged, err := saveDeviceEvent(event)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save report")
+		return
+	}
+	if logged {
+		// The telemetry and forensics are recorded once the record is written
+		c.JSON(http.StatusAccepted, device)
+		return
+	}
+	if err := recordReportDetails(req.DeviceID, r, device.LastReport); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save telemetry")
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// deviceReport is an install or progress report as a device sent it.
+type deviceReport struct {
+	App           string     `json:"app,omitempty"` // the plugin when empty
+	Version       string     `json:"version"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	Telemetry     *Telemetry `json:"telemetry,omitempty"`
+	DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+	Progress      *int       `json:"progress,omitempty"`
+	At            time.Time  `json:"at"` // when the device entered the state
+	DurationMS    int64      `json:"duration_ms,omitempty"`
+
+	// Mandatory is whether a deferred version is mandatory, nil until the
+	// release metadata was read
+	Mandatory *bool `json:"mandatory,omitempty"`
+}
+
+// Helper function to tell whether a report is the outcome of a plugin install
+func (r deviceReport) pluginInstall() bool {
+	return !isProgressState(r.Status) && (r.App == "" || r.App == "plugin")
+}
+
+// Helper function to get the install report kept of a plugin install report
+// received at the given time
+func (r deviceReport) installReport(at time.Time) InstallReport {
+	return InstallReport{Version: r.Version, Status: r.Status, Error: r.Error, Telemetry: r.Telemetry, ReportedAt: at, DurationMS: r.DurationMS}
+}
+
+// Helper function to apply a report received at the given time to a device
+// record
+func applyReport(d *Device, r deviceReport, at time.Time) {
+	d.LastSeen = at
+	switch {
+	case isProgressState(r.Status):
+		advanceProgress(d, firstNonEmpty(r.App, "plugin"), r.Version, r.Status, r.Progress, r.At)
+		return
+	case !r.pluginInstall():
+		if r.Status == reportSuccess {
+			setAppVersion(d, r.App, r.Version)
+		}
+		finishProgress(d, r.App, r.Version, r.At)
+		return
+	}
+
+	report := r.installReport(at)
+	if r.Status != reportDeferred {
+		stages, elapsed := finishProgress(d, "plugin", r.Version, r.At)
+		report.Stages = stages
+		if report.DurationMS == 0 && stages != nil {
+			report.DurationMS = elapsed.Milliseconds()
+		}
+	}
+	d.LastReport = &report
+	switch r.Status {
+	case reportSuccess:
+		d.CurrentVersion = r.Version
+		if d.PendingVersion == r.Version {
+			d.PendingVersion = ""
+			d.DownloadAttempts = 0
+			d.Stuck = false
+		}
+		clearDeferral(d, r.Version)
+	case reportDeferred:
+		deferUpdate(d, r.Version, r.DeferredUntil.UTC(), r.Mandatory != nil && *r.Mandatory)
+	}
+}
+
+// Helper function to record the telemetry of a plugin install report and
+// capture the forensics of a failed install, once the device record holds
+// the report
+func recordReportDetails(deviceID string, r deviceReport, report *InstallReport) error {
+	if r.Telemetry != nil {
+		if err := recordTelemetry(r.Version, r.Telemetry); err != nil {
+			return err
+		}
+	}
+	if r.Status == reportFailure && report != nil {
+		if err := captureForensics(deviceID, *report, r.SHA256); err != nil {
+			log.Printf("capturing download forensics for %s: %v", deviceID, err)
+		}
+	}
+	return nil
+}
+
+// Admin endpoint listing devices with their convergence to the desired
+// version; ?stuck=true shows only stuck devices, ?deferred=true only devices
+// whose user deferred the update, ?convergence=pending only devices in that
+// state, ?cohort=<name> only the members of an experiment cohort and
+// ?tag=<tag> only the devices carrying a tag
+func listFleet(c *gin.Context) {
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	view, err := fleetView(devices)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load groups")
+		return
+	}
+
+	stuck, deferred, state, cohort, tag := c.Query("stuck") == "true", c.Query("deferred") == "true", c.Query("convergence"), c.Query("cohort"), c.Query("tag")
+	filtered := []FleetDevice{}
+	for _, d := range view {
+		if (stuck && !d.Stuck) || (deferred && !d.Deferred) || (state != "" && d.Convergence != state) {
+			continue
+		}
+		if cohort != "" && !slices.Contains(d.Cohorts, cohort) {
+			continue
+		}
+		if tag != "" && !slices.Contains(d.Tags, tag) {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"devices": filtered})
+}
+
+// Admin endpoint clearing a device's download attempts so it is offered updates again
+func resetDeviceAttempts(c *gin.Context) {
+	id := c.Param("id")
+	if !deviceIDPattern.MatchString(id) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error())
+		return
+	}
+	device, err := updateDevice(id, func(d *Device) {
+		d.PendingVersion = ""
+		d.DownloadAttempts = 0
+		d.Stuck = false
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not reset device")
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
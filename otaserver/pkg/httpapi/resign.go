@@ -0,0 +1,146 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// ResignJob reports the progress of re-signing every retained release with
+// the current signing key of its app, used after a key rotation.
+type ResignJob struct {
+	State      string            `json:"state"` // running, succeeded, failed
+	KeyID      string            `json:"key_id,omitempty"`
+	AppKeyIDs  map[string]string `json:"app_key_ids,omitempty"`
+	Total      int               `json:"total"`
+	Done       int               `json:"done"`
+	Failed     int               `json:"failed"`
+	Errors     []string          `json:"errors,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+var resignState = struct {
+	sync.Mutex
+	job *ResignJob
+}{}
+
+// Admin endpoint to start re-signing all releases. The signing key files are
+// reloaded first, so rotating a key is: replace the file, then call this.
+// Releases of apps without a key are left alone.
+func startResign(c *gin.Context) {
+	resignState.Lock()
+	defer resignState.Unlock()
+
+	if resignState.job != nil && resignState.job.State == "running" {
+		respondError(c, http.StatusConflict, CodeConflict, "a re-signing job is already running")
+		return
+	}
+
+	if err := initSigning(); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load signing key: "+err.Error())
+		return
+	}
+	all, err := artifacts.Releases()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list releases")
+		return
+	}
+	job := &ResignJob{State: "running", StartedAt: time.Now().UTC()}
+	if key := currentSigningKey(); key != nil {
+		job.KeyID = key.ID
+	}
+	var releases []catalog.Release
+	for _, release := range all {
+		key := signingKeyFor(release.App)
+		if key == nil {
+			continue
+		}
+		if key.ID != job.KeyID {
+			if job.AppKeyIDs == nil {
+				job.AppKeyIDs = make(map[string]string)
+			}
+			job.AppKeyIDs[release.App] = key.ID
+		}
+		releases = append(releases, release)
+	}
+	if job.KeyID == "" && job.AppKeyIDs == nil {
+		respondError(c, http.StatusConflict, CodeConflict, errNoSigningKey.Error())
+		return
+	}
+	job.Total = len(releases)
+
+	resignState.job = job
+	go runResign(job, releases)
+
+	c.JSON(http.StatusAccepted, *job)
+}
+
+// Helper function to re-sign each release and verify the new signature
+func runResign(job *ResignJob, releases []catalog.Release) {
+	for _, release := range releases {
+		err := resignRelease(release)
+
+		resignState.Lock()
+		job.Done++
+		if err != nil {
+			job.Failed++
+			job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", release.FileName, err))
+		}
+		resignState.Unlock()
+	}
+
+	resignState.Lock()
+	job.State = "succeeded"
+	if job.Failed > 0 {
+		job.State = "failed"
+	}
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	resignState.Unlock()
+	log.Printf("re-signing finished: %d/%d failed", job.Failed, job.Total)
+}
+
+func resignRelease(release catalog.Release) error {
+	key := signingKeyFor(release.App)
+	if key == nil {
+		return errNoSigningKey
+	}
+	sig, err := signRelease(release)
+	if err != nil {
+		return err
+	}
+	if err := manifest.Verify(release, sig, key.Public); err != nil {
+		return fmt.Errorf("verification after signing: %w", err)
+	}
+
+	// Make sure the file was not replaced while we were signing
+	current, err := artifacts.Release(release.FileName)
+	if err != nil {
+		return err
+	}
+	if current.ID != release.ID {
+		return fmt.Errorf("artifact changed during re-signing")
+	}
+
+	_, err = updateReleaseMeta(release.App, release.Version, func(m *ReleaseMeta) { m.Signature = sig })
+	return err
+}
+
+// Admin endpoint reporting the progress of the last re-signing job
+func getResign(c *gin.Context) {
+	resignState.Lock()
+	defer resignState.Unlock()
+
+	if resignState.job == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no re-signing job has run")
+		return
+	}
+	c.JSON(http.StatusOK, *resignState.job)
+}
@@ -0,0 +1,137 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin edits of the catalog use optimistic concurrency. Catalog reads
+// return the catalog revision as an ETag; an edit sent with If-Match fails
+// with 409 Conflict when the catalog changed since, so two release engineers
+// editing at once cannot silently overwrite each other. With
+// OTA_REQUIRE_IF_MATCH=1 edits without If-Match are refused with 428.
+// Revisions are only meaningful within one server process: after a restart
+// every old ETag conflicts.
+//
+// Every response also carries the revision in an X-Catalog-Revision header,
+// so that client SDKs and mirrors notice when the catalog changed during a
+// session and re-validate, and support can match device logs to the catalog
+// state they saw. Any change of the value means the catalog may have changed.
+
+// catalogEpoch distinguishes the revisions of this process from those of
+// earlier ones.
+var catalogEpoch = func() string {
+	raw := make([]byte, 4)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}()
+
+// catalogEditMu serializes admin edits of the catalog, so the revision
+// checked is the one the edit applies to.
+var catalogEditMu sync.Mutex
+
+func requireIfMatch() bool {
+	v := strings.ToLower(os.Getenv("OTA_REQUIRE_IF_MATCH"))
+	return v == "1" || v == "true"
+}
+
+const catalogRevisionHeader = "X-Catalog-Revision"
+
+// catalogRevision names the current catalog revision, e.g. "3f9a01c2-17".
+func catalogRevision() string {
+	return fmt.Sprintf("%s-%d", catalogEpoch, currentCatalogRevision())
+}
+
+// catalogETag is the entity tag of the current catalog revision.
+func catalogETag() string {
+	return `"` + catalogRevision() + `"`
+}
+
+// revisionHeader sets the X-Catalog-Revision header of every response to the
+// revision the request is served from.
+func revisionHeader() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(catalogRevisionHeader, catalogRevision())
+	}
+}
+
+// Helper function to check an If-Match header against an entity tag
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogETagWriter sets the ETag of the catalog revision reached by an edit
+// just before the response is sent.
+type catalogETagWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *catalogETagWriter) WriteHeaderNow() {
+	if !w.Written() {
+		revision := catalogRevision()
+		w.Header().Set("ETag", `"`+revision+`"`)
+		w.Header().Set(catalogRevisionHeader, revision)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *catalogETagWriter) Write(b []byte) (int, error) {
+	w.WriteHeaderNow()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *catalogETagWriter) WriteString(s string) (int, error) {
+	w.WriteHeaderNow()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// catalogEdit guards an admin route editing the catalog: its If-Match must
+// name the current catalog revision, and the response carries the new one.
+func catalogEdit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		catalogEditMu.Lock()
+		defer catalogEditMu.Unlock()
+		c.Writer = &catalogETagWriter{ResponseWriter: c.Writer}
+
+		current := catalogETag()
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" && requireIfMatch() {
+			respondError(c, http.StatusPreconditionRequired, CodePreconditionRequired, "If-Match with the catalog revision is required", gin.H{"revision": current})
+			return
+		}
+		if ifMatch != "" && !etagMatches(ifMatch, current) {
+			respondError(c, http.StatusConflict, CodeConflict, "the catalog changed since it was read", gin.H{"revision": current})
+			return
+		}
+		c.Next()
+	}
+}
+
+// catalogRead sets the ETag of the current catalog revision on an admin
+// route reading the catalog.
+func catalogRead() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("ETag", catalogETag())
+	}
+}
+
+// Admin endpoint listing the published releases with the catalog revision
+func getCatalog(c *gin.Context) {
+	etag := catalogETag()
+	releases := catalogIndex.All()
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, gin.H{"revision": etag, "releases": releases})
+}
@@ -0,0 +1,255 @@
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/sbom"
+)
+
+// A release can carry a software bill of materials in SPDX or CycloneDX JSON,
+// attached at publish time (the "sbom" form field or file, or "sbom" of a
+// pull request) or later with PUT /admin/releases/<app>/<version>/sbom. It is
+// served at /releases/<app>/<version>/sbom, and
+// GET /admin/sbom/packages?name=openssl&below=3.0.7 finds the releases
+// containing a package, older than a version if given, with the number of
+// devices running each.
+
+// maxSBOMSize is the largest SBOM accepted.
+const maxSBOMSize = 16 << 20
+
+// SBOMInfo summarizes the SBOM attached to a release.
+type SBOMInfo struct {
+	Format      string `json:"format"`
+	SpecVersion string `json:"spec_version,omitempty"`
+	Packages    int    `json:"packages"`
+}
+
+// SBOMMatch is a release containing a queried package.
+type SBOMMatch struct {
+	App      string         `json:"app"`
+	Version  string         `json:"version"`
+	Channels []string       `json:"channels"`
+	Packages []sbom.Package `json:"packages"`
+	Devices  *int           `json:"devices,omitempty"` // devices running the release, for the plugin
+}
+
+// sbomCache keeps parsed SBOMs until their file changes.
+var sbomCache = struct {
+	sync.Mutex
+	entries map[string]cachedSBOM // by file path
+}{entries: make(map[string]cachedSBOM)}
+
+type cachedSBOM struct {
+	modTime time.Time
+	doc     sbom.Document
+}
+
+func sbomFile(app, version string) string {
+	return filepath.Join(metadataPath, app+"_"+version+".sbom.json")
+}
+
+// Helper function to read the "sbom" field or file of an upload form
+func uploadSBOM(c *gin.Context) ([]byte, error) {
+	data := []byte(c.PostForm("sbom"))
+	if header, err := c.FormFile("sbom"); err == nil {
+		if header.Size > maxSBOMSize {
+			return nil, fmt.Errorf("SBOM is larger than %d bytes", maxSBOMSize)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > maxSBOMSize {
+		return nil, fmt.Errorf("SBOM is larger than %d bytes", maxSBOMSize)
+	}
+	if len(data) > 0 {
+		if _, err := sbom.Parse(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Helper function to store the SBOM of a release and summarize it in the
+// release metadata
+func attachSBOM(app, version string, data []byte) (ReleaseMeta, error) {
+	doc, err := sbom.Parse(data)
+	if err != nil {
+		return ReleaseMeta{}, err
+	}
+	if err := os.MkdirAll(metadataPath, 0o755); err != nil {
+		return ReleaseMeta{}, err
+	}
+	if err := os.WriteFile(sbomFile(app, version), data, 0o644); err != nil {
+		return ReleaseMeta{}, err
+	}
+	return updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.SBOM = &SBOMInfo{Format: doc.Format, SpecVersion: doc.SpecVersion, Packages: len(doc.Packages)}
+	})
+}
+
+// Helper function to load the parsed SBOM of a release, reporting false when
+// it has none
+func loadSBOM(app, version string) (sbom.Document, bool, error) {
+	path := sbomFile(app, version)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return sbom.Document{}, false, nil
+	}
+	if err != nil {
+		return sbom.Document{}, false, err
+	}
+
+	sbomCache.Lock()
+	defer sbomCache.Unlock()
+	if cached, ok := sbomCache.entries[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.doc, true, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sbom.Document{}, false, err
+	}
+	doc, err := sbom.Parse(data)
+	if err != nil {
+		return sbom.Document{}, false, err
+	}
+	sbomCache.entries[path] = cachedSBOM{modTime: info.ModTime(), doc: doc}
+	return doc, true, nil
+}
+
+// Device endpoint serving the SBOM of a release
+func getSBOM(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	data, err := os.ReadFile(sbomFile(app, version))
+	if os.IsNotExist(err) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "release has no SBOM")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read SBOM")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s.sbom.json\"", app, version))
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+// Admin endpoint attaching an SBOM to a published release; the body is the
+// SPDX or CycloneDX JSON document
+func putSBOM(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSBOMSize+1))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read SBOM")
+		return
+	}
+	if len(data) > maxSBOMSize {
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "SBOM is too large", gin.H{"max": maxSBOMSize})
+		return
+	}
+	if _, err := sbom.Parse(data); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	meta, err := attachSBOM(app, version, data)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save SBOM")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// Admin endpoint finding the releases whose SBOM lists a package, e.g.
+// ?name=openssl&below=3.0.7 for those shipping OpenSSL older than 3.0.7.
+// With deployed=true only releases running on devices are listed.
+func queryPackages(c *gin.Context) {
+	name, below := c.Query("name"), c.Query("below")
+	if name == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "name is required")
+		return
+	}
+	deployedOnly := c.Query("deployed") == "true"
+
+	releases := catalogIndex.All()
+	var running map[string]int
+	if !anonymousMode() {
+		devices, err := listDevices()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+			return
+		}
+		running = make(map[string]int)
+		for _, device := range devices {
+			running[device.CurrentVersion]++
+		}
+	}
+
+	byRelease := make(map[string]*SBOMMatch)
+	for _, release := range releases {
+		key := release.App + "_" + release.Version
+		if match, ok := byRelease[key]; ok {
+			match.Channels = append(match.Channels, release.Channel)
+			continue
+		}
+		doc, ok, err := loadSBOM(release.App, release.Version)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not read SBOM of "+key)
+			return
+		}
+		if !ok {
+			continue
+		}
+		var packages []sbom.Package
+		for _, pkg := range doc.Find(name) {
+			if below == "" || (pkg.Version != "" && sbom.CompareVersions(pkg.Version, below) < 0) {
+				packages = append(packages, pkg)
+			}
+		}
+		if len(packages) == 0 {
+			continue
+		}
+		match := &SBOMMatch{App: release.App, Version: release.Version, Channels: []string{release.Channel}, Packages: packages}
+		// Device records track the plugin's version only
+		if running != nil && release.App == "plugin" {
+			count := running[release.Version]
+			match.Devices = &count
+		}
+		byRelease[key] = match
+	}
+
+	matches := []SBOMMatch{}
+	for _, match := range byRelease {
+		if deployedOnly && (match.Devices == nil || *match.Devices == 0) {
+			continue
+		}
+		matches = append(matches, *match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].App != matches[j].App {
+			return matches[i].App < matches[j].App
+		}
+		return catalog.CompareVersions(matches[i].Version, matches[j].Version) < 0
+	})
+	c.JSON(http.StatusOK, gin.H{"name": name, "below": below, "releases": matches})
+}
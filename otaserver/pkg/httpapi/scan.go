@@ -0,0 +1,142 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Uploads can be scanned for malware before they are published. The scanner
+// is either a command, OTA_SCAN_COMMAND, run with the file's path appended
+// (exit status 0 means clean, 1 infected with the output as detail, anything
+// else a scanner failure), or a clamd daemon at OTA_CLAMAV_ADDR ("host:port"
+// or "unix:/path/to/clamd.sock"). Infected uploads are quarantined, and
+// uploads are refused while the scanner fails, so that only files that
+// passed become downloadable. OTA_SCAN_TIMEOUT bounds a scan (default 5m).
+
+const defaultScanTimeout = 5 * time.Minute
+
+// Scan outcomes
+const (
+	scanClean    = "clean"
+	scanInfected = "infected"
+)
+
+var errScannerFailed = errors.New("malware scanner failed")
+
+// ScanResult is the outcome of scanning a release, kept in its metadata.
+type ScanResult struct {
+	Scanner   string    `json:"scanner"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// Helper function to scan a file with the configured scanner, returning nil
+// when scanning is not configured
+func scanFile(path string) (*ScanResult, error) {
+	timeout := defaultScanTimeout
+	if d, err := time.ParseDuration(os.Getenv("OTA_SCAN_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if command := os.Getenv("OTA_SCAN_COMMAND"); command != "" {
+		return scanWithCommand(ctx, command, path)
+	}
+	if addr := os.Getenv("OTA_CLAMAV_ADDR"); addr != "" {
+		return scanWithClamAV(ctx, addr, path)
+	}
+	return nil, nil
+}
+
+// Helper function to scan a file with an external command
+func scanWithCommand(ctx context.Context, command, path string) (*ScanResult, error) {
+	args := append(strings.Fields(command), path)
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	result := &ScanResult{Scanner: args[0], Status: scanClean, ScannedAt: time.Now().UTC()}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return result, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		result.Status = scanInfected
+		result.Detail = strings.TrimSpace(string(output))
+		return result, nil
+	}
+	return nil, fmt.Errorf("%w: %v: %s", errScannerFailed, err, strings.TrimSpace(string(output)))
+}
+
+// Helper function to scan a file with clamd's INSTREAM command
+func scanWithClamAV(ctx context.Context, addr, path string) (*ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errScannerFailed, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The file is streamed as length-prefixed chunks ended by an empty chunk
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("%w: %v", errScannerFailed, err)
+	}
+	chunk := make([]byte, 64<<10)
+	for {
+		n, err := file.Read(chunk)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(append(size[:], chunk[:n]...)); err != nil {
+				return nil, fmt.Errorf("%w: %v", errScannerFailed, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("%w: %v", errScannerFailed, err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errScannerFailed, err)
+	}
+	answer := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	result := &ScanResult{Scanner: "clamav", Status: scanClean, ScannedAt: time.Now().UTC()}
+	switch {
+	case strings.HasSuffix(answer, " OK"):
+		return result, nil
+	case strings.HasSuffix(answer, " FOUND"):
+		result.Status = scanInfected
+		result.Detail = strings.TrimSuffix(strings.TrimPrefix(answer, "stream: "), " FOUND")
+		return result, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errScannerFailed, answer)
+}
@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/rollout"
+)
+
+// Helper function to decide whether a release may be offered to a device now.
+// When it may not, the returned time is when the device's window next opens.
+func offerAllowed(meta ReleaseMeta, device *Device) (bool, time.Time) {
+	return rollout.WindowOpen(meta.InstallWindow, time.Now().In(deviceLocation(device)))
+}
+
+// Admin endpoint to set or clear (with an empty body) the local install window of a release
+func updateSchedule(c *gin.Context) {
+	app := c.Param("app")
+	version := c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+
+	var window *rollout.InstallWindow
+	if c.Request.ContentLength != 0 {
+		window = &rollout.InstallWindow{}
+		if err := c.ShouldBindJSON(window); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid install window")
+			return
+		}
+		if err := window.Validate(); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	meta, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) { m.InstallWindow = window })
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save schedule")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
@@ -0,0 +1,479 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/sbom"
+	"ota-server/pkg/storage"
+)
+
+// Releases fixing a vulnerability can be marked as security fixes, by hand
+// with PUT /admin/releases/<app>/<version>/security {"cves": ["CVE-2023-0286"],
+// "severity": "high"} or from a vulnerability feed. Fixes of at least
+// OTA_CVE_MANDATORY_SEVERITY (default "high") are security-critical: the
+// release becomes mandatory and a polling rollout of OTA_SECURITY_ROLLOUT_FOR
+// (default 24h, "0s" to disable) starts, so devices pick it up quickly.
+// GET /admin/security lists the advisories with the devices still running a
+// version older than the fix.
+//
+// OTA_CVE_FEED_URL names a JSON feed polled every OTA_CVE_FEED_INTERVAL
+// (default 1h), authenticated with OTA_CVE_FEED_TOKEN. It lists advisories
+// such as {"id": "CVE-2023-0286", "severity": "high", "package": "openssl",
+// "fixed": "3.0.8"}: the first release of each app whose SBOM carries the
+// fixed package version after one that carried a vulnerable version is
+// marked as the fix. Advisories about an app itself name "app" and
+// "fixed_version" instead.
+
+// severityRanks orders advisory severities.
+var severityRanks = map[string]int{"low": 1, "medium": 2, "moderate": 2, "high": 3, "critical": 4}
+
+var advisoryIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Advisory is a known vulnerability and the releases fixing it.
+type Advisory struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary,omitempty"`
+
+	// Package and Fixed name a vulnerable dependency and the first version
+	// of it with the fix, matched against release SBOMs
+	Package string `json:"package,omitempty"`
+	Fixed   string `json:"fixed,omitempty"`
+
+	// App and FixedVersion name the release fixing a vulnerability of the
+	// app itself
+	App          string `json:"app,omitempty"`
+	FixedVersion string `json:"fixed_version,omitempty"`
+
+	Source    string    `json:"source"` // "feed" or "manual"
+	Fixes     []string  `json:"fixes"`  // releases fixing it, as <app>@<version>
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SecurityFix marks a release as fixing vulnerabilities.
+type SecurityFix struct {
+	CVEs     []string  `json:"cves"`
+	Severity string    `json:"severity"`
+	Critical bool      `json:"critical"`
+	MarkedAt time.Time `json:"marked_at"`
+}
+
+// SecurityState is the advisory database and the feed's progress.
+type SecurityState struct {
+	Advisories    map[string]*Advisory `json:"advisories"`
+	FeedLastRun   time.Time            `json:"feed_last_run,omitempty"`
+	FeedLastError string               `json:"feed_last_error,omitempty"`
+}
+
+// AdvisoryStatus is an advisory with the part of the fleet it affects.
+type AdvisoryStatus struct {
+	*Advisory
+	AffectedDevices  int            `json:"affected_devices"`
+	AffectedVersions map[string]int `json:"affected_versions"` // devices by version
+}
+
+// securityMu serializes updates to the advisory database.
+var securityMu sync.Mutex
+
+func mandatorySeverity() int {
+	if rank, ok := severityRanks[strings.ToLower(os.Getenv("OTA_CVE_MANDATORY_SEVERITY"))]; ok {
+		return rank
+	}
+	return severityRanks["high"]
+}
+
+func securityRolloutFor() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("OTA_SECURITY_ROLLOUT_FOR")); err == nil && d >= 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+func cveFeedURL() string {
+	return os.Getenv("OTA_CVE_FEED_URL")
+}
+
+// Helper function to start polling the vulnerability feed, if one is configured
+func initSecurityFeed() error {
+	if cveFeedURL() == "" {
+		return nil
+	}
+	interval := time.Hour
+	if value := os.Getenv("OTA_CVE_FEED_INTERVAL"); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < time.Minute {
+			return fmt.Errorf("OTA_CVE_FEED_INTERVAL must be a duration of at least 1m")
+		}
+	}
+	go func() {
+		if !ReadOnly() {
+			enqueueSecurityFeed()
+		}
+		for range time.Tick(interval) {
+			if !ReadOnly() {
+				enqueueSecurityFeed()
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to queue a feed run unless one is already pending
+func enqueueSecurityFeed() (*Job, error) {
+	job, err := enqueueJob("cve-feed", cveFeedURL(), runSecurityFeed)
+	if err != nil {
+		log.Printf("queueing vulnerability feed: %v", err)
+	}
+	return job, err
+}
+
+// Helper function to load the advisory database
+func loadSecurityState() (SecurityState, error) {
+	state := SecurityState{Advisories: make(map[string]*Advisory)}
+	err := storage.ReadJSON(securityFile, &state)
+	if state.Advisories == nil {
+		state.Advisories = make(map[string]*Advisory)
+	}
+	return state, err
+}
+
+// Helper function to fetch the vulnerability feed and mark the releases
+// fixing its advisories
+func runSecurityFeed() error {
+	headers := map[string]string{"Accept": "application/json"}
+	if token := os.Getenv("OTA_CVE_FEED_TOKEN"); token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	var feed []Advisory
+	fetchErr := getReleaseSyncJSON(cveFeedURL(), headers, &feed)
+
+	securityMu.Lock()
+	defer securityMu.Unlock()
+	state, err := loadSecurityState()
+	if err != nil {
+		return err
+	}
+	state.FeedLastRun = time.Now().UTC()
+	state.FeedLastError = ""
+	if fetchErr != nil {
+		state.FeedLastError = fetchErr.Error()
+		if err := storage.WriteJSON(securityFile, state); err != nil {
+			return err
+		}
+		return fetchErr
+	}
+
+	var failures []string
+	for _, entry := range feed {
+		if !advisoryIDPattern.MatchString(entry.ID) {
+			continue
+		}
+		entry.Severity = strings.ToLower(entry.Severity)
+		entry.Source = "feed"
+		fixes, err := advisoryFixes(&entry)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", entry.ID, err))
+			continue
+		}
+		for _, fix := range fixes {
+			app, version, _ := strings.Cut(fix, "@")
+			if err := markSecurityFix(app, version, entry.ID, entry.Severity); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: marking %s: %v", entry.ID, fix, err))
+			}
+		}
+		if known, ok := state.Advisories[entry.ID]; ok {
+			// Releases once marked stay marked, also when later removed
+			fixes = mergeSorted(known.Fixes, fixes)
+		}
+		entry.Fixes = fixes
+		entry.UpdatedAt = time.Now().UTC()
+		state.Advisories[entry.ID] = &entry
+	}
+	state.FeedLastError = strings.Join(failures, "; ")
+	if err := storage.WriteJSON(securityFile, state); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", state.FeedLastError)
+	}
+	return nil
+}
+
+// Helper function to find the releases fixing an advisory, as <app>@<version>
+func advisoryFixes(advisory *Advisory) ([]string, error) {
+	if advisory.App != "" {
+		if _, ok := catalogIndex.Find(advisory.App, advisory.FixedVersion); !ok {
+			return []string{}, nil
+		}
+		return []string{advisory.App + "@" + advisory.FixedVersion}, nil
+	}
+	if advisory.Package == "" || advisory.Fixed == "" {
+		return []string{}, nil
+	}
+
+	releases := catalogIndex.All()
+	// Whether each release with the package in its SBOM ships a vulnerable
+	// version, by app and version
+	vulnerable := make(map[string]map[string]bool)
+	for _, release := range releases {
+		if _, seen := vulnerable[release.App][release.Version]; seen {
+			continue
+		}
+		doc, ok, err := loadSBOM(release.App, release.Version)
+		if err != nil {
+			return nil, err
+		}
+		packages := doc.Find(advisory.Package)
+		if !ok || len(packages) == 0 {
+			continue
+		}
+		affected := false
+		for _, pkg := range packages {
+			affected = affected || sbom.CompareVersions(pkg.Version, advisory.Fixed) < 0
+		}
+		if vulnerable[release.App] == nil {
+			vulnerable[release.App] = make(map[string]bool)
+		}
+		vulnerable[release.App][release.Version] = affected
+	}
+
+	fixes := []string{}
+	for app, versions := range vulnerable {
+		sorted := make([]string, 0, len(versions))
+		for version := range versions {
+			sorted = append(sorted, version)
+		}
+		catalog.SortVersions(sorted)
+		// The fix is the first unaffected release after the newest affected one
+		newestAffected := -1
+		for i, version := range sorted {
+			if versions[version] {
+				newestAffected = i
+			}
+		}
+		if newestAffected >= 0 && newestAffected+1 < len(sorted) {
+			fixes = append(fixes, app+"@"+sorted[newestAffected+1])
+		}
+	}
+	sort.Strings(fixes)
+	return fixes, nil
+}
+
+// Helper function to record that a release fixes an advisory. Fixes of
+// critical severity make the release mandatory and start a polling rollout.
+func markSecurityFix(app, version, id, severity string) error {
+	if meta, err := loadReleaseMeta(app, version); err == nil && meta.Security != nil &&
+		slices.Contains(meta.Security.CVEs, id) && severityRanks[severity] <= severityRanks[meta.Security.Severity] {
+		return nil
+	}
+	newlyCritical := false
+	_, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		fix := m.Security
+		if fix == nil {
+			fix = &SecurityFix{MarkedAt: time.Now().UTC()}
+		}
+		fix.CVEs = mergeSorted(fix.CVEs, []string{id})
+		if severityRanks[severity] > severityRanks[fix.Severity] {
+			fix.Severity = severity
+		}
+		if !fix.Critical && severityRanks[fix.Severity] >= mandatorySeverity() {
+			fix.Critical, newlyCritical = true, true
+			m.Mandatory = true
+		}
+		m.Security = fix
+	})
+	if err != nil {
+		return err
+	}
+	if newlyCritical {
+		log.Printf("%s %s fixes %s and is now mandatory", app, version, id)
+		if err := startSecurityRollout(); err != nil {
+			log.Printf("starting security rollout: %v", err)
+		}
+	}
+	return nil
+}
+
+// Helper function to poll at the rollout interval for OTA_SECURITY_ROLLOUT_FOR,
+// unless a longer rollout is already running
+func startSecurityRollout() error {
+	duration := securityRolloutFor()
+	if duration == 0 {
+		return nil
+	}
+	pollingState.Lock()
+	defer pollingState.Unlock()
+	settings := pollingState.settings
+	until := time.Now().UTC().Add(duration)
+	if !until.After(settings.RolloutUntil) {
+		return nil
+	}
+	settings.RolloutUntil = until
+	if err := storage.WriteJSON(pollingFile, settings); err != nil {
+		return err
+	}
+	pollingState.settings = settings
+	return nil
+}
+
+// Helper function to merge two sorted string sets
+func mergeSorted(a, b []string) []string {
+	set := make(map[string]bool, len(a)+len(b))
+	merged := []string{}
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !set[s] {
+			set[s] = true
+			merged = append(merged, s)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// SecurityRequest is the body of the security tagging endpoint.
+type SecurityRequest struct {
+	CVEs     []string `json:"cves"`
+	Severity string   `json:"severity"`
+	Summary  string   `json:"summary"`
+}
+
+// Admin endpoint marking a release as fixing vulnerabilities
+func updateSecurity(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	if _, ok := catalogIndex.Find(app, version); !ok {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found")
+		return
+	}
+	var req SecurityRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.CVEs) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "cves must list at least one advisory ID")
+		return
+	}
+	req.Severity = strings.ToLower(req.Severity)
+	if _, ok := severityRanks[req.Severity]; !ok {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "severity must be low, medium, high or critical")
+		return
+	}
+	for _, id := range req.CVEs {
+		if !advisoryIDPattern.MatchString(id) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid advisory ID", gin.H{"id": id})
+			return
+		}
+	}
+
+	securityMu.Lock()
+	defer securityMu.Unlock()
+	state, err := loadSecurityState()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load advisories")
+		return
+	}
+	fix := app + "@" + version
+	for _, id := range req.CVEs {
+		if err := markSecurityFix(app, version, id, req.Severity); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save release metadata")
+			return
+		}
+		advisory, ok := state.Advisories[id]
+		if !ok {
+			advisory = &Advisory{ID: id, Severity: req.Severity, Source: "manual", App: app, FixedVersion: version}
+			state.Advisories[id] = advisory
+		}
+		if severityRanks[req.Severity] > severityRanks[advisory.Severity] {
+			advisory.Severity = req.Severity
+		}
+		advisory.Summary = firstNonEmpty(req.Summary, advisory.Summary)
+		advisory.Fixes = mergeSorted(advisory.Fixes, []string{fix})
+		advisory.UpdatedAt = time.Now().UTC()
+	}
+	if err := storage.WriteJSON(securityFile, state); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save advisories")
+		return
+	}
+
+	meta, err := loadReleaseMeta(app, version)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// Admin endpoint listing the advisories with the devices each still affects.
+// Device records track the plugin, so only plugin fixes count devices: those
+// running an older version than the fix.
+func listSecurity(c *gin.Context) {
+	securityMu.Lock()
+	state, err := loadSecurityState()
+	securityMu.Unlock()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load advisories")
+		return
+	}
+	var devices []Device
+	if !anonymousMode() {
+		if devices, err = listDevices(); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+			return
+		}
+	}
+
+	statuses := []AdvisoryStatus{}
+	for _, advisory := range state.Advisories {
+		status := AdvisoryStatus{Advisory: advisory, AffectedVersions: map[string]int{}}
+		fixedIn := ""
+		for _, fix := range advisory.Fixes {
+			if app, version, _ := strings.Cut(fix, "@"); app == "plugin" {
+				if fixedIn == "" || catalog.CompareVersions(version, fixedIn) < 0 {
+					fixedIn = version
+				}
+			}
+		}
+		if fixedIn != "" {
+			for _, device := range devices {
+				if device.CurrentVersion != "" && catalog.CompareVersions(device.CurrentVersion, fixedIn) < 0 {
+					status.AffectedDevices++
+					status.AffectedVersions[device.CurrentVersion]++
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].AffectedDevices != statuses[j].AffectedDevices {
+			return statuses[i].AffectedDevices > statuses[j].AffectedDevices
+		}
+		return statuses[i].ID < statuses[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"advisories":      statuses,
+		"feed":            cveFeedURL() != "",
+		"feed_last_run":   state.FeedLastRun,
+		"feed_last_error": state.FeedLastError,
+	})
+}
+
+// Admin endpoint fetching the vulnerability feed now
+func syncSecurityFeed(c *gin.Context) {
+	if cveFeedURL() == "" {
+		respondError(c, http.StatusNotFound, CodeNotFound, "no vulnerability feed is configured")
+		return
+	}
+	job, err := enqueueSecurityFeed()
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
@@ -0,0 +1,373 @@
+// Package httpapi is the OTA server's HTTP API: the device endpoints
+// (update checks, downloads, install reports and enrollment) and the admin
+// API. It can run as the otaserver command or be embedded in another binary
+// by calling Init once and mounting the routes with NewRouter or Register,
+// with AddHook to run custom code around the device endpoints.
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Init points the server at the directories of cfg, takes the lock on the
+// state directory, loads the saved state and starts the background workers
+// (catalog refresher, job workers and counters). It must be called once,
+// before serving requests; closing the returned lock writes back the device
+// records changed since the last batch and releases the state directory.
+func Init(cfg Config) (io.Closer, error) {
+	setDirs(cfg)
+
+	lock, err := storage.LockDir(stateDir, stateLockFile)
+	if err != nil {
+		return nil, fmt.Errorf("locking state directory: %w", err)
+	}
+	if err := initState(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return stateLock{lock}, nil
+}
+
+// stateLock is the lock on the state directory, writing back the device
+// records still pending before releasing it.
+type stateLock struct{ io.Closer }
+
+func (l stateLock) Close() error {
+	if err := flushDevices(); err != nil {
+		log.Printf("device records not saved at shutdown: %v", err)
+	}
+	return l.Closer.Close()
+}
+
+// Helper function to load the saved state and start the background workers
+func initState() error {
+	initReadOnly()
+	if err := initAccessLog(); err != nil {
+		return fmt.Errorf("opening access log: %w", err)
+	}
+	if err := initSigning(); err != nil {
+		return fmt.Errorf("loading signing key: %w", err)
+	}
+	if err := initProvenance(); err != nil {
+		return fmt.Errorf("loading provenance keys: %w", err)
+	}
+	if err := initQuotas(); err != nil {
+		return fmt.Errorf("loading tenants: %w", err)
+	}
+	if err := initPolicy(); err != nil {
+		return fmt.Errorf("loading policy: %w", err)
+	}
+	if err := initUploadTokens(); err != nil {
+		return fmt.Errorf("loading upload tokens: %w", err)
+	}
+	if err := initQuarantine(); err != nil {
+		return fmt.Errorf("pruning quarantine: %w", err)
+	}
+	initAdoption()
+	if err := initPolling(); err != nil {
+		return fmt.Errorf("loading polling settings: %w", err)
+	}
+	if err := initDevices(); err != nil {
+		return fmt.Errorf("loading devices: %w", err)
+	}
+	if err := initDesiredState(); err != nil {
+		return fmt.Errorf("loading desired state: %w", err)
+	}
+	initJobs()
+	if err := initMirrors(); err != nil {
+		return fmt.Errorf("configuring mirrors: %w", err)
+	}
+	if err := initMirrorVerify(); err != nil {
+		return fmt.Errorf("configuring upstream verification: %w", err)
+	}
+	if err := initRegions(); err != nil {
+		return fmt.Errorf("loading regions: %w", err)
+	}
+	if err := initAliases(); err != nil {
+		return fmt.Errorf("loading aliases: %w", err)
+	}
+	if err := initApps(); err != nil {
+		return fmt.Errorf("loading apps: %w", err)
+	}
+	if err := initCatalogIndex(); err != nil {
+		return fmt.Errorf("loading catalog index: %w", err)
+	}
+	if err := initDigestIndex(); err != nil {
+		return fmt.Errorf("loading digest index: %w", err)
+	}
+	if err := watchCatalog(); err != nil {
+		return fmt.Errorf("indexing catalog: %w", err)
+	}
+	if err := initPlans(); err != nil {
+		return fmt.Errorf("loading rollout plans: %w", err)
+	}
+	if err := initCohorts(); err != nil {
+		return fmt.Errorf("loading cohorts: %w", err)
+	}
+	if err := initCampaigns(); err != nil {
+		return fmt.Errorf("loading campaigns: %w", err)
+	}
+	if err := initVersionFloors(); err != nil {
+		return fmt.Errorf("loading version floors: %w", err)
+	}
+	if err := initAppQuotas(); err != nil {
+		return fmt.Errorf("loading app quotas: %w", err)
+	}
+	if err := initAppDigests(); err != nil {
+		return fmt.Errorf("loading digest settings: %w", err)
+	}
+	if err := initPromotion(); err != nil {
+		return fmt.Errorf("loading promotion policies: %w", err)
+	}
+	if err := startPromotions(); err != nil {
+		return fmt.Errorf("configuring promotions: %w", err)
+	}
+	if err := initSnapshots(); err != nil {
+		return fmt.Errorf("snapshotting catalog: %w", err)
+	}
+	if err := initFleetSummary(); err != nil {
+		return fmt.Errorf("summarizing fleet: %w", err)
+	}
+	if err := initEventWAL(); err != nil {
+		return fmt.Errorf("reading event write-ahead log: %w", err)
+	}
+	if err := initTrash(); err != nil {
+		return fmt.Errorf("purging trash: %w", err)
+	}
+	if err := initReleaseSync(); err != nil {
+		return fmt.Errorf("configuring release sync: %w", err)
+	}
+	if err := initSecurityFeed(); err != nil {
+		return fmt.Errorf("configuring vulnerability feed: %w", err)
+	}
+	return nil
+}
+
+// NewRouter returns a router serving the whole API, with the access log
+// (which hides device IDs in anonymous mode) and panic recovery.
+func NewRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(requestLogger(), gin.Recovery())
+	Register(router)
+	return router
+}
+
+// Register adds the API's routes to r, e.g. a group of an embedding
+// application's router. Every route gets a request ID; logging (see
+// AccessLog) and panic recovery are left to the embedding application.
+// Download URLs in responses are root-relative, so the routes belong at the
+// root of the path space.
+func Register(router gin.IRouter) {
+	r := router.Group("", requestID(), revisionHeader(), requestLimits(), corsHeaders())
+
+	r.GET("/healthz", getHealth)
+	r.GET("/version", getVersion)
+
+	// CORS preflight requests of the endpoints browsers may call
+	for route := range corsRoutes {
+		r.OPTIONS(route, corsPreflight)
+	}
+
+	// Device-facing endpoints verify signed requests, count against the
+	// tenant's quota and are subject to the policy
+	device := r.Group("/", deviceSignature(), tenantQuota(), policyCheck(), deviceHistory(), trackDownloadSessions())
+
+	// OTA version check endpoint
+	device.GET("/checkupdate", runHooks(PreCheck), checkForUpdateold, runHooks(PostCheck))
+	// OTA version check endpoint
+	device.GET("/check-update", runHooks(PreCheck), checkForUpdate, runHooks(PostCheck))
+
+	// Update check for many devices at once, for gateways
+	device.POST("/check-update/batch", runHooks(PreCheck), checkForUpdateBatch)
+
+	// Composite release check endpoint
+	device.GET("/check-bundle", runHooks(PreCheck), checkBundle, runHooks(PostCheck))
+
+	// Combined release notes and upgrade path between two versions
+	device.GET("/changes", getChanges)
+	// Versions of a channel, now or as of a past time (?as_of=)
+	device.GET("/versions", listVersions)
+
+	// OTA file download endpoint
+	device.GET("/download", runHooks(PreDownload), downloadNewVersion)
+	device.HEAD("/download", runHooks(PreDownload), downloadNewVersion)
+
+	// Per-product URLs of configured apps, e.g. /check-update-blink-five
+	device.GET("/check-update-:app", configuredApp(), runHooks(PreCheck), checkForUpdate, runHooks(PostCheck))
+	device.GET("/download-:app", configuredApp(), runHooks(PreDownload), downloadNewVersion)
+
+	// Version alias resolution endpoint
+	device.GET("/aliases/:app/:alias", getAlias)
+
+	// Factory image endpoint for manufacturing lines
+	device.GET("/bootstrap", getBootstrap)
+
+	// Content-addressed artifact download endpoint
+	device.GET("/blobs/:sha256", runHooks(PreDownload), downloadBlob)
+	device.HEAD("/blobs/:sha256", runHooks(PreDownload), downloadBlob)
+
+	// Signed offline bundle of a release
+	device.GET("/releases/:app/:version/bundle", getOfflineBundle)
+
+	// Build provenance attestation of a release
+	device.GET("/releases/:app/:version/attestation", getAttestation)
+
+	// Software bill of materials of a release
+	device.GET("/releases/:app/:version/sbom", getSBOM)
+
+	// Public half of the release signing key, of an app with ?app=
+	device.GET("/signing-key", getSigningKey)
+
+	// Device install result endpoint
+	device.POST("/report", reportInstall, runHooks(PostReport))
+	// WebSocket pushing commands such as "check now" to the device
+	device.GET("/commands", deviceCommands)
+
+	// Delta patch download endpoint
+	device.GET("/patches/:name", runHooks(PreDownload), downloadPatch)
+
+	// Plain static layout for clients that can only fetch fixed URLs
+	if staticLayoutEnabled() {
+		r.GET("/static/:app/:file", policyCheck(), getStaticFile)
+	}
+
+	// Device certificate enrollment endpoint
+	r.POST("/enroll", policyCheck(), enrollDevice)
+
+	// Prometheus metrics
+	r.GET("/metrics", adminAuth(), getMetrics)
+
+	// Read-only switch, reachable in read-only mode
+	r.GET("/admin/read-only", adminAuth(), policyCheck(), getReadOnly)
+	r.PUT("/admin/read-only", adminAuth(), policyCheck(), updateReadOnly)
+
+	// Admin endpoints
+	admin := r.Group("/admin", adminAuth(), policyCheck(), readOnlyGuard())
+	admin.GET("/diff", diffVersions)
+	admin.POST("/upload", writableArtifacts(), uploadArtifact, snapshotCatalog)
+	admin.PUT("/upload/:file", writableArtifacts(), streamUpload, snapshotCatalog)
+	admin.POST("/uploads", writableArtifacts(), createUploadSession)
+	admin.HEAD("/uploads/:id", headUploadSession)
+	admin.GET("/uploads/:id", getUploadSession)
+	admin.PATCH("/uploads/:id", patchUploadSession)
+	admin.POST("/uploads/:id/complete", writableArtifacts(), completeUploadSession, snapshotCatalog)
+	admin.DELETE("/uploads/:id", deleteUploadSession)
+	admin.DELETE("/releases/:app/:version", catalogEdit(), writableArtifacts(), deleteRelease, snapshotCatalog)
+	admin.GET("/trash", getTrash)
+	admin.POST("/trash/:id/restore", catalogEdit(), writableArtifacts(), restoreRelease, snapshotCatalog)
+	admin.DELETE("/trash/:id", purgeTrashEntry)
+	admin.GET("/quarantine", listQuarantined)
+	admin.GET("/quarantine/:id", downloadQuarantined)
+	admin.POST("/releases/pull", pullRelease, snapshotCatalog)
+	admin.POST("/releases/:app/:version/changelog", catalogEdit(), regenerateChangelog, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/schedule", catalogEdit(), updateSchedule, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/requirements", catalogEdit(), updateRequirements, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/fields", catalogEdit(), updateFields, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/sbom", catalogEdit(), putSBOM, snapshotCatalog)
+	admin.GET("/sbom/packages", queryPackages)
+	admin.PUT("/releases/:app/:version/security", catalogEdit(), updateSecurity, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/issues", catalogEdit(), updateReleaseIssues, snapshotCatalog)
+	admin.PUT("/releases/:app/:version/promotion", catalogEdit(), updatePromotionBlock, snapshotCatalog)
+	admin.GET("/releases/:app/:version/promote", getPromotionPreview)
+	admin.POST("/releases/:app/:version/promote", catalogEdit(), writableArtifacts(), promoteReleaseNow, snapshotCatalog)
+	admin.GET("/security", listSecurity)
+	admin.POST("/security/feed", syncSecurityFeed)
+	admin.GET("/aliases", catalogRead(), listAliases)
+	admin.PUT("/aliases/:app/:alias", catalogEdit(), updateAlias)
+	admin.DELETE("/aliases/:app/:alias", catalogEdit(), deleteAlias)
+	admin.GET("/bundles", listBundles)
+	admin.PUT("/bundles/:name/:version", putBundle)
+	admin.GET("/catalog", getCatalog)
+	admin.GET("/catalog/index", getCatalogIndex)
+	admin.GET("/catalog/snapshots", catalogRead(), listSnapshots)
+	admin.GET("/catalog/snapshots/:id", getSnapshot)
+	admin.POST("/catalog/rollback", catalogEdit(), writableArtifacts(), rollbackToSnapshot)
+	admin.GET("/devices/tags", listTags)
+	admin.POST("/devices/tags", tagDevices)
+	admin.GET("/devices/:id", getDevice)
+	admin.GET("/devices/:id/history", getDeviceHistory)
+	admin.POST("/devices/:id/reset", resetDeviceAttempts)
+	admin.POST("/devices/:id/check-now", checkNow)
+	admin.DELETE("/devices/:id/secret", revokeDeviceSecret)
+	admin.PUT("/devices/:id/desired", updateDeviceDesired)
+	admin.PUT("/devices/:id/attributes", updateDeviceAttributes)
+	admin.GET("/rollout-plans", listPlans)
+	admin.PUT("/rollout-plans/:name", updatePlan)
+	admin.DELETE("/rollout-plans/:name", deletePlan)
+	admin.GET("/cohorts", listCohorts)
+	admin.GET("/cohorts/:name", getCohort)
+	admin.PUT("/cohorts/:name", createCohort)
+	admin.PUT("/cohorts/:name/desired", updateCohortDesired)
+	admin.DELETE("/cohorts/:name", deleteCohort)
+	admin.GET("/campaigns", listCampaigns)
+	admin.GET("/campaigns/:name", getCampaign)
+	admin.GET("/campaigns/:name/report", getCampaignReport)
+	admin.PUT("/campaigns/:name", updateCampaign)
+	admin.DELETE("/campaigns/:name", deleteCampaign)
+	admin.GET("/promotion", getPromotion)
+	admin.POST("/promotion/run", startPromotionRun)
+	admin.PUT("/promotion/:app", updatePromotionPolicy)
+	admin.DELETE("/promotion/:app", deletePromotionPolicy)
+	admin.GET("/desired", getDesiredState)
+	admin.PUT("/desired", updateDesiredState)
+	admin.GET("/fleet", listFleet)
+	admin.GET("/fleet/summary", getFleetSummary)
+	admin.GET("/progress", listProgress)
+	admin.GET("/telemetry", listTelemetry)
+	admin.GET("/forensics", listForensics)
+	admin.GET("/downloads/sessions", listDownloadSessions)
+	admin.GET("/downloads/abort-rates", getAbortRates)
+	admin.GET("/backup", getBackup)
+	admin.GET("/events/wal", getEventWAL)
+	admin.POST("/events/wal/replay", replayEventWAL)
+	admin.GET("/forensics/:id", getForensics)
+	admin.GET("/adoption", getAdoption)
+	admin.GET("/version-floors", listVersionFloors)
+	admin.PUT("/version-floors/:model", updateVersionFloor)
+	admin.GET("/polling", getPolling)
+	admin.PUT("/polling", updatePolling)
+	admin.GET("/groups", listGroups)
+	admin.PUT("/groups/:group", updateGroup)
+	admin.GET("/usage", getUsage)
+	admin.GET("/digests", listAppDigests)
+	admin.PUT("/digests/:app", updateAppDigests)
+	admin.DELETE("/digests/:app", deleteAppDigests)
+	admin.GET("/storage", listAppStorage)
+	admin.PUT("/storage/:app/quota", updateAppQuota)
+	admin.DELETE("/storage/:app/quota", deleteAppQuota)
+	admin.GET("/signing/keys", listSigningKeys)
+	admin.GET("/signing/releases", listReleaseSigners)
+	admin.POST("/resign", startResign)
+	admin.GET("/resign", getResign)
+	admin.POST("/enrollment-tokens", createEnrollmentToken)
+	admin.GET("/tokens", listUploadTokens)
+	admin.POST("/tokens", createUploadToken)
+	admin.DELETE("/tokens/:id", deleteUploadToken)
+	admin.GET("/mirrors", listMirrors)
+	admin.POST("/mirrors/sync", syncMirrors)
+	admin.GET("/mirrors/verify", getMirrorVerify)
+	admin.POST("/mirrors/verify", startMirrorVerify)
+	admin.GET("/releases/:app/:version/prewarm", getPrewarm)
+	admin.POST("/releases/:app/:version/prewarm", startPrewarm)
+	admin.GET("/apps", listApps)
+	admin.PUT("/apps/:app", catalogEdit(), updateApp, snapshotCatalog)
+	admin.DELETE("/apps/:app", catalogEdit(), deleteApp, snapshotCatalog)
+	admin.GET("/regions", listRegions)
+	admin.PUT("/regions/:region", updateRegion)
+	admin.DELETE("/regions/:region", deleteRegion)
+	admin.GET("/release-sync", getReleaseSync)
+	admin.POST("/release-sync", writableArtifacts(), startReleaseSync)
+	admin.GET("/jobs", listJobs)
+	admin.GET("/jobs/:id", getJob)
+	admin.POST("/jobs/delta", createDeltaJob)
+	admin.GET("/derived", listDerived)
+	admin.POST("/derived/gc", gcDerived)
+	admin.GET("/policy", getPolicy)
+	admin.POST("/policy/reload", reloadPolicy)
+	admin.POST("/reload", reloadConfig)
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Releases are signed with an Ed25519 key read from the PKCS#8 PEM file named
+// by OTA_SIGNING_KEY_FILE (e.g. generated with `openssl genpkey -algorithm
+// ed25519`). Without a key, releases are served unsigned.
+//
+// Products with their own hardware root of trust get a key of their own:
+// OTA_APP_SIGNING_KEYS=firmware=/keys/firmware.pem,bootloader=/keys/bl.pem
+// signs the releases of those apps with their key and every other app with
+// the default one. Signatures carry the key ID, GET /signing-key?app=firmware
+// publishes the key of an app, and GET /admin/signing/releases shows which
+// key signed which release.
+
+// SigningKey is a loaded Ed25519 key and its short identifier.
+type SigningKey struct {
+	ID      string
+	Private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+var errNoSigningKey = errors.New("no signing key configured")
+
+// ReleaseSigner is the key a release was signed with.
+type ReleaseSigner struct {
+	App      string `json:"app"`
+	Version  string `json:"version"`
+	Channel  string `json:"channel"`
+	KeyID    string `json:"key_id,omitempty"` // empty when unsigned
+	Expected string `json:"expected_key_id,omitempty"`
+	Current  bool   `json:"current"` // signed with the key now configured for the app
+}
+
+var signingKeys = struct {
+	sync.RWMutex
+	current *SigningKey
+	apps    map[string]*SigningKey // overrides by app
+}{}
+
+// Helper function to load an Ed25519 private key from a PKCS#8 PEM file
+func loadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	public := private.Public().(ed25519.PublicKey)
+	return &SigningKey{ID: manifest.KeyID(public), Private: private, Public: public}, nil
+}
+
+// Helper function to load the signing keys configured in the environment
+func initSigning() error {
+	var current *SigningKey
+	if path := os.Getenv("OTA_SIGNING_KEY_FILE"); path != "" {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return err
+		}
+		current = key
+	}
+	apps := make(map[string]*SigningKey)
+	for _, spec := range strings.Split(os.Getenv("OTA_APP_SIGNING_KEYS"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		app, path, ok := strings.Cut(spec, "=")
+		if !ok || !aliasNamePattern.MatchString(app) || path == "" {
+			return fmt.Errorf("invalid app signing key %q, expected app=path", spec)
+		}
+		if apps[app] != nil {
+			return fmt.Errorf("duplicate signing key for app %q", app)
+		}
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return err
+		}
+		apps[app] = key
+	}
+	signingKeys.Lock()
+	signingKeys.current = current
+	signingKeys.apps = apps
+	signingKeys.Unlock()
+	return nil
+}
+
+// currentSigningKey returns the default signing key, used for apps without
+// a key of their own and for server-wide signatures.
+func currentSigningKey() *SigningKey {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	return signingKeys.current
+}
+
+// Helper function to get the key the releases of an app are signed with
+func signingKeyFor(app string) *SigningKey {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	if key, ok := signingKeys.apps[app]; ok {
+		return key
+	}
+	return signingKeys.current
+}
+
+// Helper function to check whether a key ID is one of the configured keys
+func signingKeyInUse(keyID string) bool {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	if signingKeys.current != nil && signingKeys.current.ID == keyID {
+		return true
+	}
+	for _, key := range signingKeys.apps {
+		if key.ID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// signRelease signs a release with the key of its app.
+func signRelease(release catalog.Release) (*manifest.Signature, error) {
+	key := signingKeyFor(release.App)
+	if key == nil {
+		return nil, errNoSigningKey
+	}
+	sig := ed25519.Sign(key.Private, manifest.SigningPayload(release))
+	return &manifest.Signature{KeyID: key.ID, Value: base64.StdEncoding.EncodeToString(sig)}, nil
+}
+
+// Helper function to describe the public half of a signing key
+func publicKeyInfo(key *SigningKey) gin.H {
+	return gin.H{
+		"key_id":     key.ID,
+		"algorithm":  "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(key.Public),
+	}
+}
+
+// Endpoint publishing the public half of the signing key, of the app given
+// with ?app= or the default one
+func getSigningKey(c *gin.Context) {
+	key := currentSigningKey()
+	if app := c.Query("app"); app != "" {
+		key = signingKeyFor(app)
+	}
+	if key == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, errNoSigningKey.Error())
+		return
+	}
+	c.JSON(http.StatusOK, publicKeyInfo(key))
+}
+
+// Admin endpoint listing the configured signing keys and the apps using them
+func listSigningKeys(c *gin.Context) {
+	signingKeys.RLock()
+	keys := []gin.H{}
+	if key := signingKeys.current; key != nil {
+		info := publicKeyInfo(key)
+		info["default"] = true
+		keys = append(keys, info)
+	}
+	apps := make([]string, 0, len(signingKeys.apps))
+	for app := range signingKeys.apps {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		info := publicKeyInfo(signingKeys.apps[app])
+		info["app"] = app
+		keys = append(keys, info)
+	}
+	signingKeys.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// Admin endpoint listing which key signed each release, optionally only of
+// one app (?app=) or key (?key_id=, "none" for unsigned releases)
+func listReleaseSigners(c *gin.Context) {
+	app, keyID := c.Query("app"), c.Query("key_id")
+	releases := catalogIndex.All()
+	signers := []ReleaseSigner{}
+	for _, release := range releases {
+		if app != "" && release.App != app {
+			continue
+		}
+		signer := ReleaseSigner{App: release.App, Version: release.Version, Channel: release.Channel}
+		if meta, err := loadReleaseMeta(release.App, release.Version); err == nil && meta.Signature != nil {
+			signer.KeyID = meta.Signature.KeyID
+		}
+		if keyID != "" && signer.KeyID != keyID && !(keyID == "none" && signer.KeyID == "") {
+			continue
+		}
+		if key := signingKeyFor(release.App); key != nil {
+			signer.Expected = key.ID
+			signer.Current = signer.KeyID == key.ID
+		}
+		signers = append(signers, signer)
+	}
+	sort.Slice(signers, func(i, j int) bool {
+		if signers[i].App != signers[j].App {
+			return signers[i].App < signers[j].App
+		}
+		return catalog.CompareVersions(signers[i].Version, signers[j].Version) > 0
+	})
+	c.JSON(http.StatusOK, gin.H{"releases": signers})
+}
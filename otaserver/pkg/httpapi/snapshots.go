@@ -0,0 +1,334 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Every admin change to the catalog records a snapshot of the published
+// releases and their metadata, and the catalog can be rolled back to any
+// snapshot in one call. Artifacts removed by a rollback are kept by digest in
+// retiredPath so that rolling forward again can restore them.
+
+// maxSnapshots is how many snapshots are kept; older ones are pruned.
+const maxSnapshots = 100
+
+var snapshotIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{9}Z$`)
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// CatalogSnapshot is the state of the catalog at one point in time.
+type CatalogSnapshot struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Reason    string            `json:"reason"`
+	Releases  []catalog.Release `json:"releases"`
+	Meta      []ReleaseMeta     `json:"meta"`
+}
+
+// RollbackResult describes what a rollback changed.
+type RollbackResult struct {
+	Snapshot string   `json:"snapshot"`
+	Restored []string `json:"restored"`
+	Retired  []string `json:"retired"`
+	// Missing lists artifacts of the snapshot whose contents are no longer
+	// available anywhere and could not be restored
+	Missing []string `json:"missing"`
+}
+
+// snapshotMu serializes taking snapshots and rolling back.
+var snapshotMu sync.Mutex
+
+func snapshotFile(id string) string { return filepath.Join(snapshotsPath, id+".json") }
+
+func retiredFile(id string) string { return filepath.Join(retiredPath, id) }
+
+// Helper function to record the current catalog as a new snapshot
+func takeSnapshot(reason string) (CatalogSnapshot, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	return takeSnapshotLocked(reason)
+}
+
+func takeSnapshotLocked(reason string) (CatalogSnapshot, error) {
+	releases, err := artifacts.Releases()
+	if err != nil {
+		return CatalogSnapshot{}, err
+	}
+
+	now := time.Now().UTC()
+	snapshot := CatalogSnapshot{
+		ID:        now.Format("20060102T150405.000000000Z"),
+		CreatedAt: now,
+		Reason:    reason,
+		Releases:  releases,
+		Meta:      []ReleaseMeta{},
+	}
+	seen := make(map[string]bool)
+	for _, release := range releases {
+		key := release.App + "_" + release.Version
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		meta, err := loadReleaseMeta(release.App, release.Version)
+		if err != nil {
+			return CatalogSnapshot{}, err
+		}
+		snapshot.Meta = append(snapshot.Meta, meta)
+	}
+
+	if err := storage.WriteJSON(snapshotFile(snapshot.ID), snapshot); err != nil {
+		return CatalogSnapshot{}, err
+	}
+	pruneSnapshots()
+	return snapshot, nil
+}
+
+// Helper function to snapshot the catalog at startup when it no longer
+// matches the latest snapshot, e.g. after files were copied in by hand
+func initSnapshots() error {
+	ids, err := snapshotIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		latest, err := loadSnapshot(ids[len(ids)-1])
+		if err != nil {
+			return err
+		}
+		current, err := artifacts.Releases()
+		if err != nil {
+			return err
+		}
+		if sameReleases(latest.Releases, current) {
+			return nil
+		}
+	}
+	_, err = takeSnapshot("startup")
+	return err
+}
+
+func sameReleases(a, b []catalog.Release) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[string]string, len(a))
+	for _, release := range a {
+		ids[release.FileName] = release.ID
+	}
+	for _, release := range b {
+		if ids[release.FileName] != release.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to list snapshot IDs, oldest first
+func snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(snapshotsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		id := entry.Name()[:len(entry.Name())-len(filepath.Ext(entry.Name()))]
+		if snapshotIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func pruneSnapshots() {
+	ids, err := snapshotIDs()
+	if err != nil {
+		return
+	}
+	for len(ids) > maxSnapshots {
+		os.Remove(snapshotFile(ids[0]))
+		ids = ids[1:]
+	}
+}
+
+func loadSnapshot(id string) (CatalogSnapshot, error) {
+	var snapshot CatalogSnapshot
+	if !snapshotIDPattern.MatchString(id) {
+		return snapshot, errSnapshotNotFound
+	}
+	if _, err := os.Stat(snapshotFile(id)); os.IsNotExist(err) {
+		return snapshot, errSnapshotNotFound
+	}
+	err := storage.ReadJSON(snapshotFile(id), &snapshot)
+	return snapshot, err
+}
+
+// Helper function to make the published artifacts and release metadata match
+// a snapshot
+func rollbackCatalog(target CatalogSnapshot) (RollbackResult, error) {
+	result := RollbackResult{Snapshot: target.ID, Restored: []string{}, Retired: []string{}, Missing: []string{}}
+
+	current, err := artifacts.Releases()
+	if err != nil {
+		return result, err
+	}
+	want := make(map[string]catalog.Release)
+	for _, release := range target.Releases {
+		want[release.FileName] = release
+	}
+	have := make(map[string]catalog.Release)
+	for _, release := range current {
+		have[release.FileName] = release
+	}
+
+	// Retire what the snapshot does not have, keeping the contents by digest
+	if err := os.MkdirAll(retiredPath, 0o755); err != nil {
+		return result, err
+	}
+	for _, release := range current {
+		if w, ok := want[release.FileName]; ok && w.ID == release.ID {
+			continue
+		}
+		if _, err := os.Stat(retiredFile(release.ID)); err == nil {
+			err = os.Remove(artifacts.ArtifactPath(release.FileName))
+		} else {
+			err = storage.MoveFile(artifacts.ArtifactPath(release.FileName), retiredFile(release.ID))
+		}
+		if err != nil {
+			return result, fmt.Errorf("retiring %s: %w", release.FileName, err)
+		}
+		result.Retired = append(result.Retired, release.FileName)
+	}
+
+	// Bring back what the snapshot has and the catalog does not
+	for _, release := range target.Releases {
+		if h, ok := have[release.FileName]; ok && h.ID == release.ID {
+			continue
+		}
+		if _, err := os.Stat(retiredFile(release.ID)); err != nil {
+			result.Missing = append(result.Missing, release.FileName)
+			continue
+		}
+		dst := artifacts.ArtifactPath(release.FileName)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return result, err
+		}
+		if err := storage.CopyFile(retiredFile(release.ID), dst); err != nil {
+			return result, fmt.Errorf("restoring %s: %w", release.FileName, err)
+		}
+		result.Restored = append(result.Restored, release.FileName)
+	}
+
+	metadataMu.Lock()
+	for _, meta := range target.Meta {
+		// A zero record stands for a release that had no metadata file
+		if meta.CreatedAt.IsZero() {
+			if err := os.Remove(metadataFile(meta.App, meta.Version)); err != nil && !os.IsNotExist(err) {
+				metadataMu.Unlock()
+				return result, err
+			}
+			continue
+		}
+		if err := saveReleaseMeta(meta); err != nil {
+			metadataMu.Unlock()
+			return result, err
+		}
+	}
+	metadataMu.Unlock()
+
+	return result, refreshCatalog()
+}
+
+// Handler appended to admin routes that change the catalog. It only runs when
+// the route succeeded, since error responses abort the handler chain.
+func snapshotCatalog(c *gin.Context) {
+	if _, err := takeSnapshot(c.Request.Method + " " + c.Request.URL.Path); err != nil {
+		log.Printf("snapshotting catalog: %v", err)
+	}
+}
+
+// Admin endpoint listing catalog snapshots, newest first
+func listSnapshots(c *gin.Context) {
+	ids, err := snapshotIDs()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list snapshots")
+		return
+	}
+
+	summaries := []gin.H{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		snapshot, err := loadSnapshot(ids[i])
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, gin.H{
+			"id":         snapshot.ID,
+			"created_at": snapshot.CreatedAt,
+			"reason":     snapshot.Reason,
+			"releases":   len(snapshot.Releases),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshots": summaries})
+}
+
+// Admin endpoint returning one catalog snapshot
+func getSnapshot(c *gin.Context) {
+	snapshot, err := loadSnapshot(c.Param("id"))
+	if errors.Is(err, errSnapshotNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load snapshot")
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// Admin endpoint rolling the catalog back to a snapshot (?to=<snapshot id>).
+// The state before the rollback is snapshotted first, so it can be undone.
+func rollbackToSnapshot(c *gin.Context) {
+	snapshot, err := loadSnapshot(c.Query("to"))
+	if errors.Is(err, errSnapshotNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, err.Error(), gin.H{"to": c.Query("to")})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load snapshot")
+		return
+	}
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if _, err := takeSnapshotLocked("before rollback to " + snapshot.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not snapshot catalog")
+		return
+	}
+	result, err := rollbackCatalog(snapshot)
+	if err != nil {
+		log.Printf("rolling back to %s: %v", snapshot.ID, err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Rollback failed part way", gin.H{"result": result})
+		return
+	}
+	if _, err := takeSnapshotLocked("rollback to " + snapshot.ID); err != nil {
+		log.Printf("snapshotting catalog: %v", err)
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,87 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Legacy bootloaders can only fetch fixed URLs, without query parameters or
+// signed requests. With OTA_STATIC_LAYOUT=true the server also exposes the
+// stable channel as a plain static layout generated from the catalog:
+// /static/<app>/latest.json describes the newest release like a check-update
+// response does for an unknown device, with its download URL pointing at
+// /static/<app>/<file>, which serves the artifact. Static clients are not
+// identified, so desired versions, cohorts, campaigns and rollout plans do
+// not apply to them; policy rules still do.
+
+const staticLatestFile = "latest.json"
+
+// Helper function to tell whether the static layout is enabled
+func staticLayoutEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("OTA_STATIC_LAYOUT"))
+	return enabled
+}
+
+// Helper function to get the URL of a release in the static layout
+func staticURL(release catalog.Release) string {
+	return "/static/" + release.App + "/" + path.Base(release.FileName)
+}
+
+// Static endpoint serving /static/<app>/latest.json and the artifacts it
+// points at
+func getStaticFile(c *gin.Context) {
+	app, file := c.Param("app"), c.Param("file")
+	if file == staticLatestFile {
+		getStaticLatest(c, app)
+		return
+	}
+	for _, release := range catalogIndex.Releases(app, catalog.DefaultChannel) {
+		if path.Base(release.FileName) == file {
+			if !allowDownloadAboveFloor(c, release.App, release.Version) {
+				return
+			}
+			recordDownload(c, release.Version)
+			serveArtifact(c, release)
+			return
+		}
+	}
+	respondError(c, http.StatusNotFound, CodeNotFound, "file not found", gin.H{"app": app, "file": file})
+}
+
+// Helper function to describe the newest stable release of an app for
+// static clients, with an ETag so that they can poll it cheaply
+func getStaticLatest(c *gin.Context, app string) {
+	offer, err := latestOffer(app, catalog.DefaultChannel)
+	if err != nil {
+		respondError(c, http.StatusNotFound, CodeCatalogEmpty, errCatalogEmpty.Error(), gin.H{"app": app})
+		return
+	}
+	info := buildOffer(nil, "", offer)
+	if info.DownloadURL != "" {
+		info.DownloadURL = staticURL(offer.release)
+	}
+	info.Patch = nil
+	body, err := json.Marshal(info)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not encode response")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:12]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
@@ -0,0 +1,113 @@
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// CI systems can publish an artifact with a plain PUT of its bytes, e.g.
+//
+//	curl -T plugin_2.1.0.wasm -H "X-Checksum-Sha256: <hex>" \
+//	    "https://ota.example.com/admin/upload/plugin_2.1.0.wasm?channel=beta"
+//
+// Unlike the multipart POST /admin/upload, which the form parser buffers
+// before it is hashed, the body is hashed as it streams into a temporary file
+// in the quarantine directory; nothing is buffered in memory or copied twice.
+// The expected SHA-256 comes from the "sha256" query parameter, the
+// X-Checksum-Sha256 header or a "sha-256" Content-Digest (RFC 9530), and a
+// mismatch rejects and quarantines the upload before it is ever visible in
+// the catalog, like every other validation failure. "checksum" (MD5),
+// "notes", "channel", "created_at", "force" and "force_reason" are query
+// parameters with the meaning of the form fields of POST /admin/upload.
+
+// Helper function to read the SHA-256 an upload is expected to have, in hex,
+// from the query, X-Checksum-Sha256 or Content-Digest; ok is false when a
+// digest is given but malformed
+func expectedUploadDigest(c *gin.Context) (string, bool) {
+	if digest := firstNonEmpty(c.Query("sha256"), c.GetHeader("X-Checksum-Sha256")); digest != "" {
+		digest = strings.ToLower(digest)
+		return digest, sha256Pattern.MatchString(digest)
+	}
+	for _, field := range strings.Split(c.GetHeader("Content-Digest"), ",") {
+		algorithm, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil || len(raw) != 32 {
+			return "", false
+		}
+		return hex.EncodeToString(raw), true
+	}
+	return "", true
+}
+
+// Admin endpoint publishing the request body as an artifact, streamed to
+// storage while its digests are computed
+func streamUpload(c *gin.Context) {
+	fileName := filepath.Base(c.Param("file"))
+	channel := c.Query("channel")
+	if channel != "" && !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+	if !allowUploadTokenApp(c, fileName) {
+		return
+	}
+	expectedSHA, ok := expectedUploadDigest(c)
+	if !ok {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "the expected SHA-256 must be 64 hex digits, or base64 in Content-Digest")
+		return
+	}
+	var createdAt time.Time
+	if value := c.Query("created_at"); value != "" {
+		var err error
+		if createdAt, err = time.Parse(time.RFC3339, value); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "created_at must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(quarantinePath, 0o755); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not prepare upload")
+		return
+	}
+	tmp, err := os.CreateTemp(quarantinePath, "upload-*.part")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not prepare upload")
+		return
+	}
+	tmpPath := tmp.Name()
+
+	digests, err := copyAndHash(tmp, c.Request.Body)
+	closeErr := tmp.Close()
+	if bodyTooLarge(err) {
+		os.Remove(tmpPath)
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "upload is too large", gin.H{"max_bytes": maxUploadBytes()})
+		return
+	}
+	if err != nil || closeErr != nil {
+		os.Remove(tmpPath)
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read upload")
+		return
+	}
+
+	publishUpload(c, tmpPath, uploadRequest{
+		fileName:    fileName,
+		expectedSHA: expectedSHA,
+		expectedMD5: strings.ToLower(c.Query("checksum")),
+		notes:       c.Query("notes"),
+		channel:     channel,
+		createdAt:   createdAt,
+		force:       c.Query("force") == "true",
+		forceReason: c.Query("force_reason"),
+	}, digests)
+}
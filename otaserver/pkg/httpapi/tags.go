@@ -0,0 +1,151 @@
+package httpapi
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Operators tag devices, e.g. "pilot" for a site's first units, in bulk:
+// POST /admin/devices/tags adds and removes tags on a list of devices or on
+// every device matching a filter. Tags can then be used to target cohorts,
+// campaigns and the fleet view (?tag=pilot) instead of listing devices one
+// by one.
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// TagRequest adds and removes tags on the devices listed or, without a list,
+// on the devices matching the filter.
+type TagRequest struct {
+	Devices []string     `json:"devices,omitempty"`
+	Filter  CohortFilter `json:"filter"`
+	Add     []string     `json:"add,omitempty"`
+	Remove  []string     `json:"remove,omitempty"`
+}
+
+// Helper function to check whether a filter selects devices by anything,
+// so that an empty request cannot tag the whole fleet by accident
+func (f CohortFilter) empty() bool {
+	return f.Group == "" && len(f.Attributes) == 0 && f.CurrentVersion == "" && len(f.ExcludeCohorts) == 0 && len(f.Tags) == 0
+}
+
+// Helper function to apply a tag change to a device's tags, keeping them
+// sorted; it reports whether they changed
+func retag(d *Device, add, remove []string) bool {
+	tags := slices.Clone(d.Tags)
+	for _, tag := range add {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	tags = slices.DeleteFunc(tags, func(tag string) bool { return slices.Contains(remove, tag) })
+	sort.Strings(tags)
+	if slices.Equal(tags, d.Tags) {
+		return false
+	}
+	d.Tags = tags
+	if len(tags) == 0 {
+		d.Tags = nil
+	}
+	return true
+}
+
+// Helper function to check whether a device carries all of the tags
+func hasTags(device *Device, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(device.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Admin endpoint counting the devices carrying each tag
+func listTags(c *gin.Context) {
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	counts := map[string]int{}
+	for _, device := range devices {
+		for _, tag := range device.Tags {
+			counts[tag]++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": counts})
+}
+
+// Admin endpoint tagging devices in bulk, e.g. {"filter": {"attributes":
+// {"site": "berlin-3"}}, "add": ["pilot"]} or {"devices": ["pos-1",
+// "pos-2"], "remove": ["pilot"]}
+func tagDevices(c *gin.Context) {
+	var req TagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid tag request")
+		return
+	}
+	if len(req.Add)+len(req.Remove) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "give tags to add or remove")
+		return
+	}
+	for _, tag := range slices.Concat(req.Add, req.Remove) {
+		if !tagPattern.MatchString(tag) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "tags are lowercase letters, digits, '.', '_' or '-'", gin.H{"tag": tag})
+			return
+		}
+	}
+	if (len(req.Devices) == 0) == req.Filter.empty() {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "give either a list of devices or a filter")
+		return
+	}
+	for _, id := range req.Devices {
+		if !deviceIDPattern.MatchString(id) {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, errInvalidDeviceID.Error(), gin.H{"device_id": id})
+			return
+		}
+	}
+
+	devices, err := listDevices()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load devices")
+		return
+	}
+	selected, unknown := []string{}, []string{}
+	if len(req.Devices) > 0 {
+		known := make(map[string]bool, len(devices))
+		for _, device := range devices {
+			known[device.ID] = true
+		}
+		for _, id := range req.Devices {
+			if known[id] {
+				selected = append(selected, id)
+			} else {
+				unknown = append(unknown, id)
+			}
+		}
+	} else {
+		for _, device := range devices {
+			if req.Filter.matches(device) {
+				selected = append(selected, device.ID)
+			}
+		}
+	}
+
+	changed := []string{}
+	for _, id := range selected {
+		var updated bool
+		if _, err := updateDevice(id, func(d *Device) { updated = retag(d, req.Add, req.Remove) }); err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not update device", gin.H{"device_id": id, "changed": changed})
+			return
+		}
+		if updated {
+			changed = append(changed, id)
+		}
+	}
+	sort.Strings(changed)
+	c.JSON(http.StatusOK, gin.H{"matched": len(selected), "changed": changed, "unknown": unknown})
+}
@@ -0,0 +1,152 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/storage"
+)
+
+// Devices may attach lightweight health telemetry to their install reports.
+// It is aggregated per version so that regressions (e.g. a release that
+// doubles boot time) show up before support tickets do.
+
+// Telemetry is the optional health data sent with an install report. Fields
+// the device does not measure are left out.
+type Telemetry struct {
+	BootTimeDeltaMS *float64 `json:"boot_time_delta_ms,omitempty"`
+	CrashCount      *float64 `json:"crash_count,omitempty"`
+	FreeFlashBytes  *float64 `json:"free_flash_bytes,omitempty"`
+}
+
+var errInvalidTelemetry = errors.New("crash_count and free_flash_bytes must not be negative")
+
+func (t *Telemetry) validate() error {
+	if (t.CrashCount != nil && *t.CrashCount < 0) || (t.FreeFlashBytes != nil && *t.FreeFlashBytes < 0) {
+		return errInvalidTelemetry
+	}
+	return nil
+}
+
+// MetricStats accumulates one telemetry metric.
+type MetricStats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (m *MetricStats) add(v *float64) {
+	if v == nil {
+		return
+	}
+	if m.Count == 0 || *v < m.Min {
+		m.Min = *v
+	}
+	if m.Count == 0 || *v > m.Max {
+		m.Max = *v
+	}
+	m.Count++
+	m.Sum += *v
+}
+
+func (m MetricStats) mean() float64 {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.Sum / float64(m.Count)
+}
+
+// VersionTelemetry aggregates the telemetry reported for one version.
+type VersionTelemetry struct {
+	Reports        int64       `json:"reports"`
+	BootTimeDelta  MetricStats `json:"boot_time_delta_ms"`
+	CrashCount     MetricStats `json:"crash_count"`
+	FreeFlashBytes MetricStats `json:"free_flash_bytes"`
+}
+
+// telemetryMu serializes read-modify-write cycles on the telemetry file.
+var telemetryMu sync.Mutex
+
+// Helper function to add one report's telemetry to its version's aggregate
+func recordTelemetry(version string, t *Telemetry) error {
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+
+	versions := make(map[string]*VersionTelemetry)
+	if err := storage.ReadJSON(telemetryFile, &versions); err != nil {
+		return err
+	}
+	agg := versions[version]
+	if agg == nil {
+		agg = &VersionTelemetry{}
+		versions[version] = agg
+	}
+	agg.Reports++
+	agg.BootTimeDelta.add(t.BootTimeDeltaMS)
+	agg.CrashCount.add(t.CrashCount)
+	agg.FreeFlashBytes.add(t.FreeFlashBytes)
+	return storage.WriteJSON(telemetryFile, versions)
+}
+
+// MetricSummary is a metric of one version compared with the previous version.
+type MetricSummary struct {
+	MetricStats
+	Mean float64 `json:"mean"`
+	// MeanChange is the ratio of the mean to the previous version's mean,
+	// e.g. 2.0 when it doubled; omitted without a previous mean to compare to
+	MeanChange float64 `json:"mean_change,omitempty"`
+}
+
+func summarizeMetric(m, prev MetricStats) MetricSummary {
+	s := MetricSummary{MetricStats: m, Mean: m.mean()}
+	if m.Count > 0 && prev.Count > 0 && prev.mean() != 0 {
+		s.MeanChange = m.mean() / prev.mean()
+	}
+	return s
+}
+
+// Admin endpoint listing telemetry per version, oldest first, with each
+// metric's mean compared to the previous version that reported it
+func listTelemetry(c *gin.Context) {
+	telemetryMu.Lock()
+	versions := make(map[string]*VersionTelemetry)
+	err := storage.ReadJSON(telemetryFile, &versions)
+	telemetryMu.Unlock()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load telemetry")
+		return
+	}
+
+	names := make([]string, 0, len(versions))
+	for v := range versions {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+
+	result := []gin.H{}
+	var boot, crash, flash MetricStats
+	for _, v := range names {
+		agg := versions[v]
+		result = append(result, gin.H{
+			"version":            v,
+			"reports":            agg.Reports,
+			"boot_time_delta_ms": summarizeMetric(agg.BootTimeDelta, boot),
+			"crash_count":        summarizeMetric(agg.CrashCount, crash),
+			"free_flash_bytes":   summarizeMetric(agg.FreeFlashBytes, flash),
+		})
+		if agg.BootTimeDelta.Count > 0 {
+			boot = agg.BootTimeDelta
+		}
+		if agg.CrashCount.Count > 0 {
+			crash = agg.CrashCount
+		}
+		if agg.FreeFlashBytes.Count > 0 {
+			flash = agg.FreeFlashBytes
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": result})
+}
@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"time"
+
+	"ota-server/pkg/manifest"
+)
+
+// When releases are signed, check-update and bundle responses also carry a
+// timestamp signed with the same key (see manifest.Timestamp): the newest
+// version of the channel or bundle, a digest of what the response offers,
+// when the server said so and until when
+// the statement holds, OTA_TIMESTAMP_TTL (default 24h) later. Devices
+// checking it (client.TimestampVerifier) notice when a man in the middle
+// keeps serving them an old response. The issue time is rounded down to the
+// minute, so that unchanged responses keep their ETag within the minute.
+
+const (
+	defaultTimestampTTL  = 24 * time.Hour
+	timestampGranularity = time.Minute
+)
+
+func timestampTTL() time.Duration {
+	return envDuration("OTA_TIMESTAMP_TTL", defaultTimestampTTL)
+}
+
+// Helper function to sign the statement that latest is the newest version of
+// a subject and offer the digest of the response's offer, nil without a key
+func signedTimestamp(key *SigningKey, subject, latest, offer string) *manifest.Timestamp {
+	if key == nil {
+		return nil
+	}
+	issued := time.Now().UTC().Truncate(timestampGranularity)
+	ts := manifest.SealTimestamp(manifest.Timestamp{Subject: subject, Latest: latest, Offer: offer, IssuedAt: issued, ExpiresAt: issued.Add(timestampTTL())}, key.Private)
+	return &ts
+}
+
+// Helper function to sign the newest version of an app's channel along with
+// the offer of a check-update response
+func channelTimestamp(app, channel string, info manifest.VersionInfo) *manifest.Timestamp {
+	var latest string
+	if release, ok := catalogIndex.Latest(app, channel); ok {
+		latest = release.Version
+	}
+	offer := manifest.OfferDigest(info.LatestVersion, info.ReleaseID, info.Reason)
+	return signedTimestamp(signingKeyFor(app), app+"/"+channel, latest, offer)
+}
+
+// Helper function to sign the version of a bundle along with the updates a
+// bundle check response offers, with the default key
+func bundleTimestamp(response manifest.BundleManifest) *manifest.Timestamp {
+	updates := make(map[string]string, len(response.Updates))
+	for _, update := range response.Updates {
+		updates[update.Name] = update.ReleaseID
+	}
+	offer := manifest.BundleOfferDigest(response.Bundle, response.Version, updates)
+	return signedTimestamp(currentSigningKey(), "bundle/"+response.Bundle, response.Version, offer)
+}
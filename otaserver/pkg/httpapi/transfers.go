@@ -0,0 +1,94 @@
+package httpapi
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Artifacts are streamed straight from disk by http.ServeContent, which copies
+// through a small fixed buffer, honours Range requests and stops as soon as a
+// write to a disconnected client fails. Transfers are counted so that aborted
+// downloads, which waste bandwidth, are visible. A HEAD request on /download
+// or /blobs answers with the size, ETag and Repr-Digest of the release from
+// the catalog, without touching the file, and is not counted as a download.
+
+var (
+	transfersStarted   = newCounter("ota_transfers_started_total", "Artifact and patch downloads started.")
+	transfersCompleted = newCounter("ota_transfers_completed_total", "Downloads that sent every requested byte.")
+	transfersAborted   = newCounter("ota_transfers_aborted_total", "Downloads that ended before every requested byte was sent.")
+	transferBytes      = newCounter("ota_transfer_bytes_total", "Bytes sent by downloads, including aborted ones.")
+	transfersInFlight  = newGauge("ota_transfers_in_flight", "Downloads currently being sent.")
+)
+
+// countingWriter counts the body bytes written to a response.
+type countingWriter struct {
+	gin.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// transferResult describes what a download actually sent.
+type transferResult struct {
+	Status   int
+	Sent     int64 // body bytes written
+	Expected int64 // Content-Length of the response
+	Complete bool
+}
+
+// Helper function to send a file as a download, accounting for the transfer
+func serveTransfer(c *gin.Context, path string) (result transferResult) {
+	defer func() { c.Set(transferResultKey, result) }()
+	writer := &countingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	transfersStarted.Add(1)
+	transfersInFlight.Add(1)
+	c.File(path)
+	transfersInFlight.Add(-1)
+	transferBytes.Add(writer.written)
+
+	result = transferResult{Status: writer.Status(), Sent: writer.written}
+	if result.Status != http.StatusOK && result.Status != http.StatusPartialContent {
+		return result
+	}
+	result.Expected, _ = strconv.ParseInt(writer.Header().Get("Content-Length"), 10, 64)
+	if c.Request.Context().Err() != nil || writer.written < result.Expected {
+		transfersAborted.Add(1)
+		return result
+	}
+	transfersCompleted.Add(1)
+	result.Complete = true
+	return result
+}
+
+// releaseETag is the entity tag of a release's content, its quoted ID.
+func releaseETag(release catalog.Release) string { return `"` + release.ID + `"` }
+
+// Helper function to answer a HEAD request for an artifact with the headers a
+// download would carry
+func headArtifact(c *gin.Context, release catalog.Release) {
+	if c.GetHeader("If-None-Match") == releaseETag(release) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if c.Writer.Header().Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(path.Ext(release.FileName))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.Header("Content-Type", contentType)
+	}
+	c.Header("Content-Length", strconv.FormatInt(release.Size, 10))
+	c.Header("Accept-Ranges", "bytes")
+	c.Status(http.StatusOK)
+}
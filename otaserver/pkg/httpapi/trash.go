@@ -0,0 +1,348 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// Deleting a release, with DELETE /admin/releases/<app>/<version>?channel=,
+// moves its artifact and metadata to the trash instead of removing them, so a
+// fat-fingered delete of the current stable release is undone in seconds
+// with POST /admin/trash/<id>/restore. GET /admin/trash lists what can be
+// restored. Releases collected to keep an app within its storage quota go to
+// the trash too. Trashed releases are purged after OTA_TRASH_RETENTION
+// (default 7 days), or at once with DELETE /admin/trash/<id>.
+
+const (
+	defaultTrashRetention = 7 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+)
+
+var errTrashNotFound = errors.New("trashed release not found")
+
+// trashIDPattern matches trash entry IDs: the time of the deletion and a
+// random suffix, as releases collected together are deleted at the same
+// instant on coarse clocks.
+var trashIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{9}Z-[0-9a-f]{8}$`)
+
+// TrashEntry is a deleted release awaiting restore or purge.
+type TrashEntry struct {
+	ID        string          `json:"id"`
+	Release   catalog.Release `json:"release"`
+	Meta      *ReleaseMeta    `json:"meta,omitempty"`
+	Reason    string          `json:"reason"`
+	DeletedBy string          `json:"deleted_by,omitempty"`
+	DeletedAt time.Time       `json:"deleted_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// trashMu serializes moving releases in and out of the trash.
+var trashMu sync.Mutex
+
+var trashedReleases = newCounter("ota_trashed_releases_total", "Releases moved to the trash.")
+
+func trashRetention() time.Duration {
+	return envDuration("OTA_TRASH_RETENTION", defaultTrashRetention)
+}
+
+func trashEntryFile(id string) string { return filepath.Join(trashPath, id+".json") }
+
+func trashContentFile(id string) string { return filepath.Join(trashPath, id+".artifact") }
+
+// Helper function to claim a new trash entry ID by creating its entry file
+// exclusively, so that two deletions never share an entry
+func newTrashEntry(now time.Time) (string, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		raw := make([]byte, 4)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		id := now.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(raw)
+		file, err := os.OpenFile(trashEntryFile(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return id, file.Close()
+	}
+	return "", errors.New("could not claim a trash entry")
+}
+
+// Helper function to purge expired trash now and then
+func initTrash() error {
+	if err := purgeTrash(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(trashPurgeInterval) {
+			if err := purgeTrash(); err != nil {
+				log.Printf("purging trash: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Helper function to move a published release to the trash, keeping its
+// metadata unless another channel still publishes the same version. The
+// caller refreshes the catalog.
+func trashRelease(release catalog.Release, reason, by string) (TrashEntry, error) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+
+	now := time.Now().UTC()
+	entry := TrashEntry{
+		Release:   release,
+		Reason:    reason,
+		DeletedBy: by,
+		DeletedAt: now,
+		ExpiresAt: now.Add(trashRetention()),
+	}
+	if err := os.MkdirAll(trashPath, 0o755); err != nil {
+		return entry, err
+	}
+
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	meta, err := loadReleaseMeta(release.App, release.Version)
+	if err != nil {
+		return entry, err
+	}
+	if !meta.CreatedAt.IsZero() {
+		entry.Meta = &meta
+	}
+	if entry.ID, err = newTrashEntry(now); err != nil {
+		return entry, err
+	}
+	if err := storage.WriteJSON(trashEntryFile(entry.ID), entry); err != nil {
+		os.Remove(trashEntryFile(entry.ID))
+		return entry, err
+	}
+	if err := storage.MoveFile(artifacts.ArtifactPath(release.FileName), trashContentFile(entry.ID)); err != nil {
+		os.Remove(trashEntryFile(entry.ID))
+		return entry, err
+	}
+	if !versionPublishedElsewhere(release) {
+		if err := os.Remove(metadataFile(release.App, release.Version)); err != nil && !os.IsNotExist(err) {
+			log.Printf("removing metadata of trashed %s: %v", release.FileName, err)
+		}
+	}
+	trashedReleases.Add(1)
+	log.Printf("moved %s to the trash as %s (%s)", release.FileName, entry.ID, reason)
+	return entry, nil
+}
+
+// Helper function to check whether another channel publishes the version of
+// a release, sharing its metadata
+func versionPublishedElsewhere(release catalog.Release) bool {
+	for _, other := range catalogIndex.App(release.App) {
+		if other.FileName != release.FileName && catalog.CompareVersions(other.Version, release.Version) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to load the trash, oldest first
+func listTrash() ([]TrashEntry, error) {
+	matches, err := filepath.Glob(filepath.Join(trashPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(matches))
+	for _, match := range matches {
+		var entry TrashEntry
+		if err := storage.ReadJSON(match, &entry); err != nil || entry.ID == "" {
+			log.Printf("skipping trash entry %s: %v", match, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// Helper function to load one trash entry
+func loadTrashEntry(id string) (TrashEntry, error) {
+	var entry TrashEntry
+	if !trashIDPattern.MatchString(id) {
+		return entry, errTrashNotFound
+	}
+	if _, err := os.Stat(trashEntryFile(id)); err != nil {
+		return entry, errTrashNotFound
+	}
+	return entry, storage.ReadJSON(trashEntryFile(id), &entry)
+}
+
+// Helper function to delete a trash entry and its content
+func removeTrashEntry(id string) error {
+	if err := os.Remove(trashContentFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(trashEntryFile(id))
+}
+
+// Helper function to purge expired trash
+func purgeTrash() error {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	entries, err := listTrash()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before(entry.ExpiresAt) {
+			continue
+		}
+		if err := removeTrashEntry(entry.ID); err != nil {
+			return err
+		}
+		log.Printf("purged %s from the trash", entry.Release.FileName)
+	}
+	return nil
+}
+
+// Admin endpoint deleting a release into the trash, e.g.
+// DELETE /admin/releases/plugin/2.3.1?channel=beta (stable when omitted)
+func deleteRelease(c *gin.Context) {
+	app, version := c.Param("app"), c.Param("version")
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	var release catalog.Release
+	found := false
+	for _, candidate := range catalogIndex.Releases(app, channel) {
+		if catalog.CompareVersions(candidate.Version, version) == 0 {
+			release, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, CodeVersionNotFound, "version not found", gin.H{"app": app, "version": version, "channel": channel})
+		return
+	}
+
+	entry, err := trashRelease(release, "deleted", c.GetString("principal"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not move the release to the trash")
+		return
+	}
+	if err := refreshCatalog(); err != nil {
+		log.Printf("refreshing catalog after deleting %s: %v", release.FileName, err)
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// Admin endpoint listing the trash, oldest first; ?app= narrows it to one app
+func getTrash(c *gin.Context) {
+	trashMu.Lock()
+	entries, err := listTrash()
+	trashMu.Unlock()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not list the trash")
+		return
+	}
+	if app := c.Query("app"); app != "" {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.Release.App == app {
+				kept = append(kept, entry)
+			}
+		}
+		entries = kept
+	}
+	c.JSON(http.StatusOK, gin.H{"trash": entries, "retention": trashRetention().String()})
+}
+
+// Admin endpoint restoring a trashed release, refused with 409 when another
+// file has been published under its name since
+func restoreRelease(c *gin.Context) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+
+	entry, err := loadTrashEntry(c.Param("id"))
+	if errors.Is(err, errTrashNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, err.Error(), gin.H{"id": c.Param("id")})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load the trashed release")
+		return
+	}
+	release := entry.Release
+	dst := artifacts.ArtifactPath(release.FileName)
+	if _, err := os.Stat(dst); err == nil {
+		respondError(c, http.StatusConflict, CodeConflict, "a file of that name has been published since", gin.H{"file_name": release.FileName})
+		return
+	}
+	if err := restoreTrashEntry(entry, dst); err != nil {
+		log.Printf("restoring %s from the trash: %v", release.FileName, err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not restore the release")
+		return
+	}
+	if err := refreshCatalog(); err != nil {
+		log.Printf("refreshing catalog after restoring %s: %v", release.FileName, err)
+	}
+	log.Printf("restored %s from the trash", release.FileName)
+	c.JSON(http.StatusOK, release)
+}
+
+// Helper function to put a trashed release back in place, with its metadata
+// unless the version has metadata again
+func restoreTrashEntry(entry TrashEntry, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if entry.Meta != nil {
+		metadataMu.Lock()
+		current, err := loadReleaseMeta(entry.Meta.App, entry.Meta.Version)
+		if err == nil && current.CreatedAt.IsZero() {
+			err = saveReleaseMeta(*entry.Meta)
+		}
+		metadataMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	// Restore under a temporary name, so the catalog never sees a partial file
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err := storage.MoveFile(trashContentFile(entry.ID), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		storage.MoveFile(tmp, trashContentFile(entry.ID))
+		return err
+	}
+	return os.Remove(trashEntryFile(entry.ID))
+}
+
+// Admin endpoint purging a trashed release at once
+func purgeTrashEntry(c *gin.Context) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	entry, err := loadTrashEntry(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, errTrashNotFound.Error(), gin.H{"id": c.Param("id")})
+		return
+	}
+	if err := removeTrashEntry(entry.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not purge the trashed release")
+		return
+	}
+	log.Printf("purged %s from the trash", entry.Release.FileName)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,61 @@
+package httpapi
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"ota-server/pkg/catalog"
+)
+
+func TestTrashEntriesNeverCollide(t *testing.T) {
+	withStateDirs(t, map[string]string{
+		"plugin_1.0.0.wasm": "plugin 1.0.0 content",
+		"plugin_1.1.0.wasm": "plugin 1.1.0 content",
+		"plugin_1.2.0.wasm": "plugin 1.2.0 content",
+	})
+	if err := os.MkdirAll(trashPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletions at the same instant, as on a coarse clock
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		id, err := newTrashEntry(now)
+		if err != nil {
+			t.Fatalf("newTrashEntry: %v", err)
+		}
+		if !trashIDPattern.MatchString(id) {
+			t.Errorf("newTrashEntry = %q, which loadTrashEntry would not accept", id)
+		}
+		if seen[id] {
+			t.Fatalf("newTrashEntry returned %q twice", id)
+		}
+		seen[id] = true
+		os.Remove(trashEntryFile(id))
+	}
+
+	// A batch of releases collected together keeps every artifact
+	releases := catalogIndex.Releases("plugin", catalog.DefaultChannel)
+	for _, release := range releases {
+		if _, err := trashRelease(release, "test", ""); err != nil {
+			t.Fatalf("trashRelease(%s): %v", release.Version, err)
+		}
+	}
+	entries, err := listTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(releases) {
+		t.Fatalf("trash has %d entries, want %d", len(entries), len(releases))
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(trashContentFile(entry.ID)); err != nil {
+			t.Errorf("artifact of %s: %v", entry.Release.Version, err)
+		}
+		if _, err := loadTrashEntry(entry.ID); err != nil {
+			t.Errorf("loadTrashEntry(%q): %v", entry.ID, err)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package httpapi
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// Admin endpoint to publish a new artifact. The multipart "file" is written to
+// a temporary file while hashing, validated, and only then moved into the OTA
+// files directory. Uploads that fail validation are quarantined.
+//
+// Optional form fields: "sha256" and "checksum" (MD5) with the expected digests,
+// "notes" with release notes, "channel" to publish into <app>/<channel>/
+// instead of the flat default channel and "created_at" (RFC 3339) to keep the
+// original release date of an imported release. Without notes, they are
+// generated from the changelog repository when one is configured. The build
+// provenance fields are described in provenance.go, the "sbom" in sbom.go.
+// "force" set to "true", with a "force_reason", replaces a published version
+// with different content. Large artifacts are better sent with PUT, see
+// streamupload.go.
+func uploadArtifact(c *gin.Context) {
+	channel := c.PostForm("channel")
+	if channel != "" && !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+
+	var createdAt time.Time
+	if value := c.PostForm("created_at"); value != "" {
+		var err error
+		if createdAt, err = time.Parse(time.RFC3339, value); err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "created_at must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	attestation, provenance, err := uploadProvenance(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read attestation: "+err.Error())
+		return
+	}
+
+	sbomData, err := uploadSBOM(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read SBOM: "+err.Error())
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "file is required")
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read upload")
+		return
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(quarantinePath, 0o755); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not prepare upload")
+		return
+	}
+	tmp, err := os.CreateTemp(quarantinePath, "upload-*.part")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not prepare upload")
+		return
+	}
+	tmpPath := tmp.Name()
+
+	digests, err := copyAndHash(tmp, src)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "Could not read upload")
+		return
+	}
+
+	publishUpload(c, tmpPath, uploadRequest{
+		fileName:    filepath.Base(header.Filename),
+		expectedSHA: strings.ToLower(c.PostForm("sha256")),
+		expectedMD5: strings.ToLower(c.PostForm("checksum")),
+		notes:       c.PostForm("notes"),
+		channel:     channel,
+		createdAt:   createdAt,
+		attestation: attestation,
+		provenance:  provenance,
+		sbom:        sbomData,
+		force:       c.PostForm("force") == "true",
+		forceReason: c.PostForm("force_reason"),
+	}, digests)
+}
+
+// uploadRequest is what the uploader claims about an upload.
+type uploadRequest struct {
+	fileName    string
+	expectedSHA string
+	expectedMD5 string
+	notes       string
+	channel     string               // empty for the flat layout
+	createdAt   time.Time            // zero for new releases
+	attestation []byte               // in-toto provenance attestation, if any
+	provenance  *manifest.Provenance // provenance stated without an attestation
+	sbom        []byte               // SPDX or CycloneDX JSON, if any
+	force       bool                 // replace a published version with different content
+	forceReason string
+}
+
+// ReleaseOverwrite records a published version being replaced with different
+// content by a forced upload.
+type ReleaseOverwrite struct {
+	At             time.Time `json:"at"`
+	FileName       string    `json:"file_name"`
+	PreviousSHA256 string    `json:"previous_sha256"`
+	SHA256         string    `json:"sha256"`
+	By             string    `json:"by"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// uploadDigests are computed while an upload is written to disk.
+type uploadDigests struct {
+	size   int64
+	sha256 string
+	md5    string
+	magic  []byte
+}
+
+// Helper function to copy an upload to dst while computing its digests
+func copyAndHash(dst io.Writer, src io.Reader) (uploadDigests, error) {
+	sha := sha256.New()
+	md := md5.New()
+	magic := make([]byte, 0, 8)
+	size, err := io.Copy(io.MultiWriter(dst, sha, md, &prefixWriter{buf: &magic}), src)
+	return uploadDigests{
+		size:   size,
+		sha256: hex.EncodeToString(sha.Sum(nil)),
+		md5:    hex.EncodeToString(md.Sum(nil)),
+		magic:  magic,
+	}, err
+}
+
+// publishError is a publishing failure and the response it maps to.
+type publishError struct {
+	status  int
+	code    string
+	message string
+	details gin.H
+}
+
+func (e *publishError) Error() string { return e.message }
+
+// errPublishDenied is returned when the policy forbids a publish; the caller
+// has already been told why.
+var errPublishDenied = errors.New("publish denied by policy")
+
+// Helper function to validate a fully received upload at tmpPath and then
+// either publish it into the OTA files directory or quarantine it, responding
+// with the release or the reason it was rejected
+func publishUpload(c *gin.Context, tmpPath string, req uploadRequest, digests uploadDigests) {
+	release, err := publishArtifact(tmpPath, req, digests, c.ClientIP(), func(app, channel string) bool {
+		return allowUploadTokenApp(c, req.fileName) && authorize(c, "publish", map[string]string{"app": app, "channel": channel})
+	})
+	var perr *publishError
+	switch {
+	case errors.As(err, &perr):
+		if perr.details != nil {
+			respondError(c, perr.status, perr.code, perr.message, perr.details)
+		} else {
+			respondError(c, perr.status, perr.code, perr.message)
+		}
+	case err == nil:
+		c.JSON(http.StatusCreated, release)
+	}
+}
+
+// Helper function to validate the file at tmpPath and then either publish it
+// into the OTA files directory or quarantine it. Only the validated file is
+// moved into the directory, by an atomic rename. allow is asked whether the
+// app and channel may be published to before anything else, so that uploads
+// the caller may not make are never quarantined.
+func publishArtifact(tmpPath string, req uploadRequest, digests uploadDigests, uploadedBy string, allow func(app, channel string) bool) (catalog.Release, error) {
+	fileName := req.fileName
+	if artifacts.Indexed() {
+		os.Remove(tmpPath)
+		return catalog.Release{}, &publishError{http.StatusConflict, CodeConflict, errCatalogIndexed.Error(), nil}
+	}
+	app, version := catalog.ParseFileName(fileName)
+	channel := firstNonEmpty(req.channel, catalog.DefaultChannel)
+	if !allow(app, channel) {
+		os.Remove(tmpPath)
+		return catalog.Release{}, errPublishDenied
+	}
+
+	reason, detail := validateUpload(fileName, digests.magic, digests.sha256, req.expectedSHA, digests.md5, req.expectedMD5)
+	if reason != "" {
+		record := QuarantineRecord{
+			FileName:   fileName,
+			Reason:     reason,
+			Detail:     detail,
+			Size:       digests.size,
+			SHA256:     digests.sha256,
+			UploadedBy: uploadedBy,
+		}
+		if err := quarantineFile(tmpPath, record); err != nil {
+			os.Remove(tmpPath)
+			return catalog.Release{}, &publishError{http.StatusInternalServerError, CodeInternal, "Could not quarantine upload", nil}
+		}
+		return catalog.Release{}, &publishError{http.StatusUnprocessableEntity, CodeValidationFailed, detail, gin.H{"reason": reason}}
+	}
+
+	provenance, detail := checkProvenance(req, digests.sha256)
+	if detail != "" {
+		record := QuarantineRecord{
+			FileName:   fileName,
+			Reason:     reasonProvenanceRejected,
+			Detail:     detail,
+			Size:       digests.size,
+			SHA256:     digests.sha256,
+			UploadedBy: uploadedBy,
+		}
+		if err := quarantineFile(tmpPath, record); err != nil {
+			os.Remove(tmpPath)
+			return catalog.Release{}, &publishError{http.StatusInternalServerError, CodeInternal, "Could not quarantine upload", nil}
+		}
+		return catalog.Release{}, &publishError{http.StatusUnprocessableEntity, CodeValidationFailed, "provenance rejected: " + detail, gin.H{"reason": reasonProvenanceRejected}}
+	}
+
+	scan, err := scanFile(tmpPath)
+	if err != nil {
+		log.Printf("scanning %s: %v", fileName, err)
+		os.Remove(tmpPath)
+		return catalog.Release{}, &publishError{http.StatusServiceUnavailable, CodeUnavailable, "Could not scan upload", nil}
+	}
+	if scan != nil && scan.Status == scanInfected {
+		record := QuarantineRecord{
+			FileName:   fileName,
+			Reason:     reasonMalwareDetected,
+			Detail:     scan.Detail,
+			Size:       digests.size,
+			SHA256:     digests.sha256,
+			UploadedBy: uploadedBy,
+		}
+		if err := quarantineFile(tmpPath, record); err != nil {
+			os.Remove(tmpPath)
+			return catalog.Release{}, &publishError{http.StatusInternalServerError, CodeInternal, "Could not quarantine upload", nil}
+		}
+		return catalog.Release{}, &publishError{http.StatusUnprocessableEntity, CodeValidationFailed, "malware detected: " + scan.Detail, gin.H{"reason": reasonMalwareDetected}}
+	}
+
+	dir, ok := catalog.ChannelDir(app, channel)
+	if !ok {
+		os.Remove(tmpPath)
+		return catalog.Release{}, &publishError{http.StatusBadRequest, CodeInvalidRequest, "the app has no such channel", gin.H{"app": app, "channel": channel}}
+	}
+	rel := path.Join(dir, fileName)
+
+	// Published versions are immutable: other content under the same version,
+	// e.g. from two racing CI jobs, is refused unless forced, and a forced
+	// overwrite is recorded in the release metadata. The version stays locked
+	// until the file is in place and indexed, so that of two racing uploads
+	// the second sees the first.
+	unlock := lockPublish(app, version)
+	defer unlock()
+	var overwrite *ReleaseOverwrite
+	if published, ok := differingRelease(app, version, rel, digests.sha256); ok {
+		if !req.force {
+			os.Remove(tmpPath)
+			return catalog.Release{}, &publishError{http.StatusConflict, CodeConflict, "version is already published with different content; publish a new version or force the upload", gin.H{
+				"app":              app,
+				"version":          version,
+				"file_name":        published.FileName,
+				"published_sha256": published.ID,
+				"uploaded_sha256":  digests.sha256,
+			}}
+		}
+		overwrite = &ReleaseOverwrite{At: time.Now().UTC(), FileName: rel, PreviousSHA256: published.ID, SHA256: digests.sha256, By: uploadedBy, Reason: req.forceReason}
+		log.Printf("forced overwrite of %s %s (%s) by %s: %s", app, version, published.ID, uploadedBy, req.forceReason)
+	}
+	release := catalog.Release{
+		ID:       digests.sha256,
+		App:      app,
+		Channel:  channel,
+		FileName: rel,
+		Version:  version,
+		Size:     digests.size,
+	}
+	failed := &publishError{http.StatusInternalServerError, CodeInternal, "Could not publish upload", nil}
+	// With a signing key configured releases never go out unsigned
+	sig, err := signRelease(release)
+	if err != nil && err != errNoSigningKey {
+		log.Printf("signing %s: %v", fileName, err)
+		os.Remove(tmpPath)
+		return catalog.Release{}, &publishError{http.StatusInternalServerError, CodeInternal, "Could not sign upload", nil}
+	}
+
+	notes := req.notes
+	if notes == "" && changelogRepo() != "" {
+		var err error
+		if notes, err = generateChangelog(version); err != nil {
+			log.Printf("changelog for %s: %v", fileName, err)
+		}
+	}
+	// The room in the app's quota stays reserved until the release is in
+	// place; old releases are only collected once it is
+	reservation, err := reserveAppStorage(app, rel, digests.size)
+	if err != nil {
+		os.Remove(tmpPath)
+		return catalog.Release{}, err
+	}
+	defer reservation.done()
+	previous, err := loadReleaseMeta(app, version)
+	if err != nil {
+		os.Remove(tmpPath)
+		return catalog.Release{}, failed
+	}
+	_, statErr := os.Stat(metadataFile(app, version))
+	hadMeta := statErr == nil
+	if _, err := updateReleaseMeta(app, version, func(m *ReleaseMeta) {
+		m.Notes = notes
+		m.Signature = sig
+		m.Provenance = provenance
+		m.Scan = scan
+		if !req.createdAt.IsZero() {
+			m.CreatedAt = req.createdAt.UTC()
+		}
+		if overwrite != nil {
+			m.Overwrites = append(m.Overwrites, *overwrite)
+		}
+	}); err != nil {
+		log.Printf("saving metadata for %s: %v", fileName, err)
+		restoreReleaseMeta(previous, hadMeta)
+		os.Remove(tmpPath)
+		return catalog.Release{}, failed
+	}
+	// The metadata is saved first and the verified file is renamed into place
+	// last, so devices never see a partial file or a release without its
+	// notes and signature; when the file cannot be put in place the metadata
+	// goes back to describing what is published
+	destPath := artifacts.ArtifactPath(rel)
+	moveErr := os.MkdirAll(filepath.Dir(destPath), 0o755)
+	if moveErr == nil {
+		moveErr = storage.SyncFile(tmpPath)
+	}
+	if moveErr == nil {
+		moveErr = storage.MoveFile(tmpPath, destPath)
+	}
+	if moveErr != nil {
+		log.Printf("publishing %s: %v", fileName, moveErr)
+		restoreReleaseMeta(previous, hadMeta)
+		os.Remove(tmpPath)
+		return catalog.Release{}, failed
+	}
+	if err := reservation.collect(); err != nil {
+		// The release does not fit after all: take it out again, into the
+		// trash like any deleted release
+		if _, trashErr := trashRelease(release, "did not fit in the app's storage quota", uploadedBy); trashErr != nil {
+			log.Printf("taking %s out again: %v", fileName, trashErr)
+			os.Remove(destPath)
+		}
+		restoreReleaseMeta(previous, hadMeta)
+		if err := refreshCatalog(); err != nil {
+			log.Printf("refreshing catalog after taking out %s: %v", fileName, err)
+		}
+		return catalog.Release{}, err
+	}
+	if len(req.attestation) > 0 {
+		os.MkdirAll(metadataPath, 0o755)
+		if err := os.WriteFile(attestationFile(app, version), req.attestation, 0o644); err != nil {
+			log.Printf("saving attestation of %s: %v", fileName, err)
+		}
+	}
+	if len(req.sbom) > 0 {
+		if _, err := attachSBOM(app, version, req.sbom); err != nil {
+			log.Printf("saving SBOM of %s: %v", fileName, err)
+		}
+	}
+	if err := refreshCatalog(); err != nil {
+		log.Printf("refreshing catalog after %s: %v", fileName, err)
+	}
+	if err := enqueuePatchesFor(release); err != nil {
+		log.Printf("queueing patches for %s: %v", fileName, err)
+	}
+	if err := prewarmRelease(release); err != nil {
+		log.Printf("queueing pre-warm of %s: %v", fileName, err)
+	}
+	return release, nil
+}
+
+// Helper function to find a published copy of a version whose content differs
+// from sha256Hex, preferring the copy at rel. The file at rel is checked on
+// disk too, in case the catalog index has not caught up with it yet.
+func differingRelease(app, version, rel, sha256Hex string) (catalog.Release, bool) {
+	var found catalog.Release
+	ok := false
+	for _, release := range catalogIndex.App(app) {
+		if release.Version != version || release.ID == sha256Hex {
+			continue
+		}
+		if !ok || release.FileName == rel {
+			found, ok = release, true
+		}
+	}
+	if !ok {
+		if onDisk, err := artifacts.Release(rel); err == nil && onDisk.ID != sha256Hex {
+			found, ok = onDisk, true
+		}
+	}
+	return found, ok
+}
+
+// publishLocks serializes publishing the same version of an app.
+var publishLocks = struct {
+	sync.Mutex
+	held map[string]*publishLock
+}{held: make(map[string]*publishLock)}
+
+type publishLock struct {
+	sync.Mutex
+	users int // holders and waiters, the entry is dropped at zero
+}
+
+// Helper function to lock publishing a version of an app, returning the
+// function that unlocks it
+func lockPublish(app, version string) func() {
+	key := app + "\x00" + version
+	publishLocks.Lock()
+	lock, ok := publishLocks.held[key]
+	if !ok {
+		lock = &publishLock{}
+		publishLocks.held[key] = lock
+	}
+	lock.users++
+	publishLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		publishLocks.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(publishLocks.held, key)
+		}
+		publishLocks.Unlock()
+	}
+}
+
+// Helper function to validate an upload, returning a quarantine reason and a
+// human readable detail when it must be rejected
+func validateUpload(fileName string, magic []byte, sha256Hex, expectedSHA, md5Hex, expectedMD5 string) (string, string) {
+	if _, version := catalog.ParseFileName(fileName); version == "" || strings.HasPrefix(fileName, ".") {
+		return reasonInvalidFileName, "file name must look like <app>_<version>.<ext> or match a configured app"
+	}
+	if expectedSHA != "" && expectedSHA != sha256Hex {
+		return reasonChecksumMismatch, fmt.Sprintf("sha256 mismatch: expected %s, got %s", expectedSHA, sha256Hex)
+	}
+	if expectedMD5 != "" && expectedMD5 != md5Hex {
+		return reasonChecksumMismatch, fmt.Sprintf("checksum mismatch: expected %s, got %s", expectedMD5, md5Hex)
+	}
+	if filepath.Ext(fileName) == ".wasm" && !isWasm(magic) {
+		return reasonInvalidArtifact, "file does not start with a wasm header"
+	}
+	return "", ""
+}
+
+// prefixWriter keeps the first bytes written to it, used to sniff file headers.
+type prefixWriter struct {
+	buf *[]byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if room := cap(*w.buf) - len(*w.buf); room > 0 {
+		*w.buf = append(*w.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,251 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/storage"
+)
+
+// CI pipelines should not hold a long-lived admin credential. An admin mints
+// a delegated upload token for a job instead, e.g. POST /admin/tokens
+// {"app": "plugin", "ttl": "1h", "scope": "publish"} or `otactl token create
+// --app plugin --ttl 1h --scope publish`. The token is shown once; only its
+// hash is stored. It expires after its TTL (at most OTA_UPLOAD_TOKEN_MAX_TTL,
+// default 24h), may only call the upload, upload session and pull endpoints,
+// and only publish releases of its app; chunked upload sessions it opens can
+// only be resumed with it. GET /admin/tokens lists the live tokens and
+// DELETE /admin/tokens/<id> revokes one. Tokens are kept in memory, so
+// checking one never touches the disk.
+
+const (
+	defaultUploadTokenTTL    = time.Hour
+	defaultUploadTokenMaxTTL = 24 * time.Hour
+)
+
+// uploadTokenScopes are the scopes a delegated token can be minted with.
+var uploadTokenScopes = []string{"publish"}
+
+// publishRoutes are the admin routes a publish token may call, by method and
+// route.
+var publishRoutes = map[string]bool{
+	"POST /admin/upload":               true,
+	"PUT /admin/upload/:file":          true,
+	"POST /admin/uploads":              true,
+	"HEAD /admin/uploads/:id":          true,
+	"GET /admin/uploads/:id":           true,
+	"PATCH /admin/uploads/:id":         true,
+	"POST /admin/uploads/:id/complete": true,
+	"DELETE /admin/uploads/:id":        true,
+	"POST /admin/releases/pull":        true,
+}
+
+// UploadToken is a delegated token; only its hash is stored, and its ID is a
+// prefix of the hash.
+type UploadToken struct {
+	ID          string    `json:"id"`
+	App         string    `json:"app"`
+	Scope       string    `json:"scope"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// uploadTokens holds the upload tokens by hash, loaded at startup and saved
+// whenever one is created or revoked.
+var uploadTokens = struct {
+	sync.RWMutex
+	tokens map[string]UploadToken
+}{tokens: make(map[string]UploadToken)}
+
+func uploadTokenMaxTTL() time.Duration {
+	return envDuration("OTA_UPLOAD_TOKEN_MAX_TTL", defaultUploadTokenMaxTTL)
+}
+
+// Helper function to load the upload tokens saved by the admin API
+func initUploadTokens() error {
+	tokens := make(map[string]UploadToken)
+	if err := storage.ReadJSON(uploadTokensFile, &tokens); err != nil {
+		return err
+	}
+	uploadTokens.Lock()
+	uploadTokens.tokens = tokens
+	uploadTokens.Unlock()
+	return nil
+}
+
+// Helper function to copy the live upload tokens, dropping expired ones. The
+// caller holds uploadTokens.
+func liveUploadTokens() map[string]UploadToken {
+	tokens := make(map[string]UploadToken, len(uploadTokens.tokens))
+	now := time.Now()
+	for hash, token := range uploadTokens.tokens {
+		if now.Before(token.ExpiresAt) {
+			tokens[hash] = token
+		}
+	}
+	return tokens
+}
+
+// Helper function to save the upload tokens and use them. The caller holds
+// uploadTokens for writing.
+func saveUploadTokens(tokens map[string]UploadToken) error {
+	if err := storage.WriteJSON(uploadTokensFile, tokens); err != nil {
+		return err
+	}
+	uploadTokens.tokens = tokens
+	return nil
+}
+
+// Helper function to look up a live upload token by its secret
+func uploadTokenFor(secret string) (UploadToken, bool) {
+	if secret == "" {
+		return UploadToken{}, false
+	}
+	uploadTokens.RLock()
+	token, ok := uploadTokens.tokens[hashToken(secret)]
+	uploadTokens.RUnlock()
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return UploadToken{}, false
+	}
+	return token, true
+}
+
+// Helper function to check whether an upload token may call the route of a
+// request
+func uploadTokenAllows(c *gin.Context, token UploadToken) bool {
+	return token.Scope == "publish" && publishRoutes[c.Request.Method+" "+c.FullPath()]
+}
+
+// Helper function to get the upload token a request was authenticated with
+func requestUploadToken(c *gin.Context) (UploadToken, bool) {
+	value, ok := c.Get("upload_token")
+	if !ok {
+		return UploadToken{}, false
+	}
+	token, ok := value.(UploadToken)
+	return token, ok
+}
+
+// Helper function to refuse, with 403, a file of another app than the upload
+// token the request was authenticated with may publish
+func allowUploadTokenApp(c *gin.Context, fileName string) bool {
+	app, _ := catalog.ParseFileName(fileName)
+	if token, ok := requestUploadToken(c); ok && token.App != app {
+		respondError(c, http.StatusForbidden, CodeForbidden, "the upload token may only publish its app", gin.H{"app": app, "token_app": token.App})
+		return false
+	}
+	return true
+}
+
+// Admin endpoint minting a delegated upload token, e.g. {"app": "plugin",
+// "ttl": "1h", "scope": "publish", "description": "plugin CI #1234"}
+func createUploadToken(c *gin.Context) {
+	if _, delegated := requestUploadToken(c); delegated {
+		respondError(c, http.StatusForbidden, CodeForbidden, "upload tokens cannot mint tokens")
+		return
+	}
+	var req struct {
+		App         string `json:"app"`
+		TTL         string `json:"ttl"`
+		Scope       string `json:"scope"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !aliasNamePattern.MatchString(req.App) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "a valid app is required")
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = "publish"
+	}
+	if !slices.Contains(uploadTokenScopes, req.Scope) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "unknown scope", gin.H{"scope": req.Scope, "scopes": uploadTokenScopes})
+		return
+	}
+	ttl, maxTTL := defaultUploadTokenTTL, uploadTokenMaxTTL()
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "ttl must be a positive duration such as 1h")
+			return
+		}
+		ttl = parsed
+	}
+	if ttl > maxTTL {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "ttl exceeds the maximum", gin.H{"max_ttl": maxTTL.String()})
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not generate token")
+		return
+	}
+	secret := hex.EncodeToString(raw)
+	hash := hashToken(secret)
+	now := time.Now().UTC()
+	token := UploadToken{
+		ID:          hash[:12],
+		App:         req.App,
+		Scope:       req.Scope,
+		Description: req.Description,
+		CreatedBy:   c.GetString("principal"),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	uploadTokens.Lock()
+	defer uploadTokens.Unlock()
+	tokens := liveUploadTokens()
+	tokens[hash] = token
+	if err := saveUploadTokens(tokens); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save upload token")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": secret, "upload_token": token})
+}
+
+// Admin endpoint listing the live upload tokens
+func listUploadTokens(c *gin.Context) {
+	uploadTokens.RLock()
+	tokens := liveUploadTokens()
+	uploadTokens.RUnlock()
+	list := make([]UploadToken, 0, len(tokens))
+	for _, token := range tokens {
+		list = append(list, token)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"tokens": list})
+}
+
+// Admin endpoint revoking an upload token by its ID
+func deleteUploadToken(c *gin.Context) {
+	id := c.Param("id")
+	uploadTokens.Lock()
+	defer uploadTokens.Unlock()
+	tokens := liveUploadTokens()
+	found := false
+	for hash, token := range tokens {
+		if token.ID == id {
+			delete(tokens, hash)
+			found = true
+		}
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, CodeNotFound, "upload token not found", gin.H{"id": id})
+		return
+	}
+	if err := saveUploadTokens(tokens); err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save upload tokens")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to save upload tokens for the duration of a test, by
+// secret
+func withUploadTokens(t *testing.T, tokens map[string]UploadToken) {
+	t.Helper()
+	byHash := make(map[string]UploadToken)
+	for secret, token := range tokens {
+		byHash[hashToken(secret)] = token
+	}
+	uploadTokens.Lock()
+	previous := uploadTokens.tokens
+	err := saveUploadTokens(byHash)
+	uploadTokens.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		uploadTokens.Lock()
+		uploadTokens.tokens = previous
+		uploadTokens.Unlock()
+	})
+}
+
+func TestUploadTokenFor(t *testing.T) {
+	withStateDirs(t, nil)
+	now := time.Now()
+	withUploadTokens(t, map[string]UploadToken{
+		"live-secret":    {ID: "live", App: "plugin", Scope: "publish", ExpiresAt: now.Add(time.Hour)},
+		"expired-secret": {ID: "expired", App: "plugin", Scope: "publish", ExpiresAt: now.Add(-time.Second)},
+	})
+	if err := initUploadTokens(); err != nil {
+		t.Fatalf("initUploadTokens: %v", err)
+	}
+	// Lookups are answered from memory
+	if err := os.Remove(uploadTokensFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		secret string
+		wantID string // "" when refused
+	}{
+		{"live-secret", "live"},
+		{"expired-secret", ""},
+		{"unknown-secret", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		token, ok := uploadTokenFor(tt.secret)
+		if ok != (tt.wantID != "") || token.ID != tt.wantID {
+			t.Errorf("uploadTokenFor(%q) = %q, %v, want %q", tt.secret, token.ID, ok, tt.wantID)
+		}
+	}
+}
+
+func TestUploadSessionsBelongToTheirToken(t *testing.T) {
+	withStateDirs(t, nil)
+	t.Setenv("OTA_ADMIN_TOKEN", "admin-token")
+	expires := time.Now().Add(time.Hour)
+	withUploadTokens(t, map[string]UploadToken{
+		"plugin-ci":  {ID: "plugin-ci", App: "plugin", Scope: "publish", ExpiresAt: expires},
+		"runtime-ci": {ID: "runtime-ci", App: "runtime", Scope: "publish", ExpiresAt: expires},
+	})
+
+	r := gin.New()
+	admin := r.Group("/admin", adminAuth())
+	admin.POST("/uploads", createUploadSession)
+	admin.HEAD("/uploads/:id", headUploadSession)
+	admin.GET("/uploads/:id", getUploadSession)
+	admin.PATCH("/uploads/:id", patchUploadSession)
+	admin.POST("/uploads/:id/complete", completeUploadSession)
+	admin.DELETE("/uploads/:id", deleteUploadSession)
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The token cannot smuggle another owner in the declaration
+	w := do(http.MethodPost, "/admin/uploads", "plugin-ci", `{"file_name": "plugin_2.0.0.wasm", "size": 4, "sha256": "`+strings.Repeat("ab", 32)+`", "token_id": "runtime-ci"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the upload: status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		ID string `json:"upload_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	url := "/admin/uploads/" + created.ID
+
+	tests := []struct {
+		name, method, url, token string
+		want                     int
+	}{
+		{"other token reads", http.MethodGet, url, "runtime-ci", http.StatusNotFound},
+		{"other token resumes", http.MethodHead, url, "runtime-ci", http.StatusNotFound},
+		{"other token appends", http.MethodPatch, url, "runtime-ci", http.StatusNotFound},
+		{"other token completes", http.MethodPost, url + "/complete", "runtime-ci", http.StatusNotFound},
+		{"other token abandons", http.MethodDelete, url, "runtime-ci", http.StatusNotFound},
+		{"owner reads", http.MethodGet, url, "plugin-ci", http.StatusOK},
+		{"admin reads", http.MethodGet, url, "admin-token", http.StatusOK},
+		{"owner abandons", http.MethodDelete, url, "plugin-ci", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if w := do(tt.method, tt.url, tt.token, "data"); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
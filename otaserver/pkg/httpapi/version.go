@@ -0,0 +1,99 @@
+package httpapi
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version, Commit and BuildDate identify the server build. Release builds set
+// them with -ldflags "-X ota-server/pkg/httpapi.Version=..."; otherwise the
+// commit and date come from the VCS information Go embeds in the binary.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// BuildInfo is the response of the version endpoint.
+type BuildInfo struct {
+	Version         string   `json:"version"`
+	Commit          string   `json:"commit,omitempty"`
+	BuildDate       string   `json:"build_date,omitempty"`
+	GoVersion       string   `json:"go_version"`
+	CatalogRevision uint64   `json:"catalog_revision"`
+	CatalogSnapshot string   `json:"catalog_snapshot,omitempty"`
+	Features        []string `json:"features"`
+}
+
+// Helper function to describe the running build
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if embedded, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range embedded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	offerCache.RLock()
+	info.CatalogRevision = offerCache.revision
+	offerCache.RUnlock()
+	if ids, err := snapshotIDs(); err == nil && len(ids) > 0 {
+		info.CatalogSnapshot = ids[len(ids)-1]
+	}
+	info.Features = enabledFeatures()
+	return info
+}
+
+// Helper function to list the optional features enabled in this server's
+// configuration, sorted by name
+func enabledFeatures() []string {
+	features := []string{}
+	enabled := func(name string, on bool) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	enabled("anonymous", anonymousMode())
+	enabled("device_hmac", requireSignedRequests())
+	enabled("enrollment", os.Getenv("OTA_CA_CERT_FILE") != "" && os.Getenv("OTA_CA_KEY_FILE") != "")
+	enabled("tls", os.Getenv("OTA_TLS_CERT_FILE") != "" && os.Getenv("OTA_TLS_KEY_FILE") != "")
+	enabled("signing", currentSigningKey() != nil || os.Getenv("OTA_APP_SIGNING_KEYS") != "")
+	enabled("policy", policyFile() != "")
+	enabled("changelog", changelogRepo() != "")
+	enabled("provenance", len(trustedProvenanceKeys()) > 0)
+	enabled("scan", os.Getenv("OTA_SCAN_COMMAND") != "" || os.Getenv("OTA_CLAMAV_ADDR") != "")
+	enabled("mirrors", len(mirrorBackends()) > 0)
+	enabled("release_sync", releaseSyncConfig() != nil)
+	enabled("cve_feed", cveFeedURL() != "")
+	enabled("read_only", ReadOnly())
+	enabled("upstream_verify", upstreamURL() != "")
+	enabled("mdns", mdnsEnabled())
+	enabled("catalog_index", artifacts.Indexed())
+
+	regionState.RLock()
+	enabled("regions", len(regionState.regions) > 0)
+	regionState.RUnlock()
+
+	if notifiers, err := configuredNotifiers(); err == nil {
+		for _, n := range notifiers {
+			features = append(features, "notify:"+n.name())
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Endpoint reporting which server build is running and how it is configured
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, buildInfo())
+}
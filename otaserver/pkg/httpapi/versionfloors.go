@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+	"ota-server/pkg/storage"
+)
+
+// Anti-rollback version floors. Hardware whose bootloader burns a fuse or
+// bumps an anti-rollback counter with some releases cannot boot anything
+// older again, so operators set, per device model and app, the lowest version
+// the server may hand out: PUT /admin/version-floors/<model> with
+// {"app": "plugin", "version": "2.0.0", "note": "secure boot counter 3"}.
+// Floors only ever go up; lowering one is refused.
+//
+// Devices tell their model with ?model= on check-update (or operators set the
+// "model" attribute). Checks then never offer a version below the floor: a
+// desired version below it is ignored, and when nothing at or above it can be
+// offered the response says reason "version_floor". Bundle checks that would
+// install a component below it fail with 409. Downloads of a version below the
+// floor of the requesting device's model (or ?model=), whether through
+// /download, /blobs, /static, /bootstrap or a patch leading to it, are refused
+// with 403 unless they carry ?override_floor=true and admin credentials the policy
+// allows the "override_floor" action, e.g. to recover a board on the bench.
+
+// VersionFloor is the lowest version of an app the server hands out to
+// devices of a model.
+type VersionFloor struct {
+	Model     string    `json:"model"`
+	App       string    `json:"app"`
+	Version   string    `json:"version"`
+	Note      string    `json:"note,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// floorNamePattern matches the models and apps floors are set for.
+var floorNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// versionFloors holds the floors by model and app.
+var versionFloors = struct {
+	sync.RWMutex
+	floors map[string]map[string]VersionFloor
+}{floors: make(map[string]map[string]VersionFloor)}
+
+// Helper function to load the version floors saved by the admin API
+func initVersionFloors() error {
+	floors := make(map[string]map[string]VersionFloor)
+	if err := storage.ReadJSON(versionFloorsFile, &floors); err != nil {
+		return err
+	}
+	versionFloors.Lock()
+	versionFloors.floors = floors
+	versionFloors.Unlock()
+	return nil
+}
+
+// Helper function to get the model of a device: the one it reported, then
+// the "model" attribute operators set
+func deviceModel(device *Device) string {
+	if device == nil {
+		return ""
+	}
+	return firstNonEmpty(device.Model, device.Attributes["model"])
+}
+
+// Helper function to get the floor of an app on a model, if any
+func versionFloor(model, app string) (VersionFloor, bool) {
+	if model == "" {
+		return VersionFloor{}, false
+	}
+	if app == "" {
+		app = "plugin"
+	}
+	versionFloors.RLock()
+	defer versionFloors.RUnlock()
+	floor, ok := versionFloors.floors[model][app]
+	return floor, ok
+}
+
+// Helper function to tell whether a version of an app is below the floor of a
+// model, returning the floor when it is
+func belowVersionFloor(model, app, version string) (VersionFloor, bool) {
+	floor, ok := versionFloor(model, app)
+	if !ok || version == "" {
+		return floor, false
+	}
+	return floor, catalog.CompareVersions(version, floor.Version) < 0
+}
+
+// Helper function to replace an offer below the floor of the device's model
+// with no offer
+func enforceVersionFloor(device *Device, app, currentVersion string, info manifest.VersionInfo) manifest.VersionInfo {
+	floor, below := belowVersionFloor(deviceModel(device), app, info.LatestVersion)
+	if !below {
+		return info
+	}
+	log.Printf("not offering %s %s to %s: below the version floor %s of model %s", app, info.LatestVersion, device.ID, floor.Version, floor.Model)
+	return manifest.VersionInfo{LatestVersion: currentVersion, Reason: manifest.ReasonVersionFloor, NextCheckAfter: nextCheckAfter(device)}
+}
+
+// Helper function to refuse downloads of a version below the floor of the
+// requesting device's model, responding 403 unless an admin overrides it
+func allowDownloadAboveFloor(c *gin.Context, app, version string) bool {
+	// With device auth, anonymous requests cannot pick a model without a floor
+	model := ""
+	if !deviceAuthEnabled() || authenticatedDeviceID(c) != "" {
+		model = c.Query("model")
+	}
+	if model == "" {
+		if id := downloadDeviceID(c); deviceIDPattern.MatchString(id) {
+			if device, err := loadDevice(id); err == nil {
+				model = deviceModel(&device)
+			}
+		}
+	}
+	floor, below := belowVersionFloor(model, app, version)
+	if !below {
+		return true
+	}
+	details := gin.H{"model": floor.Model, "app": floor.App, "version": version, "floor": floor.Version}
+	if c.Query("override_floor") != "true" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "version is below the anti-rollback floor of the device model", details)
+		return false
+	}
+	if !adminCredentials(c) {
+		respondError(c, http.StatusForbidden, CodeForbidden, "overriding the version floor needs admin credentials", details)
+		return false
+	}
+	if !authorize(c, "override_floor", map[string]string{"app": app}) {
+		return false
+	}
+	log.Printf("%s overrode the version floor %s of model %s to download %s %s", c.GetString("principal"), floor.Version, floor.Model, app, version)
+	return true
+}
+
+// Admin endpoint listing the version floors, by model then app
+func listVersionFloors(c *gin.Context) {
+	versionFloors.RLock()
+	floors := make([]VersionFloor, 0)
+	for _, apps := range versionFloors.floors {
+		for _, floor := range apps {
+			floors = append(floors, floor)
+		}
+	}
+	versionFloors.RUnlock()
+	sort.Slice(floors, func(i, j int) bool {
+		if floors[i].Model != floors[j].Model {
+			return floors[i].Model < floors[j].Model
+		}
+		return floors[i].App < floors[j].App
+	})
+	c.JSON(http.StatusOK, gin.H{"floors": floors})
+}
+
+// Admin endpoint raising the version floor of an app on a device model, e.g.
+// {"app": "plugin", "version": "2.0.0", "note": "..."}. Floors never go down:
+// a lower version is refused with 409, the same one only updates the note.
+func updateVersionFloor(c *gin.Context) {
+	model := c.Param("model")
+	var req struct {
+		App     string `json:"app"`
+		Version string `json:"version"`
+		Note    string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid version floor")
+		return
+	}
+	if !floorNamePattern.MatchString(model) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid model", gin.H{"model": model})
+		return
+	}
+	app := firstNonEmpty(req.App, "plugin")
+	if !floorNamePattern.MatchString(app) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid app", gin.H{"app": app})
+		return
+	}
+	version, ok := requireVersion(c, "version", req.Version)
+	if !ok {
+		return
+	}
+
+	versionFloors.Lock()
+	current, exists := versionFloors.floors[model][app]
+	if exists && catalog.CompareVersions(version, current.Version) < 0 {
+		versionFloors.Unlock()
+		respondError(c, http.StatusConflict, CodeConflict, "version floors can only be raised", gin.H{"model": model, "app": app, "floor": current.Version, "version": version})
+		return
+	}
+	floor := VersionFloor{Model: model, App: app, Version: version, Note: req.Note, UpdatedAt: time.Now().UTC(), UpdatedBy: c.GetString("principal")}
+	if exists && catalog.CompareVersions(version, current.Version) == 0 {
+		floor.UpdatedAt, floor.UpdatedBy = current.UpdatedAt, current.UpdatedBy
+	}
+	if versionFloors.floors[model] == nil {
+		versionFloors.floors[model] = make(map[string]VersionFloor)
+	}
+	versionFloors.floors[model][app] = floor
+	if err := storage.WriteJSON(versionFloorsFile, versionFloors.floors); err != nil {
+		if exists {
+			versionFloors.floors[model][app] = current
+		} else {
+			delete(versionFloors.floors[model], app)
+		}
+		versionFloors.Unlock()
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Could not save version floors")
+		return
+	}
+	versionFloors.Unlock()
+
+	// Devices already running something older are worth a look: they can
+	// only be updated, not rolled back
+	below := 0
+	if devices, err := listDevices(); err == nil {
+		for i := range devices {
+			if v := appVersion(&devices[i], app); deviceModel(&devices[i]) == model && v != "" && catalog.CompareVersions(v, version) < 0 {
+				below++
+			}
+		}
+	}
+	if _, ok := catalogIndex.Version(app, catalog.DefaultChannel, version); !ok {
+		log.Printf("version floor %s of %s on model %s is not a published release", version, app, model)
+	}
+	c.JSON(http.StatusOK, gin.H{"floor": floor, "devices_below": below})
+}
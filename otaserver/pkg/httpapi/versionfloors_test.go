@@ -0,0 +1,127 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// Helper function to point the server at empty directories for the duration
+// of a test, publishing the given artifacts by file name, with the default
+// policy
+func withStateDirs(t *testing.T, files map[string]string) {
+	t.Helper()
+	filesDir, state := t.TempDir(), t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(filesDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setDirs(Config{FilesDir: filesDir, StateDir: state})
+	if err := refreshCatalog(); err != nil {
+		t.Fatalf("refreshCatalog: %v", err)
+	}
+	if err := initPolicy(); err != nil {
+		t.Fatalf("initPolicy: %v", err)
+	}
+	t.Cleanup(func() {
+		setDirs(Config{})
+		policyState.Lock()
+		policyState.policy = Policy{}
+		policyState.Unlock()
+		catalogIndex.Set(nil)
+		invalidateCatalog()
+	})
+}
+
+func TestDownloadsRespectVersionFloors(t *testing.T) {
+	withStateDirs(t, map[string]string{
+		"plugin_1.0.0.wasm": "plugin 1.0.0 content",
+		"plugin_2.0.0.wasm": "plugin 2.0.0 content",
+	})
+	old, _ := catalogIndex.Version("plugin", catalog.DefaultChannel, "1.0.0")
+	current, _ := catalogIndex.Version("plugin", catalog.DefaultChannel, "2.0.0")
+	for _, p := range [][2]catalog.Release{{old, current}, {current, old}} {
+		if err := os.MkdirAll(patchesPath, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(patchesPath, patchFileName(p[0].ID, p[1].ID)), []byte("patch"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versionFloors.Lock()
+	previousFloors := versionFloors.floors
+	versionFloors.floors = map[string]map[string]VersionFloor{"m1": {"plugin": {Model: "m1", App: "plugin", Version: "2.0.0"}}}
+	versionFloors.Unlock()
+	aliasState.Lock()
+	previousAliases := aliasState.aliases
+	aliasState.aliases = map[string]map[string]Alias{"plugin": {"old": {Version: "1.0.0"}, "new": {Version: "2.0.0"}}}
+	aliasState.Unlock()
+	t.Cleanup(func() {
+		versionFloors.Lock()
+		versionFloors.floors = previousFloors
+		versionFloors.Unlock()
+		aliasState.Lock()
+		aliasState.aliases = previousAliases
+		aliasState.Unlock()
+	})
+	t.Setenv("OTA_ADMIN_TOKEN", "admin-token")
+
+	r := gin.New()
+	r.GET("/download", downloadNewVersion)
+	r.GET("/blobs/:sha256", downloadBlob)
+	r.GET("/static/:app/:file", getStaticFile)
+	r.GET("/bootstrap", getBootstrap)
+	r.GET("/patches/:name", downloadPatch)
+	get := func(url, query, token string) int {
+		if strings.Contains(url, "?") {
+			url += "&" + query
+		} else {
+			url += "?" + query
+		}
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name      string
+		below, at string // URLs of a release below the floor and of one at it
+	}{
+		{"download", "/download?release_id=" + old.ID, "/download?release_id=" + current.ID},
+		{"blob", "/blobs/" + old.ID, "/blobs/" + current.ID},
+		{"static", "/static/plugin/plugin_1.0.0.wasm", "/static/plugin/plugin_2.0.0.wasm"},
+		{"bootstrap", "/bootstrap?app=plugin&channel=old", "/bootstrap?app=plugin&channel=new"},
+		{"patch", "/patches/" + patchFileName(current.ID, old.ID), "/patches/" + patchFileName(old.ID, current.ID)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := []struct {
+				name, url, query, token string
+				want                    int
+			}{
+				{"below the floor", tt.below, "model=m1", "", http.StatusForbidden},
+				{"override without admin credentials", tt.below, "model=m1&override_floor=true", "", http.StatusForbidden},
+				{"override with admin credentials", tt.below, "model=m1&override_floor=true", "admin-token", http.StatusOK},
+				{"model without a floor", tt.below, "model=m2", "", http.StatusOK},
+				{"at the floor", tt.at, "model=m1", "", http.StatusOK},
+			}
+			for _, step := range steps {
+				if code := get(step.url, step.query, step.token); code != step.want {
+					t.Errorf("%s: status %d, want %d", step.name, code, step.want)
+				}
+			}
+		})
+	}
+}
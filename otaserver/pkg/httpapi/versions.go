@@ -0,0 +1,155 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"ota-server/pkg/catalog"
+)
+
+// GET /versions?app=plugin&channel=stable lists the versions of a channel and
+// the one a device would be offered. With as_of=<RFC 3339 time or date> the
+// answer comes from the catalog snapshot in force at that time (see
+// snapshots.go), e.g. to find out what devices were offered last Tuesday when
+// investigating a field incident after the catalog changed. current_version
+// tells whether a device running it would have been offered an update. Only
+// the catalog is replayed: desired versions, rollout plans and install
+// windows are applied to live checks but not here, and history goes back as
+// far as the oldest snapshot kept.
+
+// CatalogVersion is one version of a channel.
+type CatalogVersion struct {
+	Version        string     `json:"version"`
+	ReleaseID      string     `json:"release_id"`
+	Size           int64      `json:"size"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	Mandatory      bool       `json:"mandatory,omitempty"`
+	MinimumVersion string     `json:"minimum_version,omitempty"`
+}
+
+// CatalogVersions is the response of GET /versions.
+type CatalogVersions struct {
+	App      string           `json:"app"`
+	Channel  string           `json:"channel"`
+	AsOf     *time.Time       `json:"as_of,omitempty"`
+	Snapshot gin.H            `json:"snapshot,omitempty"`
+	Versions []CatalogVersion `json:"versions"`
+	Latest   string           `json:"latest,omitempty"`
+
+	// Offered is the version offered to a device on current_version, empty
+	// when it was up to date
+	Offered string `json:"offered,omitempty"`
+}
+
+var errBeforeHistory = errors.New("as_of is older than the catalog history")
+
+// Helper function to parse an as_of time, an RFC 3339 timestamp or a date
+// meaning the end of that day in UTC
+func parseAsOf(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		return day.Add(24*time.Hour - time.Nanosecond), true
+	}
+	return time.Time{}, false
+}
+
+// Helper function to find the snapshot of the catalog in force at a time,
+// the newest one taken at or before it
+func snapshotAsOf(t time.Time) (CatalogSnapshot, error) {
+	ids, err := snapshotIDs()
+	if err != nil {
+		return CatalogSnapshot{}, err
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		taken, err := time.Parse("20060102T150405.000000000Z", ids[i])
+		if err != nil || taken.After(t) {
+			continue
+		}
+		return loadSnapshot(ids[i])
+	}
+	return CatalogSnapshot{}, errBeforeHistory
+}
+
+// Endpoint listing the versions of a channel, now or as of a past time
+func listVersions(c *gin.Context) {
+	app := c.DefaultQuery("app", "plugin")
+	channel := c.DefaultQuery("channel", catalog.DefaultChannel)
+	if !catalog.ValidChannel(channel) {
+		respondError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid channel")
+		return
+	}
+	currentVersion := c.Query("current_version")
+	if currentVersion != "" {
+		var ok bool
+		if currentVersion, ok = requireVersion(c, "current_version", currentVersion); !ok {
+			return
+		}
+	}
+	response := CatalogVersions{App: app, Channel: channel, Versions: []CatalogVersion{}}
+
+	// The catalog of the time is indexed the way the live one is, so that
+	// the same rules pick the latest release
+	index := &catalogIndex
+	meta := func(version string) (ReleaseMeta, error) { return loadReleaseMeta(app, version) }
+	if value := c.Query("as_of"); value != "" {
+		asOf, ok := parseAsOf(value)
+		if !ok {
+			respondError(c, http.StatusBadRequest, CodeInvalidRequest, "as_of must be an RFC 3339 timestamp or a date", gin.H{"as_of": value})
+			return
+		}
+		snapshot, err := snapshotAsOf(asOf)
+		if errors.Is(err, errBeforeHistory) {
+			details := gin.H{"as_of": asOf}
+			if ids, err := snapshotIDs(); err == nil && len(ids) > 0 {
+				details["oldest_snapshot"] = ids[0]
+			}
+			respondError(c, http.StatusNotFound, CodeNotFound, err.Error(), details)
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load catalog history")
+			return
+		}
+		index = &catalog.Index{}
+		index.Set(snapshot.Releases)
+		metas := make(map[string]ReleaseMeta)
+		for _, m := range snapshot.Meta {
+			if m.App == app {
+				metas[m.Version] = m
+			}
+		}
+		meta = func(version string) (ReleaseMeta, error) { return metas[version], nil }
+		response.AsOf = &asOf
+		response.Snapshot = gin.H{"id": snapshot.ID, "created_at": snapshot.CreatedAt, "reason": snapshot.Reason}
+	}
+
+	for _, release := range index.Releases(app, channel) {
+		m, err := meta(release.Version)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Could not load release metadata")
+			return
+		}
+		version := CatalogVersion{
+			Version:        release.Version,
+			ReleaseID:      release.ID,
+			Size:           release.Size,
+			Mandatory:      m.Mandatory,
+			MinimumVersion: m.MinimumVersion,
+		}
+		if !m.CreatedAt.IsZero() {
+			version.CreatedAt = &m.CreatedAt
+		}
+		response.Versions = append(response.Versions, version)
+	}
+	if latest, ok := index.Latest(app, channel); ok {
+		response.Latest = latest.Version
+		if currentVersion == "" || catalog.CompareVersions(latest.Version, currentVersion) > 0 {
+			response.Offered = latest.Version
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
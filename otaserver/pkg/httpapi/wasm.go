@@ -0,0 +1,261 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var wasmMagic = []byte{0x00, 0x61, 0x73, 0x6d}
+
+var wasmSectionNames = map[byte]string{
+	1:  "type",
+	2:  "import",
+	3:  "function",
+	4:  "table",
+	5:  "memory",
+	6:  "global",
+	7:  "export",
+	8:  "start",
+	9:  "element",
+	10: "code",
+	11: "data",
+	12: "datacount",
+}
+
+// wasmComponentSectionNames names the sections of the component model binary
+// format, which our plugins are built with.
+var wasmComponentSectionNames = map[byte]string{
+	1:  "core-module",
+	2:  "core-instance",
+	3:  "core-type",
+	4:  "component",
+	5:  "instance",
+	6:  "alias",
+	7:  "type",
+	8:  "canon",
+	9:  "start",
+	10: "import",
+	11: "export",
+}
+
+// WasmSection is one top-level section of a WebAssembly module.
+type WasmSection struct {
+	Name   string
+	Size   int
+	Digest [32]byte
+}
+
+// WasmModule is the subset of a WebAssembly module needed for diffing.
+type WasmModule struct {
+	Sections []WasmSection
+	Symbols  map[string]bool // exported names and named functions
+}
+
+// isWasm reports whether data starts with the WebAssembly magic number.
+func isWasm(data []byte) bool {
+	return len(data) >= 8 && bytes.Equal(data[:4], wasmMagic)
+}
+
+// isWasmComponent reports whether a wasm binary uses the component layer.
+func isWasmComponent(data []byte) bool {
+	return isWasm(data) && data[6] == 0x01 && data[7] == 0x00
+}
+
+// parseWasm splits a WebAssembly binary into its sections and collects the
+// exported and (when a name section is present) function symbol names.
+// Core modules embedded in a component are parsed as well, with their
+// sections prefixed by their position in the component.
+func parseWasm(data []byte) (*WasmModule, error) {
+	module := &WasmModule{Symbols: make(map[string]bool)}
+	if err := parseWasmInto(module, data, ""); err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+func parseWasmInto(module *WasmModule, data []byte, prefix string) error {
+	if !isWasm(data) {
+		return errors.New("not a wasm module")
+	}
+
+	sectionNames := wasmSectionNames
+	component := isWasmComponent(data)
+	if component {
+		sectionNames = wasmComponentSectionNames
+	}
+
+	occurrences := make(map[string]int)
+	r := &wasmReader{data: data, pos: 8}
+	for r.pos < len(r.data) {
+		id, err := r.byte()
+		if err != nil {
+			return err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return err
+		}
+		content, err := r.bytes(int(size))
+		if err != nil {
+			return err
+		}
+
+		name, ok := sectionNames[id]
+		switch {
+		case id == 0:
+			cr := &wasmReader{data: content}
+			customName, err := cr.name()
+			if err != nil {
+				return err
+			}
+			name = "custom:" + customName
+			if customName == "name" && !component {
+				collectFunctionNames(cr.data[cr.pos:], module.Symbols)
+			}
+		case !component && id == 7:
+			if err := collectExports(content, module.Symbols); err != nil {
+				return err
+			}
+		case !ok:
+			name = fmt.Sprintf("unknown:%d", id)
+		}
+
+		// Components repeat section kinds, so later occurrences are numbered
+		if n := occurrences[name]; n > 0 {
+			occurrences[name]++
+			name = fmt.Sprintf("%s[%d]", name, n)
+		} else {
+			occurrences[name] = 1
+		}
+
+		if component && id == 1 {
+			if err := parseWasmInto(module, content, prefix+name+"/"); err != nil {
+				return err
+			}
+		}
+
+		module.Sections = append(module.Sections, WasmSection{
+			Name:   prefix + name,
+			Size:   len(content),
+			Digest: sha256.Sum256(content),
+		})
+	}
+
+	return nil
+}
+
+// collectExports adds every export name from an export section.
+func collectExports(content []byte, symbols map[string]bool) error {
+	r := &wasmReader{data: content}
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		name, err := r.name()
+		if err != nil {
+			return err
+		}
+		if _, err := r.byte(); err != nil { // export kind
+			return err
+		}
+		if _, err := r.u32(); err != nil { // export index
+			return err
+		}
+		symbols["export:"+name] = true
+	}
+	return nil
+}
+
+// collectFunctionNames adds function names from the name custom section.
+// Malformed name sections are ignored since they are only debug information.
+func collectFunctionNames(content []byte, symbols map[string]bool) {
+	r := &wasmReader{data: content}
+	for r.pos < len(r.data) {
+		id, err := r.byte()
+		if err != nil {
+			return
+		}
+		size, err := r.u32()
+		if err != nil {
+			return
+		}
+		sub, err := r.bytes(int(size))
+		if err != nil {
+			return
+		}
+		if id != 1 { // function names subsection
+			continue
+		}
+		sr := &wasmReader{data: sub}
+		count, err := sr.u32()
+		if err != nil {
+			return
+		}
+		for i := uint32(0); i < count; i++ {
+			if _, err := sr.u32(); err != nil {
+				return
+			}
+			name, err := sr.name()
+			if err != nil {
+				return
+			}
+			symbols["func:"+name] = true
+		}
+	}
+}
+
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+var errWasmTruncated = errors.New("truncated wasm module")
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errWasmTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errWasmTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// u32 decodes an unsigned LEB128 value.
+func (r *wasmReader) u32() (uint32, error) {
+	var result uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		result |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, nil
+		}
+	}
+	return 0, errors.New("invalid LEB128 value")
+}
+
+func (r *wasmReader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(int(n))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"ota-server/pkg/catalog"
+)
+
+// A catalog index lists the releases of an OTA files directory with their
+// digests, generated once (e.g. by otactl catalog-index) when the files are
+// burned to read-only media, so that the server can serve them without
+// scanning or hashing. It uses the envelope of offline release bundles: the
+// signatures cover the exact payload bytes.
+
+// CatalogIndexFormat identifies the envelope format.
+const CatalogIndexFormat = "ota-catalog-index-v1"
+
+// CatalogIndexFile is the name of the index in the files directory.
+const CatalogIndexFile = "catalog.json"
+
+// CatalogIndex is the payload of a catalog index.
+type CatalogIndex struct {
+	Releases    []catalog.Release `json:"releases"`
+	GeneratedAt time.Time         `json:"generated_at"`
+}
+
+// SignedCatalogIndex is the envelope of a catalog index. Payload is the
+// base64 encoded JSON of a CatalogIndex.
+type SignedCatalogIndex struct {
+	Format     string      `json:"format"`
+	Payload    string      `json:"payload"`
+	Signatures []Signature `json:"signatures"`
+}
+
+// CatalogIndexSigningPayload is the byte string an index signature covers.
+func CatalogIndexSigningPayload(payload []byte) []byte {
+	return append([]byte(CatalogIndexFormat+"\n"), payload...)
+}
+
+// SealCatalogIndex signs a catalog index with an Ed25519 key.
+func SealCatalogIndex(index CatalogIndex, private ed25519.PrivateKey) (SignedCatalogIndex, error) {
+	payload, err := json.Marshal(index)
+	if err != nil {
+		return SignedCatalogIndex{}, err
+	}
+	public := private.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(private, CatalogIndexSigningPayload(payload))
+	return SignedCatalogIndex{
+		Format:     CatalogIndexFormat,
+		Payload:    base64.StdEncoding.EncodeToString(payload),
+		Signatures: []Signature{{KeyID: KeyID(public), Value: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// OpenCatalogIndex checks that a catalog index is signed by one of the
+// trusted keys and returns its payload.
+func OpenCatalogIndex(signed SignedCatalogIndex, trusted []ed25519.PublicKey) (CatalogIndex, error) {
+	var index CatalogIndex
+	if signed.Format != CatalogIndexFormat {
+		return index, fmt.Errorf("unsupported catalog index format %q", signed.Format)
+	}
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return index, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	verified := false
+	for _, sig := range signed.Signatures {
+		for _, pub := range trusted {
+			if sig.KeyID != KeyID(pub) {
+				continue
+			}
+			raw, err := base64.StdEncoding.DecodeString(sig.Value)
+			if err != nil {
+				return index, fmt.Errorf("malformed signature: %w", err)
+			}
+			if !ed25519.Verify(pub, CatalogIndexSigningPayload(payload), raw) {
+				return index, errors.New("catalog index signature does not match payload")
+			}
+			verified = true
+		}
+	}
+	if !verified {
+		return index, errors.New("catalog index is not signed with a trusted key")
+	}
+
+	if err := json.Unmarshal(payload, &index); err != nil {
+		return index, fmt.Errorf("malformed payload: %w", err)
+	}
+	return index, nil
+}
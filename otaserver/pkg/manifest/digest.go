@@ -0,0 +1,58 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Digest algorithms artifacts can be described with. The release ID is
+// always the SHA-256 digest; the others are computed for apps whose devices
+// verify images with them, e.g. secure elements that only accelerate
+// SHA-512.
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA512 = "sha512"
+	DigestBLAKE3 = "blake3"
+)
+
+// DigestAlgorithms lists the supported digest algorithms.
+var DigestAlgorithms = []string{DigestSHA256, DigestSHA512, DigestBLAKE3}
+
+// NewDigest returns a hash computing the named digest algorithm.
+func NewDigest(algorithm string) (hash.Hash, bool) {
+	switch algorithm {
+	case DigestSHA256:
+		return sha256.New(), true
+	case DigestSHA512:
+		return sha512.New(), true
+	case DigestBLAKE3:
+		return blake3.New(32, nil), true
+	}
+	return nil, false
+}
+
+// ParseDigestAlgorithm turns an algorithm name as devices and HTTP headers
+// write it ("sha-512", "SHA512", "blake3") into a supported algorithm.
+func ParseDigestAlgorithm(name string) (string, bool) {
+	algorithm := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "")
+	if _, ok := NewDigest(algorithm); !ok {
+		return "", false
+	}
+	return algorithm, true
+}
+
+// HTTPDigestName is the name of an algorithm in Repr-Digest and
+// Want-Repr-Digest headers (RFC 9530).
+func HTTPDigestName(algorithm string) string {
+	switch algorithm {
+	case DigestSHA256:
+		return "sha-256"
+	case DigestSHA512:
+		return "sha-512"
+	}
+	return algorithm
+}
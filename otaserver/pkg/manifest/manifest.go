@@ -0,0 +1,136 @@
+// Package manifest defines what the OTA server tells devices about releases:
+// check-update responses, bundle manifests and change summaries, and the
+// signatures that let a device verify a release came from its publisher,
+// also packaged as signed offline release bundles.
+package manifest
+
+// Reasons a device is not offered an update
+const (
+	ReasonUpToDate      = "up_to_date"     // it runs the newest release of its channel
+	ReasonPinned        = "pinned"         // operators pinned it to the version it runs
+	ReasonHeld          = "held"           // a rollout plan holds newer releases back, see HeldBy
+	ReasonInstallWindow = "install_window" // the release's install window opens at AvailableAt
+	ReasonDeferred      = "deferred"       // its user deferred the update until DeferredUntil
+	ReasonStuck         = "stuck"          // it kept downloading without installing and awaits an operator
+	ReasonVersionFloor  = "version_floor"  // what it could be offered is below the anti-rollback floor of its model
+)
+
+// VersionInfo is the response to an update check. DownloadURL is empty when
+// no download is offered.
+type VersionInfo struct {
+	LatestVersion string      `json:"latest_version"`
+	DownloadURL   string      `json:"download_url,omitempty"`
+	CheckSum      string      `json:"checksum,omitempty"`
+	ReleaseID     string      `json:"release_id,omitempty"`
+	Size          int64       `json:"size,omitempty"`
+	ReleaseNotes  string      `json:"release_notes,omitempty"`
+	Signature     *Signature  `json:"signature,omitempty"`
+	Provenance    *Provenance `json:"provenance,omitempty"`
+	Patch         *PatchInfo  `json:"patch,omitempty"`
+	AvailableAt   string      `json:"available_at,omitempty"`
+
+	// Mandatory offers can no longer be deferred; DeferredUntil is set
+	// instead of a download while the device's user has deferred the update
+	Mandatory     bool   `json:"mandatory,omitempty"`
+	DeferredUntil string `json:"deferred_until,omitempty"`
+
+	// SecurityFixes lists the vulnerabilities the offered release fixes
+	SecurityFixes []string `json:"security_fixes,omitempty"`
+
+	// Fields are the release's device-specific values, rendered for the
+	// checking device
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// HeldBy explains why a newer release is held back by a rollout plan
+	HeldBy string `json:"held_by,omitempty"`
+
+	// Reason says why the device is not offered anything newer than it
+	// runs, one of the Reason constants; empty when it is
+	Reason string `json:"reason,omitempty"`
+
+	// SizeBytes, SHA256 and CreatedAt describe the offered artifact, even when
+	// its download is held back, so the device can reserve flash and verify
+	// the image before applying it
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+
+	// Digest is the artifact's digest in DigestAlgorithm, the app's or the
+	// one the device asked for, and Digests has it in every algorithm
+	// configured for the app, by algorithm name (see DigestAlgorithms)
+	DigestAlgorithm string            `json:"digest_algorithm,omitempty"`
+	Digest          string            `json:"digest,omitempty"`
+	Digests         map[string]string `json:"digests,omitempty"`
+
+	// NextCheckAfter is the number of seconds the device should wait before
+	// checking again
+	NextCheckAfter int `json:"next_check_after,omitempty"`
+
+	// Timestamp is the signed statement of the newest release of the
+	// channel, when the server signs releases
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+// PatchInfo describes a ready patch in a check-update response.
+type PatchInfo struct {
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	From   string `json:"from"`
+}
+
+// ComponentUpdate is one entry of a bundle manifest.
+type ComponentUpdate struct {
+	Name           string     `json:"name"`
+	CurrentVersion string     `json:"current_version,omitempty"`
+	Version        string     `json:"version"`
+	ReleaseID      string     `json:"release_id"`
+	Size           int64      `json:"size"`
+	DownloadURL    string     `json:"download_url"`
+	Signature      *Signature `json:"signature,omitempty"`
+	Patch          *PatchInfo `json:"patch,omitempty"`
+
+	// Digests of the component in the algorithms configured for it
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// BundleManifest is the response to a bundle check. Manifest lists every
+// component of the bundle so the device can verify the complete image, and
+// Updates only those that differ from what the device runs. TotalSize and
+// UpdatesSize let the device check for free space before downloading.
+type BundleManifest struct {
+	Bundle   string            `json:"bundle"`
+	Version  string            `json:"version"`
+	Notes    string            `json:"notes,omitempty"`
+	Manifest []ComponentUpdate `json:"manifest"`
+	Updates  []ComponentUpdate `json:"updates"`
+
+	TotalSize   int64 `json:"total_size"`   // all components as full images
+	UpdatesSize int64 `json:"updates_size"` // the updates as full images
+
+	NextCheckAfter int `json:"next_check_after"` // seconds
+
+	// Timestamp is the signed statement of the bundle's version, when the
+	// server signs releases
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+// ReleaseChange describes one release between two versions.
+type ReleaseChange struct {
+	Version        string `json:"version"`
+	Notes          string `json:"notes,omitempty"`
+	Mandatory      bool   `json:"mandatory,omitempty"`
+	MinimumVersion string `json:"minimum_version,omitempty"`
+}
+
+// ChangeSummary is what a device needs to catch up from one version to another.
+type ChangeSummary struct {
+	App         string          `json:"app"`
+	Channel     string          `json:"channel"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Releases    []ReleaseChange `json:"releases"`
+	Notes       string          `json:"notes"`
+	Mandatory   bool            `json:"mandatory"`
+	UpgradePath []string        `json:"upgrade_path"`
+}
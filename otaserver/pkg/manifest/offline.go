@@ -0,0 +1,163 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"ota-server/pkg/catalog"
+)
+
+// An offline release bundle carries everything an installer without network
+// access (e.g. a USB field update) needs to check an artifact: the release,
+// its metadata, whole-file and per-chunk hashes and the release signature,
+// all wrapped in an envelope signed with the release signing key. The
+// envelope signature covers the exact payload bytes, so verifiers in any
+// language can check it without canonicalizing JSON.
+
+// ReleaseBundleFormat identifies the envelope format.
+const ReleaseBundleFormat = "ota-release-bundle-v1"
+
+// BundleChunkSize is the size of the chunks hashed individually, so that an
+// installer can locate corruption in a partially copied file.
+const BundleChunkSize = 4 << 20
+
+// ArtifactHashes are the digests of an artifact.
+type ArtifactHashes struct {
+	SHA256    string   `json:"sha256"`
+	SHA512    string   `json:"sha512"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"` // SHA-256 of each chunk, in order
+}
+
+// ReleaseBundle is the payload of an offline release bundle.
+type ReleaseBundle struct {
+	Release        catalog.Release `json:"release"`
+	Hashes         ArtifactHashes  `json:"hashes"`
+	Notes          string          `json:"notes,omitempty"`
+	Mandatory      bool            `json:"mandatory,omitempty"`
+	MinimumVersion string          `json:"minimum_version,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Signature      *Signature      `json:"signature"` // the release signature, see SigningPayload
+	Provenance     *Provenance     `json:"provenance,omitempty"`
+	GeneratedAt    time.Time       `json:"generated_at"`
+}
+
+// SignedReleaseBundle is the envelope of an offline release bundle. Payload
+// is the base64 encoded JSON of a ReleaseBundle.
+type SignedReleaseBundle struct {
+	Format     string      `json:"format"`
+	Payload    string      `json:"payload"`
+	Signatures []Signature `json:"signatures"`
+}
+
+// BundleSigningPayload is the byte string an envelope signature covers.
+func BundleSigningPayload(payload []byte) []byte {
+	return append([]byte(ReleaseBundleFormat+"\n"), payload...)
+}
+
+// HashArtifact computes the digests of an artifact read from r.
+func HashArtifact(r io.Reader) (ArtifactHashes, error) {
+	hashes := ArtifactHashes{ChunkSize: BundleChunkSize, Chunks: []string{}}
+	whole256, whole512 := sha256.New(), sha512.New()
+	for {
+		chunk := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(whole256, whole512, chunk), r, BundleChunkSize)
+		if n > 0 {
+			hashes.Chunks = append(hashes.Chunks, hex.EncodeToString(chunk.Sum(nil)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hashes, err
+		}
+	}
+	hashes.SHA256 = hex.EncodeToString(whole256.Sum(nil))
+	hashes.SHA512 = hex.EncodeToString(whole512.Sum(nil))
+	return hashes, nil
+}
+
+// SealReleaseBundle signs a bundle with an Ed25519 key.
+func SealReleaseBundle(bundle ReleaseBundle, private ed25519.PrivateKey) (SignedReleaseBundle, error) {
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return SignedReleaseBundle{}, err
+	}
+	public := private.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(private, BundleSigningPayload(payload))
+	return SignedReleaseBundle{
+		Format:     ReleaseBundleFormat,
+		Payload:    base64.StdEncoding.EncodeToString(payload),
+		Signatures: []Signature{{KeyID: KeyID(public), Value: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// OpenReleaseBundle checks the envelope and release signatures of a bundle
+// against a public key and returns its payload.
+func OpenReleaseBundle(signed SignedReleaseBundle, pub ed25519.PublicKey) (ReleaseBundle, error) {
+	var bundle ReleaseBundle
+	if signed.Format != ReleaseBundleFormat {
+		return bundle, fmt.Errorf("unsupported bundle format %q", signed.Format)
+	}
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return bundle, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	verified := false
+	for _, sig := range signed.Signatures {
+		if sig.KeyID != KeyID(pub) {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(sig.Value)
+		if err != nil {
+			return bundle, fmt.Errorf("malformed signature: %w", err)
+		}
+		if !ed25519.Verify(pub, BundleSigningPayload(payload), raw) {
+			return bundle, errors.New("bundle signature does not match payload")
+		}
+		verified = true
+	}
+	if !verified {
+		return bundle, fmt.Errorf("bundle is not signed with key %s", KeyID(pub))
+	}
+
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return bundle, fmt.Errorf("malformed payload: %w", err)
+	}
+	if err := Verify(bundle.Release, bundle.Signature, pub); err != nil {
+		return bundle, err
+	}
+	return bundle, nil
+}
+
+// VerifyArtifact checks an artifact read from r against the bundle's hashes,
+// naming the first corrupted chunk on a mismatch.
+func (b ReleaseBundle) VerifyArtifact(r io.Reader) error {
+	hashes, err := HashArtifact(r)
+	if err != nil {
+		return err
+	}
+	if hashes.SHA256 == b.Hashes.SHA256 && hashes.SHA512 == b.Hashes.SHA512 && hashes.SHA256 == b.Release.ID {
+		return nil
+	}
+	if b.Hashes.ChunkSize == hashes.ChunkSize {
+		for i, chunk := range hashes.Chunks {
+			if i >= len(b.Hashes.Chunks) || chunk != b.Hashes.Chunks[i] {
+				return fmt.Errorf("artifact differs from the release from byte %d", int64(i)*hashes.ChunkSize)
+			}
+		}
+		if len(hashes.Chunks) < len(b.Hashes.Chunks) {
+			return fmt.Errorf("artifact is truncated: %d of %d chunks", len(hashes.Chunks), len(b.Hashes.Chunks))
+		}
+	}
+	return errors.New("artifact does not match the release")
+}
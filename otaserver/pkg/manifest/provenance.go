@@ -0,0 +1,309 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Build provenance records who built a release and from what: the builder,
+// the source repository and commit, and the build workflow. It is taken from
+// an in-toto attestation with a SLSA provenance predicate, as produced by
+// e.g. slsa-github-generator or `gh attestation`, either bare or wrapped in a
+// DSSE envelope. Only enveloped attestations can be verified, against the
+// Ed25519 or ECDSA public keys the verifier trusts.
+
+// Attestation formats understood by ParseAttestation
+const (
+	InTotoPayloadType  = "application/vnd.in-toto+json"
+	InTotoStatementV1  = "https://in-toto.io/Statement/v1"
+	InTotoStatementV01 = "https://in-toto.io/Statement/v0.1"
+	SLSAProvenanceV1   = "https://slsa.dev/provenance/v1"
+	SLSAProvenanceV02  = "https://slsa.dev/provenance/v0.2"
+)
+
+// Provenance describes how a release was built.
+type Provenance struct {
+	Builder       string `json:"builder"`
+	SourceRepo    string `json:"source_repo,omitempty"`
+	SourceCommit  string `json:"source_commit,omitempty"`
+	BuildWorkflow string `json:"build_workflow,omitempty"`
+
+	// PredicateType is the SLSA provenance version of the attestation the
+	// provenance was taken from; empty when the publisher stated it directly
+	PredicateType string `json:"predicate_type,omitempty"`
+
+	// Verified is set when the attestation was signed by a trusted key,
+	// identified by KeyID
+	Verified bool   `json:"verified"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+// Envelope is a DSSE envelope. Payload is base64 encoded.
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     string              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is one signature of a DSSE envelope. Sig is base64 encoded.
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// Statement is an in-toto statement.
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []Subject       `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// Subject is an artifact an in-toto statement is about.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// PAE is the DSSE pre-authentication encoding an envelope signature covers.
+func PAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// ParseAttestation reads an in-toto statement, bare or in a DSSE envelope.
+// Of a JSON lines bundle (.intoto.jsonl) the first attestation is read. The
+// envelope is nil for bare statements.
+func ParseAttestation(data []byte) (Statement, *Envelope, error) {
+	var statement Statement
+	data = firstJSONLine(data)
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return statement, nil, fmt.Errorf("attestation is not JSON: %w", err)
+	}
+	if envelope.PayloadType == "" {
+		if err := parseStatement(data, &statement); err != nil {
+			return statement, nil, err
+		}
+		return statement, nil, nil
+	}
+
+	if envelope.PayloadType != InTotoPayloadType {
+		return statement, nil, fmt.Errorf("unsupported payload type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return statement, nil, errors.New("envelope payload is not base64")
+	}
+	if err := parseStatement(payload, &statement); err != nil {
+		return statement, nil, err
+	}
+	return statement, &envelope, nil
+}
+
+// Helper function to pick the first non-empty line of a JSON lines bundle;
+// other documents are returned unchanged
+func firstJSONLine(data []byte) []byte {
+	trimmed := bytes.TrimSpace(data)
+	if json.Valid(trimmed) {
+		return trimmed
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(nil, len(trimmed)+1)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			return line
+		}
+	}
+	return trimmed
+}
+
+// Helper function to decode an in-toto statement and check its type
+func parseStatement(data []byte, statement *Statement) error {
+	if err := json.Unmarshal(data, statement); err != nil {
+		return fmt.Errorf("invalid in-toto statement: %w", err)
+	}
+	if statement.Type != InTotoStatementV1 && statement.Type != InTotoStatementV01 {
+		return fmt.Errorf("unsupported statement type %q", statement.Type)
+	}
+	if len(statement.Subject) == 0 {
+		return errors.New("statement has no subject")
+	}
+	return nil
+}
+
+// Covers reports whether the statement is about the artifact with the given
+// SHA-256 digest.
+func (s Statement) Covers(sha256Hex string) bool {
+	for _, subject := range s.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], sha256Hex) {
+			return true
+		}
+	}
+	return false
+}
+
+// slsaV1Predicate is the part of a SLSA v1 provenance predicate read here.
+type slsaV1Predicate struct {
+	BuildDefinition struct {
+		ExternalParameters struct {
+			Workflow struct {
+				Repository string `json:"repository"`
+				Path       string `json:"path"`
+				Ref        string `json:"ref"`
+			} `json:"workflow"`
+		} `json:"externalParameters"`
+		ResolvedDependencies []struct {
+			URI    string            `json:"uri"`
+			Digest map[string]string `json:"digest"`
+		} `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+}
+
+// slsaV02Predicate is the part of a SLSA v0.2 provenance predicate read here.
+type slsaV02Predicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	Invocation struct {
+		ConfigSource struct {
+			URI        string            `json:"uri"`
+			Digest     map[string]string `json:"digest"`
+			EntryPoint string            `json:"entryPoint"`
+		} `json:"configSource"`
+	} `json:"invocation"`
+}
+
+// Provenance extracts the build provenance from a SLSA provenance statement.
+// The result is not verified.
+func (s Statement) Provenance() (Provenance, error) {
+	prov := Provenance{PredicateType: s.PredicateType}
+	switch s.PredicateType {
+	case SLSAProvenanceV1:
+		var p slsaV1Predicate
+		if err := json.Unmarshal(s.Predicate, &p); err != nil {
+			return prov, fmt.Errorf("invalid SLSA provenance: %w", err)
+		}
+		workflow := p.BuildDefinition.ExternalParameters.Workflow
+		prov.Builder = p.RunDetails.Builder.ID
+		prov.SourceRepo = workflow.Repository
+		prov.BuildWorkflow = workflow.Path
+		if workflow.Path != "" && workflow.Ref != "" {
+			prov.BuildWorkflow += "@" + workflow.Ref
+		}
+		for _, dep := range p.BuildDefinition.ResolvedDependencies {
+			if commit := gitCommit(dep.Digest); commit != "" {
+				prov.SourceRepo = firstNonEmpty(prov.SourceRepo, stripGitRef(dep.URI))
+				prov.SourceCommit = commit
+				break
+			}
+		}
+	case SLSAProvenanceV02:
+		var p slsaV02Predicate
+		if err := json.Unmarshal(s.Predicate, &p); err != nil {
+			return prov, fmt.Errorf("invalid SLSA provenance: %w", err)
+		}
+		source := p.Invocation.ConfigSource
+		prov.Builder = p.Builder.ID
+		prov.SourceRepo = stripGitRef(source.URI)
+		prov.SourceCommit = gitCommit(source.Digest)
+		prov.BuildWorkflow = source.EntryPoint
+	default:
+		return prov, fmt.Errorf("unsupported predicate type %q", s.PredicateType)
+	}
+	if prov.Builder == "" {
+		return prov, errors.New("provenance names no builder")
+	}
+	return prov, nil
+}
+
+// Helper function to pick the commit from an in-toto digest set
+func gitCommit(digest map[string]string) string {
+	return firstNonEmpty(digest["gitCommit"], digest["sha1"])
+}
+
+// Helper function to strip the ref from a source URI such as
+// git+https://github.com/acme/plugin@refs/heads/main
+func stripGitRef(uri string) string {
+	uri = strings.TrimPrefix(uri, "git+")
+	if scheme := strings.Index(uri, "://"); scheme >= 0 {
+		if at := strings.LastIndex(uri, "@"); at > scheme {
+			uri = uri[:at]
+		}
+	}
+	return uri
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// PublicKeyID returns the short identifier of an Ed25519 or ECDSA public key:
+// for Ed25519 keys that of KeyID, for others derived from the PKIX encoding.
+func PublicKeyID(pub crypto.PublicKey) string {
+	if key, ok := pub.(ed25519.PublicKey); ok {
+		return KeyID(key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Verify checks that at least one signature of the envelope was made by one
+// of the trusted keys, returning the identifier of that key. Ed25519
+// signatures cover the PAE directly, ECDSA signatures (ASN.1) its SHA-256.
+func (e Envelope) Verify(trusted []crypto.PublicKey) (string, error) {
+	if len(e.Signatures) == 0 {
+		return "", errors.New("envelope is not signed")
+	}
+	payload, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return "", errors.New("envelope payload is not base64")
+	}
+	message := PAE(e.PayloadType, payload)
+	digest := sha256.Sum256(message)
+
+	for _, signature := range e.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			continue
+		}
+		for _, pub := range trusted {
+			var ok bool
+			switch key := pub.(type) {
+			case ed25519.PublicKey:
+				ok = ed25519.Verify(key, message, sig)
+			case *ecdsa.PublicKey:
+				ok = ecdsa.VerifyASN1(key, digest[:], sig)
+			}
+			if ok {
+				return PublicKeyID(pub), nil
+			}
+		}
+	}
+	return "", errors.New("no signature by a trusted key")
+}
@@ -0,0 +1,47 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"ota-server/pkg/catalog"
+)
+
+// Signature is the detached signature of a release payload.
+type Signature struct {
+	KeyID string `json:"key_id"`
+	Value string `json:"value"` // base64
+}
+
+// KeyID returns the short identifier of a public key.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SigningPayload is the canonical byte string a release signature covers.
+func SigningPayload(release catalog.Release) []byte {
+	return []byte(fmt.Sprintf("ota-release-v1\n%s\n%s\n%s\n%d\n", release.App, release.Version, release.ID, release.Size))
+}
+
+// Verify checks a release signature against a public key.
+func Verify(release catalog.Release, sig *Signature, pub ed25519.PublicKey) error {
+	if sig == nil {
+		return errors.New("release is not signed")
+	}
+	if sig.KeyID != KeyID(pub) {
+		return fmt.Errorf("signed with key %s, expected %s", sig.KeyID, KeyID(pub))
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Value)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	if !ed25519.Verify(pub, SigningPayload(release), raw) {
+		return errors.New("signature does not match release")
+	}
+	return nil
+}
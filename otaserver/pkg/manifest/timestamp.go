@@ -0,0 +1,97 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A signed timestamp ties a response to the time the server issued it and to
+// the newest release it knew of, so that a device can tell a fresh answer
+// from an old "no update" response a man in the middle keeps replaying (a
+// freeze attack): the signature covers what the response is about, the
+// newest version, a digest of the offer the response makes and when the
+// statement was issued and expires. The offer digest keeps the fresh
+// timestamp of one response from vouching for the body of another.
+
+// Timestamp is the signed statement of the newest version of a subject, e.g.
+// "plugin/stable" for a channel of an app or "bundle/gateway" for a bundle,
+// at IssuedAt. Devices treat responses as stale after ExpiresAt.
+type Timestamp struct {
+	Subject   string    `json:"subject"`
+	Latest    string    `json:"latest,omitempty"` // empty when nothing is published
+	Offer     string    `json:"offer"`            // see OfferDigest and BundleOfferDigest
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	KeyID     string    `json:"key_id"`
+	Value     string    `json:"signature"` // base64
+}
+
+// TimestampSigningPayload is the canonical byte string a timestamp signature
+// covers; times are in UTC to the second.
+func TimestampSigningPayload(t Timestamp) []byte {
+	return []byte(fmt.Sprintf("ota-timestamp-v2\n%s\n%s\n%s\n%s\n%s\n", t.Subject, t.Latest, t.Offer, t.IssuedAt.UTC().Format(time.RFC3339), t.ExpiresAt.UTC().Format(time.RFC3339)))
+}
+
+// OfferDigest is the SHA-256 hex digest of what a check-update response
+// offers: the latest version, the offered release (empty when none is) and
+// the reason nothing newer is offered.
+func OfferDigest(latestVersion, releaseID, reason string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("ota-offer-v1\n%s\n%s\n%s\n", latestVersion, releaseID, reason)))
+	return hex.EncodeToString(sum[:])
+}
+
+// BundleOfferDigest is the SHA-256 hex digest of what a bundle check
+// response offers: the bundle's version and the release of each component
+// to update, by component name.
+func BundleOfferDigest(bundle, version string, updates map[string]string) string {
+	names := make([]string, 0, len(updates))
+	for name := range updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "ota-bundle-offer-v1\n%s\n%s\n", bundle, version)
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s %s\n", name, updates[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// SealTimestamp signs a timestamp with an Ed25519 key, truncating its times
+// to the second.
+func SealTimestamp(t Timestamp, private ed25519.PrivateKey) Timestamp {
+	t.IssuedAt = t.IssuedAt.UTC().Truncate(time.Second)
+	t.ExpiresAt = t.ExpiresAt.UTC().Truncate(time.Second)
+	t.KeyID = KeyID(private.Public().(ed25519.PublicKey))
+	t.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(private, TimestampSigningPayload(t)))
+	return t
+}
+
+// VerifyTimestamp checks a timestamp's signature against a public key and
+// that it has not expired at now. Callers also compare Offer with the digest
+// of the response the timestamp came with.
+func VerifyTimestamp(t *Timestamp, pub ed25519.PublicKey, now time.Time) error {
+	if t == nil {
+		return errors.New("response carries no timestamp")
+	}
+	if t.KeyID != KeyID(pub) {
+		return fmt.Errorf("timestamp signed with key %s, expected %s", t.KeyID, KeyID(pub))
+	}
+	raw, err := base64.StdEncoding.DecodeString(t.Value)
+	if err != nil {
+		return fmt.Errorf("malformed timestamp signature: %w", err)
+	}
+	if !ed25519.Verify(pub, TimestampSigningPayload(*t), raw) {
+		return errors.New("timestamp signature does not match")
+	}
+	if now.After(t.ExpiresAt) {
+		return fmt.Errorf("timestamp expired at %s", t.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+// Package mdns advertises a service on the local network with multicast DNS
+// (RFC 6762) and DNS-based service discovery (RFC 6763). A Responder answers
+// queries for the service type, the service instance and its host name, and
+// announces the service when it starts, whenever Announce is called and, with
+// a zero TTL, when it is closed. Only IPv4 is supported.
+package mdns
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// group is the multicast address and port mDNS messages are exchanged on.
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	// ttl is how long records may be cached, the RFC 6762 recommendation for
+	// records carrying a host name
+	ttl = 120
+	// cacheFlush marks records this responder is the only owner of
+	cacheFlush = 1 << 15
+)
+
+// servicesName is the name browsers query to enumerate service types.
+var servicesName = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+
+// Service is what a Responder advertises.
+type Service struct {
+	Instance string          // name shown to users, e.g. "ota-server on gw-3"
+	Type     string          // e.g. "_ota._tcp"
+	Host     string          // host name without ".local", e.g. "gw-3"
+	Port     int             // port the service listens on
+	Text     func() []string // "key=value" strings of the TXT record, read for every answer
+}
+
+// Responder answers mDNS queries for a Service.
+type Responder struct {
+	svc      Service
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	conn     *net.UDPConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Advertise starts answering queries for a service and announces it.
+func Advertise(svc Service) (*Responder, error) {
+	if svc.Type == "" || svc.Host == "" || svc.Port <= 0 || svc.Port > 65535 {
+		return nil, errors.New("mdns: a service needs a type, a host and a port")
+	}
+	if svc.Instance == "" {
+		svc.Instance = svc.Host
+	}
+	if svc.Text == nil {
+		svc.Text = func() []string { return nil }
+	}
+	r := &Responder{svc: svc}
+	var err error
+	if r.service, err = dnsmessage.NewName(svc.Type + ".local."); err != nil {
+		return nil, err
+	}
+	// Dots would split the instance name into labels
+	if r.instance, err = dnsmessage.NewName(strings.ReplaceAll(svc.Instance, ".", "-") + "." + r.service.String()); err != nil {
+		return nil, err
+	}
+	if r.host, err = dnsmessage.NewName(svc.Host + ".local."); err != nil {
+		return nil, err
+	}
+	if r.conn, err = net.ListenMulticastUDP("udp4", nil, group); err != nil {
+		return nil, err
+	}
+	go r.serve()
+	r.Announce()
+	return r, nil
+}
+
+// Announce sends the service's records unsolicited, e.g. after its TXT record
+// changed. As RFC 6762 asks, the announcement is repeated a second later.
+func (r *Responder) Announce() {
+	r.send(r.announcement(ttl))
+	time.AfterFunc(time.Second, func() { r.send(r.announcement(ttl)) })
+}
+
+// Close withdraws the service and stops answering queries.
+func (r *Responder) Close() error {
+	goodbye := r.announcement(0)
+	r.send(goodbye)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.conn.Close()
+}
+
+// Helper function to send a message to the multicast group unless the
+// responder is closed
+func (r *Responder) send(msg []byte) {
+	r.sendTo(msg, group)
+}
+
+// Helper function to send a message to an address unless the responder is
+// closed
+func (r *Responder) sendTo(msg []byte, addr *net.UDPAddr) {
+	if msg == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if _, err := r.conn.WriteToUDP(msg, addr); err != nil {
+		log.Printf("mdns: sending to %s: %v", addr, err)
+	}
+}
+
+// Helper function to read queries until the responder is closed
+func (r *Responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("mdns: reading: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		r.answer(buf[:n], from)
+	}
+}
+
+// Helper function to answer a query. Queries from a port other than 5353
+// come from simple resolvers (RFC 6762 section 6.7), which get a unicast
+// reply echoing their ID and questions.
+func (r *Responder) answer(query []byte, from *net.UDPAddr) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	var answers, extra []dnsmessage.Resource
+	wants := map[dnsmessage.Type]bool{}
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		all := q.Type == dnsmessage.TypeALL
+		switch {
+		case name == servicesName.String() && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, r.ptr(servicesName, r.service, ttl))
+		case name == strings.ToLower(r.service.String()) && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, r.ptr(r.service, r.instance, ttl))
+			wants[dnsmessage.TypeSRV], wants[dnsmessage.TypeTXT], wants[dnsmessage.TypeA] = true, true, true
+		case name == strings.ToLower(r.instance.String()):
+			if all || q.Type == dnsmessage.TypeSRV {
+				answers = append(answers, r.srv(ttl))
+				wants[dnsmessage.TypeA] = true
+			}
+			if all || q.Type == dnsmessage.TypeTXT {
+				answers = append(answers, r.txt(ttl))
+			}
+		case name == strings.ToLower(r.host.String()) && (all || q.Type == dnsmessage.TypeA):
+			answers = append(answers, r.addresses(ttl)...)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	// Records the querier will need next go in the additional section
+	answered := map[dnsmessage.Type]bool{}
+	for _, a := range answers {
+		answered[a.Header.Type] = true
+	}
+	if wants[dnsmessage.TypeSRV] && !answered[dnsmessage.TypeSRV] {
+		extra = append(extra, r.srv(ttl))
+	}
+	if wants[dnsmessage.TypeTXT] && !answered[dnsmessage.TypeTXT] {
+		extra = append(extra, r.txt(ttl))
+	}
+	if wants[dnsmessage.TypeA] && !answered[dnsmessage.TypeA] {
+		extra = append(extra, r.addresses(ttl)...)
+	}
+
+	if from.Port != group.Port {
+		r.sendTo(r.message(hdr.ID, questions, answers, extra), from)
+		return
+	}
+	r.send(r.message(0, nil, answers, extra))
+}
+
+// Helper function to build the unsolicited announcement of the service
+func (r *Responder) announcement(ttl uint32) []byte {
+	answers := append([]dnsmessage.Resource{r.ptr(r.service, r.instance, ttl), r.srv(ttl), r.txt(ttl)}, r.addresses(ttl)...)
+	return r.message(0, nil, answers, nil)
+}
+
+// Helper function to encode a response
+func (r *Responder) message(id uint16, questions []dnsmessage.Question, answers, extra []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions:   questions,
+		Answers:     answers,
+		Additionals: extra,
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		log.Printf("mdns: encoding a response: %v", err)
+		return nil
+	}
+	return packed
+}
+
+// Helper function to build a record header; shared records (PTR) have no
+// cache-flush bit
+func header(name dnsmessage.Name, typ dnsmessage.Type, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= cacheFlush
+	}
+	return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+}
+
+// Helper function to build a PTR record
+func (r *Responder) ptr(name, target dnsmessage.Name, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypePTR, ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: target},
+	}
+}
+
+// Helper function to build the SRV record of the instance
+func (r *Responder) srv(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(r.instance, dnsmessage.TypeSRV, ttl, true),
+		Body:   &dnsmessage.SRVResource{Port: uint16(r.svc.Port), Target: r.host},
+	}
+}
+
+// Helper function to build the TXT record of the instance; an empty record
+// is a single empty string
+func (r *Responder) txt(ttl uint32) dnsmessage.Resource {
+	text := r.svc.Text()
+	if len(text) == 0 {
+		text = []string{""}
+	}
+	return dnsmessage.Resource{
+		Header: header(r.instance, dnsmessage.TypeTXT, ttl, true),
+		Body:   &dnsmessage.TXTResource{TXT: text},
+	}
+}
+
+// Helper function to build the A records of the host from the addresses of
+// its interfaces, which may change while the server runs
+func (r *Responder) addresses(ttl uint32) []dnsmessage.Resource {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("mdns: listing addresses: %v", err)
+		return nil
+	}
+	var records []dnsmessage.Resource
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ipnet.IP.To4())
+		records = append(records, dnsmessage.Resource{
+			Header: header(r.host, dnsmessage.TypeA, ttl, true),
+			Body:   &a,
+		})
+	}
+	return records
+}
@@ -0,0 +1,82 @@
+package rollout
+
+import (
+	"ota-server/pkg/catalog"
+	"ota-server/pkg/manifest"
+)
+
+// Sources of a desired version, the most specific taking precedence.
+const (
+	SourceDevice   = "device"
+	SourceCohort   = "cohort"
+	SourceCampaign = "campaign"
+	SourceGroup    = "group"
+	SourceFleet    = "fleet"
+)
+
+// Convergence states of a device against its desired version.
+const (
+	Converged = "converged"
+	Pending   = "pending"
+	Unmanaged = "unmanaged" // no desired version
+)
+
+// DesiredVersion resolves the version a device should run from the targets
+// set for the device, its experiment cohort, an update campaign it is
+// targeted by, its group and the fleet, and reports where it comes from; both
+// are empty when no target is set.
+func DesiredVersion(device, cohort, campaign, group, fleet string) (string, string) {
+	switch {
+	case device != "":
+		return device, SourceDevice
+	case cohort != "":
+		return cohort, SourceCohort
+	case campaign != "":
+		return campaign, SourceCampaign
+	case group != "":
+		return group, SourceGroup
+	case fleet != "":
+		return fleet, SourceFleet
+	}
+	return "", ""
+}
+
+// Convergence classifies the version a device runs against its desired version.
+func Convergence(current, desired string) string {
+	switch {
+	case desired == "":
+		return Unmanaged
+	case current != "" && catalog.CompareVersions(current, desired) == 0:
+		return Converged
+	}
+	return Pending
+}
+
+// UpgradePath plans the installs that take a device from one version to the
+// last of the given releases (sorted ascending). Each step jumps to the
+// newest release that can be installed over the current version, stopping at
+// mandatory releases. It reports false when some release cannot be reached.
+func UpgradePath(from string, releases []manifest.ReleaseChange) ([]string, bool) {
+	path := []string{}
+	current := from
+	for i := 0; i < len(releases); {
+		next := -1
+		for j := i; j < len(releases); j++ {
+			installable := releases[j].MinimumVersion == "" || catalog.CompareVersions(releases[j].MinimumVersion, current) <= 0
+			if installable {
+				next = j
+			}
+			// Mandatory releases cannot be skipped
+			if releases[j].Mandatory {
+				break
+			}
+		}
+		if next == -1 {
+			return nil, false
+		}
+		current = releases[next].Version
+		path = append(path, current)
+		i = next + 1
+	}
+	return path, true
+}
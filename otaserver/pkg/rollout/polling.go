@@ -0,0 +1,53 @@
+package rollout
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// Check responses tell devices when to check again, so that the fleet's
+// polling frequency is tuned centrally: devices normally back off to the
+// regular interval and poll at the shorter rollout interval while a rollout
+// is active. Each device's hint is shortened by a stable per-device amount of
+// up to a tenth, which spreads the fleet's checks without changing the
+// response from one check to the next.
+
+// Polling intervals used until an operator changes them.
+const (
+	DefaultPollInterval        = time.Hour
+	DefaultRolloutPollInterval = time.Minute
+)
+
+// PollingSettings are the fleet-wide polling intervals.
+type PollingSettings struct {
+	Interval        string    `json:"interval"`         // e.g. "1h"
+	RolloutInterval string    `json:"rollout_interval"` // e.g. "1m"
+	RolloutUntil    time.Time `json:"rollout_until,omitempty"`
+}
+
+// DefaultPollingSettings returns the settings used until an operator changes them.
+func DefaultPollingSettings() PollingSettings {
+	return PollingSettings{Interval: DefaultPollInterval.String(), RolloutInterval: DefaultRolloutPollInterval.String()}
+}
+
+// RolloutActive reports whether a rollout is active at now.
+func (s PollingSettings) RolloutActive(now time.Time) bool {
+	return now.Before(s.RolloutUntil)
+}
+
+// NextCheckAfter computes a device's next_check_after hint in seconds; an
+// empty device ID gets the plain interval.
+func (s PollingSettings) NextCheckAfter(deviceID string, now time.Time) int {
+	interval, _ := time.ParseDuration(s.Interval)
+	if s.RolloutActive(now) {
+		interval, _ = time.ParseDuration(s.RolloutInterval)
+	}
+	seconds := int(interval.Seconds())
+
+	if deviceID != "" && seconds >= 10 {
+		hash := fnv.New32a()
+		hash.Write([]byte(deviceID))
+		seconds -= int(hash.Sum32() % uint32(seconds/10+1))
+	}
+	return max(seconds, 1)
+}
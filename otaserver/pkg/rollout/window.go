@@ -0,0 +1,67 @@
+// Package rollout decides when and what a device is offered: install windows
+// in device-local time, polling intervals, desired versions and the upgrade
+// path across mandatory releases.
+package rollout
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // devices may report zones missing from minimal host images
+)
+
+// InstallWindow is a daily window in device-local time ("HH:MM", 24h clock)
+// during which a release may be offered. A window whose end is before its
+// start wraps past midnight, e.g. 23:00-02:00.
+type InstallWindow struct {
+	Start string `json:"local_start"`
+	End   string `json:"local_end"`
+}
+
+// Helper function to parse an "HH:MM" time of day into minutes after midnight
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks that both ends of the window are valid times of day.
+func (w InstallWindow) Validate() error {
+	if _, err := parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	_, err := parseTimeOfDay(w.End)
+	return err
+}
+
+// Contains reports whether the local time t falls inside the window.
+func (w InstallWindow) Contains(t time.Time) bool {
+	start, _ := parseTimeOfDay(w.Start)
+	end, _ := parseTimeOfDay(w.End)
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// NextStart returns the next time the window opens at or after t, in t's location.
+func (w InstallWindow) NextStart(t time.Time) time.Time {
+	start, _ := parseTimeOfDay(w.Start)
+	next := time.Date(t.Year(), t.Month(), t.Day(), start/60, start%60, 0, 0, t.Location())
+	if next.Before(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// WindowOpen decides whether a release with the given window (nil when it
+// has none) may be offered at the device-local time now. When it may not,
+// the returned time is when the window next opens.
+func WindowOpen(window *InstallWindow, now time.Time) (bool, time.Time) {
+	if window == nil || window.Contains(now) {
+		return true, time.Time{}
+	}
+	return false, window.NextStart(now)
+}
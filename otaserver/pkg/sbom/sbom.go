@@ -0,0 +1,220 @@
+// Package sbom reads software bills of materials in the SPDX and CycloneDX
+// JSON formats far enough to answer which packages, in which versions, a
+// release contains.
+package sbom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ota-server/pkg/catalog"
+)
+
+// Formats of the documents Parse accepts
+const (
+	FormatSPDX      = "spdx"
+	FormatCycloneDX = "cyclonedx"
+)
+
+// Document is the package inventory of an SBOM.
+type Document struct {
+	Format      string    `json:"format"`
+	SpecVersion string    `json:"spec_version"`
+	Packages    []Package `json:"packages"`
+}
+
+// Package is one software package listed in an SBOM.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// spdxDocument is the part of an SPDX 2.x JSON document read here.
+type spdxDocument struct {
+	SPDXVersion string `json:"spdxVersion"`
+	Packages    []struct {
+		Name         string `json:"name"`
+		VersionInfo  string `json:"versionInfo"`
+		ExternalRefs []struct {
+			ReferenceType    string `json:"referenceType"`
+			ReferenceLocator string `json:"referenceLocator"`
+		} `json:"externalRefs"`
+	} `json:"packages"`
+}
+
+// cycloneDXComponent is the part of a CycloneDX component read here.
+type cycloneDXComponent struct {
+	Name       string               `json:"name"`
+	Version    string               `json:"version"`
+	PURL       string               `json:"purl"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// cycloneDXDocument is the part of a CycloneDX JSON document read here.
+type cycloneDXDocument struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+// Parse reads an SPDX or CycloneDX JSON document.
+func Parse(data []byte) (Document, error) {
+	var probe struct {
+		SPDXVersion string `json:"spdxVersion"`
+		BOMFormat   string `json:"bomFormat"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return Document{}, fmt.Errorf("SBOM is not JSON: %w", err)
+	}
+
+	switch {
+	case strings.HasPrefix(probe.SPDXVersion, "SPDX-"):
+		var doc spdxDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return Document{}, fmt.Errorf("invalid SPDX document: %w", err)
+		}
+		out := Document{Format: FormatSPDX, SpecVersion: strings.TrimPrefix(doc.SPDXVersion, "SPDX-"), Packages: []Package{}}
+		for _, p := range doc.Packages {
+			pkg := Package{Name: p.Name, Version: p.VersionInfo}
+			for _, ref := range p.ExternalRefs {
+				if ref.ReferenceType == "purl" {
+					pkg.PURL = ref.ReferenceLocator
+					break
+				}
+			}
+			out.Packages = append(out.Packages, pkg)
+		}
+		return out, nil
+
+	case probe.BOMFormat == "CycloneDX":
+		var doc cycloneDXDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return Document{}, fmt.Errorf("invalid CycloneDX document: %w", err)
+		}
+		out := Document{Format: FormatCycloneDX, SpecVersion: doc.SpecVersion, Packages: []Package{}}
+		var walk func([]cycloneDXComponent)
+		walk = func(components []cycloneDXComponent) {
+			for _, c := range components {
+				out.Packages = append(out.Packages, Package{Name: c.Name, Version: c.Version, PURL: c.PURL})
+				walk(c.Components)
+			}
+		}
+		walk(doc.Components)
+		return out, nil
+	}
+	return Document{}, errors.New("not an SPDX or CycloneDX JSON document")
+}
+
+// Matches reports whether the package has the given name, ignoring case, in
+// its name or in its package URL (pkg:deb/debian/openssl@3.0.11 is openssl).
+func (p Package) Matches(name string) bool {
+	return strings.EqualFold(p.Name, name) || strings.EqualFold(purlName(p.PURL), name)
+}
+
+// Helper function to extract the name from a package URL
+func purlName(purl string) string {
+	if !strings.HasPrefix(purl, "pkg:") {
+		return ""
+	}
+	purl, _, _ = strings.Cut(purl, "?")
+	purl, _, _ = strings.Cut(purl, "#")
+	purl, _, _ = strings.Cut(purl, "@")
+	return purl[strings.LastIndex(purl, "/")+1:]
+}
+
+// Find returns the packages of the document with the given name.
+func (d Document) Find(name string) []Package {
+	var found []Package
+	for _, p := range d.Packages {
+		if p.Matches(name) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// CompareVersions returns -1, 0 or 1 as package version a is older than,
+// equal to or newer than b. Semantic versions are compared as such; others,
+// like OpenSSL's "1.1.1t" or Debian's "3.0.11-1~deb12u2", by comparing runs of
+// digits numerically and everything else as text.
+func CompareVersions(a, b string) int {
+	if isSemver(a) && isSemver(b) {
+		return catalog.CompareVersions(a, b)
+	}
+	ra, rb := versionRuns(a), versionRuns(b)
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		if c := compareRun(ra[i], rb[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(ra) < len(rb):
+		return -1
+	case len(ra) > len(rb):
+		return 1
+	}
+	return 0
+}
+
+// Helper function to check whether a version is plain semver
+func isSemver(version string) bool {
+	core, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), "+")
+	core, _, _ = strings.Cut(core, "-")
+	for _, part := range strings.Split(core, ".") {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to split a version into runs of digits and of letters,
+// dropping separators
+func versionRuns(version string) []string {
+	var runs []string
+	start := -1
+	kind := func(r byte) int {
+		switch {
+		case r >= '0' && r <= '9':
+			return 1
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			return 2
+		}
+		return 0
+	}
+	for i := 0; i <= len(version); i++ {
+		if start >= 0 && (i == len(version) || kind(version[i]) != kind(version[start])) {
+			runs = append(runs, version[start:i])
+			start = -1
+		}
+		if i < len(version) && start < 0 && kind(version[i]) != 0 {
+			start = i
+		}
+	}
+	return runs
+}
+
+// Helper function to compare two runs of a version
+func compareRun(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	case errA == nil:
+		return 1 // numbers sort after letters: 1.0.1 is newer than 1.0a
+	case errB == nil:
+		return -1
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
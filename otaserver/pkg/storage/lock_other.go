@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package storage
+
+import "os"
+
+// lockFile is a no-op on platforms without file locking; running two servers
+// on one state directory there is not detected.
+func lockFile(file *os.File) error {
+	return nil
+}
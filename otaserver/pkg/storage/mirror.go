@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backend is a storage service that artifacts are mirrored to, so that the
+// fleet can keep downloading when one copy is unavailable. Keys are
+// slash-separated paths such as "plugin/beta/plugin_1.2.0.wasm".
+type Backend interface {
+	// Name identifies the backend in release metadata and the admin API.
+	Name() string
+
+	// Put stores the file at path under key. digest is the file's SHA-256
+	// hex digest, which backends may use to have the copy checked on arrival.
+	Put(ctx context.Context, key, path, digest string) error
+
+	// Verify checks that the copy under key has the given size and digest.
+	Verify(ctx context.Context, key string, size int64, digest string) error
+
+	// Probe checks that the backend is reachable.
+	Probe(ctx context.Context) error
+
+	// Locate tells how to serve the copy under key.
+	Locate(key string, expiry time.Duration) (Location, error)
+}
+
+// Location is where a mirrored copy can be served from: a local Path that
+// the server sends itself, or a URL, valid for the requested time, that
+// clients are redirected to.
+type Location struct {
+	Path string
+	URL  string
+}
+
+// ErrDigestMismatch is returned by Verify when a copy differs from the original.
+var ErrDigestMismatch = errors.New("mirrored copy does not match the original")
+
+// ParseBackend builds a backend from a spec: "file:///mnt/replica" (or a plain
+// absolute path) for a directory, for instance on another disk or a network
+// share, and "s3://bucket/prefix?region=eu-west-1" for an S3 bucket.
+// S3 specs accept "endpoint" for S3-compatible services (path-style requests)
+// and "public_url" to redirect clients there instead of to presigned URLs.
+// Every spec accepts "name"; the default is derived from the location.
+func ParseBackend(spec string, creds AWSCredentials) (Backend, error) {
+	if filepath.IsAbs(spec) {
+		spec = "file://" + filepath.ToSlash(spec)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror %q: %w", spec, err)
+	}
+	query := u.Query()
+	name := query.Get("name")
+
+	switch u.Scheme {
+	case "file":
+		dir := filepath.FromSlash(u.Path)
+		if dir == "" {
+			return nil, fmt.Errorf("mirror %q has no directory", spec)
+		}
+		if name == "" {
+			name = "file:" + u.Path
+		}
+		return &FileBackend{name: name, dir: dir}, nil
+	case "s3":
+		region := query.Get("region")
+		if u.Host == "" || region == "" {
+			return nil, fmt.Errorf("mirror %q needs a bucket and a region", spec)
+		}
+		if creds.AccessKey == "" || creds.SecretKey == "" {
+			return nil, fmt.Errorf("mirror %q needs AWS credentials", spec)
+		}
+		endpoint := query.Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		if name == "" {
+			name = "s3:" + u.Host + "@" + region
+		}
+		return &S3Backend{
+			name:      name,
+			bucket:    u.Host,
+			prefix:    strings.Trim(u.Path, "/"),
+			region:    region,
+			endpoint:  strings.TrimSuffix(endpoint, "/"),
+			publicURL: strings.TrimSuffix(query.Get("public_url"), "/"),
+			creds:     creds,
+			client:    &http.Client{Timeout: 10 * time.Minute},
+		}, nil
+	}
+	return nil, fmt.Errorf("mirror %q: unsupported scheme %q", spec, u.Scheme)
+}
+
+// FileBackend mirrors artifacts into a directory.
+type FileBackend struct {
+	name string
+	dir  string
+}
+
+func (b *FileBackend) Name() string { return b.name }
+
+func (b *FileBackend) path(key string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(key))
+}
+
+func (b *FileBackend) Put(ctx context.Context, key, path, digest string) error {
+	dst := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return CopyFile(path, dst)
+}
+
+func (b *FileBackend) Verify(ctx context.Context, key string, size int64, digest string) error {
+	file, err := os.Open(b.path(key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if n != size || hex.EncodeToString(hash.Sum(nil)) != digest {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (b *FileBackend) Probe(ctx context.Context) error {
+	probe, err := os.CreateTemp(b.dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (b *FileBackend) Locate(key string, expiry time.Duration) (Location, error) {
+	return Location{Path: b.path(key)}, nil
+}
+
+// S3Backend mirrors artifacts into an S3 bucket, or a bucket of an
+// S3-compatible service.
+type S3Backend struct {
+	name      string
+	bucket    string
+	prefix    string
+	region    string
+	endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com
+	publicURL string // optional base URL clients are redirected to
+	creds     AWSCredentials
+	client    *http.Client
+}
+
+// digestHeader stores the SHA-256 digest with each object so Verify can
+// compare it without downloading the object.
+const digestHeader = "X-Amz-Meta-Sha256"
+
+func (b *S3Backend) Name() string { return b.name }
+
+func (b *S3Backend) objectKey(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return b.prefix + "/" + key
+}
+
+func (b *S3Backend) objectURL(key string) *url.URL {
+	u, _ := url.Parse(b.endpoint)
+	u.Path = "/" + b.bucket
+	if key != "" {
+		u.Path += "/" + b.objectKey(key)
+	}
+	return u
+}
+
+// Helper function to send a signed request to the bucket
+func (b *S3Backend) do(ctx context.Context, method, key string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	SignAWSRequest(req, payloadHash, b.creds, b.region, "s3", time.Now())
+	return b.client.Do(req)
+}
+
+// Put uploads the file with its digest as the payload hash, so S3 rejects a
+// copy that was corrupted on the way.
+func (b *S3Backend) Put(ctx context.Context, key, path, digest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(digestHeader, digest)
+	resp, err := b.do(ctx, http.MethodPut, key, file, info.Size(), digest, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (b *S3Backend) Verify(ctx context.Context, key string, size int64, digest string) error {
+	resp, err := b.do(ctx, http.MethodHead, key, nil, 0, SHA256Hex(nil), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	if resp.ContentLength != size || resp.Header.Get(digestHeader) != digest {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (b *S3Backend) Probe(ctx context.Context) error {
+	resp, err := b.do(ctx, http.MethodHead, "", nil, 0, SHA256Hex(nil), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (b *S3Backend) Locate(key string, expiry time.Duration) (Location, error) {
+	if b.publicURL != "" {
+		return Location{URL: b.publicURL + "/" + b.objectKey(key)}, nil
+	}
+	return Location{URL: PresignAWSURL(b.objectURL(key), b.creds, b.region, "s3", time.Now(), expiry)}, nil
+}
+
+// Helper function to turn an unsuccessful S3 response into an error
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if len(body) == 0 {
+		return fmt.Errorf("s3: %s", resp.Status)
+	}
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
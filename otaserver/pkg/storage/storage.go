@@ -0,0 +1,105 @@
+// Package storage holds the filesystem primitives of the OTA server: crash
+// safe writes and moves, JSON state files and the lock that keeps two servers
+// off one state directory.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LockDir takes an exclusive lock on the file name in dir, creating both, and
+// holds it until the returned closer is closed. It fails immediately when
+// another process holds the lock.
+func LockDir(dir, name string) (io.Closer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is in use by another process: %w", dir, err)
+	}
+	return file, nil
+}
+
+// MoveFile moves a file into place. The source and destination may be on
+// different filesystems, where a rename is not possible, so it falls back to
+// copying.
+func MoveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		SyncDir(filepath.Dir(dst))
+		return nil
+	}
+	if err := CopyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// SyncFile flushes a file's contents to disk.
+func SyncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// SyncDir flushes a directory so that renames into it survive a power loss.
+// Not every platform can sync directories, so errors are ignored.
+func SyncDir(dir string) {
+	if file, err := os.Open(dir); err == nil {
+		file.Sync()
+		file.Close()
+	}
+}
+
+// CopyFile copies a file by writing a temporary file next to the destination
+// and renaming it into place.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".move-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	SyncDir(filepath.Dir(dst))
+	return nil
+}
+
+// InsideDir reports whether path is inside dir; both must be clean.
+func InsideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}